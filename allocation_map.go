@@ -0,0 +1,259 @@
+package fat
+
+// This file contains functions for classifying every cluster in a FAT32
+// filesystem, and exporting the result as an image or JSON. This is intended
+// to help visualize where data lives on a damaged volume.
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// Describes how a single cluster is used.
+type ClusterState uint8
+
+// The possible cluster states. When several clusters are combined into one
+// pixel of an allocation map image, states later in this list take
+// precedence.
+const (
+	// The cluster is marked as free in the FAT.
+	ClusterFree ClusterState = iota
+	// The cluster belongs to a file reachable from the root directory.
+	ClusterUsed
+	// The cluster belongs to a directory reachable from the root directory.
+	ClusterDirectory
+	// The cluster is allocated in the FAT, but its chain isn't referenced by
+	// any directory entry reachable from the root directory.
+	ClusterOrphan
+	// The cluster is marked as bad in the FAT.
+	ClusterBad
+	// More than one FAT entry points to this cluster.
+	ClusterCrossLinked
+	clusterStateCount
+)
+
+var clusterStateNames = [...]string{
+	"free",
+	"used",
+	"directory",
+	"orphan",
+	"bad",
+	"cross-linked",
+}
+
+// The color used for each state in allocation map images.
+var clusterStateColors = [...]color.RGBA{
+	{0xf0, 0xf0, 0xf0, 0xff},
+	{0x30, 0x60, 0xd0, 0xff},
+	{0x20, 0xa0, 0x40, 0xff},
+	{0xf0, 0x90, 0x20, 0xff},
+	{0x00, 0x00, 0x00, 0xff},
+	{0xe0, 0x10, 0x10, 0xff},
+}
+
+// The color used for pixels past the last cluster in allocation map images.
+var allocationMapPadding = color.RGBA{0x80, 0x80, 0x80, 0xff}
+
+func (s ClusterState) String() string {
+	if s >= clusterStateCount {
+		return fmt.Sprintf("unknown state %d", s)
+	}
+	return clusterStateNames[s]
+}
+
+// Holds the state of every cluster in the data region of a filesystem.
+type AllocationMap struct {
+	// The number of the cluster corresponding to States[0]; always 2.
+	FirstCluster uint32
+	States       []ClusterState
+}
+
+// Returns the state of the given cluster.
+func (m *AllocationMap) State(cluster uint32) ClusterState {
+	return m.States[cluster-m.FirstCluster]
+}
+
+// Adds the start cluster of every directory entry reachable from the given
+// directory to the given maps. Unlike WalkFiles, this ignores directories it
+// can't read, since we want a map even if parts of the tree are damaged.
+func (f *FAT32Filesystem) collectEntryClusters(cluster uint32,
+	files, directories map[uint32]bool) {
+	if directories[cluster] {
+		return
+	}
+	directories[cluster] = true
+	entries, e := f.ReadDirectory(cluster)
+	if e != nil {
+		return
+	}
+	for i := range entries {
+		d := &(entries[i].Entry)
+		if d.IsDeleted() || d.IsVolumeLabel() || d.IsDotEntry() {
+			continue
+		}
+		start := d.StartCluster()
+		if start < 2 {
+			continue
+		}
+		if d.IsDirectory() {
+			f.collectEntryClusters(start, files, directories)
+		} else {
+			files[start] = true
+		}
+	}
+}
+
+// Classifies every cluster in the filesystem, using f.FAT, the chains returned
+// by GetAllChains, and the directory tree.
+func (f *FAT32Filesystem) GetAllocationMap() (*AllocationMap, error) {
+	clusterCount := f.ClusterCount()
+	toReturn := &AllocationMap{
+		FirstCluster: 2,
+		States:       make([]ClusterState, clusterCount-2),
+	}
+	states := toReturn.States
+
+	// Start by marking everything that isn't free as an orphan; we'll mark
+	// the clusters that are reachable afterwards.
+	references := make([]uint8, clusterCount)
+	for c := uint32(2); c < clusterCount; c++ {
+		v := f.FAT[c] & 0x0fffffff
+		if v == 0 {
+			continue
+		}
+		if v == BadClusterMarker {
+			states[c-2] = ClusterBad
+			continue
+		}
+		states[c-2] = ClusterOrphan
+		if (v >= 2) && (v < clusterCount) && (references[v] < 2) {
+			references[v]++
+		}
+	}
+
+	// Find the chains referred to by directory entries.
+	files := make(map[uint32]bool)
+	directories := make(map[uint32]bool)
+	f.collectEntryClusters(f.Header.EBR.RootDirClusterNumber, files,
+		directories)
+	chains, e := f.GetAllChains()
+	if e != nil {
+		return nil, fmt.Errorf("Error getting chains: %w", e)
+	}
+	for i := range chains {
+		chain := &(chains[i])
+		state := ClusterOrphan
+		if directories[chain.StartCluster] {
+			state = ClusterDirectory
+		} else if files[chain.StartCluster] {
+			state = ClusterUsed
+		}
+		for _, x := range chain.Extents {
+			for c := x.StartCluster; c < x.EndCluster(); c++ {
+				states[c-2] = state
+			}
+		}
+	}
+
+	// Finally, mark cross-linked clusters, regardless of their chain.
+	for c := uint32(2); c < clusterCount; c++ {
+		if references[c] > 1 {
+			states[c-2] = ClusterCrossLinked
+		}
+	}
+	return toReturn, nil
+}
+
+// Returns the number of clusters in each state.
+func (m *AllocationMap) Counts() map[ClusterState]int {
+	toReturn := make(map[ClusterState]int)
+	for _, s := range m.States {
+		toReturn[s]++
+	}
+	return toReturn
+}
+
+// Writes the allocation map to w as a PNG image, with rows of the given width
+// in pixels. Each pixel represents clustersPerPixel consecutive clusters,
+// colored according to the state of the most significant cluster among them.
+// Pixels past the last cluster are gray.
+func (m *AllocationMap) WritePNG(w io.Writer, width,
+	clustersPerPixel int) error {
+	if (width < 1) || (clustersPerPixel < 1) {
+		return fmt.Errorf("Invalid allocation map image width (%d) or "+
+			"clusters per pixel (%d)", width, clustersPerPixel)
+	}
+	pixelCount := (len(m.States) + clustersPerPixel - 1) / clustersPerPixel
+	height := (pixelCount + width - 1) / width
+	if height < 1 {
+		height = 1
+	}
+	palette := make(color.Palette, 0, len(clusterStateColors)+1)
+	for _, c := range clusterStateColors {
+		palette = append(palette, c)
+	}
+	paddingIndex := uint8(len(palette))
+	palette = append(palette, allocationMapPadding)
+	pic := image.NewPaletted(image.Rect(0, 0, width, height), palette)
+	for i := range pic.Pix {
+		pic.Pix[i] = paddingIndex
+	}
+	for i := 0; i < pixelCount; i++ {
+		start := i * clustersPerPixel
+		end := start + clustersPerPixel
+		if end > len(m.States) {
+			end = len(m.States)
+		}
+		state := ClusterFree
+		for _, s := range m.States[start:end] {
+			if s > state {
+				state = s
+			}
+		}
+		pic.Pix[(i/width)*pic.Stride+(i%width)] = uint8(state)
+	}
+	e := png.Encode(w, pic)
+	if e != nil {
+		return fmt.Errorf("Error encoding PNG: %w", e)
+	}
+	return nil
+}
+
+// The format in which allocation maps are written as JSON.
+type allocationMapJSON struct {
+	FirstCluster uint32 `json:"first_cluster"`
+	ClusterCount int    `json:"cluster_count"`
+	// The name of each state; runs refer to states by their index here.
+	States []string `json:"states"`
+	// Each run is a pair of numbers: the state index and the number of
+	// consecutive clusters in that state.
+	Runs [][2]int `json:"runs"`
+}
+
+// Writes a compact run-length encoded copy of the allocation map to w, in
+// JSON format.
+func (m *AllocationMap) WriteJSON(w io.Writer) error {
+	output := allocationMapJSON{
+		FirstCluster: m.FirstCluster,
+		ClusterCount: len(m.States),
+		States:       clusterStateNames[:],
+		Runs:         make([][2]int, 0, 64),
+	}
+	for i, s := range m.States {
+		runs := output.Runs
+		if (i != 0) && (runs[len(runs)-1][0] == int(s)) {
+			runs[len(runs)-1][1]++
+			continue
+		}
+		output.Runs = append(runs, [2]int{int(s), 1})
+	}
+	e := json.NewEncoder(w).Encode(&output)
+	if e != nil {
+		return fmt.Errorf("Error encoding JSON: %w", e)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/png"
+	"testing"
+)
+
+func TestAllocationMap(t *testing.T) {
+	m := newTestImage()
+	m.addFile(testRootCluster, 0, "A", 1000, []uint32{3, 4})
+	subdirectory := m.addFile(testRootCluster, 1, "SUB", 0, []uint32{5})
+	subdirectory.Attributes = AttributeDirectory
+	m.setEntry(testRootCluster, 1, subdirectory)
+	copy(m.cluster(5), make([]byte, SectorSize))
+	m.setFAT(8, 0x0fffffff)
+	m.setFAT(10, BadClusterMarker)
+	m.setFAT(11, 12)
+	m.setFAT(13, 12)
+	m.setFAT(12, 0x0fffffff)
+	f := m.open(t)
+	a, e := f.GetAllocationMap()
+	if e != nil {
+		t.Logf("Failed getting allocation map: %s\n", e)
+		t.FailNow()
+	}
+	expected := map[uint32]ClusterState{
+		2:  ClusterDirectory,
+		3:  ClusterUsed,
+		4:  ClusterUsed,
+		5:  ClusterDirectory,
+		6:  ClusterFree,
+		8:  ClusterOrphan,
+		10: ClusterBad,
+		11: ClusterOrphan,
+		12: ClusterCrossLinked,
+		14: ClusterFree,
+	}
+	for c, s := range expected {
+		if a.State(c) != s {
+			t.Logf("Expected cluster %d to be %s, got %s\n", c, s,
+				a.State(c))
+			t.FailNow()
+		}
+	}
+
+	var jsonData bytes.Buffer
+	e = a.WriteJSON(&jsonData)
+	if e != nil {
+		t.Logf("Failed writing allocation map JSON: %s\n", e)
+		t.FailNow()
+	}
+	var parsed allocationMapJSON
+	e = json.Unmarshal(jsonData.Bytes(), &parsed)
+	if e != nil {
+		t.Logf("Failed parsing allocation map JSON: %s\n", e)
+		t.FailNow()
+	}
+	total := 0
+	for _, r := range parsed.Runs {
+		total += r[1]
+	}
+	if total != len(a.States) {
+		t.Logf("JSON runs cover %d clusters, expected %d\n", total,
+			len(a.States))
+		t.FailNow()
+	}
+
+	var pngData bytes.Buffer
+	e = a.WritePNG(&pngData, 100, 4)
+	if e != nil {
+		t.Logf("Failed writing allocation map PNG: %s\n", e)
+		t.FailNow()
+	}
+	pic, e := png.Decode(&pngData)
+	if e != nil {
+		t.Logf("Failed decoding allocation map PNG: %s\n", e)
+		t.FailNow()
+	}
+	// 4000 clusters at 4 clusters per pixel, 100 pixels per row.
+	if pic.Bounds().Dy() != 10 {
+		t.Logf("Expected a 10-pixel tall image, got %d\n", pic.Bounds().Dy())
+		t.FailNow()
+	}
+}
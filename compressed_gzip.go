@@ -0,0 +1,286 @@
+package fat
+
+// This file contains support for random access to gzip-compressed images. The
+// first pass over the file records a checkpoint (the position of a DEFLATE
+// block and the 32 KB of output preceding it) every gzipCheckpointInterval
+// bytes, from which decompression can later resume.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// The minimum amount of decompressed data between checkpoints in a gzip
+// image.
+const gzipCheckpointInterval = 8 * 1024 * 1024
+
+// Flags in the gzip member header.
+const (
+	gzipFlagHeaderCRC = 2
+	gzipFlagExtra     = 4
+	gzipFlagName      = 8
+	gzipFlagComment   = 16
+)
+
+// Holds what's needed to resume decompressing a gzip image at the start of a
+// DEFLATE block.
+type deflateCheckpoint struct {
+	// The number of bits of the byte at the index entry's compressedOffset
+	// that belong to the previous block.
+	bitOffset uint8
+	// The (up to) 32 KB of data preceding the block, compressed using flate.
+	window []byte
+}
+
+// Decompresses a gzip file, which may contain several members, starting at a
+// member header or a checkpoint.
+type gzipReader struct {
+	br       *bitReader
+	inflater *inflater
+	// If set, the CRC and size of each member is checked. This is only
+	// possible when starting at the beginning of a member.
+	verify     bool
+	crc        uint32
+	memberSize uint32
+	// The offset of the current member's header, and whether its first
+	// block has yet to be started.
+	memberOffset   int64
+	memberStarting bool
+	// Set once the last member has been decompressed.
+	done bool
+}
+
+// Reads the NUL-terminated string following some gzip headers.
+func skipGzipString(br *bitReader) error {
+	for {
+		b, e := br.readByte()
+		if e != nil {
+			return e
+		}
+		if b == 0 {
+			return nil
+		}
+	}
+}
+
+// Reads a gzip member header. Returns io.EOF if there are no more members.
+// Like gzip itself, this ignores trailing data that isn't a gzip member.
+func readGzipHeader(br *bitReader) error {
+	var header [10]byte
+	b, e := br.readByte()
+	if e != nil {
+		return e
+	}
+	header[0] = b
+	e = br.readFull(header[1:])
+	if (e == io.ErrUnexpectedEOF) || (header[0] != 0x1f) ||
+		(header[1] != 0x8b) {
+		return io.EOF
+	}
+	if e != nil {
+		return e
+	}
+	if header[2] != 8 {
+		return fmt.Errorf("Unsupported gzip compression method: %d",
+			header[2])
+	}
+	flags := header[3]
+	if (flags & gzipFlagExtra) != 0 {
+		var length [2]byte
+		e = br.readFull(length[:])
+		if e != nil {
+			return e
+		}
+		extra := make([]byte, int(length[0])|(int(length[1])<<8))
+		e = br.readFull(extra)
+		if e != nil {
+			return e
+		}
+	}
+	if (flags & gzipFlagName) != 0 {
+		e = skipGzipString(br)
+		if e != nil {
+			return e
+		}
+	}
+	if (flags & gzipFlagComment) != 0 {
+		e = skipGzipString(br)
+		if e != nil {
+			return e
+		}
+	}
+	if (flags & gzipFlagHeaderCRC) != 0 {
+		var crc [2]byte
+		e = br.readFull(crc[:])
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Reads the trailer of the current member, and the header of the next one if
+// there is one.
+func (z *gzipReader) nextMember() error {
+	z.br.alignToByte()
+	var trailer [8]byte
+	e := z.br.readFull(trailer[:])
+	if e != nil {
+		return fmt.Errorf("Error reading gzip trailer: %w", e)
+	}
+	crc := uint32(trailer[0]) | (uint32(trailer[1]) << 8) |
+		(uint32(trailer[2]) << 16) | (uint32(trailer[3]) << 24)
+	size := uint32(trailer[4]) | (uint32(trailer[5]) << 8) |
+		(uint32(trailer[6]) << 16) | (uint32(trailer[7]) << 24)
+	z.memberOffset = z.br.bitOffset() / 8
+	if z.verify && ((crc != z.crc) || (size != z.memberSize)) {
+		return fmt.Errorf("gzip member ending at offset %d has an incorrect "+
+			"CRC or size", z.memberOffset)
+	}
+	e = readGzipHeader(z.br)
+	if e == io.EOF {
+		z.done = true
+		return nil
+	}
+	if e != nil {
+		return fmt.Errorf("Error reading gzip header at offset %d: %w",
+			z.memberOffset, e)
+	}
+	z.memberStarting = true
+	z.inflater.restart()
+	z.verify = true
+	z.crc = 0
+	z.memberSize = 0
+	return nil
+}
+
+func (z *gzipReader) Read(dst []byte) (int, error) {
+	for !z.done {
+		n, e := z.inflater.Read(dst)
+		if n > 0 {
+			if z.verify {
+				z.crc = crc32.Update(z.crc, crc32.IEEETable, dst[:n])
+				z.memberSize += uint32(n)
+			}
+			return n, nil
+		}
+		if e != io.EOF {
+			return 0, e
+		}
+		e = z.nextMember()
+		if e != nil {
+			return 0, e
+		}
+	}
+	return 0, io.EOF
+}
+
+func (z *gzipReader) Close() error {
+	return nil
+}
+
+// Returns a reader that decompresses the gzip file f, starting at the given
+// index entry.
+func newGzipDecompressor(f *os.File, index []compressedIndexEntry) (
+	io.ReadCloser, error) {
+	entry := &(index[0])
+	_, e := f.Seek(entry.compressedOffset, io.SeekStart)
+	if e != nil {
+		return nil, e
+	}
+	br := newBitReader(bufio.NewReaderSize(f, 1024*1024),
+		entry.compressedOffset)
+	checkpoint, ok := entry.restartState.(*deflateCheckpoint)
+	if !ok {
+		// Index entries without a checkpoint are at the start of a member.
+		e = readGzipHeader(br)
+		if e == io.EOF {
+			return nil, fmt.Errorf("No gzip header at offset %d",
+				entry.compressedOffset)
+		}
+		if e != nil {
+			return nil, e
+		}
+		return &gzipReader{
+			br:       br,
+			inflater: newInflater(br, nil),
+			verify:   true,
+		}, nil
+	}
+	_, e = br.readBits(uint(checkpoint.bitOffset))
+	if e != nil {
+		return nil, e
+	}
+	window, e := io.ReadAll(flate.NewReader(bytes.NewReader(
+		checkpoint.window)))
+	if e != nil {
+		return nil, fmt.Errorf("Error decompressing window: %w", e)
+	}
+	return &gzipReader{
+		br:       br,
+		inflater: newInflater(br, window),
+	}, nil
+}
+
+// Decompresses an entire gzip file, returning its size and a list of
+// checkpoints at least gzipCheckpointInterval bytes apart. Checkpoints at the
+// start of a member don't need a window, so files compressed in independent
+// members (e.g. by bgzip, or "pigz --independent") are indexed cheaply.
+func buildGzipIndex(f *os.File) (int64, []compressedIndexEntry, error) {
+	r, e := newGzipDecompressor(f, []compressedIndexEntry{{}})
+	if e != nil {
+		return 0, nil, e
+	}
+	z := r.(*gzipReader)
+	index := []compressedIndexEntry{{}}
+	var windowBuffer bytes.Buffer
+	windowCompressor, _ := flate.NewWriter(&windowBuffer, flate.BestSpeed)
+	var checkpointError error
+	z.inflater.onBlock = func(f *inflater) {
+		memberStarting := z.memberStarting
+		z.memberStarting = false
+		previous := &(index[len(index)-1])
+		if (f.total - previous.uncompressedOffset) < gzipCheckpointInterval {
+			return
+		}
+		if memberStarting {
+			index = append(index, compressedIndexEntry{
+				compressedOffset:   z.memberOffset,
+				uncompressedOffset: f.total,
+			})
+			return
+		}
+		windowBuffer.Reset()
+		windowCompressor.Reset(&windowBuffer)
+		windowCompressor.Write(f.window())
+		e := windowCompressor.Close()
+		if e != nil {
+			checkpointError = e
+			return
+		}
+		position := f.br.bitOffset()
+		index = append(index, compressedIndexEntry{
+			compressedOffset:   position / 8,
+			uncompressedOffset: f.total,
+			restartState: &deflateCheckpoint{
+				bitOffset: uint8(position % 8),
+				window:    bytes.Clone(windowBuffer.Bytes()),
+			},
+		})
+	}
+	size, e := io.Copy(io.Discard, z)
+	if e != nil {
+		return 0, nil, fmt.Errorf("Error decompressing offset %d: %w",
+			size, e)
+	}
+	if checkpointError != nil {
+		return 0, nil, fmt.Errorf("Error saving checkpoint: %w",
+			checkpointError)
+	}
+	return size, index, nil
+}
@@ -0,0 +1,369 @@
+package fat
+
+// This file contains support for reading disk images stored in a compressed
+// format, usually without decompressing them to disk first. The individual
+// formats are handled in compressed_gzip.go, compressed_xz.go and
+// compressed_zstd.go.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Returned (wrapped) by OpenImage for images in a format that is recognized
+// but not supported.
+var ErrUnsupportedFormat = errors.New("Unsupported image format")
+
+// Returned (wrapped) by OpenImage for compressed images that can only be read
+// by decompressing them to a temporary file, if no temporary directory was
+// given in the ImageOptions.
+var ErrNeedsDecompression = errors.New("Image must be decompressed first")
+
+// The size of the blocks of decompressed data cached by compressed images.
+const compressedBlockSize = 1024 * 1024
+
+// The number of decompressed blocks cached by each compressed image.
+const compressedCacheBlocks = 32
+
+// If an image's index has restart points further apart than this, it must be
+// decompressed into a temporary file instead, which is only done if
+// ImageOptions.TemporaryDirectory is set.
+const compressedMaxRestartGap = 64 * 1024 * 1024
+
+// A point in a compressed image at which decompression can start.
+type compressedIndexEntry struct {
+	compressedOffset   int64
+	uncompressedOffset int64
+	// Any format-specific information needed to start here, e.g. a
+	// *deflateCheckpoint for gzip or an *xzBlock for xz.
+	restartState interface{}
+}
+
+// Describes a compression format we may encounter.
+type compressionFormat struct {
+	name  string
+	magic []byte
+	// Reads or builds the index of points from which decompression can
+	// start, returning the image's decompressed size. Nil if the format isn't
+	// supported.
+	buildIndex func(f *os.File) (int64, []compressedIndexEntry, error)
+	// Returns a new decompressor starting at the first of the given index
+	// entries, and continuing to the end of the image.
+	newDecompressor func(f *os.File,
+		index []compressedIndexEntry) (io.ReadCloser, error)
+}
+
+var compressionFormats = []compressionFormat{
+	{
+		name:            "gzip",
+		magic:           []byte{0x1f, 0x8b},
+		buildIndex:      buildGzipIndex,
+		newDecompressor: newGzipDecompressor,
+	},
+	{
+		name:            "xz",
+		magic:           xzStreamHeaderMagic,
+		buildIndex:      buildXZIndex,
+		newDecompressor: newXZDecompressor,
+	},
+	{
+		name:            "zstd",
+		magic:           []byte{0x28, 0xb5, 0x2f, 0xfd},
+		buildIndex:      buildZstdIndex,
+		newDecompressor: newZstdDecompressor,
+	},
+	{
+		name:  "bzip2",
+		magic: []byte("BZh"),
+	},
+	{
+		name:  "lz4",
+		magic: []byte{0x04, 0x22, 0x4d, 0x18},
+	},
+}
+
+// Returns the compression format of a file starting with the given bytes, or
+// nil if it doesn't appear to be compressed.
+func detectCompression(start []byte) *compressionFormat {
+	for i := range compressionFormats {
+		if bytes.HasPrefix(start, compressionFormats[i].magic) {
+			return &(compressionFormats[i])
+		}
+	}
+	return nil
+}
+
+// An Image backed by a compressed file. Opening the image reads or builds an
+// index of points from which decompression can start: checkpoints recorded
+// while decompressing a gzip file once, the frames of a zstd file (using the
+// seek table of the seekable format if present), or the blocks listed in an
+// xz file's index. Seeking backward restarts decompression from the closest
+// preceding point, and recently read blocks are cached. If the points are
+// too far apart for this to be efficient, e.g. in a zstd file with a single
+// frame, opening the image fails with ErrNeedsDecompression unless a
+// temporary directory is given in the ImageOptions. In that case, the image
+// is decompressed once into a sparse file in that directory, which is deleted
+// when the image is closed.
+type CompressedImage struct {
+	readerAtSeeker
+	file   *os.File
+	format *compressionFormat
+	index  []compressedIndexEntry
+	// The decompressed image, if it was decompressed to a temporary file.
+	temporaryFile *os.File
+	// Protects everything below, so that ReadAt can be used concurrently.
+	lock sync.Mutex
+	// The current decompressor, and its offset in the uncompressed data.
+	decompressor io.ReadCloser
+	position     int64
+	// Maps block numbers to decompressed content, and holds the cached
+	// block numbers from least to most recently used.
+	cache      map[int64][]byte
+	cacheOrder []int64
+}
+
+// Returns the name of the compression format, e.g. "gzip".
+func (c *CompressedImage) Format() string {
+	return c.format.name
+}
+
+// Returns the number of points from which decompression can start.
+func (c *CompressedImage) IndexSize() int {
+	return len(c.index)
+}
+
+// Returns true if the image was decompressed to a temporary file.
+func (c *CompressedImage) UsesTemporaryFile() bool {
+	return c.temporaryFile != nil
+}
+
+func (c *CompressedImage) Size() int64 {
+	return c.size
+}
+
+// Closes the current decompressor, if there is one.
+func (c *CompressedImage) stopDecompressor() {
+	if c.decompressor != nil {
+		c.decompressor.Close()
+		c.decompressor = nil
+	}
+}
+
+// Closes and deletes the temporary file, if there is one.
+func (c *CompressedImage) removeTemporaryFile() error {
+	if c.temporaryFile == nil {
+		return nil
+	}
+	c.temporaryFile.Close()
+	e := os.Remove(c.temporaryFile.Name())
+	c.temporaryFile = nil
+	return e
+}
+
+func (c *CompressedImage) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stopDecompressor()
+	e := c.removeTemporaryFile()
+	e2 := c.file.Close()
+	if e == nil {
+		e = e2
+	}
+	return e
+}
+
+// Returns the largest amount of decompressed data between two points in the
+// index.
+func (c *CompressedImage) maxRestartGap() int64 {
+	maxGap := int64(0)
+	for i := range c.index {
+		end := c.size
+		if (i + 1) < len(c.index) {
+			end = c.index[i+1].uncompressedOffset
+		}
+		gap := end - c.index[i].uncompressedOffset
+		if gap > maxGap {
+			maxGap = gap
+		}
+	}
+	return maxGap
+}
+
+// Decompresses the entire image into a temporary file in the given directory.
+// Blocks of zeros aren't written, leaving holes in the file where the
+// filesystem supports them.
+func (c *CompressedImage) decompressToTemporaryFile(dir string) error {
+	f, e := os.CreateTemp(dir, "fat-decompressed-*.img")
+	if e != nil {
+		return fmt.Errorf("Error creating temporary file: %w", e)
+	}
+	c.temporaryFile = f
+	r, e := c.format.newDecompressor(c.file, c.index)
+	if e != nil {
+		return e
+	}
+	defer r.Close()
+	buffer := make([]byte, compressedBlockSize)
+	zeros := make([]byte, compressedBlockSize)
+	for offset := int64(0); offset < c.size; {
+		size := int64(len(buffer))
+		if (c.size - offset) < size {
+			size = c.size - offset
+		}
+		_, e = io.ReadFull(r, buffer[:size])
+		if e != nil {
+			return fmt.Errorf("Error decompressing offset %d: %w", offset, e)
+		}
+		if !bytes.Equal(buffer[:size], zeros[:size]) {
+			_, e = f.WriteAt(buffer[:size], offset)
+			if e != nil {
+				return fmt.Errorf("Error writing %s: %w", f.Name(), e)
+			}
+		}
+		offset += size
+	}
+	e = f.Truncate(c.size)
+	if e != nil {
+		return fmt.Errorf("Error setting size of %s: %w", f.Name(), e)
+	}
+	return nil
+}
+
+// Opens a compressed image, reading or building its index. This requires
+// decompressing the whole image for gzip files, and for zstd files without a
+// seek table or frame sizes. The options may be nil.
+func openCompressedImage(f *os.File, format *compressionFormat,
+	options *ImageOptions) (*CompressedImage, error) {
+	if format.buildIndex == nil {
+		return nil, fmt.Errorf("%s is %s-compressed, which isn't supported; "+
+			"decompress it first: %w", f.Name(), format.name,
+			ErrUnsupportedFormat)
+	}
+	toReturn := &CompressedImage{
+		file:   f,
+		format: format,
+		cache:  make(map[int64][]byte),
+	}
+	var e error
+	toReturn.size, toReturn.index, e = format.buildIndex(f)
+	if e != nil {
+		return nil, fmt.Errorf("Error reading %s-compressed image %s: %w",
+			format.name, f.Name(), e)
+	}
+	maxGap := toReturn.maxRestartGap()
+	if maxGap > compressedMaxRestartGap {
+		if (options == nil) || (options.TemporaryDirectory == "") {
+			return nil, fmt.Errorf("%s is %s-compressed with up to %d bytes "+
+				"between the points where decompression can start, which "+
+				"is too slow to read in place; decompress it first, or "+
+				"give a temporary directory with room for %d bytes: %w",
+				f.Name(), format.name, maxGap, toReturn.size,
+				ErrNeedsDecompression)
+		}
+		e = toReturn.decompressToTemporaryFile(options.TemporaryDirectory)
+		if e != nil {
+			toReturn.removeTemporaryFile()
+			return nil, fmt.Errorf("Error decompressing %s-compressed image "+
+				"%s: %w", format.name, f.Name(), e)
+		}
+	}
+	toReturn.r = toReturn
+	return toReturn, nil
+}
+
+// Returns the index of the last point in the index at or before the given
+// offset in the uncompressed data.
+func (c *CompressedImage) restartPoint(offset int64) int {
+	return sort.Search(len(c.index), func(i int) bool {
+		return c.index[i].uncompressedOffset > offset
+	}) - 1
+}
+
+// Starts decompressing from the last point in the index at or before the
+// given offset in the uncompressed data.
+func (c *CompressedImage) restart(offset int64) error {
+	c.stopDecompressor()
+	i := c.restartPoint(offset)
+	var e error
+	c.decompressor, e = c.format.newDecompressor(c.file, c.index[i:])
+	if e != nil {
+		return e
+	}
+	c.position = c.index[i].uncompressedOffset
+	return nil
+}
+
+// Returns the decompressed content of the given block, which may be shorter
+// than compressedBlockSize at the end of the image.
+func (c *CompressedImage) getBlock(block int64) ([]byte, error) {
+	data, ok := c.cache[block]
+	if ok {
+		for i, b := range c.cacheOrder {
+			if b == block {
+				c.cacheOrder = append(c.cacheOrder[:i], c.cacheOrder[i+1:]...)
+				break
+			}
+		}
+		c.cacheOrder = append(c.cacheOrder, block)
+		return data, nil
+	}
+	start := block * compressedBlockSize
+	// Restart unless the current position is between the closest restart
+	// point and the start of the block.
+	if (c.decompressor == nil) || (c.position > start) || (c.position <
+		c.index[c.restartPoint(start)].uncompressedOffset) {
+		e := c.restart(start)
+		if e != nil {
+			return nil, fmt.Errorf("Error restarting decompression: %w", e)
+		}
+	}
+	if c.position < start {
+		_, e := io.CopyN(io.Discard, c.decompressor, start-c.position)
+		if e != nil {
+			c.stopDecompressor()
+			return nil, fmt.Errorf("Error skipping to offset %d: %w", start,
+				e)
+		}
+		c.position = start
+	}
+	size := int64(compressedBlockSize)
+	if (c.size - start) < size {
+		size = c.size - start
+	}
+	data = make([]byte, size)
+	_, e := io.ReadFull(c.decompressor, data)
+	if e != nil {
+		c.stopDecompressor()
+		return nil, fmt.Errorf("Error decompressing offset %d: %w", start, e)
+	}
+	c.position += size
+	if len(c.cacheOrder) >= compressedCacheBlocks {
+		delete(c.cache, c.cacheOrder[0])
+		c.cacheOrder = c.cacheOrder[1:]
+	}
+	c.cache[block] = data
+	c.cacheOrder = append(c.cacheOrder, block)
+	return data, nil
+}
+
+func (c *CompressedImage) ReadAt(dst []byte, offset int64) (int, error) {
+	if c.temporaryFile != nil {
+		return c.temporaryFile.ReadAt(dst, offset)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return readBlocks(dst, offset, c.size, compressedBlockSize,
+		func(dst []byte, block, blockOffset int64) error {
+			data, e := c.getBlock(block)
+			if e != nil {
+				return e
+			}
+			copy(dst, data[blockOffset:])
+			return nil
+		})
+}
@@ -0,0 +1,239 @@
+package fat
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes the data to a file in a temporary directory, returning its path.
+func writeCompressedImage(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	e := os.WriteFile(path, data, 0644)
+	if e != nil {
+		t.Logf("Failed writing %s: %s\n", name, e)
+		t.FailNow()
+	}
+	return path
+}
+
+// Writes the data to a gzip file, starting a new member every memberSize
+// bytes. Returns the path to the file.
+func writeGzipImage(t *testing.T, data []byte, memberSize int) string {
+	var buffer bytes.Buffer
+	for offset := 0; offset < len(data); offset += memberSize {
+		end := offset + memberSize
+		if end > len(data) {
+			end = len(data)
+		}
+		w, _ := gzip.NewWriterLevel(&buffer, gzip.BestSpeed)
+		w.Write(data[offset:end])
+		w.Close()
+	}
+	return writeCompressedImage(t, "disk.img.gz", buffer.Bytes())
+}
+
+// Opens the compressed image at the given path, checking its format, size
+// and number of restart points.
+func openTestCompressedImage(t *testing.T, path, format string,
+	indexSize int, data []byte) *CompressedImage {
+	img, e := OpenImage(path)
+	if e != nil {
+		t.Logf("Failed opening %s image: %s\n", format, e)
+		t.FailNow()
+	}
+	compressed, ok := img.(*CompressedImage)
+	if !ok {
+		t.Logf("Didn't get a CompressedImage for %s\n", path)
+		t.FailNow()
+	}
+	if (compressed.Format() != format) ||
+		(compressed.IndexSize() != indexSize) ||
+		(img.Size() != int64(len(data))) {
+		t.Logf("Got format %s, %d restart points, %d bytes. Expected %s, %d "+
+			"restart points, %d bytes\n", compressed.Format(),
+			compressed.IndexSize(), img.Size(), format, indexSize, len(data))
+		t.FailNow()
+	}
+	return compressed
+}
+
+// Reads the image backwards, to make sure decompression restarts correctly.
+func checkCompressedImageContent(t *testing.T, img Image, data []byte) {
+	buffer := make([]byte, 100000)
+	step := int64(len(data)/17) + 1
+	for offset := int64(len(data) - 50000); offset > 0; offset -= step {
+		n, e := img.ReadAt(buffer, offset)
+		expected := data[offset:]
+		if len(expected) > len(buffer) {
+			expected = expected[:len(buffer)]
+		}
+		if !bytes.Equal(buffer[:n], expected) {
+			t.Logf("Read incorrect data at offset %d\n", offset)
+			t.FailNow()
+		}
+		if (n < len(buffer)) && (e != io.EOF) {
+			t.Logf("Expected EOF for short read at %d, got %v\n", offset, e)
+			t.Fail()
+		}
+	}
+}
+
+func TestCompressedImage(t *testing.T) {
+	m := newTestImage()
+	m.addFile(testRootCluster, 0, "TEST.TXT", 3*SectorSize, []uint32{3, 4, 5})
+	// Follow the test image with enough data for several checkpoints.
+	data := append(bytes.Clone(m.data),
+		mixedTestData(5*gzipCheckpointInterval/2)...)
+	memberSizes := []int{len(data), 700000}
+	for _, memberSize := range memberSizes {
+		path := writeGzipImage(t, data, memberSize)
+		img := openTestCompressedImage(t, path, "gzip", 3, data)
+		defer img.Close()
+		if img.UsesTemporaryFile() {
+			t.Logf("The gzip image was unnecessarily decompressed to a " +
+				"temporary file\n")
+			t.Fail()
+		}
+		checkCompressedImageContent(t, img, data)
+		img.Seek(0, io.SeekStart)
+		f, e := NewFAT32Filesystem(img)
+		if e != nil {
+			t.Logf("Failed loading filesystem from gzip image: %s\n", e)
+			t.FailNow()
+		}
+		content, e := f.ReadFile("TEST.TXT")
+		if (e != nil) || (len(content) != 3*SectorSize) {
+			t.Logf("Failed reading file from gzip image: %v\n", e)
+			t.Fail()
+		}
+	}
+}
+
+func TestXZImage(t *testing.T) {
+	data := mixedTestData(3 * compressedBlockSize)
+	// Write two streams, with several blocks in the first.
+	var buffer bytes.Buffer
+	config := xz.WriterConfig{
+		BlockSize: compressedBlockSize,
+	}
+	split := 5 * compressedBlockSize / 2
+	w, e := config.NewWriter(&buffer)
+	if e != nil {
+		t.Logf("Failed creating xz writer: %s\n", e)
+		t.FailNow()
+	}
+	w.Write(data[:split])
+	w.Close()
+	// Streams may be separated by padding.
+	buffer.Write(make([]byte, 8))
+	w, _ = config.NewWriter(&buffer)
+	w.Write(data[split:])
+	w.Close()
+	path := writeCompressedImage(t, "disk.img.xz", buffer.Bytes())
+	img := openTestCompressedImage(t, path, "xz", 4, data)
+	defer img.Close()
+	checkCompressedImageContent(t, img, data)
+}
+
+// Compresses each frameSize bytes of data into a separate zstd frame. The
+// frames record their size if seekable is set, in which case the seek table
+// is also written.
+func writeZstdImage(t *testing.T, data []byte, frameSize int,
+	seekable bool) string {
+	var buffer, seekTable bytes.Buffer
+	encoder, _ := zstd.NewWriter(nil)
+	frameCount := 0
+	for offset := 0; offset < len(data); offset += frameSize {
+		end := offset + frameSize
+		if end > len(data) {
+			end = len(data)
+		}
+		start := buffer.Len()
+		if seekable {
+			buffer.Write(encoder.EncodeAll(data[offset:end], nil))
+		} else {
+			encoder.Reset(&buffer)
+			encoder.Write(data[offset:end])
+			encoder.Close()
+		}
+		binary.Write(&seekTable, binary.LittleEndian, []uint32{
+			uint32(buffer.Len() - start), uint32(end - offset)})
+		frameCount++
+	}
+	if seekable {
+		binary.Write(&seekTable, binary.LittleEndian, uint32(frameCount))
+		seekTable.WriteByte(0)
+		binary.Write(&seekTable, binary.LittleEndian,
+			uint32(zstdSeekTableMagic))
+		binary.Write(&buffer, binary.LittleEndian, []uint32{
+			zstdSeekTableFrameType, uint32(seekTable.Len())})
+		buffer.Write(seekTable.Bytes())
+	}
+	return writeCompressedImage(t, "disk.img.zst", buffer.Bytes())
+}
+
+func TestZstdImage(t *testing.T) {
+	data := mixedTestData(3 * compressedBlockSize)
+	for _, seekable := range []bool{true, false} {
+		path := writeZstdImage(t, data, 700000, seekable)
+		img := openTestCompressedImage(t, path, "zstd", 5, data)
+		defer img.Close()
+		checkCompressedImageContent(t, img, data)
+	}
+	// Files with a single large frame can only be read by decompressing them
+	// to a temporary file, which must be allowed explicitly.
+	data = make([]byte, compressedMaxRestartGap+compressedBlockSize)
+	copy(data[compressedMaxRestartGap:], mixedTestData(compressedBlockSize))
+	copy(data[5000:], mixedTestData(100000))
+	path := writeZstdImage(t, data, len(data), false)
+	_, e := OpenImage(path)
+	if !errors.Is(e, ErrNeedsDecompression) {
+		t.Logf("Didn't get ErrNeedsDecompression opening a zstd image with "+
+			"one large frame: %v\n", e)
+		t.FailNow()
+	}
+	t.Logf("Got expected error opening a zstd image with one large "+
+		"frame: %s\n", e)
+	temporaryDir := t.TempDir()
+	opened, e := OpenImageWithOptions(path, &ImageOptions{
+		TemporaryDirectory: temporaryDir,
+	})
+	if e != nil {
+		t.Logf("Failed opening a zstd image with one large frame: %s\n", e)
+		t.FailNow()
+	}
+	img := opened.(*CompressedImage)
+	if !img.UsesTemporaryFile() ||
+		(filepath.Dir(img.temporaryFile.Name()) != temporaryDir) {
+		t.Logf("A zstd image with one large frame wasn't decompressed to " +
+			"a temporary file in the given directory\n")
+		t.FailNow()
+	}
+	checkCompressedImageContent(t, img, data)
+	temporaryPath := img.temporaryFile.Name()
+	img.Close()
+	_, e = os.Stat(temporaryPath)
+	if !errors.Is(e, fs.ErrNotExist) {
+		t.Logf("The temporary file %s wasn't deleted: %v\n", temporaryPath,
+			e)
+		t.Fail()
+	}
+}
+
+func TestUnsupportedCompression(t *testing.T) {
+	path := writeCompressedImage(t, "disk.img.bz2", []byte("BZh91AY&SY"))
+	_, e := OpenImage(path)
+	if !errors.Is(e, ErrUnsupportedFormat) {
+		t.Logf("Expected ErrUnsupportedFormat for bzip2 image, got %v\n", e)
+		t.Fail()
+	}
+}
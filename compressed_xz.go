@@ -0,0 +1,353 @@
+package fat
+
+// This file contains support for random access to xz-compressed images. The
+// index at the end of each xz stream lists the size of every block, so
+// decompression can start at any block without reading the blocks before it.
+// Images compressed with "xz -T" are split into blocks a few times the size of
+// the dictionary; single-threaded xz writes a single block.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/ulikunitz/xz/lzma"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+var (
+	xzStreamHeaderMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	xzStreamFooterMagic = []byte{'Y', 'Z'}
+)
+
+// The size of the xz stream header and footer.
+const xzStreamHeaderSize = 12
+
+// The ID of the LZMA2 filter, the only one supported in xz blocks.
+const xzFilterLZMA2 = 0x21
+
+// The location of a block in an xz file.
+type xzBlock struct {
+	// The size of the block header, compressed data and check, excluding
+	// padding.
+	unpaddedSize int64
+	// The size of the data once decompressed.
+	uncompressedSize int64
+}
+
+// Returns the size of the check used by blocks in a stream with the given
+// flags.
+func xzCheckSize(flags []byte) (int64, error) {
+	if (flags[0] != 0) || ((flags[1] & 0xf0) != 0) {
+		return 0, fmt.Errorf("Unsupported xz stream flags: %x", flags)
+	}
+	checkType := flags[1] & 0x0f
+	if checkType == 0 {
+		return 0, nil
+	}
+	return 4 << ((checkType - 1) / 3), nil
+}
+
+// Reads a variable-length integer from an xz header or index.
+func readXZVarint(r io.ByteReader) (int64, error) {
+	v := int64(0)
+	for i := 0; i < 9; i++ {
+		b, e := r.ReadByte()
+		if e != nil {
+			return 0, e
+		}
+		v |= int64(b&0x7f) << (7 * i)
+		if (b & 0x80) == 0 {
+			if (b == 0) && (i != 0) {
+				break
+			}
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid xz variable-length integer")
+}
+
+// Parses the xz stream ending at the given offset (just after its footer),
+// returning its blocks and the offset at which the stream starts.
+func readXZStreamIndex(f *os.File, end int64) ([]xzBlock, int64, error) {
+	if end < (2 * xzStreamHeaderSize) {
+		return nil, 0, fmt.Errorf("Truncated xz stream")
+	}
+	var footer [xzStreamHeaderSize]byte
+	_, e := f.ReadAt(footer[:], end-xzStreamHeaderSize)
+	if e != nil {
+		return nil, 0, fmt.Errorf("Error reading stream footer: %w", e)
+	}
+	if !bytes.Equal(footer[10:], xzStreamFooterMagic) ||
+		(crc32.ChecksumIEEE(footer[4:10]) !=
+			binary.LittleEndian.Uint32(footer[:4])) {
+		return nil, 0, fmt.Errorf("Invalid xz stream footer ending at "+
+			"offset %d", end)
+	}
+	checkSize, e := xzCheckSize(footer[8:10])
+	if e != nil {
+		return nil, 0, e
+	}
+	indexSize := (int64(binary.LittleEndian.Uint32(footer[4:8])) + 1) * 4
+	indexStart := end - xzStreamHeaderSize - indexSize
+	if indexStart < xzStreamHeaderSize {
+		return nil, 0, fmt.Errorf("Invalid xz index size: %d", indexSize)
+	}
+	index := make([]byte, indexSize)
+	_, e = f.ReadAt(index, indexStart)
+	if e != nil {
+		return nil, 0, fmt.Errorf("Error reading xz index: %w", e)
+	}
+	if (index[0] != 0) || (crc32.ChecksumIEEE(index[:indexSize-4]) !=
+		binary.LittleEndian.Uint32(index[indexSize-4:])) {
+		return nil, 0, fmt.Errorf("Invalid xz index at offset %d",
+			indexStart)
+	}
+	r := bytes.NewReader(index[1 : indexSize-4])
+	count, e := readXZVarint(r)
+	if e != nil {
+		return nil, 0, e
+	}
+	if count > (indexSize / 2) {
+		return nil, 0, fmt.Errorf("Invalid xz index record count: %d", count)
+	}
+	blocks := make([]xzBlock, count)
+	blocksSize := int64(0)
+	for i := range blocks {
+		b := &(blocks[i])
+		b.unpaddedSize, e = readXZVarint(r)
+		if e != nil {
+			return nil, 0, e
+		}
+		b.uncompressedSize, e = readXZVarint(r)
+		if e != nil {
+			return nil, 0, e
+		}
+		if b.unpaddedSize <= checkSize {
+			return nil, 0, fmt.Errorf("Invalid xz block size: %d",
+				b.unpaddedSize)
+		}
+		blocksSize += (b.unpaddedSize + 3) &^ 3
+	}
+	start := indexStart - blocksSize - xzStreamHeaderSize
+	if start < 0 {
+		return nil, 0, fmt.Errorf("The xz index lists more data than the " +
+			"stream holds")
+	}
+	var header [xzStreamHeaderSize]byte
+	_, e = f.ReadAt(header[:], start)
+	if e != nil {
+		return nil, 0, fmt.Errorf("Error reading stream header: %w", e)
+	}
+	if !bytes.HasPrefix(header[:], xzStreamHeaderMagic) ||
+		!bytes.Equal(header[6:8], footer[8:10]) {
+		return nil, 0, fmt.Errorf("Invalid xz stream header at offset %d",
+			start)
+	}
+	return blocks, start, nil
+}
+
+// Reads the indices of every stream in an xz file, returning its
+// decompressed size and the location of each block.
+func buildXZIndex(f *os.File) (int64, []compressedIndexEntry, error) {
+	end, e := f.Seek(0, io.SeekEnd)
+	if e != nil {
+		return 0, nil, e
+	}
+	// Streams are read from last to first, so collect them in reverse.
+	var streams [][]compressedIndexEntry
+	for end > 0 {
+		if end < 4 {
+			return 0, nil, fmt.Errorf("Truncated xz file")
+		}
+		// Streams may be followed by padding, in multiples of 4 bytes.
+		var padding [4]byte
+		_, e = f.ReadAt(padding[:], end-4)
+		if e != nil {
+			return 0, nil, fmt.Errorf("Error reading xz file: %w", e)
+		}
+		if binary.LittleEndian.Uint32(padding[:]) == 0 {
+			end -= 4
+			continue
+		}
+		blocks, start, e := readXZStreamIndex(f, end)
+		if e != nil {
+			return 0, nil, e
+		}
+		entries := make([]compressedIndexEntry, len(blocks))
+		offset := start + xzStreamHeaderSize
+		for i := range blocks {
+			entries[i].compressedOffset = offset
+			entries[i].restartState = &(blocks[i])
+			offset += (blocks[i].unpaddedSize + 3) &^ 3
+		}
+		streams = append(streams, entries)
+		end = start
+	}
+	var index []compressedIndexEntry
+	size := int64(0)
+	for i := len(streams) - 1; i >= 0; i-- {
+		for _, entry := range streams[i] {
+			entry.uncompressedOffset = size
+			size += entry.restartState.(*xzBlock).uncompressedSize
+			index = append(index, entry)
+		}
+	}
+	if len(index) == 0 {
+		return 0, nil, fmt.Errorf("The xz file contains no blocks")
+	}
+	return size, index, nil
+}
+
+// Reads an xz block header, returning the dictionary size used by its LZMA2
+// filter.
+func readXZBlockHeader(r *bufio.Reader) (int64, error) {
+	sizeByte, e := r.ReadByte()
+	if e != nil {
+		return 0, e
+	}
+	if sizeByte == 0 {
+		return 0, fmt.Errorf("Expected an xz block header, found an index")
+	}
+	header := make([]byte, (int(sizeByte)+1)*4)
+	header[0] = sizeByte
+	_, e = io.ReadFull(r, header[1:])
+	if e != nil {
+		return 0, e
+	}
+	crcOffset := len(header) - 4
+	if crc32.ChecksumIEEE(header[:crcOffset]) !=
+		binary.LittleEndian.Uint32(header[crcOffset:]) {
+		return 0, fmt.Errorf("Invalid xz block header CRC")
+	}
+	fields := bytes.NewReader(header[2:crcOffset])
+	flags := header[1]
+	if (flags & 3) != 0 {
+		return 0, fmt.Errorf("xz blocks with filters other than LZMA2 "+
+			"aren't supported: %w", ErrUnsupportedFormat)
+	}
+	// Skip the optional compressed and uncompressed sizes.
+	if (flags & 0x40) != 0 {
+		_, e = readXZVarint(fields)
+		if e != nil {
+			return 0, e
+		}
+	}
+	if (flags & 0x80) != 0 {
+		_, e = readXZVarint(fields)
+		if e != nil {
+			return 0, e
+		}
+	}
+	filterID, e := readXZVarint(fields)
+	if e != nil {
+		return 0, e
+	}
+	propertiesSize, e := readXZVarint(fields)
+	if e != nil {
+		return 0, e
+	}
+	if (filterID != xzFilterLZMA2) || (propertiesSize != 1) {
+		return 0, fmt.Errorf("Unsupported xz filter 0x%x: %w", filterID,
+			ErrUnsupportedFormat)
+	}
+	properties, e := fields.ReadByte()
+	if e != nil {
+		return 0, e
+	}
+	bits := int(properties & 0x3f)
+	if bits > 40 {
+		return 0, fmt.Errorf("Invalid LZMA2 dictionary size")
+	}
+	if bits == 40 {
+		return 0xffffffff, nil
+	}
+	return int64(2|(bits&1)) << (bits/2 + 11), nil
+}
+
+// Decompresses consecutive xz blocks.
+type xzReader struct {
+	f *os.File
+	// The remaining blocks, starting with the current one.
+	index []compressedIndexEntry
+	// Decompresses the current block, or nil if it has yet to be started.
+	block io.Reader
+	// The amount of data left in the current block.
+	remaining int64
+}
+
+// Starts decompressing the first block in r.index.
+func (r *xzReader) startBlock() error {
+	entry := &(r.index[0])
+	block := entry.restartState.(*xzBlock)
+	input := bufio.NewReaderSize(io.NewSectionReader(r.f,
+		entry.compressedOffset, block.unpaddedSize), 1024*1024)
+	dictionarySize, e := readXZBlockHeader(input)
+	if e != nil {
+		return fmt.Errorf("Error reading xz block header at offset %d: %w",
+			entry.compressedOffset, e)
+	}
+	// Nothing in the block can refer further back than its start.
+	if dictionarySize > block.uncompressedSize {
+		dictionarySize = block.uncompressedSize
+	}
+	if dictionarySize < lzma.MinDictCap {
+		dictionarySize = lzma.MinDictCap
+	}
+	config := lzma.Reader2Config{
+		DictCap: int(dictionarySize),
+	}
+	r.block, e = config.NewReader2(input)
+	if e != nil {
+		return fmt.Errorf("Error starting xz block at offset %d: %w",
+			entry.compressedOffset, e)
+	}
+	r.remaining = block.uncompressedSize
+	return nil
+}
+
+func (r *xzReader) Read(dst []byte) (int, error) {
+	for len(r.index) > 0 {
+		if r.block == nil {
+			e := r.startBlock()
+			if e != nil {
+				return 0, e
+			}
+		}
+		if r.remaining == 0 {
+			r.index = r.index[1:]
+			r.block = nil
+			continue
+		}
+		if int64(len(dst)) > r.remaining {
+			dst = dst[:r.remaining]
+		}
+		n, e := r.block.Read(dst)
+		r.remaining -= int64(n)
+		if n > 0 {
+			return n, nil
+		}
+		if e == io.EOF {
+			e = io.ErrUnexpectedEOF
+		}
+		return 0, fmt.Errorf("Error decompressing xz block at offset %d: %w",
+			r.index[0].compressedOffset, e)
+	}
+	return 0, io.EOF
+}
+
+func (r *xzReader) Close() error {
+	return nil
+}
+
+// Returns a reader that decompresses the xz file f, starting at the block in
+// the first index entry.
+func newXZDecompressor(f *os.File, index []compressedIndexEntry) (
+	io.ReadCloser, error) {
+	return &xzReader{
+		f:     f,
+		index: index,
+	}, nil
+}
@@ -0,0 +1,202 @@
+package fat
+
+// This file contains support for random access to zstd-compressed images.
+// Decompression can start at any zstd frame. Files in the seekable format
+// (written by e.g. "t2sz" or zstd's contrib/seekable_format) end with a seek
+// table listing the size of every frame. For other files, the frames are found
+// by reading their headers and block headers.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"os"
+)
+
+// Values used by the seekable format's seek table.
+const (
+	zstdSeekTableMagic      = 0x8f92eab1
+	zstdSeekTableFrameType  = 0x184d2a5e
+	zstdSeekTableFooterSize = 9
+	zstdSkippableHeaderSize = 8
+	zstdSeekTableChecksums  = 0x80
+)
+
+// The types of blocks in a zstd frame.
+const (
+	zstdBlockRaw        = 0
+	zstdBlockRLE        = 1
+	zstdBlockCompressed = 2
+)
+
+// Returns a decoder that decompresses data from one frame at a time.
+func newZstdDecoder(r io.Reader) (*zstd.Decoder, error) {
+	return zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+}
+
+// Reads the seek table at the end of a file in the zstd seekable format.
+// Returns a nil index if the file doesn't end with a valid seek table.
+func readZstdSeekTable(f *os.File, fileSize int64) (int64,
+	[]compressedIndexEntry, error) {
+	if fileSize < (zstdSkippableHeaderSize + zstdSeekTableFooterSize) {
+		return 0, nil, nil
+	}
+	var footer [zstdSeekTableFooterSize]byte
+	_, e := f.ReadAt(footer[:], fileSize-zstdSeekTableFooterSize)
+	if e != nil {
+		return 0, nil, fmt.Errorf("Error reading seek table footer: %w", e)
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != zstdSeekTableMagic {
+		return 0, nil, nil
+	}
+	frameCount := int64(binary.LittleEndian.Uint32(footer[:4]))
+	entrySize := int64(8)
+	if (footer[4] & zstdSeekTableChecksums) != 0 {
+		entrySize += 4
+	}
+	tableSize := frameCount*entrySize + zstdSeekTableFooterSize
+	tableStart := fileSize - tableSize - zstdSkippableHeaderSize
+	if ((footer[4] & 0x7c) != 0) || (tableStart < 0) {
+		return 0, nil, nil
+	}
+	table := make([]byte, tableSize+zstdSkippableHeaderSize)
+	_, e = f.ReadAt(table, tableStart)
+	if e != nil {
+		return 0, nil, fmt.Errorf("Error reading seek table: %w", e)
+	}
+	if (binary.LittleEndian.Uint32(table) != zstdSeekTableFrameType) ||
+		(int64(binary.LittleEndian.Uint32(table[4:])) != tableSize) {
+		return 0, nil, nil
+	}
+	table = table[zstdSkippableHeaderSize:]
+	index := make([]compressedIndexEntry, frameCount)
+	compressedOffset, size := int64(0), int64(0)
+	for i := range index {
+		entry := table[int64(i)*entrySize:]
+		index[i].compressedOffset = compressedOffset
+		index[i].uncompressedOffset = size
+		compressedOffset += int64(binary.LittleEndian.Uint32(entry))
+		size += int64(binary.LittleEndian.Uint32(entry[4:]))
+	}
+	if (frameCount == 0) || (compressedOffset != tableStart) {
+		// The table doesn't describe this file.
+		return 0, nil, nil
+	}
+	return size, index, nil
+}
+
+// Returns the offset of the end of the zstd frame with the given header,
+// starting at the given offset, by reading the headers of its blocks.
+func findZstdFrameEnd(f *os.File, offset int64, header *zstd.Header) (int64,
+	error) {
+	position := offset + int64(header.HeaderSize)
+	for {
+		var blockHeader [4]byte
+		_, e := f.ReadAt(blockHeader[:3], position)
+		if e != nil {
+			return 0, fmt.Errorf("Error reading zstd block header at "+
+				"offset %d: %w", position, e)
+		}
+		v := binary.LittleEndian.Uint32(blockHeader[:])
+		size := int64(v >> 3)
+		switch (v >> 1) & 3 {
+		case zstdBlockRLE:
+			size = 1
+		case zstdBlockRaw, zstdBlockCompressed:
+		default:
+			return 0, fmt.Errorf("Invalid zstd block type at offset %d",
+				position)
+		}
+		position += 3 + size
+		if (v & 1) != 0 {
+			break
+		}
+	}
+	if header.HasCheckSum {
+		position += 4
+	}
+	return position, nil
+}
+
+// Finds every frame in a zstd file, returning its decompressed size and the
+// offset of each frame. The size of frames that don't record it is found by
+// decompressing them.
+func buildZstdIndex(f *os.File) (int64, []compressedIndexEntry, error) {
+	fileSize, e := f.Seek(0, io.SeekEnd)
+	if e != nil {
+		return 0, nil, e
+	}
+	size, index, e := readZstdSeekTable(f, fileSize)
+	if (e != nil) || (index != nil) {
+		return size, index, e
+	}
+	decoder, e := newZstdDecoder(nil)
+	if e != nil {
+		return 0, nil, e
+	}
+	defer decoder.Close()
+	offset := int64(0)
+	for offset < fileSize {
+		buffer := make([]byte, zstd.HeaderMaxSize)
+		n, e := f.ReadAt(buffer, offset)
+		if (e != nil) && (e != io.EOF) {
+			return 0, nil, fmt.Errorf("Error reading zstd frame header at "+
+				"offset %d: %w", offset, e)
+		}
+		var header zstd.Header
+		e = header.Decode(buffer[:n])
+		if e != nil {
+			return 0, nil, fmt.Errorf("Invalid zstd frame header at offset "+
+				"%d: %w", offset, e)
+		}
+		if header.Skippable {
+			offset += int64(header.HeaderSize) + int64(header.SkippableSize)
+			continue
+		}
+		frameEnd, e := findZstdFrameEnd(f, offset, &header)
+		if e != nil {
+			return 0, nil, e
+		}
+		index = append(index, compressedIndexEntry{
+			compressedOffset:   offset,
+			uncompressedOffset: size,
+		})
+		if header.HasFCS {
+			size += int64(header.FrameContentSize)
+		} else {
+			e = decoder.Reset(io.NewSectionReader(f, offset,
+				frameEnd-offset))
+			if e != nil {
+				return 0, nil, e
+			}
+			n, e := io.Copy(io.Discard, decoder)
+			if e != nil {
+				return 0, nil, fmt.Errorf("Error decompressing zstd frame "+
+					"at offset %d: %w", offset, e)
+			}
+			size += n
+		}
+		offset = frameEnd
+	}
+	if len(index) == 0 {
+		return 0, nil, fmt.Errorf("The zstd file contains no frames")
+	}
+	return size, index, nil
+}
+
+// Returns a reader that decompresses the zstd file f, starting at the frame in
+// the first index entry.
+func newZstdDecompressor(f *os.File, index []compressedIndexEntry) (
+	io.ReadCloser, error) {
+	_, e := f.Seek(index[0].compressedOffset, io.SeekStart)
+	if e != nil {
+		return nil, e
+	}
+	decoder, e := newZstdDecoder(bufio.NewReaderSize(f, 1024*1024))
+	if e != nil {
+		return nil, e
+	}
+	return decoder.IOReadCloser(), nil
+}
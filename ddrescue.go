@@ -0,0 +1,405 @@
+package fat
+
+// This file contains support for GNU ddrescue mapfiles, which record the
+// parts of a disk that couldn't be read while it was being imaged. ddrescue
+// leaves such regions zero-filled in the image, so the mapfile is needed to
+// tell missing data apart from real zeros.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The status characters used for blocks in ddrescue mapfiles.
+const (
+	RescueNonTried   = '?'
+	RescueNonTrimmed = '*'
+	RescueNonScraped = '/'
+	RescueBadSector  = '-'
+	RescueFinished   = '+'
+)
+
+// Returns a human-readable name for a block status from a ddrescue mapfile.
+func RescueStatusName(status byte) string {
+	switch status {
+	case RescueNonTried:
+		return "non-tried"
+	case RescueNonTrimmed:
+		return "non-trimmed"
+	case RescueNonScraped:
+		return "non-scraped"
+	case RescueBadSector:
+		return "bad sector"
+	case RescueFinished:
+		return "finished"
+	}
+	return fmt.Sprintf("unknown status '%c'", status)
+}
+
+// A single line from a ddrescue mapfile: a range of bytes and its status.
+type RescueBlock struct {
+	Offset int64
+	Size   int64
+	Status byte
+}
+
+// Returns the offset just past the end of the block.
+func (b *RescueBlock) End() int64 {
+	return b.Offset + b.Size
+}
+
+// The content of a ddrescue mapfile.
+type RescueMap struct {
+	// The position and status of ddrescue when the mapfile was written.
+	CurrentPosition int64
+	CurrentStatus   byte
+	// The current pass, or 0 if the mapfile didn't include it.
+	CurrentPass int
+	// The blocks in the map, sorted by offset and not overlapping.
+	Blocks []RescueBlock
+}
+
+// Parses a ddrescue mapfile.
+func ParseRescueMap(r io.Reader) (*RescueMap, error) {
+	scanner := bufio.NewScanner(r)
+	var toReturn *RescueMap
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		comment := strings.IndexByte(line, '#')
+		if comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// The first line that isn't a comment holds the current status.
+		if toReturn == nil {
+			if (len(fields) < 2) || (len(fields) > 3) ||
+				(len(fields[1]) != 1) {
+				return nil, fmt.Errorf("Invalid status on line %d",
+					lineNumber)
+			}
+			position, e := strconv.ParseInt(fields[0], 0, 64)
+			if e != nil {
+				return nil, fmt.Errorf("Invalid position on line %d: %w",
+					lineNumber, e)
+			}
+			toReturn = &RescueMap{
+				CurrentPosition: position,
+				CurrentStatus:   fields[1][0],
+			}
+			if len(fields) == 3 {
+				toReturn.CurrentPass, e = strconv.Atoi(fields[2])
+				if e != nil {
+					return nil, fmt.Errorf("Invalid pass on line %d: %w",
+						lineNumber, e)
+				}
+			}
+			continue
+		}
+		if (len(fields) != 3) || (len(fields[2]) != 1) ||
+			!strings.Contains("?*/-+", fields[2]) {
+			return nil, fmt.Errorf("Invalid block on line %d", lineNumber)
+		}
+		offset, e := strconv.ParseInt(fields[0], 0, 64)
+		if e != nil {
+			return nil, fmt.Errorf("Invalid offset on line %d: %w",
+				lineNumber, e)
+		}
+		size, e := strconv.ParseInt(fields[1], 0, 64)
+		if e != nil {
+			return nil, fmt.Errorf("Invalid size on line %d: %w",
+				lineNumber, e)
+		}
+		if (offset < 0) || (size <= 0) {
+			return nil, fmt.Errorf("Invalid block on line %d", lineNumber)
+		}
+		count := len(toReturn.Blocks)
+		if (count != 0) && (toReturn.Blocks[count-1].End() > offset) {
+			return nil, fmt.Errorf("Block on line %d overlaps or precedes "+
+				"the previous block", lineNumber)
+		}
+		toReturn.Blocks = append(toReturn.Blocks, RescueBlock{
+			Offset: offset,
+			Size:   size,
+			Status: fields[2][0],
+		})
+	}
+	if e := scanner.Err(); e != nil {
+		return nil, e
+	}
+	if toReturn == nil {
+		return nil, fmt.Errorf("The mapfile doesn't contain a status line")
+	}
+	return toReturn, nil
+}
+
+// Loads the ddrescue mapfile at the given path.
+func LoadRescueMap(path string) (*RescueMap, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	toReturn, e := ParseRescueMap(f)
+	if e != nil {
+		return nil, fmt.Errorf("Error parsing %s: %w", path, e)
+	}
+	return toReturn, nil
+}
+
+// Writes the map in the format used by ddrescue.
+func (m *RescueMap) Write(w io.Writer) error {
+	_, e := fmt.Fprintf(w, "# Mapfile. Created by github.com/yalue/fat\n"+
+		"# current_pos  current_status  current_pass\n"+
+		"0x%08X     %c               %d\n"+
+		"#      pos        size  status\n", m.CurrentPosition,
+		m.CurrentStatus, m.CurrentPass)
+	if e != nil {
+		return e
+	}
+	for i := range m.Blocks {
+		b := &(m.Blocks[i])
+		_, e = fmt.Fprintf(w, "0x%08X  0x%08X  %c\n", b.Offset, b.Size,
+			b.Status)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Returns the parts of the given range that weren't finished by ddrescue, in
+// order. Parts of the range that aren't covered by the map are returned with
+// the RescueNonTried status.
+func (m *RescueMap) UnreadableRanges(offset, size int64) []RescueBlock {
+	var toReturn []RescueBlock
+	// Adds a range, merging it with the previous one if possible.
+	add := func(start, end int64, status byte) {
+		count := len(toReturn)
+		if (count != 0) && (toReturn[count-1].End() == start) &&
+			(toReturn[count-1].Status == status) {
+			toReturn[count-1].Size += end - start
+			return
+		}
+		toReturn = append(toReturn, RescueBlock{
+			Offset: start,
+			Size:   end - start,
+			Status: status,
+		})
+	}
+	end := offset + size
+	current := offset
+	i := sort.Search(len(m.Blocks), func(i int) bool {
+		return m.Blocks[i].End() > offset
+	})
+	for ; (i < len(m.Blocks)) && (current < end); i++ {
+		b := &(m.Blocks[i])
+		if b.Offset >= end {
+			break
+		}
+		if b.Offset > current {
+			add(current, b.Offset, RescueNonTried)
+			current = b.Offset
+		}
+		blockEnd := b.End()
+		if blockEnd > end {
+			blockEnd = end
+		}
+		if b.Status != RescueFinished {
+			add(current, blockEnd, b.Status)
+		}
+		current = blockEnd
+	}
+	if current < end {
+		add(current, end, RescueNonTried)
+	}
+	return toReturn
+}
+
+// Sets the status of the given range, splitting any blocks it overlaps and
+// merging adjacent blocks with the same status.
+func (m *RescueMap) SetStatus(offset, size int64, status byte) {
+	if size <= 0 {
+		return
+	}
+	end := offset + size
+	first := sort.Search(len(m.Blocks), func(i int) bool {
+		return m.Blocks[i].End() > offset
+	})
+	last := first
+	for (last < len(m.Blocks)) && (m.Blocks[last].Offset < end) {
+		last++
+	}
+	// Build the blocks replacing m.Blocks[first:last], including the blocks
+	// on either side so they can be merged.
+	replacement := make([]RescueBlock, 0, 5)
+	if first > 0 {
+		first--
+		replacement = append(replacement, m.Blocks[first])
+	}
+	for i := first; i < last; i++ {
+		b := m.Blocks[i]
+		if (b.Offset < offset) && (b.End() > offset) {
+			replacement = append(replacement, RescueBlock{
+				Offset: b.Offset,
+				Size:   offset - b.Offset,
+				Status: b.Status,
+			})
+		}
+	}
+	replacement = append(replacement, RescueBlock{
+		Offset: offset,
+		Size:   size,
+		Status: status,
+	})
+	if (last > 0) && (m.Blocks[last-1].End() > end) {
+		b := m.Blocks[last-1]
+		replacement = append(replacement, RescueBlock{
+			Offset: end,
+			Size:   b.End() - end,
+			Status: b.Status,
+		})
+	}
+	if last < len(m.Blocks) {
+		replacement = append(replacement, m.Blocks[last])
+		last++
+	}
+	merged := replacement[:1]
+	for _, b := range replacement[1:] {
+		previous := &(merged[len(merged)-1])
+		if (previous.End() == b.Offset) && (previous.Status == b.Status) {
+			previous.Size += b.Size
+			continue
+		}
+		merged = append(merged, b)
+	}
+	merged = append(merged, m.Blocks[last:]...)
+	m.Blocks = append(m.Blocks[:first], merged...)
+}
+
+// Returns the total number of bytes in blocks with the given status.
+func (m *RescueMap) StatusSize(status byte) int64 {
+	toReturn := int64(0)
+	for i := range m.Blocks {
+		if m.Blocks[i].Status == status {
+			toReturn += m.Blocks[i].Size
+		}
+	}
+	return toReturn
+}
+
+// Implemented by images that know which of their regions couldn't be read
+// when they were acquired, e.g. a RescuedImage, or a LimitedReadSeeker
+// wrapping one.
+type UnreadableRangeReporter interface {
+	// Returns the parts of the given range that couldn't be read, in order.
+	UnreadableRanges(offset, size int64) []RescueBlock
+}
+
+// Returned by RescuedImage reads that reach a region ddrescue didn't finish
+// reading.
+type UnreadableError struct {
+	// The unreadable range, relative to the start of the image.
+	Offset int64
+	Size   int64
+	// The range's status in the mapfile.
+	Status byte
+}
+
+func (e *UnreadableError) Error() string {
+	return fmt.Sprintf("%d bytes at offset %d weren't read when the image "+
+		"was acquired (%s)", e.Size, e.Offset, RescueStatusName(e.Status))
+}
+
+// Wraps an Image created by ddrescue, along with its mapfile.
+type RescuedImage struct {
+	readerAtSeeker
+	image Image
+	Map   *RescueMap
+	// If false, reads stop at the first unreadable byte and return an
+	// *UnreadableError. If true, reads return the image's content (usually
+	// zeros) for unreadable regions; UnreadableRanges can still be used to
+	// find them.
+	AllowUnreadable bool
+}
+
+// Returns a RescuedImage reading from the given image, using the given
+// ddrescue map.
+func NewRescuedImage(image Image, m *RescueMap) *RescuedImage {
+	toReturn := &RescuedImage{
+		image: image,
+		Map:   m,
+	}
+	toReturn.r = toReturn
+	toReturn.size = image.Size()
+	return toReturn
+}
+
+// Opens the image at the given path using OpenImage, along with the ddrescue
+// mapfile at mapPath.
+func OpenRescuedImage(path, mapPath string) (*RescuedImage, error) {
+	m, e := LoadRescueMap(mapPath)
+	if e != nil {
+		return nil, e
+	}
+	image, e := OpenImage(path)
+	if e != nil {
+		return nil, e
+	}
+	return NewRescuedImage(image, m), nil
+}
+
+func (r *RescuedImage) Size() int64 {
+	return r.size
+}
+
+func (r *RescuedImage) underlyingImage() Image {
+	return r.image
+}
+
+// Closes the underlying image.
+func (r *RescuedImage) Close() error {
+	return r.image.Close()
+}
+
+// Returns the parts of the given range, clipped to the image's size, that
+// ddrescue didn't finish reading.
+func (r *RescuedImage) UnreadableRanges(offset, size int64) []RescueBlock {
+	if (offset + size) > r.size {
+		size = r.size - offset
+	}
+	if size <= 0 {
+		return nil
+	}
+	return r.Map.UnreadableRanges(offset, size)
+}
+
+func (r *RescuedImage) ReadAt(dst []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("Invalid offset: %d", offset)
+	}
+	if !r.AllowUnreadable {
+		bad := r.UnreadableRanges(offset, int64(len(dst)))
+		if len(bad) != 0 {
+			n, e := r.image.ReadAt(dst[:bad[0].Offset-offset], offset)
+			if e != nil {
+				return n, e
+			}
+			return n, &UnreadableError{
+				Offset: bad[0].Offset,
+				Size:   bad[0].Size,
+				Status: bad[0].Status,
+			}
+		}
+	}
+	return r.image.ReadAt(dst, offset)
+}
@@ -0,0 +1,151 @@
+package fat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testRescueMap = `# Mapfile. Created by GNU ddrescue version 1.27
+# Command line: ddrescue /dev/sdb card.img card.map
+# current_pos  current_status  current_pass
+0x00100000     +               1
+#      pos        size  status
+0x00000000  0x00000400  +
+0x00000400  0x00000200  -
+0x00000600  0x00000A00  +
+0x00001000  0x00001000  ?
+`
+
+func TestParseRescueMap(t *testing.T) {
+	m, e := ParseRescueMap(strings.NewReader(testRescueMap))
+	if e != nil {
+		t.Logf("Failed parsing mapfile: %s\n", e)
+		t.FailNow()
+	}
+	if (m.CurrentPosition != 0x100000) || (m.CurrentStatus != '+') ||
+		(m.CurrentPass != 1) || (len(m.Blocks) != 4) {
+		t.Logf("Parsed incorrect mapfile: %+v\n", m)
+		t.FailNow()
+	}
+	if m.StatusSize(RescueFinished) != 0xe00 {
+		t.Logf("Expected 0xe00 finished bytes, got 0x%x\n",
+			m.StatusSize(RescueFinished))
+		t.Fail()
+	}
+	ranges := m.UnreadableRanges(0x500, 0x3000)
+	expected := []RescueBlock{
+		{0x500, 0x100, RescueBadSector},
+		{0x1000, 0x2500, RescueNonTried},
+	}
+	if fmt.Sprint(ranges) != fmt.Sprint(expected) {
+		t.Logf("Expected unreadable ranges %v, got %v\n", expected, ranges)
+		t.Fail()
+	}
+	if len(m.UnreadableRanges(0x600, 0xa00)) != 0 {
+		t.Logf("Got unreadable ranges in a finished block\n")
+		t.Fail()
+	}
+
+	var buffer bytes.Buffer
+	e = m.Write(&buffer)
+	if e != nil {
+		t.Logf("Failed writing mapfile: %s\n", e)
+		t.FailNow()
+	}
+	written, e := ParseRescueMap(&buffer)
+	if (e != nil) || (fmt.Sprint(written) != fmt.Sprint(m)) {
+		t.Logf("Written mapfile didn't parse to the same map: %v\n", e)
+		t.Fail()
+	}
+
+	_, e = ParseRescueMap(strings.NewReader("0 +\n0x400 0x200 -\n0 0x200 +\n"))
+	if e == nil {
+		t.Logf("Didn't get an error for out-of-order blocks\n")
+		t.Fail()
+	}
+}
+
+func TestRescuedImage(t *testing.T) {
+	m := newTestImage()
+	m.addFile(testRootCluster, 0, "TEST.TXT", 3*SectorSize, []uint32{3, 4, 5})
+	m.addFile(testRootCluster, 1, "OTHER", SectorSize, []uint32{6})
+	imagePath := filepath.Join(t.TempDir(), "card.img")
+	e := os.WriteFile(imagePath, m.data, 0644)
+	if e != nil {
+		t.Logf("Failed writing image: %s\n", e)
+		t.FailNow()
+	}
+	// Mark part of cluster 4 as a bad sector.
+	badOffset := int64(testReservedSectors+(2*testSectorsPerFAT)+2)*
+		SectorSize + 100
+	mapPath := filepath.Join(t.TempDir(), "card.map")
+	mapContent := fmt.Sprintf("0 +\n0 %d +\n%d 100 -\n%d %d +\n", badOffset,
+		badOffset, badOffset+100, int64(len(m.data))-badOffset-100)
+	e = os.WriteFile(mapPath, []byte(mapContent), 0644)
+	if e != nil {
+		t.Logf("Failed writing mapfile: %s\n", e)
+		t.FailNow()
+	}
+	img, e := OpenRescuedImage(imagePath, mapPath)
+	if e != nil {
+		t.Logf("Failed opening rescued image: %s\n", e)
+		t.FailNow()
+	}
+	defer img.Close()
+
+	// Access the filesystem through a LimitedReadSeeker, as if it were in a
+	// partition.
+	partition, e := LimitReadSeeker(img, 0, img.Size())
+	if e != nil {
+		t.Logf("Failed limiting image: %s\n", e)
+		t.FailNow()
+	}
+	f, e := NewFAT32Filesystem(partition)
+	if e != nil {
+		t.Logf("Failed loading filesystem from rescued image: %s\n", e)
+		t.FailNow()
+	}
+	chains, e := f.GetAllChains()
+	if e != nil {
+		t.Logf("Failed getting chains: %s\n", e)
+		t.FailNow()
+	}
+	for i := range chains {
+		c := &(chains[i])
+		expected := "[]"
+		if c.StartCluster == 3 {
+			expected = "[4]"
+		}
+		if fmt.Sprint(c.UnreadableClusters) != expected {
+			t.Logf("Chain starting at cluster %d has unreadable clusters "+
+				"%v, expected %s\n", c.StartCluster, c.UnreadableClusters,
+				expected)
+			t.Fail()
+		}
+	}
+
+	_, e = f.ReadFile("OTHER")
+	if e != nil {
+		t.Logf("Failed reading readable file: %s\n", e)
+		t.Fail()
+	}
+	_, e = f.ReadFile("TEST.TXT")
+	var unreadable *UnreadableError
+	if !errors.As(e, &unreadable) || (unreadable.Offset != badOffset) ||
+		(unreadable.Status != RescueBadSector) {
+		t.Logf("Expected an UnreadableError at offset %d, got %v\n",
+			badOffset, e)
+		t.Fail()
+	}
+	img.AllowUnreadable = true
+	content, e := f.ReadFile("TEST.TXT")
+	if (e != nil) || (len(content) != 3*SectorSize) {
+		t.Logf("Failed reading file with AllowUnreadable set: %v\n", e)
+		t.Fail()
+	}
+}
@@ -0,0 +1,620 @@
+package fat
+
+// This file contains definitions for parsing FAT directory entries. Directory
+// entries are where file names, sizes and starting clusters are stored, so
+// they are needed to make sense of the chains in the FAT, or to rebuild the
+// FAT when it has been lost.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"strings"
+	"unicode/utf16"
+)
+
+// The size of a single directory entry, in bytes.
+const DirectoryEntrySize = 32
+
+// Bits in the Attributes field of a directory entry.
+const (
+	AttributeReadOnly  = 0x01
+	AttributeHidden    = 0x02
+	AttributeSystem    = 0x04
+	AttributeVolumeID  = 0x08
+	AttributeDirectory = 0x10
+	AttributeArchive   = 0x20
+	// This combination of attributes indicates a long file name entry.
+	AttributeLongName = 0x0f
+)
+
+// The first byte of a short name is set to this when a file is deleted.
+const DeletedEntryMarker = 0xe5
+
+// A single 32-byte "short name" directory entry.
+type DirectoryEntry struct {
+	// The 8.3 name, padded with spaces.
+	Name             [8]byte
+	Extension        [3]byte
+	Attributes       byte
+	Reserved         byte
+	CreateTimeTenths byte
+	CreateTime       uint16
+	CreateDate       uint16
+	AccessDate       uint16
+	// The upper 16 bits of the start cluster.
+	ClusterHigh uint16
+	ModifyTime  uint16
+	ModifyDate  uint16
+	// The lower 16 bits of the start cluster.
+	ClusterLow uint16
+	// The size of the file, in bytes. Always 0 for directories.
+	FileSize uint32
+}
+
+// Returns the first cluster of the file or directory.
+func (d *DirectoryEntry) StartCluster() uint32 {
+	return (uint32(d.ClusterHigh) << 16) | uint32(d.ClusterLow)
+}
+
+// Returns true if this entry marks the end of the directory; no entries
+// following it are in use.
+func (d *DirectoryEntry) IsEndMarker() bool {
+	return d.Name[0] == 0
+}
+
+// Returns true if the entry was for a deleted file.
+func (d *DirectoryEntry) IsDeleted() bool {
+	return d.Name[0] == DeletedEntryMarker
+}
+
+// Returns true if this is actually a part of a long file name rather than a
+// short-name entry.
+func (d *DirectoryEntry) IsLongName() bool {
+	return (d.Attributes & 0x3f) == AttributeLongName
+}
+
+// Returns true if the entry refers to a subdirectory.
+func (d *DirectoryEntry) IsDirectory() bool {
+	return !d.IsLongName() && ((d.Attributes & AttributeDirectory) != 0)
+}
+
+// Returns true if the entry holds the volume label rather than a file.
+func (d *DirectoryEntry) IsVolumeLabel() bool {
+	return !d.IsLongName() && ((d.Attributes & AttributeVolumeID) != 0)
+}
+
+// Returns true if this is the "." or ".." entry found at the start of every
+// subdirectory.
+func (d *DirectoryEntry) IsDotEntry() bool {
+	return d.IsDirectory() && (d.Name[0] == '.') &&
+		bytes.Equal(d.Extension[:], []byte("   ")) &&
+		((d.Name[1] == ' ') || ((d.Name[1] == '.') && (d.Name[2] == ' ')))
+}
+
+// Returns the 8.3 name of the entry, e.g. "FILE.TXT". The first character of
+// deleted entries is replaced with a '?', since it is lost on deletion.
+func (d *DirectoryEntry) ShortName() string {
+	name := make([]byte, 8)
+	copy(name, d.Name[:])
+	switch name[0] {
+	case DeletedEntryMarker:
+		name[0] = '?'
+	case 0x05:
+		// 0x05 is used to store an actual 0xe5 as the first character.
+		name[0] = DeletedEntryMarker
+	}
+	toReturn := strings.TrimRight(string(name), " ")
+	extension := strings.TrimRight(string(d.Extension[:]), " ")
+	if extension != "" {
+		toReturn += "." + extension
+	}
+	return toReturn
+}
+
+// Returns the checksum of the 11-byte short name, which is stored in each of
+// the long file name entries preceding this entry.
+func (d *DirectoryEntry) ShortNameChecksum() byte {
+	var sum byte
+	for _, c := range d.Name {
+		sum = ((sum & 1) << 7) + (sum >> 1) + c
+	}
+	for _, c := range d.Extension {
+		sum = ((sum & 1) << 7) + (sum >> 1) + c
+	}
+	return sum
+}
+
+// Returns the first character of the short name that, combined with the
+// rest of the entry's short name, produces the given checksum. This can be
+// used to recover the first character of a deleted entry's name from its long
+// name entries. Returns false if the character isn't valid in a short name.
+func (d *DirectoryEntry) firstCharacterForChecksum(checksum byte) (byte,
+	bool) {
+	candidate := *d
+	// The checksum after the first character is the character itself, and
+	// each following step is a bijection, so exactly one character matches.
+	for c := 0; c < 256; c++ {
+		candidate.Name[0] = byte(c)
+		if candidate.ShortNameChecksum() != checksum {
+			continue
+		}
+		if (c == ' ') || (c == DeletedEntryMarker) || ((c >= 'a') &&
+			(c <= 'z')) || !isValidShortNameChar(byte(c)) {
+			return 0, false
+		}
+		return byte(c), true
+	}
+	return 0, false
+}
+
+func (d *DirectoryEntry) String() string {
+	var kind string
+	if d.IsDirectory() {
+		kind = "Directory"
+	} else if d.IsVolumeLabel() {
+		kind = "Volume label"
+	} else {
+		kind = "File"
+	}
+	if d.IsDeleted() {
+		kind = "Deleted " + strings.ToLower(kind)
+	}
+	return fmt.Sprintf("%s %s: starts at cluster %d, %d bytes", kind,
+		d.ShortName(), d.StartCluster(), d.FileSize)
+}
+
+// Returns true if c may appear in a short file name.
+func isValidShortNameChar(c byte) bool {
+	if c < 0x20 {
+		return false
+	}
+	return bytes.IndexByte([]byte("\"*+,./:;<=>?[\\]|"), c) < 0
+}
+
+// Returns true if the entry appears to be a plausible short-name entry on a
+// volume with the given number of clusters (see ClusterCount()). This is only
+// a heuristic, intended for finding directory clusters in data that can't be
+// located using the FAT.
+func (d *DirectoryEntry) LooksValid(clusterCount uint32) bool {
+	if d.IsLongName() || d.IsEndMarker() {
+		return false
+	}
+	if (d.Attributes & 0xc0) != 0 {
+		return false
+	}
+	if d.IsDotEntry() {
+		return d.StartCluster() < clusterCount
+	}
+	for i, c := range d.Name {
+		if (i == 0) && ((c == DeletedEntryMarker) || (c == 0x05)) {
+			continue
+		}
+		if (i == 0) && (c == ' ') {
+			return false
+		}
+		if !isValidShortNameChar(c) {
+			return false
+		}
+	}
+	for _, c := range d.Extension {
+		if !isValidShortNameChar(c) {
+			return false
+		}
+	}
+	if d.IsVolumeLabel() {
+		return d.StartCluster() == 0
+	}
+	if d.StartCluster() >= clusterCount {
+		return false
+	}
+	if d.IsDirectory() && (d.FileSize != 0) {
+		return false
+	}
+	// Files with content must have a start cluster.
+	if (d.FileSize != 0) && (d.StartCluster() < 2) {
+		return false
+	}
+	return true
+}
+
+// A single 32-byte entry holding part of a long file name.
+type LongNameEntry struct {
+	// The index of this entry in the name, starting at 1. The 0x40 bit is set
+	// for the last entry, which is stored first.
+	Sequence   byte
+	Name1      [5]uint16
+	Attributes byte
+	Type       byte
+	Checksum   byte
+	Name2      [6]uint16
+	// Always 0 in a valid long name entry.
+	ClusterLow uint16
+	Name3      [2]uint16
+}
+
+// Returns the (up to 13) UTF-16 characters held in this entry, not including
+// any terminating NULL or padding.
+func (l *LongNameEntry) characters() []uint16 {
+	toReturn := make([]uint16, 0, 13)
+	toReturn = append(toReturn, l.Name1[:]...)
+	toReturn = append(toReturn, l.Name2[:]...)
+	toReturn = append(toReturn, l.Name3[:]...)
+	for i, c := range toReturn {
+		if c == 0 {
+			return toReturn[:i]
+		}
+	}
+	return toReturn
+}
+
+// Returns true if the long name entry appears valid. Like
+// DirectoryEntry.LooksValid, this is just a heuristic.
+func (l *LongNameEntry) LooksValid() bool {
+	if (l.Attributes & 0x3f) != AttributeLongName {
+		return false
+	}
+	if (l.Type != 0) || (l.ClusterLow != 0) {
+		return false
+	}
+	if l.Sequence == DeletedEntryMarker {
+		return true
+	}
+	index := l.Sequence & 0x1f
+	return (index >= 1) && (index <= 20) && ((l.Sequence & 0xa0) == 0)
+}
+
+// Parses all directory entries in the given buffer, which should usually hold
+// a single cluster. Returns an error if the buffer isn't a multiple of the
+// directory entry size. Parsing does *not* stop at end-of-directory markers.
+func ParseDirectoryEntries(data []byte) ([]DirectoryEntry, error) {
+	if (len(data) % DirectoryEntrySize) != 0 {
+		return nil, fmt.Errorf("Directory data size (%d bytes) isn't a "+
+			"multiple of %d bytes", len(data), DirectoryEntrySize)
+	}
+	toReturn := make([]DirectoryEntry, len(data)/DirectoryEntrySize)
+	e := binary.Read(bytes.NewReader(data), binary.LittleEndian, toReturn)
+	if e != nil {
+		return nil, fmt.Errorf("Error parsing directory entries: %w", e)
+	}
+	return toReturn, nil
+}
+
+// Reinterprets a short-name entry as a long name entry. Only meaningful if
+// d.IsLongName() is true.
+func (d *DirectoryEntry) toLongNameEntry() *LongNameEntry {
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, d)
+	var toReturn LongNameEntry
+	binary.Read(&buffer, binary.LittleEndian, &toReturn)
+	return &toReturn
+}
+
+// Assembles a long file name from the long name entries immediately preceding
+// a short-name entry. The entries must be in on-disk order (i.e. the last part
+// of the name first). Returns the name and the number of entries, counting
+// backwards from the end of parts, that hold it. Returns an empty string if
+// the entries don't form a valid name for the given short-name entry.
+func assembleLongName(parts []*LongNameEntry, entry *DirectoryEntry) (string,
+	int) {
+	if len(parts) == 0 {
+		return "", 0
+	}
+	checksum := entry.ShortNameChecksum()
+	deleted := entry.IsDeleted()
+	if deleted {
+		// The first character of a deleted entry's short name has been
+		// overwritten, so we can only check that some first character would
+		// produce the checksum in the preceding entry.
+		checksum = parts[len(parts)-1].Checksum
+		_, ok := entry.firstCharacterForChecksum(checksum)
+		if !ok {
+			return "", 0
+		}
+	}
+	var characters []uint16
+	used := 0
+	// Walk backwards from the entry, since the first part of the name is
+	// stored immediately before the short-name entry.
+	for i := len(parts) - 1; i >= 0; i-- {
+		p := parts[i]
+		// Deleted entries lose their sequence numbers, so the checksum is the
+		// only way to tell which of them belong to this entry.
+		if p.Checksum != checksum {
+			break
+		}
+		if deleted && (p.Sequence != DeletedEntryMarker) {
+			break
+		}
+		if (p.Sequence != DeletedEntryMarker) &&
+			(int(p.Sequence&0x1f) != (len(parts) - i)) {
+			return "", 0
+		}
+		characters = append(characters, p.characters()...)
+		used++
+	}
+	return string(utf16.Decode(characters)), used
+}
+
+// Holds information about a directory entry located somewhere in the data
+// region of a FAT32 filesystem.
+type FoundDirectoryEntry struct {
+	// The cluster containing the directory entry.
+	Cluster uint32
+	// The index of the entry within its cluster.
+	Index int
+	// The long file name, if one was found for the entry. Empty otherwise.
+	LongName string
+	// The number of long name entries immediately preceding this entry that
+	// hold the long name. These may be in the previous cluster of the
+	// directory.
+	LongNameEntries int
+	Entry           DirectoryEntry
+}
+
+// Returns the long name of the entry if it has one, or the short name
+// otherwise.
+func (n *FoundDirectoryEntry) Name() string {
+	if n.LongName != "" {
+		return n.LongName
+	}
+	return n.Entry.ShortName()
+}
+
+// Parses the entries in the given directory data, returning all entries prior
+// to the end-of-directory marker, including deleted ones. The data must hold
+// the content of the given clusters, in order. If validate is true, this
+// returns an error if any of the entries don't look valid, which is usually a
+// sign that the data isn't a directory.
+func (f *FAT32Filesystem) parseDirectoryData(clusters []uint32, data []byte,
+	validate bool) ([]FoundDirectoryEntry, error) {
+	entries, e := ParseDirectoryEntries(data)
+	if e != nil {
+		return nil, e
+	}
+	entriesPerCluster := int(f.ClusterSize / DirectoryEntrySize)
+	if len(entries) > (len(clusters) * entriesPerCluster) {
+		return nil, fmt.Errorf("Directory data is larger than the %d "+
+			"clusters holding it", len(clusters))
+	}
+	clusterCount := f.ClusterCount()
+	var toReturn []FoundDirectoryEntry
+	var longNameParts []*LongNameEntry
+	for i := range entries {
+		entry := &(entries[i])
+		if entry.IsEndMarker() {
+			break
+		}
+		if entry.IsLongName() {
+			longNameEntry := entry.toLongNameEntry()
+			if validate && !longNameEntry.LooksValid() {
+				return nil, fmt.Errorf("Invalid long name entry at index %d",
+					i)
+			}
+			// The entry with the 0x40 bit set starts a new long name. (The
+			// deleted marker also has this bit set, so ignore it.)
+			if (longNameEntry.Sequence != DeletedEntryMarker) &&
+				((longNameEntry.Sequence & 0x40) != 0) {
+				longNameParts = longNameParts[:0]
+			}
+			longNameParts = append(longNameParts, longNameEntry)
+			continue
+		}
+		if validate && !entry.LooksValid(clusterCount) {
+			return nil, fmt.Errorf("Invalid directory entry at index %d", i)
+		}
+		longName, longNameEntries := assembleLongName(longNameParts, entry)
+		toReturn = append(toReturn, FoundDirectoryEntry{
+			Cluster:         clusters[i/entriesPerCluster],
+			Index:           i % entriesPerCluster,
+			LongName:        longName,
+			LongNameEntries: longNameEntries,
+			Entry:           *entry,
+		})
+		longNameParts = longNameParts[:0]
+	}
+	return toReturn, nil
+}
+
+// Reads every cluster in the data region, looking for clusters that appear to
+// contain directory entries. Returns all entries found, including deleted
+// ones, in the order they occur on disk. This does not use the FAT at all, so
+// it can find directories even if the FAT has been zeroed, but it is slow for
+// large volumes.
+func (f *FAT32Filesystem) ScanForDirectoryEntries() ([]FoundDirectoryEntry,
+	error) {
+	clusterCount := f.ClusterCount()
+	data := make([]byte, f.ClusterSize)
+	var toReturn []FoundDirectoryEntry
+	for c := uint32(2); c < clusterCount; c++ {
+		e := f.ReadCluster(c, data)
+		if e != nil {
+			return nil, fmt.Errorf("Error reading cluster %d: %w", c, e)
+		}
+		entries, e := f.parseDirectoryData([]uint32{c}, data, true)
+		if e != nil {
+			// The cluster doesn't contain a directory.
+			continue
+		}
+		toReturn = append(toReturn, entries...)
+	}
+	return toReturn, nil
+}
+
+// Returns the clusters holding the directory starting at the given cluster,
+// along with their content.
+func (f *FAT32Filesystem) readDirectoryData(startCluster uint32) ([]uint32,
+	[]byte, error) {
+	clusters, e := f.ChainClusters(startCluster)
+	if e != nil {
+		return nil, nil, fmt.Errorf("Error following directory chain: %w", e)
+	}
+	data := make([]byte, len(clusters)*int(f.ClusterSize))
+	for i, c := range clusters {
+		e = f.ReadCluster(c, data[i*int(f.ClusterSize):])
+		if e != nil {
+			return nil, nil, fmt.Errorf("Error reading directory cluster: %w",
+				e)
+		}
+	}
+	return clusters, data, nil
+}
+
+// Returns the entries in the directory starting at the given cluster,
+// following the directory's chain in the FAT. Deleted entries are included,
+// but entries after the end-of-directory marker are not.
+func (f *FAT32Filesystem) ReadDirectory(startCluster uint32) (
+	[]FoundDirectoryEntry, error) {
+	clusters, data, e := f.readDirectoryData(startCluster)
+	if e != nil {
+		return nil, e
+	}
+	toReturn, e := f.parseDirectoryData(clusters, data, false)
+	if e != nil {
+		return nil, fmt.Errorf("Error parsing directory: %w", e)
+	}
+	return toReturn, nil
+}
+
+// Splits a path into its components, ignoring empty components. Both "/" and
+// "\" are accepted as separators.
+func splitPath(path string) []string {
+	return strings.FieldsFunc(path, func(c rune) bool {
+		return (c == '/') || (c == '\\')
+	})
+}
+
+// Returns the entry with the given name from a list of directory entries, or
+// nil if there isn't one. The name is compared to both the long and short name
+// of each entry, ignoring case. Deleted entries, volume labels, and "." and
+// ".." are ignored.
+func findEntry(entries []FoundDirectoryEntry,
+	name string) *FoundDirectoryEntry {
+	for i := range entries {
+		entry := &(entries[i])
+		d := &(entry.Entry)
+		if d.IsDeleted() || d.IsVolumeLabel() || d.IsDotEntry() {
+			continue
+		}
+		if strings.EqualFold(entry.LongName, name) ||
+			strings.EqualFold(d.ShortName(), name) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// Returns the directory entry at the given path, relative to the root
+// directory. Returns nil and no error if the root directory itself is
+// requested, since it doesn't have an entry. Returns an error wrapping
+// fs.ErrNotExist if the path doesn't exist.
+func (f *FAT32Filesystem) Lookup(path string) (*FoundDirectoryEntry, error) {
+	components := splitPath(path)
+	directoryCluster := f.Header.EBR.RootDirClusterNumber
+	var toReturn *FoundDirectoryEntry
+	for i, name := range components {
+		entries, e := f.ReadDirectory(directoryCluster)
+		if e != nil {
+			return nil, fmt.Errorf("Error reading directory containing %s: %w",
+				name, e)
+		}
+		toReturn = findEntry(entries, name)
+		if toReturn == nil {
+			return nil, fmt.Errorf("%s: %w", path, fs.ErrNotExist)
+		}
+		if i == (len(components) - 1) {
+			break
+		}
+		if !toReturn.Entry.IsDirectory() {
+			return nil, fmt.Errorf("%s is not a directory", name)
+		}
+		directoryCluster = toReturn.Entry.StartCluster()
+		// A ".." entry referring to the root directory stores cluster 0.
+		if directoryCluster == 0 {
+			directoryCluster = f.Header.EBR.RootDirClusterNumber
+		}
+	}
+	return toReturn, nil
+}
+
+// Returns the content of the file at the given path.
+func (f *FAT32Filesystem) ReadFile(path string) ([]byte, error) {
+	entry, e := f.Lookup(path)
+	if e != nil {
+		return nil, e
+	}
+	if (entry == nil) || entry.Entry.IsDirectory() {
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+	size := int(entry.Entry.FileSize)
+	if size == 0 {
+		return []byte{}, nil
+	}
+	clusters, e := f.ChainClusters(entry.Entry.StartCluster())
+	if e != nil {
+		return nil, fmt.Errorf("Error following chain for %s: %w", path, e)
+	}
+	clusterSize := int(f.ClusterSize)
+	if (len(clusters) * clusterSize) < size {
+		return nil, fmt.Errorf("The chain for %s is too short (%d clusters) "+
+			"for its size (%d bytes)", path, len(clusters), size)
+	}
+	toReturn := make([]byte, len(clusters)*clusterSize)
+	for i, c := range clusters {
+		e = f.ReadCluster(c, toReturn[i*clusterSize:])
+		if e != nil {
+			return nil, fmt.Errorf("Error reading %s: %w", path, e)
+		}
+	}
+	return toReturn[:size], nil
+}
+
+// The signature of the callback passed to WalkFiles. The path is relative to
+// the root directory, with components separated by "/".
+type WalkFunc func(path string, entry *FoundDirectoryEntry) error
+
+// Recursively visits every file and directory reachable from the root
+// directory, calling fn for each. Deleted entries, volume labels and the "."
+// and ".." entries are skipped. Stops and returns the error if fn returns an
+// error.
+func (f *FAT32Filesystem) WalkFiles(fn WalkFunc) error {
+	visited := make(map[uint32]bool)
+	return f.walkDirectory("", f.Header.EBR.RootDirClusterNumber, visited, fn)
+}
+
+func (f *FAT32Filesystem) walkDirectory(path string, cluster uint32,
+	visited map[uint32]bool, fn WalkFunc) error {
+	// Corrupted filesystems may contain directories that contain themselves.
+	if visited[cluster] {
+		return nil
+	}
+	visited[cluster] = true
+	entries, e := f.ReadDirectory(cluster)
+	if e != nil {
+		return fmt.Errorf("Error reading directory \"%s\": %w", path, e)
+	}
+	for i := range entries {
+		entry := &(entries[i])
+		d := &(entry.Entry)
+		if d.IsDeleted() || d.IsVolumeLabel() || d.IsDotEntry() {
+			continue
+		}
+		entryPath := entry.Name()
+		if path != "" {
+			entryPath = path + "/" + entryPath
+		}
+		e = fn(entryPath, entry)
+		if e != nil {
+			return e
+		}
+		if !d.IsDirectory() || (d.StartCluster() < 2) {
+			continue
+		}
+		e = f.walkDirectory(entryPath, d.StartCluster(), visited, fn)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,550 @@
+package fat
+
+// This file contains a reader for Expert Witness Format (EWF) images, i.e.
+// the .E01, .E02, ... segment files produced by EnCase, FTK Imager, ewfacquire
+// and others. The newer EWF2 (.Ex01) segment files are parsed in ewf2.go, but
+// read using the same EWFImage type.
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The signature at the start of every EWF (E01) segment file.
+var ewfSignature = []byte{'E', 'V', 'F', 0x09, 0x0d, 0x0a, 0xff, 0x00}
+
+// Returned (wrapped) by EWFImage.Verify if the image's content doesn't match
+// a stored hash.
+var ErrHashMismatch = errors.New("Hash mismatch")
+
+// The sizes of fixed-size EWF structures.
+const (
+	ewfFileHeaderSize        = 13
+	ewfSectionDescriptorSize = 76
+	ewfTableHeaderSize       = 24
+)
+
+// The header at the start of each segment file, after the signature.
+type ewfFileHeader struct {
+	Signature     [8]byte
+	FieldsStart   uint8
+	SegmentNumber uint16
+	FieldsEnd     uint16
+}
+
+// Precedes each section in a segment file. All EWF fields are little-endian.
+type ewfSectionDescriptor struct {
+	Type [16]byte
+	// The offset of the next section in the same segment file.
+	Next uint64
+	// The size of the section, including this descriptor.
+	Size     uint64
+	Padding  [40]byte
+	Checksum uint32
+}
+
+// Returns the section type as a string, e.g. "table".
+func (d *ewfSectionDescriptor) typeName() string {
+	return string(bytes.TrimRight(d.Type[:], "\x00"))
+}
+
+// The start of the data in "volume" and "disk" sections.
+type ewfVolume struct {
+	MediaType       uint8
+	Unknown         [3]byte
+	ChunkCount      uint32
+	SectorsPerChunk uint32
+	BytesPerSector  uint32
+	SectorCount     uint64
+}
+
+// The start of the data in "table" sections.
+type ewfTableHeader struct {
+	EntryCount uint32
+	Padding    uint32
+	BaseOffset uint64
+	Padding2   uint32
+	Checksum   uint32
+}
+
+// Records where a chunk's data is stored.
+type ewfChunk struct {
+	segment    int
+	offset     int64
+	size       int64
+	compressed bool
+	// Set if the chunk's table entry didn't include a compression flag (see
+	// loadTable), in which case it's compressed unless it's the size of an
+	// uncompressed chunk and its checksum.
+	unflagged bool
+	// Set for uncompressed EWF2 chunks stored without a checksum.
+	noChecksum bool
+	// Set for EWF2 chunks consisting of an 8-byte pattern repeated, which is
+	// stored in the table instead of the chunk's data.
+	pattern []byte
+}
+
+// An Image backed by a set of EWF (E01) or EWF2 (Ex01) segment files.
+type EWFImage struct {
+	readerAtSeeker
+	segments  []*os.File
+	chunkSize int64
+	chunks    []ewfChunk
+	md5       []byte
+	sha1      []byte
+	// Set if compressed chunks use bzip2 rather than zlib, which is only
+	// possible in EWF2 images.
+	bzip2 bool
+	// Protects the cached chunk, so that ReadAt can be used concurrently.
+	lock         sync.Mutex
+	cachedIndex  int64
+	cachedChunk  []byte
+	cachedLoaded bool
+}
+
+func (w *EWFImage) Size() int64 {
+	return w.size
+}
+
+// Returns the paths of the segment files, in order.
+func (w *EWFImage) Paths() []string {
+	toReturn := make([]string, len(w.segments))
+	for i, f := range w.segments {
+		toReturn[i] = f.Name()
+	}
+	return toReturn
+}
+
+// Returns the MD5 hash of the image's content recorded when it was acquired,
+// or nil if none was stored.
+func (w *EWFImage) StoredMD5() []byte {
+	return w.md5
+}
+
+// Returns the SHA1 hash of the image's content recorded when it was acquired,
+// or nil if none was stored.
+func (w *EWFImage) StoredSHA1() []byte {
+	return w.sha1
+}
+
+// Closes every segment file.
+func (w *EWFImage) Close() error {
+	var toReturn error
+	for _, f := range w.segments {
+		e := f.Close()
+		if (e != nil) && (toReturn == nil) {
+			toReturn = e
+		}
+	}
+	return toReturn
+}
+
+// Returns the extension of the given EWF segment number, e.g. "E01", "E99",
+// "EAA", ... "EZZ", "FAA", ...
+func ewfSegmentExtension(number int) string {
+	if number < 100 {
+		return fmt.Sprintf("E%02d", number)
+	}
+	n := number - 100
+	return string([]byte{byte('E' + n/(26*26)), byte('A' + (n/26)%26),
+		byte('A' + n%26)})
+}
+
+// Returns true if the path has an EWF segment extension, e.g. ".E01" or
+// ".e01".
+func isEWFSegmentPath(path string) bool {
+	extension := strings.ToUpper(strings.TrimPrefix(filepath.Ext(path), "."))
+	if (len(extension) != 3) || (extension[0] < 'E') || (extension[0] > 'Z') {
+		return false
+	}
+	digits := (extension[1] >= '0') && (extension[1] <= '9') &&
+		(extension[2] >= '0') && (extension[2] <= '9')
+	letters := (extension[1] >= 'A') && (extension[1] <= 'Z') &&
+		(extension[2] >= 'A') && (extension[2] <= 'Z')
+	return (digits && (extension[0] == 'E')) || letters
+}
+
+// Reads and checks the section descriptor at the given offset.
+func readEWFSectionDescriptor(f *os.File, offset int64) (
+	*ewfSectionDescriptor, error) {
+	data := make([]byte, ewfSectionDescriptorSize)
+	e := readFullAt(f, data, offset)
+	if e != nil {
+		return nil, e
+	}
+	var toReturn ewfSectionDescriptor
+	binary.Read(bytes.NewReader(data), binary.LittleEndian, &toReturn)
+	if adler32.Checksum(data[:72]) != toReturn.Checksum {
+		return nil, fmt.Errorf("Bad checksum for section descriptor at "+
+			"offset %d", offset)
+	}
+	return &toReturn, nil
+}
+
+// Reads the entries from the table section at the given offset. Chunks end
+// where the next one starts, with the last ending at dataEnd.
+func (w *EWFImage) loadTable(segment int, offset, dataEnd int64) error {
+	f := w.segments[segment]
+	data := make([]byte, ewfTableHeaderSize)
+	e := readFullAt(f, data, offset+ewfSectionDescriptorSize)
+	if e != nil {
+		return e
+	}
+	var header ewfTableHeader
+	binary.Read(bytes.NewReader(data), binary.LittleEndian, &header)
+	if adler32.Checksum(data[:20]) != header.Checksum {
+		return fmt.Errorf("Bad checksum for table header")
+	}
+	data = make([]byte, int64(header.EntryCount)*4)
+	e = readFullAt(f, data, offset+ewfSectionDescriptorSize+
+		ewfTableHeaderSize)
+	if e != nil {
+		return fmt.Errorf("Error reading table entries: %w", e)
+	}
+	firstChunk := len(w.chunks)
+	// Entries normally hold a 31-bit offset, with the top bit set if the
+	// chunk is compressed. Segment files over 2 GiB, written by EnCase 6.7 and
+	// later, don't fit in 31 bits. As in libewf, once a chunk extends past
+	// 2^31 bytes from the base offset, the following entries in the table
+	// are taken to be 32-bit offsets without a compression flag.
+	overflow := false
+	for i := 0; i < int(header.EntryCount); i++ {
+		entry := binary.LittleEndian.Uint32(data[i*4:])
+		chunk := ewfChunk{
+			segment: segment,
+		}
+		offset := int64(entry)
+		if overflow {
+			chunk.unflagged = true
+		} else {
+			offset = int64(entry & 0x7fffffff)
+			chunk.compressed = (entry & 0x80000000) != 0
+			overflow = (offset + w.chunkSize) > 0x7fffffff
+		}
+		chunk.offset = int64(header.BaseOffset) + offset
+		w.chunks = append(w.chunks, chunk)
+	}
+	for i := firstChunk; i < len(w.chunks); i++ {
+		end := dataEnd
+		if (i + 1) < len(w.chunks) {
+			end = w.chunks[i+1].offset
+		}
+		if end <= w.chunks[i].offset {
+			return fmt.Errorf("Chunk %d has an invalid offset: %d", i,
+				w.chunks[i].offset)
+		}
+		w.chunks[i].size = end - w.chunks[i].offset
+	}
+	return nil
+}
+
+// Returns nil if the hash is all zeros, which indicates that it wasn't
+// computed when the image was acquired.
+func storedHash(hash []byte) []byte {
+	for _, b := range hash {
+		if b != 0 {
+			return hash
+		}
+	}
+	return nil
+}
+
+// Reads each section in the given segment file. Returns true if the last
+// segment ("done" section) was reached.
+func (w *EWFImage) loadSegment(segment int) (bool, error) {
+	f := w.segments[segment]
+	var fileHeader ewfFileHeader
+	data := make([]byte, ewfFileHeaderSize)
+	e := readFullAt(f, data, 0)
+	if e != nil {
+		return false, e
+	}
+	binary.Read(bytes.NewReader(data), binary.LittleEndian, &fileHeader)
+	if !bytes.Equal(fileHeader.Signature[:], ewfSignature) {
+		return false, fmt.Errorf("Invalid EWF signature")
+	}
+	if int(fileHeader.SegmentNumber) != (segment + 1) {
+		return false, fmt.Errorf("Expected segment %d, got segment %d",
+			segment+1, fileHeader.SegmentNumber)
+	}
+	offset := int64(ewfFileHeaderSize)
+	// The end of the most recent "sectors" section, where the data for the
+	// last chunk in the following table ends.
+	sectorsEnd := int64(-1)
+	for {
+		descriptor, e := readEWFSectionDescriptor(f, offset)
+		if e != nil {
+			return false, e
+		}
+		dataOffset := offset + ewfSectionDescriptorSize
+		switch descriptor.typeName() {
+		case "volume", "disk":
+			data = make([]byte, 24)
+			e = readFullAt(f, data, dataOffset)
+			if e != nil {
+				return false, fmt.Errorf("Error reading volume: %w", e)
+			}
+			var volume ewfVolume
+			binary.Read(bytes.NewReader(data), binary.LittleEndian, &volume)
+			w.chunkSize = int64(volume.SectorsPerChunk) *
+				int64(volume.BytesPerSector)
+			w.size = int64(volume.SectorCount) * int64(volume.BytesPerSector)
+		case "sectors":
+			sectorsEnd = offset + int64(descriptor.Size)
+		case "table":
+			dataEnd := sectorsEnd
+			if dataEnd < 0 {
+				// Older versions stored chunks after the table entries,
+				// ending where the next section starts.
+				dataEnd = int64(descriptor.Next)
+			}
+			e = w.loadTable(segment, offset, dataEnd)
+			if e != nil {
+				return false, fmt.Errorf("Error reading table at offset "+
+					"%d: %w", offset, e)
+			}
+			sectorsEnd = -1
+		case "hash":
+			data = make([]byte, md5.Size)
+			e = readFullAt(f, data, dataOffset)
+			if e != nil {
+				return false, fmt.Errorf("Error reading hash: %w", e)
+			}
+			w.md5 = storedHash(data)
+		case "digest":
+			data = make([]byte, md5.Size+sha1.Size)
+			e = readFullAt(f, data, dataOffset)
+			if e != nil {
+				return false, fmt.Errorf("Error reading digest: %w", e)
+			}
+			w.md5 = storedHash(data[:md5.Size])
+			w.sha1 = storedHash(data[md5.Size:])
+		case "next":
+			return false, nil
+		case "done":
+			return true, nil
+		}
+		if int64(descriptor.Next) <= offset {
+			return false, fmt.Errorf("Section at offset %d doesn't point to "+
+				"a following section", offset)
+		}
+		offset = int64(descriptor.Next)
+	}
+}
+
+// Opens a set of EWF (E01) or EWF2 (Ex01) segment files, given the path to
+// any segment. The segment files must be in the same directory, numbered
+// .E01, .E02, and so on, or .Ex01, .Ex02, and so on for EWF2.
+func OpenEWFImage(path string) (*EWFImage, error) {
+	version2 := isEWF2SegmentPath(path)
+	if !version2 && !isEWFSegmentPath(path) {
+		return nil, fmt.Errorf("%s doesn't have an EWF segment extension "+
+			"(e.g. .E01 or .Ex01)", path)
+	}
+	extension := filepath.Ext(path)
+	base := strings.TrimSuffix(path, extension)
+	// The x in EWF2 extensions is always lowercase, so only check the first
+	// letter.
+	lowercase := extension[1:2] != strings.ToUpper(extension[1:2])
+	toReturn := &EWFImage{}
+	for number := 1; ; number++ {
+		segmentExtension := ewfSegmentExtension(number)
+		if version2 {
+			segmentExtension = ewf2SegmentExtension(number)
+		}
+		if lowercase {
+			segmentExtension = strings.ToLower(segmentExtension)
+		}
+		f, e := os.Open(base + "." + segmentExtension)
+		if e != nil {
+			toReturn.Close()
+			return nil, fmt.Errorf("Error opening segment %d: %w", number, e)
+		}
+		toReturn.segments = append(toReturn.segments, f)
+		var done bool
+		if version2 {
+			done, e = toReturn.loadEWF2Segment(number - 1)
+		} else {
+			done, e = toReturn.loadSegment(number - 1)
+		}
+		if e != nil {
+			toReturn.Close()
+			return nil, fmt.Errorf("Error reading %s: %w", f.Name(), e)
+		}
+		if done {
+			break
+		}
+	}
+	if toReturn.chunkSize <= 0 {
+		toReturn.Close()
+		return nil, fmt.Errorf("Didn't find the image's size and chunk size")
+	}
+	expectedChunks := (toReturn.size + toReturn.chunkSize - 1) /
+		toReturn.chunkSize
+	if int64(len(toReturn.chunks)) < expectedChunks {
+		toReturn.Close()
+		return nil, fmt.Errorf("Found %d chunks, expected %d",
+			len(toReturn.chunks), expectedChunks)
+	}
+	toReturn.r = toReturn
+	return toReturn, nil
+}
+
+// Reads, decompresses and checks the content of the given chunk.
+func (w *EWFImage) readChunk(index int64) ([]byte, error) {
+	chunk := &(w.chunks[index])
+	expectedSize := w.chunkSize
+	if (w.size - index*w.chunkSize) < expectedSize {
+		expectedSize = w.size - index*w.chunkSize
+	}
+	if chunk.pattern != nil {
+		content := make([]byte, expectedSize)
+		for i := range content {
+			content[i] = chunk.pattern[i%len(chunk.pattern)]
+		}
+		return content, nil
+	}
+	stored := make([]byte, chunk.size)
+	e := readFullAt(w.segments[chunk.segment], stored, chunk.offset)
+	if e != nil {
+		return nil, fmt.Errorf("Error reading chunk %d: %w", index, e)
+	}
+	compressed := chunk.compressed
+	if chunk.unflagged {
+		compressed = int64(len(stored)) != (expectedSize + 4)
+	}
+	var content []byte
+	if compressed {
+		var decompressor io.Reader
+		if w.bzip2 {
+			decompressor = bzip2.NewReader(bytes.NewReader(stored))
+		} else {
+			decompressor, e = zlib.NewReader(bytes.NewReader(stored))
+			if e != nil {
+				return nil, fmt.Errorf("Error decompressing chunk %d: %w",
+					index, e)
+			}
+		}
+		content = make([]byte, expectedSize)
+		_, e = io.ReadFull(decompressor, content)
+		if e != nil {
+			return nil, fmt.Errorf("Error decompressing chunk %d: %w", index,
+				e)
+		}
+	} else if chunk.noChecksum {
+		if int64(len(stored)) < expectedSize {
+			return nil, fmt.Errorf("Chunk %d is truncated", index)
+		}
+		content = stored[:expectedSize]
+	} else {
+		// Uncompressed chunks are followed by an Adler-32 checksum.
+		if int64(len(stored)) < (expectedSize + 4) {
+			return nil, fmt.Errorf("Chunk %d is truncated", index)
+		}
+		content = stored[:expectedSize]
+		checksum := binary.LittleEndian.Uint32(stored[expectedSize:])
+		if adler32.Checksum(content) != checksum {
+			return nil, fmt.Errorf("Chunk %d has a bad checksum", index)
+		}
+	}
+	return content, nil
+}
+
+// Returns the content of the given chunk. The caller must hold the lock.
+func (w *EWFImage) getChunk(index int64) ([]byte, error) {
+	if w.cachedLoaded && (w.cachedIndex == index) {
+		return w.cachedChunk, nil
+	}
+	content, e := w.readChunk(index)
+	if e != nil {
+		return nil, e
+	}
+	w.cachedIndex = index
+	w.cachedChunk = content
+	w.cachedLoaded = true
+	return content, nil
+}
+
+func (w *EWFImage) ReadAt(dst []byte, offset int64) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return readBlocks(dst, offset, w.size, w.chunkSize,
+		func(dst []byte, chunk, chunkOffset int64) error {
+			data, e := w.getChunk(chunk)
+			if e != nil {
+				return e
+			}
+			copy(dst, data[chunkOffset:])
+			return nil
+		})
+}
+
+// Reads the entire image, checking its content against the stored MD5 and
+// SHA1 hashes. Returns an error wrapping ErrHashMismatch if either doesn't
+// match, or an error if the image has no stored hashes.
+func (w *EWFImage) Verify() error {
+	if (w.md5 == nil) && (w.sha1 == nil) {
+		return fmt.Errorf("The image doesn't contain any stored hashes")
+	}
+	md5Hash := md5.New()
+	sha1Hash := sha1.New()
+	_, e := io.Copy(io.MultiWriter(md5Hash, sha1Hash),
+		io.NewSectionReader(w, 0, w.size))
+	if e != nil {
+		return fmt.Errorf("Error reading image: %w", e)
+	}
+	if (w.md5 != nil) && !bytes.Equal(md5Hash.Sum(nil), w.md5) {
+		return fmt.Errorf("The image's MD5 is %x, expected %x: %w",
+			md5Hash.Sum(nil), w.md5, ErrHashMismatch)
+	}
+	if (w.sha1 != nil) && !bytes.Equal(sha1Hash.Sum(nil), w.sha1) {
+		return fmt.Errorf("The image's SHA1 is %x, expected %x: %w",
+			sha1Hash.Sum(nil), w.sha1, ErrHashMismatch)
+	}
+	return nil
+}
+
+// Implemented by images that store hashes of their content, recorded when
+// they were acquired, such as EWFImage.
+type Verifier interface {
+	// Reads the entire image, returning an error wrapping ErrHashMismatch if
+	// its content doesn't match the stored hashes.
+	Verify() error
+}
+
+// Implemented by images that read from another image, such as RescuedImage.
+type wrappedImage interface {
+	// Returns the image being read from.
+	underlyingImage() Image
+}
+
+// Checks the content of the given image against the hashes recorded when it
+// was acquired, which only EWF (E01 and Ex01) images store. Images wrapping
+// another image, e.g. a RescuedImage, are checked using the image they wrap.
+// Returns an error wrapping ErrHashMismatch if they don't match.
+func VerifyImage(img Image) error {
+	for {
+		verifier, ok := img.(Verifier)
+		if ok {
+			return verifier.Verify()
+		}
+		wrapper, ok := img.(wrappedImage)
+		if !ok {
+			return fmt.Errorf("Only EWF (E01 or Ex01) images contain " +
+				"hashes to verify")
+		}
+		img = wrapper.underlyingImage()
+	}
+}
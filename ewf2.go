@@ -0,0 +1,395 @@
+package fat
+
+// This file contains support for EWF2 (Ex01) segment files, produced by
+// EnCase 7 and later, and by ewfacquire with -f encase7-v2. EWF2 uses a
+// different layout from EWF (E01), but the content is still stored in
+// chunks, so EWF2 images are read using EWFImage.
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// The signature at the start of EWF2 (Ex01) segment files.
+var ewf2Signature = []byte{'E', 'V', 'F', '2', 0x0d, 0x0a, 0x81, 0x00}
+
+// The sizes of fixed-size EWF2 structures.
+const (
+	ewf2FileHeaderSize        = 32
+	ewf2SectionDescriptorSize = 64
+	ewf2TableHeaderSize       = 32
+	ewf2TableEntrySize        = 16
+)
+
+// EWF2 section types. Other sections, e.g. the error and session tables, are
+// ignored. Sector data sections just hold the chunks, which are located
+// using the sector tables.
+const (
+	ewf2DeviceInformation = 0x01
+	ewf2CaseData          = 0x02
+	ewf2SectorData        = 0x03
+	ewf2SectorTable       = 0x04
+	ewf2MD5Hash           = 0x08
+	ewf2SHA1Hash          = 0x09
+	ewf2Next              = 0x0d
+	ewf2Done              = 0x0f
+)
+
+// Set in a section descriptor's DataFlags if the section is encrypted.
+const ewf2EncryptedData = 0x02
+
+// Flags in EWF2 table entries.
+const (
+	ewf2ChunkCompressed  = 0x01
+	ewf2ChunkHasChecksum = 0x02
+	ewf2ChunkPatternFill = 0x04
+)
+
+// The number of sectors in each chunk if the case data doesn't say.
+const ewf2DefaultSectorsPerChunk = 64
+
+// The header at the start of each EWF2 segment file.
+type ewf2FileHeader struct {
+	Signature    [8]byte
+	MajorVersion uint8
+	MinorVersion uint8
+	// 0 or 1 for zlib, or 2 for bzip2.
+	CompressionMethod uint16
+	SegmentNumber     uint32
+	SetIdentifier     [16]byte
+}
+
+// Follows each section's data in an EWF2 segment file.
+type ewf2SectionDescriptor struct {
+	Type      uint32
+	DataFlags uint32
+	// The offset of the previous section's descriptor, or 0 for the first
+	// section.
+	PreviousOffset uint64
+	DataSize       uint64
+	DescriptorSize uint32
+	PaddingSize    uint32
+	DataHash       [16]byte
+	Padding        [12]byte
+	Checksum       uint32
+}
+
+// The start of the data in "sector table" sections.
+type ewf2TableHeader struct {
+	FirstChunk uint64
+	EntryCount uint32
+	Padding    uint32
+	Checksum   uint32
+	Padding2   [12]byte
+}
+
+// Records where a chunk's data is stored in an EWF2 segment file.
+type ewf2TableEntry struct {
+	// The chunk's offset in the segment file, or the pattern it's filled
+	// with if ewf2ChunkPatternFill is set.
+	Offset uint64
+	Size   uint32
+	Flags  uint32
+}
+
+// A section in an EWF2 segment file, located by its descriptor.
+type ewf2Section struct {
+	descriptor *ewf2SectionDescriptor
+	// The offset of the section's descriptor, which follows its data.
+	offset int64
+}
+
+// Returns the extension of the given EWF2 segment number, e.g. "Ex01",
+// "Ex99", "ExAA", ...
+func ewf2SegmentExtension(number int) string {
+	extension := ewfSegmentExtension(number)
+	return extension[:1] + "x" + extension[1:]
+}
+
+// Returns true if the path has an EWF2 segment extension, e.g. ".Ex01" or
+// ".ex01".
+func isEWF2SegmentPath(path string) bool {
+	extension := strings.ToUpper(strings.TrimPrefix(filepath.Ext(path), "."))
+	if (len(extension) != 4) || (extension[1] != 'X') {
+		return false
+	}
+	return isEWFSegmentPath("segment." + extension[:1] + extension[2:])
+}
+
+// Reads and checks the EWF2 section descriptor at the given offset.
+func readEWF2SectionDescriptor(f *os.File, offset int64) (
+	*ewf2SectionDescriptor, error) {
+	data := make([]byte, ewf2SectionDescriptorSize)
+	e := readFullAt(f, data, offset)
+	if e != nil {
+		return nil, e
+	}
+	var toReturn ewf2SectionDescriptor
+	binary.Read(bytes.NewReader(data), binary.LittleEndian, &toReturn)
+	if adler32.Checksum(data[:60]) != toReturn.Checksum {
+		return nil, fmt.Errorf("Bad checksum for section descriptor at "+
+			"offset %d", offset)
+	}
+	return &toReturn, nil
+}
+
+// Parses the data in a device information or case data section: UTF-16 text,
+// compressed using zlib, holding a line of tab-separated names followed by a
+// line of the corresponding values. Returns a map of names to values.
+func parseEWF2Values(data []byte) (map[string]string, error) {
+	decompressor, e := zlib.NewReader(bytes.NewReader(data))
+	if e != nil {
+		return nil, fmt.Errorf("Error decompressing values: %w", e)
+	}
+	decompressed, e := io.ReadAll(decompressor)
+	if e != nil {
+		return nil, fmt.Errorf("Error decompressing values: %w", e)
+	}
+	utf16Text := make([]uint16, len(decompressed)/2)
+	for i := range utf16Text {
+		utf16Text[i] = binary.LittleEndian.Uint16(decompressed[i*2:])
+	}
+	text := strings.TrimPrefix(string(utf16.Decode(utf16Text)), "\ufeff")
+	lines := strings.Split(strings.ReplaceAll(text, "\r", ""), "\n")
+	// The names follow a line with the number of categories and a line with
+	// the category's name, e.g. "main".
+	toReturn := make(map[string]string)
+	for i := 0; (i + 1) < len(lines); i++ {
+		if !strings.Contains(lines[i], "\t") {
+			continue
+		}
+		names := strings.Split(lines[i], "\t")
+		values := strings.Split(lines[i+1], "\t")
+		for j := range names {
+			if j < len(values) {
+				toReturn[names[j]] = values[j]
+			}
+		}
+		return toReturn, nil
+	}
+	return nil, fmt.Errorf("Didn't find any values")
+}
+
+// Returns the value with the given name as an integer between 1 and limit.
+func ewf2IntValue(values map[string]string, name string,
+	limit int64) (int64, error) {
+	value, e := strconv.ParseInt(values[name], 10, 64)
+	if (e != nil) || (value <= 0) || (value > limit) {
+		return 0, fmt.Errorf("Invalid %q value: %q", name, values[name])
+	}
+	return value, nil
+}
+
+// Sets the image's size and chunk size using the values from the device
+// information and case data sections. The case data may be nil.
+func (w *EWFImage) setEWF2Geometry(device, caseData map[string]string) error {
+	bytesPerSector, e := ewf2IntValue(device, "bp", 0x10000)
+	if e != nil {
+		return e
+	}
+	sectorCount, e := ewf2IntValue(device, "ts",
+		math.MaxInt64/bytesPerSector)
+	if e != nil {
+		return e
+	}
+	sectorsPerChunk := int64(ewf2DefaultSectorsPerChunk)
+	if (caseData != nil) && (caseData["sb"] != "") {
+		sectorsPerChunk, e = ewf2IntValue(caseData, "sb", 0x10000)
+		if e != nil {
+			return e
+		}
+	}
+	w.size = sectorCount * bytesPerSector
+	w.chunkSize = sectorsPerChunk * bytesPerSector
+	return nil
+}
+
+// Reads the entries from the sector table in the given data, which was read
+// from the given segment.
+func (w *EWFImage) loadEWF2Table(segment int, data []byte) error {
+	if len(data) < ewf2TableHeaderSize {
+		return fmt.Errorf("The table is truncated")
+	}
+	var header ewf2TableHeader
+	binary.Read(bytes.NewReader(data), binary.LittleEndian, &header)
+	if adler32.Checksum(data[:16]) != header.Checksum {
+		return fmt.Errorf("Bad checksum for table header")
+	}
+	entriesSize := int64(header.EntryCount) * ewf2TableEntrySize
+	if int64(len(data)-ewf2TableHeaderSize) < entriesSize {
+		return fmt.Errorf("The table's %d entries are truncated",
+			header.EntryCount)
+	}
+	if header.FirstChunk != uint64(len(w.chunks)) {
+		return fmt.Errorf("The table starts at chunk %d, expected chunk %d",
+			header.FirstChunk, len(w.chunks))
+	}
+	entries := make([]ewf2TableEntry, header.EntryCount)
+	binary.Read(bytes.NewReader(data[ewf2TableHeaderSize:]),
+		binary.LittleEndian, entries)
+	for _, entry := range entries {
+		chunk := ewfChunk{
+			segment:    segment,
+			offset:     int64(entry.Offset),
+			size:       int64(entry.Size),
+			compressed: (entry.Flags & ewf2ChunkCompressed) != 0,
+			noChecksum: (entry.Flags & ewf2ChunkHasChecksum) == 0,
+		}
+		if (entry.Flags & ewf2ChunkPatternFill) != 0 {
+			chunk.pattern = binary.LittleEndian.AppendUint64(nil,
+				entry.Offset)
+		}
+		w.chunks = append(w.chunks, chunk)
+	}
+	return nil
+}
+
+// Reads the sections in the given EWF2 segment file. Unlike in EWF (E01)
+// files, each section's descriptor follows its data and points back to the
+// previous descriptor, so the sections are found starting at the end of the
+// file. Returns true if the last segment ("done" section) was reached.
+func (w *EWFImage) loadEWF2Segment(segment int) (bool, error) {
+	f := w.segments[segment]
+	data := make([]byte, ewf2FileHeaderSize)
+	e := readFullAt(f, data, 0)
+	if e != nil {
+		return false, e
+	}
+	var header ewf2FileHeader
+	binary.Read(bytes.NewReader(data), binary.LittleEndian, &header)
+	if !bytes.Equal(header.Signature[:], ewf2Signature) {
+		return false, fmt.Errorf("Invalid EWF2 signature")
+	}
+	if header.MajorVersion != 2 {
+		return false, fmt.Errorf("EWF2 version %d.%d isn't supported: %w",
+			header.MajorVersion, header.MinorVersion, ErrUnsupportedFormat)
+	}
+	if int(header.SegmentNumber) != (segment + 1) {
+		return false, fmt.Errorf("Expected segment %d, got segment %d",
+			segment+1, header.SegmentNumber)
+	}
+	switch header.CompressionMethod {
+	case 0, 1:
+		w.bzip2 = false
+	case 2:
+		w.bzip2 = true
+	default:
+		return false, fmt.Errorf("Unknown compression method: %d",
+			header.CompressionMethod)
+	}
+	size, e := contentSize(f)
+	if e != nil {
+		return false, fmt.Errorf("Error getting file size: %w", e)
+	}
+
+	// Find the sections, from the last to the first.
+	var sections []ewf2Section
+	offset := size - ewf2SectionDescriptorSize
+	for {
+		if offset < ewf2FileHeaderSize {
+			return false, fmt.Errorf("Invalid section offset: %d", offset)
+		}
+		descriptor, e := readEWF2SectionDescriptor(f, offset)
+		if e != nil {
+			return false, e
+		}
+		sections = append(sections, ewf2Section{
+			descriptor: descriptor,
+			offset:     offset,
+		})
+		if descriptor.PreviousOffset == 0 {
+			break
+		}
+		if int64(descriptor.PreviousOffset) >= offset {
+			return false, fmt.Errorf("Section at offset %d doesn't point to "+
+				"an earlier section", offset)
+		}
+		offset = int64(descriptor.PreviousOffset)
+	}
+	lastType := sections[0].descriptor.Type
+	if (lastType != ewf2Next) && (lastType != ewf2Done) {
+		return false, fmt.Errorf("The last section has type 0x%x, expected "+
+			"\"next\" or \"done\"", lastType)
+	}
+
+	// Each section's data starts where the previous section's descriptor
+	// ends.
+	var device, caseData map[string]string
+	dataStart := int64(ewf2FileHeaderSize)
+	for i := len(sections) - 1; i >= 0; i-- {
+		descriptor := sections[i].descriptor
+		offset = sections[i].offset
+		dataSize := int64(descriptor.DataSize)
+		if (dataSize < 0) || (dataSize > (offset - dataStart)) {
+			return false, fmt.Errorf("Section at offset %d has an invalid "+
+				"size: %d", offset, descriptor.DataSize)
+		}
+		if (descriptor.DataFlags & ewf2EncryptedData) != 0 {
+			return false, fmt.Errorf("Encrypted EWF2 images aren't "+
+				"supported: %w", ErrUnsupportedFormat)
+		}
+		switch descriptor.Type {
+		case ewf2DeviceInformation, ewf2CaseData, ewf2SectorTable:
+			data = make([]byte, dataSize)
+			e = readFullAt(f, data, dataStart)
+			if e != nil {
+				return false, fmt.Errorf("Error reading section at offset "+
+					"%d: %w", offset, e)
+			}
+		}
+		switch descriptor.Type {
+		case ewf2DeviceInformation:
+			device, e = parseEWF2Values(data)
+			if e != nil {
+				return false, fmt.Errorf("Error reading device "+
+					"information: %w", e)
+			}
+		case ewf2CaseData:
+			caseData, e = parseEWF2Values(data)
+			if e != nil {
+				return false, fmt.Errorf("Error reading case data: %w", e)
+			}
+		case ewf2SectorTable:
+			e = w.loadEWF2Table(segment, data)
+			if e != nil {
+				return false, fmt.Errorf("Error reading table at offset "+
+					"%d: %w", offset, e)
+			}
+		case ewf2MD5Hash:
+			data = make([]byte, md5.Size)
+			e = readFullAt(f, data, dataStart)
+			if e != nil {
+				return false, fmt.Errorf("Error reading MD5 hash: %w", e)
+			}
+			w.md5 = storedHash(data)
+		case ewf2SHA1Hash:
+			data = make([]byte, sha1.Size)
+			e = readFullAt(f, data, dataStart)
+			if e != nil {
+				return false, fmt.Errorf("Error reading SHA1 hash: %w", e)
+			}
+			w.sha1 = storedHash(data)
+		}
+		dataStart = offset + ewf2SectionDescriptorSize
+	}
+	if device != nil {
+		e = w.setEWF2Geometry(device, caseData)
+		if e != nil {
+			return false, fmt.Errorf("Error reading device information: "+
+				"%w", e)
+		}
+	}
+	return lastType == ewf2Done, nil
+}
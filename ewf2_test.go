@@ -0,0 +1,312 @@
+package fat
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/adler32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// Builds an EWF2 segment file in memory.
+type testEWF2Segment struct {
+	data []byte
+	// The offset of the last section's descriptor, or 0 if there are no
+	// sections yet.
+	lastDescriptor int64
+}
+
+func newTestEWF2Segment(number int) *testEWF2Segment {
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, &ewf2FileHeader{
+		MajorVersion:      2,
+		MinorVersion:      1,
+		CompressionMethod: 1,
+		SegmentNumber:     uint32(number),
+	})
+	data := buffer.Bytes()
+	copy(data, ewf2Signature)
+	return &testEWF2Segment{
+		data: data,
+	}
+}
+
+// Appends a section's data, padded to a multiple of 16 bytes, followed by its
+// descriptor.
+func (s *testEWF2Segment) appendSection(sectionType uint32, data []byte) {
+	padding := (16 - (len(data) % 16)) % 16
+	s.data = append(s.data, data...)
+	s.data = append(s.data, make([]byte, padding)...)
+	descriptor := ewf2SectionDescriptor{
+		Type:           sectionType,
+		PreviousOffset: uint64(s.lastDescriptor),
+		DataSize:       uint64(len(data)),
+		DescriptorSize: ewf2SectionDescriptorSize,
+		PaddingSize:    uint32(padding),
+	}
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, &descriptor)
+	encoded := buffer.Bytes()
+	binary.LittleEndian.PutUint32(encoded[60:],
+		adler32.Checksum(encoded[:60]))
+	s.lastDescriptor = int64(len(s.data))
+	s.data = append(s.data, encoded...)
+}
+
+// Returns the data of a device information or case data section, holding the
+// given names and values.
+func testEWF2Values(names, values []string) []byte {
+	text := "\ufeff1\nmain\n" + strings.Join(names, "\t") + "\n" +
+		strings.Join(values, "\t") + "\n\n"
+	var buffer bytes.Buffer
+	w := zlib.NewWriter(&buffer)
+	for _, c := range utf16.Encode([]rune(text)) {
+		binary.Write(w, binary.LittleEndian, c)
+	}
+	w.Close()
+	return buffer.Bytes()
+}
+
+// Returns the content of EWF2 segment files containing the given data, using
+// 32KB chunks and putting at most chunksPerSegment chunks in each segment.
+// Chunks consisting of a repeated 8-byte pattern are stored as pattern fills.
+// Of the others, a third are compressed, a third are stored with a checksum
+// and a third without one.
+func newTestEWF2(data []byte, chunksPerSegment int) [][]byte {
+	const chunkSize = 64 * SectorSize
+	chunkCount := (len(data) + chunkSize - 1) / chunkSize
+	var segments [][]byte
+	for chunk := 0; chunk < chunkCount; {
+		s := newTestEWF2Segment(len(segments) + 1)
+		if len(segments) == 0 {
+			s.appendSection(ewf2DeviceInformation, testEWF2Values(
+				[]string{"sn", "md", "ts", "bp"},
+				[]string{"1234", "Test disk",
+					strconv.Itoa(len(data) / SectorSize),
+					strconv.Itoa(SectorSize)}))
+			s.appendSection(ewf2CaseData, testEWF2Values(
+				[]string{"cn", "ex", "sb", "cp"},
+				[]string{"case", "examiner",
+					strconv.Itoa(chunkSize / SectorSize), "1"}))
+		}
+
+		var buffer bytes.Buffer
+		binary.Write(&buffer, binary.LittleEndian, &ewf2TableHeader{
+			FirstChunk: uint64(chunk),
+		})
+		table := bytes.Clone(buffer.Bytes())
+		var sectors []byte
+		sectorsStart := len(s.data)
+		entryCount := 0
+		for (entryCount < chunksPerSegment) && (chunk < chunkCount) {
+			content := data[chunk*chunkSize:]
+			if len(content) > chunkSize {
+				content = content[:chunkSize]
+			}
+			entry := ewf2TableEntry{
+				Offset: uint64(sectorsStart + len(sectors)),
+			}
+			var stored []byte
+			if bytes.Equal(content, bytes.Repeat(content[:8],
+				len(content)/8)) {
+				entry.Offset = binary.LittleEndian.Uint64(content)
+				entry.Flags = ewf2ChunkPatternFill
+			} else if (chunk % 3) == 0 {
+				buffer.Reset()
+				w := zlib.NewWriter(&buffer)
+				w.Write(content)
+				w.Close()
+				stored = buffer.Bytes()
+				entry.Flags = ewf2ChunkCompressed
+			} else if (chunk % 3) == 1 {
+				stored = appendWithAdler32(nil, content)
+				entry.Flags = ewf2ChunkHasChecksum
+			} else {
+				stored = content
+			}
+			entry.Size = uint32(len(stored))
+			sectors = append(sectors, stored...)
+			// Chunks are padded to a multiple of 16 bytes.
+			sectors = append(sectors, make([]byte,
+				(16-(len(stored)%16))%16)...)
+			buffer.Reset()
+			binary.Write(&buffer, binary.LittleEndian, &entry)
+			table = append(table, buffer.Bytes()...)
+			entryCount++
+			chunk++
+		}
+		binary.LittleEndian.PutUint32(table[8:], uint32(entryCount))
+		binary.LittleEndian.PutUint32(table[16:],
+			adler32.Checksum(table[:16]))
+		table = binary.LittleEndian.AppendUint32(table,
+			adler32.Checksum(table[ewf2TableHeaderSize:]))
+		table = append(table, make([]byte, 12)...)
+		s.appendSection(ewf2SectorData, sectors)
+		s.appendSection(ewf2SectorTable, table)
+
+		if chunk < chunkCount {
+			s.appendSection(ewf2Next, nil)
+			segments = append(segments, s.data)
+			continue
+		}
+		md5Sum := md5.Sum(data)
+		sha1Sum := sha1.Sum(data)
+		s.appendSection(ewf2MD5Hash, append(md5Sum[:],
+			make([]byte, 16)...))
+		s.appendSection(ewf2SHA1Hash, append(sha1Sum[:],
+			make([]byte, 12)...))
+		s.appendSection(ewf2Done, nil)
+		segments = append(segments, s.data)
+	}
+	return segments
+}
+
+// Writes the segments to a temporary directory, returning the path to the
+// given segment.
+func writeEWF2Segments(t *testing.T, segments [][]byte, index int) string {
+	dir := t.TempDir()
+	for i, segment := range segments {
+		path := filepath.Join(dir, "evidence."+ewf2SegmentExtension(i+1))
+		e := os.WriteFile(path, segment, 0644)
+		if e != nil {
+			t.Logf("Failed writing EWF2 segment %d: %s\n", i+1, e)
+			t.FailNow()
+		}
+	}
+	return filepath.Join(dir, "evidence."+ewf2SegmentExtension(index+1))
+}
+
+func TestEWF2SegmentExtension(t *testing.T) {
+	numbers := []int{1, 99, 100, 776}
+	expected := []string{"Ex01", "Ex99", "ExAA", "FxAA"}
+	for i, n := range numbers {
+		extension := ewf2SegmentExtension(n)
+		if extension != expected[i] {
+			t.Logf("Expected extension %s for segment %d, got %s\n",
+				expected[i], n, extension)
+			t.Fail()
+		}
+		if !isEWF2SegmentPath("evidence." + extension) {
+			t.Logf("%s wasn't recognized as an EWF2 extension\n", extension)
+			t.Fail()
+		}
+	}
+	if isEWF2SegmentPath("disk.E01") || isEWF2SegmentPath("disk.Ax01") ||
+		!isEWF2SegmentPath("disk.ex01") {
+		t.Logf("Got incorrect EWF2 extensions\n")
+		t.Fail()
+	}
+}
+
+func TestEWF2Image(t *testing.T) {
+	data := newTestVirtualDiskContent()
+	// Most of the disk is blank, so add a few chunks that don't consist of
+	// a repeated pattern, and make the last chunk a partial one.
+	data = append(data, testContent(2*64*SectorSize+3*SectorSize)...)
+	segments := newTestEWF2(data, 30)
+	if len(segments) != 3 {
+		t.Logf("Expected 3 segments, got %d\n", len(segments))
+		t.FailNow()
+	}
+	img := checkImagePath(t, writeEWF2Segments(t, segments, 1), data)
+	ewf, ok := img.(*EWFImage)
+	if !ok {
+		t.Logf("Didn't get an EWFImage\n")
+		t.FailNow()
+	}
+	patterns := 0
+	for _, chunk := range ewf.chunks {
+		if chunk.pattern != nil {
+			patterns++
+		}
+	}
+	if (len(ewf.Paths()) != 3) || (patterns == 0) {
+		t.Logf("Got %d segments and %d pattern-filled chunks\n",
+			len(ewf.Paths()), patterns)
+		t.Fail()
+	}
+	e := VerifyImage(img)
+	if e != nil {
+		t.Logf("Failed verifying EWF2 image: %s\n", e)
+		t.Fail()
+	}
+
+	// Change the stored SHA1.
+	last := segments[len(segments)-1]
+	sha1Sum := sha1.Sum(data)
+	sha1Offset := bytes.Index(last, sha1Sum[:])
+	last[sha1Offset]++
+	img, e = OpenImage(writeEWF2Segments(t, segments, 0))
+	if e != nil {
+		t.Logf("Failed opening modified EWF2 image: %s\n", e)
+		t.FailNow()
+	}
+	defer img.Close()
+	e = VerifyImage(img)
+	if !errors.Is(e, ErrHashMismatch) {
+		t.Logf("Expected a hash mismatch, got %v\n", e)
+		t.Fail()
+	}
+	last[sha1Offset]--
+
+	// Damage an uncompressed chunk with a checksum, which should be
+	// detected, and one without a checksum, which can't be.
+	checked, unchecked := int64(-1), int64(-1)
+	for i, chunk := range ewf.chunks {
+		if chunk.compressed || (chunk.pattern != nil) {
+			continue
+		}
+		if chunk.noChecksum && (unchecked < 0) {
+			unchecked = int64(i)
+		} else if !chunk.noChecksum && (checked < 0) {
+			checked = int64(i)
+		}
+	}
+	if (checked < 0) || (unchecked < 0) {
+		t.Logf("Didn't find uncompressed chunks with and without "+
+			"checksums: %d, %d\n", checked, unchecked)
+		t.FailNow()
+	}
+	for _, i := range []int64{checked, unchecked} {
+		chunk := &(ewf.chunks[i])
+		segments[chunk.segment][chunk.offset+100]++
+	}
+	img, e = OpenImage(writeEWF2Segments(t, segments, 0))
+	if e != nil {
+		t.Logf("Failed opening damaged EWF2 image: %s\n", e)
+		t.FailNow()
+	}
+	defer img.Close()
+	buffer := make([]byte, 100)
+	_, e = img.ReadAt(buffer, checked*ewf.chunkSize+100)
+	if e == nil {
+		t.Logf("Didn't get an error reading a damaged chunk\n")
+		t.Fail()
+	}
+	offset := unchecked*ewf.chunkSize + 100
+	_, e = img.ReadAt(buffer, offset)
+	if (e != nil) || (buffer[0] != (data[offset] + 1)) {
+		t.Logf("Didn't read the modified data from a chunk without a "+
+			"checksum: %v\n", e)
+		t.Fail()
+	}
+
+	// Damage the last section descriptor in the first segment.
+	segments[0][len(segments[0])-10]++
+	_, e = OpenImage(writeEWF2Segments(t, segments, 0))
+	if e == nil {
+		t.Logf("Didn't get an error opening an EWF2 image with a damaged " +
+			"section descriptor\n")
+		t.Fail()
+	}
+	t.Logf("Got expected error opening an EWF2 image with a damaged "+
+		"section descriptor: %s\n", e)
+}
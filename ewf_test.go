@@ -0,0 +1,343 @@
+package fat
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/adler32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Appends a section with the given type and data to an EWF segment file. If
+// last is true, the section's next offset points to itself.
+func appendEWFSection(file []byte, sectionType string, data []byte,
+	last bool) []byte {
+	var descriptor ewfSectionDescriptor
+	copy(descriptor.Type[:], sectionType)
+	descriptor.Size = uint64(ewfSectionDescriptorSize + len(data))
+	descriptor.Next = uint64(len(file))
+	if !last {
+		descriptor.Next += descriptor.Size
+	}
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, &descriptor)
+	encoded := buffer.Bytes()
+	binary.LittleEndian.PutUint32(encoded[72:], adler32.Checksum(encoded[:72]))
+	file = append(file, encoded...)
+	return append(file, data...)
+}
+
+// Appends the data followed by its Adler-32 checksum.
+func appendWithAdler32(dst, data []byte) []byte {
+	dst = append(dst, data...)
+	return binary.LittleEndian.AppendUint32(dst, adler32.Checksum(data))
+}
+
+// Returns the content of EWF segment files containing the given data, using
+// 32KB chunks and putting at most chunksPerSegment chunks in each segment.
+// Even-numbered chunks are compressed.
+func newTestEWF(data []byte, chunksPerSegment int) [][]byte {
+	const chunkSize = 64 * SectorSize
+	chunkCount := (len(data) + chunkSize - 1) / chunkSize
+	var segments [][]byte
+	for chunk := 0; chunk < chunkCount; {
+		var buffer bytes.Buffer
+		binary.Write(&buffer, binary.LittleEndian, &ewfFileHeader{
+			FieldsStart:   1,
+			SegmentNumber: uint16(len(segments) + 1),
+		})
+		file := append([]byte{}, buffer.Bytes()...)
+		copy(file, ewfSignature)
+		if len(segments) == 0 {
+			buffer.Reset()
+			binary.Write(&buffer, binary.LittleEndian, &ewfVolume{
+				MediaType:       1,
+				ChunkCount:      uint32(chunkCount),
+				SectorsPerChunk: chunkSize / SectorSize,
+				BytesPerSector:  SectorSize,
+				SectorCount:     uint64(len(data) / SectorSize),
+			})
+			volume := make([]byte, 1052)
+			copy(volume, buffer.Bytes())
+			file = appendEWFSection(file, "volume", volume, false)
+		}
+
+		// The first segment uses absolute chunk offsets, later ones are
+		// relative to the start of the sectors section.
+		sectorsStart := len(file) + ewfSectionDescriptorSize
+		baseOffset := 0
+		if len(segments) != 0 {
+			baseOffset = sectorsStart
+		}
+		var sectors, entries []byte
+		for i := 0; (i < chunksPerSegment) && (chunk < chunkCount); i++ {
+			content := data[chunk*chunkSize:]
+			if len(content) > chunkSize {
+				content = content[:chunkSize]
+			}
+			entry := uint32(sectorsStart + len(sectors) - baseOffset)
+			if (chunk % 2) == 0 {
+				entry |= 0x80000000
+				buffer.Reset()
+				w := zlib.NewWriter(&buffer)
+				w.Write(content)
+				w.Close()
+				sectors = append(sectors, buffer.Bytes()...)
+			} else {
+				sectors = appendWithAdler32(sectors, content)
+			}
+			entries = binary.LittleEndian.AppendUint32(entries, entry)
+			chunk++
+		}
+		file = appendEWFSection(file, "sectors", sectors, false)
+		buffer.Reset()
+		binary.Write(&buffer, binary.LittleEndian, &ewfTableHeader{
+			EntryCount: uint32(len(entries) / 4),
+			BaseOffset: uint64(baseOffset),
+		})
+		table := append([]byte{}, buffer.Bytes()...)
+		binary.LittleEndian.PutUint32(table[20:], adler32.Checksum(table[:20]))
+		table = appendWithAdler32(table, entries)
+		file = appendEWFSection(file, "table", table, false)
+		file = appendEWFSection(file, "table2", table, false)
+
+		if chunk < chunkCount {
+			segments = append(segments, appendEWFSection(file, "next", nil,
+				true))
+			continue
+		}
+		md5Sum := md5.Sum(data)
+		sha1Sum := sha1.Sum(data)
+		hash := appendWithAdler32(nil, append(md5Sum[:], make([]byte, 16)...))
+		file = appendEWFSection(file, "hash", hash, false)
+		digest := append(append(md5Sum[:], sha1Sum[:]...), make([]byte, 40)...)
+		file = appendEWFSection(file, "digest", appendWithAdler32(nil, digest),
+			false)
+		segments = append(segments, appendEWFSection(file, "done", nil, true))
+	}
+	return segments
+}
+
+// Writes the segments to a temporary directory, returning the path to the
+// given segment.
+func writeEWFSegments(t *testing.T, segments [][]byte, index int) string {
+	dir := t.TempDir()
+	for i, segment := range segments {
+		path := filepath.Join(dir, "evidence."+ewfSegmentExtension(i+1))
+		e := os.WriteFile(path, segment, 0644)
+		if e != nil {
+			t.Logf("Failed writing EWF segment %d: %s\n", i+1, e)
+			t.FailNow()
+		}
+	}
+	return filepath.Join(dir, "evidence."+ewfSegmentExtension(index+1))
+}
+
+func TestEWFSegmentExtension(t *testing.T) {
+	numbers := []int{1, 99, 100, 101, 775, 776}
+	expected := []string{"E01", "E99", "EAA", "EAB", "EZZ", "FAA"}
+	for i, n := range numbers {
+		extension := ewfSegmentExtension(n)
+		if extension != expected[i] {
+			t.Logf("Expected extension %s for segment %d, got %s\n",
+				expected[i], n, extension)
+			t.Fail()
+		}
+		if !isEWFSegmentPath("evidence." + extension) {
+			t.Logf("%s wasn't recognized as an EWF extension\n", extension)
+			t.Fail()
+		}
+	}
+	if isEWFSegmentPath("disk.dd") || isEWFSegmentPath("disk.A01") {
+		t.Logf("Got incorrect EWF extensions\n")
+		t.Fail()
+	}
+}
+
+func TestEWFImage(t *testing.T) {
+	data := newTestVirtualDiskContent()
+	// Make the last chunk a partial one.
+	data = append(data, testContent(3*SectorSize)...)
+	segments := newTestEWF(data, 30)
+	if len(segments) != 3 {
+		t.Logf("Expected 3 segments, got %d\n", len(segments))
+		t.FailNow()
+	}
+	img := checkImagePath(t, writeEWFSegments(t, segments, 1), data)
+	ewf, ok := img.(*EWFImage)
+	if !ok {
+		t.Logf("Didn't get an EWFImage\n")
+		t.FailNow()
+	}
+	if (len(ewf.Paths()) != 3) || (ewf.StoredMD5() == nil) ||
+		(ewf.StoredSHA1() == nil) {
+		t.Logf("Got %d segments, MD5 %x, SHA1 %x\n", len(ewf.Paths()),
+			ewf.StoredMD5(), ewf.StoredSHA1())
+		t.Fail()
+	}
+	e := ewf.Verify()
+	if e != nil {
+		t.Logf("Failed verifying EWF image: %s\n", e)
+		t.Fail()
+	}
+	// Images read along with a ddrescue mapfile are verified using the image
+	// they wrap.
+	e = VerifyImage(NewRescuedImage(ewf, &RescueMap{}))
+	if e != nil {
+		t.Logf("Failed verifying EWF image with a mapfile: %s\n", e)
+		t.Fail()
+	}
+
+	// Change the stored SHA1 in the digest section.
+	last := segments[len(segments)-1]
+	digestOffset := bytes.Index(last, []byte("digest"))
+	last[digestOffset+ewfSectionDescriptorSize+md5.Size]++
+	img, e = OpenImage(writeEWFSegments(t, segments, 0))
+	if e != nil {
+		t.Logf("Failed opening modified EWF image: %s\n", e)
+		t.FailNow()
+	}
+	defer img.Close()
+	e = VerifyImage(img)
+	if !errors.Is(e, ErrHashMismatch) {
+		t.Logf("Expected a hash mismatch, got %v\n", e)
+		t.Fail()
+	}
+	tolerant, e := NewTolerantImage(img, SectorSize)
+	if e != nil {
+		t.Logf("Failed creating tolerant image: %s\n", e)
+		t.FailNow()
+	}
+	e = VerifyImage(tolerant)
+	if !errors.Is(e, ErrHashMismatch) {
+		t.Logf("Expected a hash mismatch through a TolerantImage, got %v\n",
+			e)
+		t.Fail()
+	}
+	rawPath := filepath.Join(t.TempDir(), "disk.img")
+	os.WriteFile(rawPath, data, 0644)
+	raw, e := OpenImage(rawPath)
+	if e != nil {
+		t.Logf("Failed opening raw image: %s\n", e)
+		t.FailNow()
+	}
+	defer raw.Close()
+	e = VerifyImage(raw)
+	if (e == nil) || errors.Is(e, ErrHashMismatch) {
+		t.Logf("Expected an error verifying a raw image, got %v\n", e)
+		t.Fail()
+	}
+
+	// Damage the second chunk, which is uncompressed.
+	segments[0][ewf.chunks[1].offset+100]++
+	img, e = OpenImage(writeEWFSegments(t, segments, 0))
+	if e != nil {
+		t.Logf("Failed opening damaged EWF image: %s\n", e)
+		t.FailNow()
+	}
+	defer img.Close()
+	buffer := make([]byte, 100)
+	_, e = img.ReadAt(buffer, 40000)
+	if e == nil {
+		t.Logf("Didn't get an error reading a damaged chunk\n")
+		t.Fail()
+	}
+}
+
+func TestEWFTableOverflow(t *testing.T) {
+	const chunkSize = 64 * SectorSize
+	data := testContent(3 * chunkSize)
+	// Store the first and last chunks compressed, and the second one
+	// uncompressed. The first chunk starts just before 2 GiB, so the table's
+	// later entries are full 32-bit offsets, without compression flags.
+	var stored [][]byte
+	var offsets []int64
+	offset := int64(0x7fffffe0)
+	var buffer bytes.Buffer
+	for i := 0; i < 3; i++ {
+		content := data[i*chunkSize : (i+1)*chunkSize]
+		if i == 1 {
+			stored = append(stored, appendWithAdler32(nil, content))
+		} else {
+			buffer.Reset()
+			w := zlib.NewWriter(&buffer)
+			w.Write(content)
+			w.Close()
+			stored = append(stored, bytes.Clone(buffer.Bytes()))
+		}
+		offsets = append(offsets, offset)
+		offset += int64(len(stored[i]))
+	}
+	if offsets[1] <= 0x7fffffff {
+		t.Logf("The second chunk doesn't start past 2 GiB\n")
+		t.FailNow()
+	}
+	var entries []byte
+	for i, offset := range offsets {
+		entry := uint32(offset)
+		if i == 0 {
+			entry |= 0x80000000
+		}
+		entries = binary.LittleEndian.AppendUint32(entries, entry)
+	}
+	buffer.Reset()
+	binary.Write(&buffer, binary.LittleEndian, &ewfTableHeader{
+		EntryCount: uint32(len(offsets)),
+	})
+	table := append([]byte{}, buffer.Bytes()...)
+	binary.LittleEndian.PutUint32(table[20:], adler32.Checksum(table[:20]))
+	table = appendWithAdler32(table, entries)
+	segment := appendEWFSection(nil, "table", table, false)
+
+	// Write the chunks to a sparse segment file.
+	path := filepath.Join(t.TempDir(), "evidence.E01")
+	f, e := os.Create(path)
+	if e != nil {
+		t.Logf("Failed creating segment file: %s\n", e)
+		t.FailNow()
+	}
+	defer f.Close()
+	f.WriteAt(segment, 0)
+	for i := range stored {
+		_, e = f.WriteAt(stored[i], offsets[i])
+		if e != nil {
+			t.Logf("Failed writing chunk %d: %s\n", i, e)
+			t.FailNow()
+		}
+	}
+	dataEnd := offset
+
+	img := &EWFImage{
+		segments:  []*os.File{f},
+		chunkSize: chunkSize,
+	}
+	img.size = int64(len(data))
+	img.r = img
+	e = img.loadTable(0, 0, dataEnd)
+	if e != nil {
+		t.Logf("Failed loading table: %s\n", e)
+		t.FailNow()
+	}
+	for i, chunk := range img.chunks {
+		if chunk.offset != offsets[i] {
+			t.Logf("Chunk %d has offset 0x%x, expected 0x%x\n", i,
+				chunk.offset, offsets[i])
+			t.FailNow()
+		}
+	}
+	content := make([]byte, len(data))
+	_, e = img.ReadAt(content, 0)
+	if e != nil {
+		t.Logf("Failed reading chunks past 2 GiB: %s\n", e)
+		t.FailNow()
+	}
+	if !bytes.Equal(content, data) {
+		t.Logf("Read incorrect data from chunks past 2 GiB\n")
+		t.Fail()
+	}
+}
@@ -324,6 +324,22 @@ type FATChain struct {
 	// The chain's size, in bytes. Note that this may differ from the file
 	// size, since it will always be rounded up to a whole cluster.
 	Size uint64
+	// The runs of consecutive clusters making up the chain, in the order
+	// they occur in the chain. Contiguous chains have a single extent.
+	Extents []ClusterExtent
+	// The largest distance, in clusters, between the end of one extent and
+	// the start of the next. This is 0 for contiguous chains.
+	LargestGap uint32
+	// The clusters in the chain containing data that couldn't be read when
+	// the image was acquired, in the order they occur in the chain. This is
+	// only known if the filesystem's content implements
+	// UnreadableRangeReporter, e.g. a RescuedImage or a partition within one.
+	UnreadableClusters []uint32
+}
+
+// Returns the number of separate fragments the chain is stored in.
+func (c *FATChain) FragmentCount() int {
+	return len(c.Extents)
 }
 
 // Populates the given FATChain structure, starting with the given endCluster
@@ -340,28 +356,88 @@ func (f *FAT32Filesystem) followChainBackwards(endCluster, clusterCount uint32,
 		startCluster = reversedFAT[startCluster]
 		chainEntries++
 	}
-	chain.Contiguous = true
 	chain.StartCluster = startCluster
 	chain.Size = chainEntries * uint64(f.ClusterSize)
-	// Scan forward to see if the chain is contiguous (moving forward across
-	// adjacent clusters)
+	// Scan forward to find the runs of adjacent clusters, which also tells us
+	// whether the chain is contiguous.
+	clusters := make([]uint32, 0, chainEntries)
 	currentCluster := startCluster
-	for f.FAT[currentCluster] < clusterCount {
-		if f.FAT[currentCluster] != (currentCluster + 1) {
-			chain.Contiguous = false
-			break
+	for uint64(len(clusters)) < chainEntries {
+		clusters = append(clusters, currentCluster)
+		currentCluster = f.FAT[currentCluster] & 0x0fffffff
+	}
+	chain.Extents = clusterExtents(clusters)
+	chain.LargestGap = largestGap(chain.Extents)
+	chain.Contiguous = len(chain.Extents) == 1
+	chain.UnreadableClusters = f.UnreadableClusters(chain.Extents)
+	return nil
+}
+
+// Returns the clusters in the given extents, in order, containing data that
+// couldn't be read when the image was acquired. Always returns nil if the
+// filesystem's content doesn't implement UnreadableRangeReporter.
+func (f *FAT32Filesystem) UnreadableClusters(extents []ClusterExtent) []uint32 {
+	reporter, ok := f.Content.(UnreadableRangeReporter)
+	if !ok {
+		return nil
+	}
+	clusterSize := int64(f.ClusterSize)
+	var toReturn []uint32
+	for i := range extents {
+		x := &(extents[i])
+		start := f.GetDataOffset(x.StartCluster, 0)
+		ranges := reporter.UnreadableRanges(start, int64(x.Length)*clusterSize)
+		for j := range ranges {
+			r := &(ranges[j])
+			first := x.StartCluster + uint32((r.Offset-start)/clusterSize)
+			last := x.StartCluster + uint32((r.End()-1-start)/clusterSize)
+			for c := first; c <= last; c++ {
+				// Adjacent ranges may share a cluster.
+				count := len(toReturn)
+				if (count != 0) && (toReturn[count-1] == c) {
+					continue
+				}
+				toReturn = append(toReturn, c)
+			}
 		}
-		currentCluster = f.FAT[currentCluster]
 	}
-	return nil
+	return toReturn
+}
+
+// Returns the index of the first sector in the data region, relative to the
+// start of the FAT32 filesystem. Cluster 2 begins at this sector.
+func (f *FAT32Filesystem) firstDataSector() uint32 {
+	return uint32(f.Header.BPB.ReservedSectorCount) +
+		(uint32(f.Header.BPB.FATCount) * f.Header.EBR.SectorsPerFAT)
+}
+
+// Returns the number of FAT entries that may refer to clusters in the data
+// region. This includes the two reserved entries at the start of the FAT, so
+// valid cluster numbers are in the range [2, ClusterCount()).
+func (f *FAT32Filesystem) ClusterCount() uint32 {
+	totalSectors := f.Header.BPB.LargeSectorCount
+	if totalSectors == 0 {
+		totalSectors = uint32(f.Header.BPB.LogicalVolumeSectors)
+	}
+	firstDataSector := f.firstDataSector()
+	if totalSectors <= firstDataSector {
+		return 2
+	}
+	toReturn := ((totalSectors - firstDataSector) /
+		uint32(f.Header.BPB.SectorsPerCluster)) + 2
+	// Never return a count that would index past the end of the FAT, even if
+	// the header claims the volume is larger.
+	if toReturn > uint32(len(f.FAT)) {
+		toReturn = uint32(len(f.FAT))
+	}
+	return toReturn
 }
 
 // Returns a list of chains in the filesystem; should correspond to a list of
 // possible files.
 func (f *FAT32Filesystem) GetAllChains() ([]FATChain, error) {
 	var e error
-	clusterCount := f.Header.BPB.LargeSectorCount /
-		uint32(f.Header.BPB.SectorsPerCluster)
+	clusterCount := f.ClusterCount()
 	// First, we'll calculate a "reversed" FAT that will let us follow chains
 	// backwards from their end.
 	reversedFAT := make([]uint32, len(f.FAT))
@@ -374,6 +450,10 @@ func (f *FAT32Filesystem) GetAllChains() ([]FATChain, error) {
 	for i := uint32(2); i < clusterCount; i++ {
 		// Ignore the top 4 bits
 		v := f.FAT[i] & 0x0fffffff
+		// Bad clusters aren't part of any chain.
+		if v == BadClusterMarker {
+			continue
+		}
 		// We don't need to record anything in the reversed FAT for end-of-
 		// chain or unused FAT entries.
 		if v >= clusterCount {
@@ -396,8 +476,9 @@ func (f *FAT32Filesystem) GetAllChains() ([]FATChain, error) {
 	chainCount = 0
 	for i := uint32(2); i < clusterCount; i++ {
 		v := f.FAT[i] & 0x0fffffff
-		if v < clusterCount {
-			// This is either a 0 or part of the middle of a chain.
+		if (v < clusterCount) || (v == BadClusterMarker) {
+			// This is either a 0, a bad cluster, or part of the middle of a
+			// chain.
 			continue
 		}
 		e = f.followChainBackwards(i, clusterCount, reversedFAT,
@@ -410,6 +491,40 @@ func (f *FAT32Filesystem) GetAllChains() ([]FATChain, error) {
 	return toReturn, nil
 }
 
+// Returns true if the given FAT entry marks the end of a chain.
+func IsEndOfChain(v uint32) bool {
+	return (v & 0x0fffffff) >= 0x0ffffff8
+}
+
+// Follows the chain in the FAT beginning at the given cluster, and returns
+// the list of clusters in the chain, in order. Returns an error if the chain
+// is invalid, i.e. if it contains a cycle, a free or bad cluster, or a
+// reference past the end of the FAT.
+func (f *FAT32Filesystem) ChainClusters(start uint32) ([]uint32, error) {
+	clusterCount := f.ClusterCount()
+	var toReturn []uint32
+	current := start
+	for {
+		if (current < 2) || (current >= clusterCount) {
+			return toReturn, fmt.Errorf("Chain starting at cluster %d "+
+				"refers to invalid cluster 0x%x", start, current)
+		}
+		// A chain can't be longer than the number of clusters without
+		// visiting at least one of them twice.
+		if uint32(len(toReturn)) >= clusterCount {
+			return toReturn, fmt.Errorf("Chain starting at cluster %d "+
+				"contains a cycle", start)
+		}
+		toReturn = append(toReturn, current)
+		next := f.FAT[current] & 0x0fffffff
+		if IsEndOfChain(next) {
+			break
+		}
+		current = next
+	}
+	return toReturn, nil
+}
+
 // Implements the io.Reader interface, used to obtain data contained within a
 // chain.
 type chainReader struct {
@@ -429,13 +544,12 @@ type chainReader struct {
 
 // Returns the offset of the given offset (mod cluster size) into cluster c.
 func (f *FAT32Filesystem) GetDataOffset(c, offset uint32) int64 {
-	firstDataSector := uint32(f.Header.BPB.ReservedSectorCount) +
-		(uint32(f.Header.BPB.FATCount) * f.Header.EBR.SectorsPerFAT)
-	clusterSize := f.ClusterSize
-	offsetInCluster := offset % clusterSize
-	// Note that this is actually indexed by cluster # - 2.
-	return int64((firstDataSector * SectorSize) + ((c - 2) * clusterSize) +
-		offsetInCluster)
+	clusterSize := int64(f.ClusterSize)
+	offsetInCluster := int64(offset) % clusterSize
+	// Note that this is actually indexed by cluster # - 2. The arithmetic is
+	// done using 64 bits, since the data region of large volumes exceeds 4 GB.
+	return (int64(f.firstDataSector()) * SectorSize) +
+		(int64(c-2) * clusterSize) + offsetInCluster
 }
 
 // Populates dst with the contents of the cluster at the given index. dst must
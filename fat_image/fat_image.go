@@ -0,0 +1,351 @@
+// This defines a command-line utility for copying a disk, or a raw image of
+// one, to a new image file. Hashes of the content are computed while it's
+// copied, saved to a JSON file alongside the image, and checked against the
+// copy afterwards. Read errors on the source are retried, and sectors that
+// can't be read are filled and logged to a ddrescue-format mapfile.
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/yalue/fat"
+	"github.com/yalue/fat/internal/cmdflags"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+// Computes the MD5, SHA-1 and SHA-256 hashes of everything written to it.
+type imageHashes struct {
+	md5    hash.Hash
+	sha1   hash.Hash
+	sha256 hash.Hash
+	writer io.Writer
+}
+
+func newImageHashes() *imageHashes {
+	toReturn := &imageHashes{
+		md5:    md5.New(),
+		sha1:   sha1.New(),
+		sha256: sha256.New(),
+	}
+	toReturn.writer = io.MultiWriter(toReturn.md5, toReturn.sha1,
+		toReturn.sha256)
+	return toReturn
+}
+
+func (h *imageHashes) Write(data []byte) (int, error) {
+	return h.writer.Write(data)
+}
+
+// Sets the hash fields in the given info to the hashes computed so far.
+func (h *imageHashes) setHashes(info *acquisitionInfo) {
+	info.MD5 = hex.EncodeToString(h.md5.Sum(nil))
+	info.SHA1 = hex.EncodeToString(h.sha1.Sum(nil))
+	info.SHA256 = hex.EncodeToString(h.sha256.Sum(nil))
+}
+
+// A range of the source that couldn't be read, in the sidecar JSON file.
+type badRangeJSON struct {
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+// The content of the sidecar JSON file written alongside the image.
+type acquisitionInfo struct {
+	Source     string `json:"source"`
+	Image      string `json:"image"`
+	Size       int64  `json:"size"`
+	BlockSize  int    `json:"block_size"`
+	StartTime  string `json:"start_time"`
+	FinishTime string `json:"finish_time"`
+	MD5        string `json:"md5"`
+	SHA1       string `json:"sha1"`
+	SHA256     string `json:"sha256"`
+	// The ranges of the source that couldn't be read, which were filled in
+	// the image. These are also listed in the mapfile.
+	BadBytes  int64          `json:"bad_bytes"`
+	BadRanges []badRangeJSON `json:"bad_ranges"`
+	MapFile   string         `json:"map_file"`
+	// Cleared if copying failed partway, in which case the image only holds
+	// the source's content up to CopiedBytes, and Error says why.
+	Complete    bool   `json:"complete"`
+	CopiedBytes int64  `json:"copied_bytes"`
+	Error       string `json:"error,omitempty"`
+	// Set if the image was read back after copying and its hashes matched.
+	Verified bool `json:"verified"`
+}
+
+// Records the source's unreadable ranges and the end time in the info, and
+// saves the mapfile.
+func (info *acquisitionInfo) finish(src *fat.TolerantImage) error {
+	info.FinishTime = time.Now().Format(time.RFC3339)
+	info.BadBytes = src.BadBytes()
+	info.BadRanges = make([]badRangeJSON, 0)
+	for _, r := range src.UnreadableRanges(0, info.Size) {
+		info.BadRanges = append(info.BadRanges, badRangeJSON{
+			Offset: r.Offset,
+			Size:   r.Size,
+		})
+	}
+	e := src.SaveMap()
+	if e != nil {
+		return fmt.Errorf("Failed saving mapfile: %w", e)
+	}
+	return nil
+}
+
+// Writes the info to the given path, as JSON.
+func (info *acquisitionInfo) save(path string) error {
+	f, e := os.Create(path)
+	if e != nil {
+		return fmt.Errorf("Error creating %s: %w", path, e)
+	}
+	defer f.Close()
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	e = encoder.Encode(info)
+	if e != nil {
+		return fmt.Errorf("Error writing %s: %w", path, e)
+	}
+	return nil
+}
+
+// Copies the source to dst in blocks of the given size, hashing the content
+// as it's copied. Returns the number of bytes written to dst, which is less
+// than the source's size if an error occurs.
+func copyImage(src *fat.TolerantImage, dst io.Writer, blockSize int,
+	hashes *imageHashes) (int64, error) {
+	size := src.Size()
+	buffer := make([]byte, blockSize)
+	bytesPerStatus := size / 20
+	nextStatus := int64(0)
+	for offset := int64(0); offset < size; {
+		if offset >= nextStatus {
+			fmt.Printf("Copied %d/%d bytes (%.02f%%).\n", offset, size,
+				100.0*float64(offset)/float64(size))
+			nextStatus = offset + bytesPerStatus
+		}
+		toRead := buffer
+		if int64(len(toRead)) > (size - offset) {
+			toRead = toRead[:size-offset]
+		}
+		n, e := src.ReadAt(toRead, offset)
+		if (e != nil) && (e != io.EOF) {
+			return offset, fmt.Errorf("Error reading offset %d: %w", offset,
+				e)
+		}
+		if n == 0 {
+			return offset, fmt.Errorf("Source ended early, at offset %d",
+				offset)
+		}
+		written, e := dst.Write(toRead[:n])
+		hashes.Write(toRead[:written])
+		if e != nil {
+			return offset + int64(written), fmt.Errorf("Error writing "+
+				"offset %d: %w", offset, e)
+		}
+		offset += int64(n)
+	}
+	fmt.Printf("Copied %d bytes.\n", size)
+	return size, nil
+}
+
+// Reads back the image at the given path, and checks that its size and
+// hashes match the given info.
+func verifyImage(path string, info *acquisitionInfo) error {
+	f, e := os.Open(path)
+	if e != nil {
+		return fmt.Errorf("Error opening %s: %w", path, e)
+	}
+	defer f.Close()
+	hashes := newImageHashes()
+	size, e := io.Copy(hashes, f)
+	if e != nil {
+		return fmt.Errorf("Error reading %s: %w", path, e)
+	}
+	if size != info.Size {
+		return fmt.Errorf("%s contains %d bytes, expected %d", path, size,
+			info.Size)
+	}
+	var copied acquisitionInfo
+	hashes.setHashes(&copied)
+	if (copied.MD5 != info.MD5) || (copied.SHA1 != info.SHA1) ||
+		(copied.SHA256 != info.SHA256) {
+		return fmt.Errorf("The hashes of %s don't match the source: got "+
+			"SHA-256 %s, expected %s", path, copied.SHA256, info.SHA256)
+	}
+	return nil
+}
+
+// Prints the partitions in the image's MBR, if it has one.
+func printPartitionSummary(path string) {
+	img, e := fat.OpenImage(path)
+	if e != nil {
+		fmt.Printf("Couldn't open %s to read its MBR: %s\n", path, e)
+		return
+	}
+	defer img.Close()
+	mbr, e := fat.ParseMBR(img)
+	if e != nil {
+		fmt.Printf("No MBR found in %s: %s\n", path, e)
+		return
+	}
+	fmt.Printf("MBR partitions in %s:\n", path)
+	for i := range mbr.Partitions {
+		p := &(mbr.Partitions[i])
+		if p.SectorCount == 0 {
+			fmt.Printf("  Partition %d: unused\n", i)
+			continue
+		}
+		fmt.Printf("  Partition %d (type 0x%02x): %s\n", i, p.PartitionType,
+			p)
+	}
+}
+
+// Copies src to dst, the new image file named in info, and saves the info as
+// JSON alongside it. The image is read back to check its hashes unless
+// skipVerify is set. Closes dst. If copying fails partway, the incomplete
+// image is kept, since the source may not be readable again, and the JSON
+// records that it's incomplete.
+func acquireImage(src *fat.TolerantImage, dst *os.File,
+	info *acquisitionInfo, skipVerify bool) error {
+	info.Size = src.Size()
+	fmt.Printf("Copying %d bytes from %s to %s.\n", info.Size, info.Source,
+		info.Image)
+	hashes := newImageHashes()
+	var e error
+	info.CopiedBytes, e = copyImage(src, dst, info.BlockSize, hashes)
+	if e == nil {
+		e = dst.Sync()
+	}
+	closeError := dst.Close()
+	if e == nil {
+		e = closeError
+	}
+	infoPath := info.Image + ".json"
+	if e != nil {
+		fmt.Printf("Failed copying %s: %s\n", info.Source, e)
+		// The hashes only cover the copied part.
+		info.Error = e.Error()
+		hashes.setHashes(info)
+		e = info.finish(src)
+		if e != nil {
+			fmt.Printf("%s\n", e)
+		}
+		e = info.save(infoPath)
+		if e != nil {
+			return fmt.Errorf("Failed saving image information: %w. The "+
+				"incomplete image was left in %s; delete it before trying "+
+				"again", e, info.Image)
+		}
+		return fmt.Errorf("The incomplete image, holding the first %d "+
+			"bytes, was left in %s and marked incomplete in %s. Move or "+
+			"delete it before trying again", info.CopiedBytes, info.Image,
+			infoPath)
+	}
+	info.Complete = true
+	hashes.setHashes(info)
+	e = info.finish(src)
+	if e != nil {
+		return e
+	}
+	fmt.Printf("MD5:     %s\nSHA-1:   %s\nSHA-256: %s\n", info.MD5, info.SHA1,
+		info.SHA256)
+	if info.BadBytes != 0 {
+		fmt.Printf("WARNING: %d bytes in %d ranges couldn't be read, and "+
+			"were filled. See %s.\n", info.BadBytes, len(info.BadRanges),
+			info.MapFile)
+	}
+
+	verifyError := error(nil)
+	if !skipVerify {
+		fmt.Printf("Verifying %s.\n", info.Image)
+		verifyError = verifyImage(info.Image, info)
+		info.Verified = verifyError == nil
+	}
+	e = info.save(infoPath)
+	if e != nil {
+		return fmt.Errorf("Failed saving image information: %w", e)
+	}
+	fmt.Printf("Saved image information to %s.\n", infoPath)
+	if verifyError != nil {
+		return fmt.Errorf("Verification failed: %w", verifyError)
+	}
+	if info.Verified {
+		fmt.Println("Verified the image's hashes OK.")
+	}
+	return nil
+}
+
+func run() int {
+	var sourcePath, imagePath string
+	var blockSize int
+	var skipVerify bool
+	flag.StringVar(&sourcePath, "source", "", "The path to the disk (e.g. "+
+		"/dev/sdb) or raw image to copy.")
+	flag.StringVar(&imagePath, "image", "", "The path of the image file to "+
+		"create. It must not already exist. The hashes and other "+
+		"information are saved to this path with a .json extension "+
+		"appended, and ranges that couldn't be read are logged to this "+
+		"path with a .map extension appended.")
+	flag.IntVar(&blockSize, "block_size", 1024*1024,
+		"The number of bytes to copy at a time. Must be a multiple of "+
+			"512.")
+	retryFlags := cmdflags.AddReadRetryFlags()
+	flag.BoolVar(&skipVerify, "skip_verify", false,
+		"If set, don't read back the image to check its hashes after "+
+			"copying it.")
+	flag.Parse()
+	if (sourcePath == "") || (imagePath == "") || (blockSize <= 0) ||
+		((blockSize % fat.SectorSize) != 0) || !retryFlags.Valid() {
+		fmt.Println("Invalid arguments. Run with -help for more information.")
+		return 1
+	}
+	fill, e := retryFlags.FillPattern()
+	if e != nil {
+		fmt.Printf("%s\n", e)
+		return 1
+	}
+	info := acquisitionInfo{
+		Source:    sourcePath,
+		Image:     imagePath,
+		BlockSize: blockSize,
+		MapFile:   imagePath + ".map",
+		StartTime: time.Now().Format(time.RFC3339),
+	}
+	// Don't overwrite an existing image; it may be the only copy of data
+	// from a disk that has since failed.
+	dst, e := os.OpenFile(imagePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if e != nil {
+		fmt.Printf("Failed creating %s: %s\n", imagePath, e)
+		return 1
+	}
+	src, e := fat.OpenTolerantImage(sourcePath, info.MapFile)
+	if e != nil {
+		fmt.Printf("Failed opening %s: %s\n", sourcePath, e)
+		dst.Close()
+		os.Remove(imagePath)
+		return 1
+	}
+	defer src.Close()
+	src.Retries = retryFlags.Retries()
+	src.FillPattern = fill
+	e = acquireImage(src, dst, &info, skipVerify)
+	if e != nil {
+		fmt.Printf("%s\n", e)
+		return 1
+	}
+	printPartitionSummary(imagePath)
+	return 0
+}
+
+func main() {
+	os.Exit(run())
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/yalue/fat"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A disk image in memory, where reads covering certain sectors always fail.
+type failingDisk struct {
+	*io.SectionReader
+	badSectors map[int64]bool
+}
+
+func newFailingDisk(data []byte, badSectors ...int64) *failingDisk {
+	toReturn := &failingDisk{
+		SectionReader: io.NewSectionReader(bytes.NewReader(data), 0,
+			int64(len(data))),
+		badSectors: make(map[int64]bool),
+	}
+	for _, sector := range badSectors {
+		toReturn.badSectors[sector] = true
+	}
+	return toReturn
+}
+
+func (d *failingDisk) ReadAt(dst []byte, offset int64) (int, error) {
+	end := offset + int64(len(dst))
+	for s := offset / fat.SectorSize; (s * fat.SectorSize) < end; s++ {
+		if d.badSectors[s] {
+			return 0, fmt.Errorf("Input/output error reading sector %d", s)
+		}
+	}
+	return d.SectionReader.ReadAt(dst, offset)
+}
+
+func (d *failingDisk) Close() error {
+	return nil
+}
+
+// Copies the disk to a new image in dir using acquireImage, returning the
+// info loaded from the sidecar JSON file and the error from acquireImage.
+// If dst is nil, a new image file is created.
+func testAcquireImage(t *testing.T, disk *failingDisk, dir string,
+	dst *os.File) (*acquisitionInfo, error) {
+	imagePath := filepath.Join(dir, "disk.img")
+	var e error
+	if dst == nil {
+		dst, e = os.Create(imagePath)
+		if e != nil {
+			t.Logf("Failed creating %s: %s\n", imagePath, e)
+			t.FailNow()
+		}
+	}
+	src, e := fat.NewTolerantImage(disk, fat.SectorSize)
+	if e != nil {
+		t.Logf("Failed creating tolerant image: %s\n", e)
+		t.FailNow()
+	}
+	defer src.Close()
+	src.Retries = 1
+	src.FillPattern = []byte("BAD!")
+	src.MapPath = imagePath + ".map"
+	info := acquisitionInfo{
+		Source:    "failing disk",
+		Image:     imagePath,
+		BlockSize: 4096,
+		MapFile:   src.MapPath,
+	}
+	acquireError := acquireImage(src, dst, &info, false)
+	content, e := os.ReadFile(imagePath + ".json")
+	if e != nil {
+		t.Logf("Failed reading the image information: %s\n", e)
+		t.FailNow()
+	}
+	var saved acquisitionInfo
+	e = json.Unmarshal(content, &saved)
+	if e != nil {
+		t.Logf("Failed parsing the image information: %s\n", e)
+		t.FailNow()
+	}
+	return &saved, acquireError
+}
+
+func TestAcquireImage(t *testing.T) {
+	data := make([]byte, 64*fat.SectorSize)
+	for i := range data {
+		data[i] = byte(i/fat.SectorSize) + 1
+	}
+	disk := newFailingDisk(data, 5, 6, 40)
+	dir := t.TempDir()
+	info, e := testAcquireImage(t, disk, dir, nil)
+	if e != nil {
+		t.Logf("Failed copying the image: %s\n", e)
+		t.FailNow()
+	}
+
+	// The unreadable sectors are filled, and the hashes must match the
+	// filled content.
+	expected := append([]byte{}, data...)
+	fill := bytes.Repeat([]byte("BAD!"), fat.SectorSize/4)
+	for _, sector := range []int{5, 6, 40} {
+		copy(expected[sector*fat.SectorSize:], fill)
+	}
+	image, e := os.ReadFile(info.Image)
+	if e != nil {
+		t.Logf("Failed reading the copied image: %s\n", e)
+		t.FailNow()
+	}
+	if !bytes.Equal(image, expected) {
+		t.Logf("The copied image doesn't contain the expected data\n")
+		t.Fail()
+	}
+	md5Sum := md5.Sum(expected)
+	sha1Sum := sha1.Sum(expected)
+	sha256Sum := sha256.Sum256(expected)
+	if (info.MD5 != hex.EncodeToString(md5Sum[:])) ||
+		(info.SHA1 != hex.EncodeToString(sha1Sum[:])) ||
+		(info.SHA256 != hex.EncodeToString(sha256Sum[:])) {
+		t.Logf("Incorrect hashes in the image information: %+v\n", info)
+		t.Fail()
+	}
+	expectedRanges := []badRangeJSON{
+		{Offset: 5 * fat.SectorSize, Size: 2 * fat.SectorSize},
+		{Offset: 40 * fat.SectorSize, Size: fat.SectorSize},
+	}
+	if (info.BadBytes != 3*fat.SectorSize) ||
+		(fmt.Sprint(info.BadRanges) != fmt.Sprint(expectedRanges)) {
+		t.Logf("Expected bad ranges %v, got %d bytes in %v\n",
+			expectedRanges, info.BadBytes, info.BadRanges)
+		t.Fail()
+	}
+	if !info.Complete || !info.Verified ||
+		(info.CopiedBytes != int64(len(data))) ||
+		(info.Size != int64(len(data))) {
+		t.Logf("Incorrect image information: %+v\n", info)
+		t.Fail()
+	}
+	m, e := fat.LoadRescueMap(info.MapFile)
+	if e != nil {
+		t.Logf("Failed loading the saved mapfile: %s\n", e)
+		t.FailNow()
+	}
+	if len(m.UnreadableRanges(0, int64(len(data)))) != 2 {
+		t.Logf("Incorrect unreadable ranges in the mapfile: %v\n",
+			m.UnreadableRanges(0, int64(len(data))))
+		t.Fail()
+	}
+
+	// If the image can't be written, the information must record that it's
+	// incomplete.
+	dir = t.TempDir()
+	dst, e := os.Create(filepath.Join(dir, "disk.img"))
+	if e != nil {
+		t.Logf("Failed creating image file: %s\n", e)
+		t.FailNow()
+	}
+	dst.Close()
+	info, e = testAcquireImage(t, newFailingDisk(data, 5), dir, dst)
+	if e == nil {
+		t.Logf("Didn't get an error writing to a closed image file\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error writing to a closed image file: %s\n", e)
+	if info.Complete || info.Verified || (info.CopiedBytes != 0) ||
+		(info.Error == "") {
+		t.Logf("The image wasn't marked incomplete: %+v\n", info)
+		t.Fail()
+	}
+}
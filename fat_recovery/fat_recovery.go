@@ -9,6 +9,7 @@ import (
 	"flag"
 	"fmt"
 	"github.com/yalue/fat"
+	"github.com/yalue/fat/internal/cmdflags"
 	"io"
 	"os"
 	"runtime"
@@ -29,6 +30,13 @@ func dumpChainContent(f *fat.FAT32Filesystem, outputDir string,
 		if e != nil {
 			return fmt.Errorf("Error reading chain %d content: %w", i, e)
 		}
+		// Reading the chain may have found new bad sectors if the image
+		// tolerates read errors, so check again.
+		unreadable := f.UnreadableClusters(c.Extents)
+		if len(unreadable) != 0 {
+			fmt.Printf("WARNING: Chain %d contains %d unreadable clusters, "+
+				"which will be filled.\n", i, len(unreadable))
+		}
 		contentSize := uint32(len(content))
 		extension := "bin"
 		if bytes.HasPrefix(content, aviHeader1) && bytes.HasPrefix(content[8:],
@@ -59,26 +67,257 @@ func dumpChainContent(f *fat.FAT32Filesystem, outputDir string,
 	return nil
 }
 
+// Opens the image at the given path, along with its ddrescue mapfile if
+// mapPath isn't empty.
+func openImage(imagePath, mapPath string,
+	options *fat.ImageOptions) (fat.Image, error) {
+	if mapPath == "" {
+		return fat.OpenImageWithOptions(imagePath, options)
+	}
+	img, e := fat.OpenRescuedImage(imagePath, mapPath)
+	if e != nil {
+		return nil, e
+	}
+	// Unreadable regions are reported separately, so don't stop on them.
+	img.AllowUnreadable = true
+	fmt.Printf("%d bytes of the image weren't read successfully by "+
+		"ddrescue.\n", img.Size()-img.Map.StatusSize(fat.RescueFinished))
+	return img, nil
+}
+
+// Prints the chains containing clusters that couldn't be read when the image
+// was acquired.
+func printUnreadableChains(chains []fat.FATChain) {
+	count := 0
+	for i := range chains {
+		c := &(chains[i])
+		if len(c.UnreadableClusters) == 0 {
+			continue
+		}
+		count++
+		fmt.Printf("  Chain %d, starting at cluster %d, has %d unreadable "+
+			"clusters, starting with cluster %d.\n", i, c.StartCluster,
+			len(c.UnreadableClusters), c.UnreadableClusters[0])
+	}
+	fmt.Printf("%d chains contain unreadable clusters.\n", count)
+}
+
+// Replaces the FAT in the given filesystem with one reconstructed from
+// directory entries found by scanning the data region.
+func reconstructFAT(f *fat.FAT32Filesystem, includeDeleted bool) error {
+	fmt.Printf("Scanning %d clusters for directory entries.\n",
+		f.ClusterCount())
+	entries, e := f.ScanForDirectoryEntries()
+	if e != nil {
+		return fmt.Errorf("Error scanning for directory entries: %w", e)
+	}
+	fmt.Printf("Found %d directory entries.\n", len(entries))
+	r, e := f.ReconstructFAT(entries, includeDeleted)
+	if e != nil {
+		return fmt.Errorf("Error rebuilding FAT: %w", e)
+	}
+	fmt.Printf("%s\n", r.FormatHumanReadable())
+	f.FAT = r.FAT
+	return nil
+}
+
+// Writes the content of the given RegionReader to a new file at the given
+// path, along with a "<path>.map" file listing the offset in the new file at
+// which each region starts, and the cluster it came from.
+func saveRegions(r *fat.RegionReader, path string) error {
+	f, e := os.Create(path)
+	if e != nil {
+		return fmt.Errorf("Error creating %s: %w", path, e)
+	}
+	defer f.Close()
+	_, e = io.Copy(f, r)
+	if e != nil {
+		return fmt.Errorf("Error writing %s: %w", path, e)
+	}
+	mapPath := path + ".map"
+	mapFile, e := os.Create(mapPath)
+	if e != nil {
+		return fmt.Errorf("Error creating %s: %w", mapPath, e)
+	}
+	defer mapFile.Close()
+	regions := r.Regions()
+	offset := int64(0)
+	for i := range regions {
+		region := &(regions[i])
+		_, e = fmt.Fprintf(mapFile, "%d %d %d %s\n", offset, region.Size,
+			region.Cluster, region.Path)
+		if e != nil {
+			return fmt.Errorf("Error writing %s: %w", mapPath, e)
+		}
+		offset += region.Size
+	}
+	fmt.Printf("Saved %d bytes from %d regions to %s.\n", r.Size(),
+		len(regions), path)
+	return nil
+}
+
+// Writes the allocation map of the filesystem to a PNG image and/or a JSON
+// file, if the corresponding paths are non-empty.
+func saveAllocationMap(f *fat.FAT32Filesystem, pngPath,
+	jsonPath string) error {
+	m, e := f.GetAllocationMap()
+	if e != nil {
+		return fmt.Errorf("Error building allocation map: %w", e)
+	}
+	counts := m.Counts()
+	fmt.Printf("Cluster allocation map:\n")
+	for s := fat.ClusterFree; s <= fat.ClusterCrossLinked; s++ {
+		fmt.Printf("  %s: %d\n", s, counts[s])
+	}
+	if pngPath != "" {
+		// Keep the image a manageable size for large volumes.
+		clustersPerPixel := (len(m.States) / (1024 * 1024)) + 1
+		output, e := os.Create(pngPath)
+		if e != nil {
+			return fmt.Errorf("Error creating %s: %w", pngPath, e)
+		}
+		e = m.WritePNG(output, 1024, clustersPerPixel)
+		output.Close()
+		if e != nil {
+			return fmt.Errorf("Error writing %s: %w", pngPath, e)
+		}
+		fmt.Printf("Saved allocation map image to %s, %d clusters per "+
+			"pixel.\n", pngPath, clustersPerPixel)
+	}
+	if jsonPath != "" {
+		output, e := os.Create(jsonPath)
+		if e != nil {
+			return fmt.Errorf("Error creating %s: %w", jsonPath, e)
+		}
+		e = m.WriteJSON(output)
+		output.Close()
+		if e != nil {
+			return fmt.Errorf("Error writing %s: %w", jsonPath, e)
+		}
+		fmt.Printf("Saved allocation map JSON to %s.\n", jsonPath)
+	}
+	return nil
+}
+
+// Checks the filesystem in the given partition of the image, printing each
+// problem found. If outputPath is non-empty, a copy of the entire image with
+// the problems repaired is written there. The image itself is never modified.
+func checkFilesystem(image io.ReadSeeker, mbr *fat.MBR, partitionIndex int,
+	outputPath string) error {
+	overlay, e := fat.NewOverlay(image)
+	if e != nil {
+		return fmt.Errorf("Error creating overlay: %w", e)
+	}
+	partition, e := fat.GetPartition(overlay, mbr, partitionIndex)
+	if e != nil {
+		return fmt.Errorf("Error getting partition: %w", e)
+	}
+	fmt.Printf("Checking filesystem consistency:\n")
+	actions, e := fat.Repair(partition, &fat.RepairOptions{
+		DryRun: outputPath == "",
+		OnAction: func(a *fat.RepairAction) {
+			fmt.Printf("  %s\n", a)
+		},
+	})
+	if e != nil {
+		return e
+	}
+	fmt.Printf("%d repair actions were needed.\n", len(actions))
+	if outputPath == "" {
+		return nil
+	}
+	e = overlay.CommitToFile(outputPath)
+	if e != nil {
+		return fmt.Errorf("Error saving repaired image: %w", e)
+	}
+	fmt.Printf("Saved repaired image to %s.\n", outputPath)
+	return nil
+}
+
 func run() int {
 	var imagePath string
 	var partitionIndex int
 	var outputDir string
-	flag.StringVar(&imagePath, "image", "", "The path to the disk image.")
+	flag.StringVar(&imagePath, "image", "", "The path to the disk image. "+
+		"For split images, give the path to any numbered segment, e.g. "+
+		"disk.001 or disk.E01. gzip, xz or zstd-compressed images, and VHD, "+
+		"VHDX and QCOW2 virtual disks, are also supported.")
 	flag.IntVar(&partitionIndex, "partition_index", 0,
 		"The index of the partition containing the FAT32 filesystem.")
+	var rebuildFAT, includeDeleted bool
+	var unallocatedPath, slackPath string
+	var mapImagePath, mapJSONPath string
+	var check bool
+	var repairedPath string
+	var mapPath string
+	var verify bool
 	flag.StringVar(&outputDir, "output_directory", "",
 		"Dump chain content into this directory, if specified.")
+	flag.BoolVar(&rebuildFAT, "reconstruct_fat", false,
+		"Ignore the FAT on the image, and instead rebuild it from directory "+
+			"entries found by scanning every cluster. Useful if the FAT "+
+			"was zeroed by a quick format.")
+	flag.BoolVar(&includeDeleted, "include_deleted", false,
+		"If set along with -reconstruct_fat, also rebuild chains for "+
+			"deleted directory entries.")
+	flag.StringVar(&unallocatedPath, "unallocated_file", "",
+		"If set, write the content of all free clusters to this file, "+
+			"which can then be scanned using raw_recovery.")
+	flag.StringVar(&slackPath, "slack_file", "",
+		"If set, write the slack space at the end of each file's last "+
+			"cluster to this file.")
+	flag.StringVar(&mapImagePath, "allocation_map_png", "",
+		"If set, save a PNG image showing the state of every cluster to "+
+			"this path.")
+	flag.StringVar(&mapJSONPath, "allocation_map_json", "",
+		"If set, save a run-length encoded JSON map of the state of every "+
+			"cluster to this path.")
+	flag.BoolVar(&check, "check", false,
+		"Check the filesystem for problems, and list the repairs that "+
+			"would fix them.")
+	flag.StringVar(&repairedPath, "repaired_image", "",
+		"If set, repair any problems in the filesystem and save a copy of "+
+			"the whole image, including the repairs, to this path. The "+
+			"original image isn't modified.")
+	flag.StringVar(&mapPath, "mapfile", "",
+		"The path to the GNU ddrescue mapfile for the image, if it was "+
+			"created by ddrescue. Chains containing clusters that weren't "+
+			"read successfully will be reported.")
+	tolerantFlags := cmdflags.AddTolerantImageFlags()
+	imageOptions := cmdflags.AddImageOptionFlags()
+	flag.BoolVar(&verify, "verify", false,
+		"If set, check the image's content against the MD5 and SHA1 "+
+			"hashes stored in it when it was acquired before continuing. "+
+			"Only EWF (E01 or Ex01) images store hashes.")
 	flag.Parse()
-	if imagePath == "" {
+	if (imagePath == "") || !tolerantFlags.Valid() ||
+		(tolerantFlags.Enabled() && (mapPath != "")) {
 		fmt.Println("Invalid arguments. Run with -help for more information.")
 		return 1
 	}
-	imageFile, e := os.Open(imagePath)
+	var imageFile fat.Image
+	var tolerant *fat.TolerantImage
+	var e error
+	if tolerantFlags.Enabled() {
+		tolerant, e = tolerantFlags.Open(imagePath)
+		imageFile = tolerant
+	} else {
+		imageFile, e = openImage(imagePath, mapPath, imageOptions)
+	}
 	if e != nil {
 		fmt.Printf("Failed opening %s: %s\n", imagePath, e)
 		return 1
 	}
 	defer imageFile.Close()
+	if verify {
+		fmt.Printf("Verifying the hashes stored in %s.\n", imagePath)
+		e = fat.VerifyImage(imageFile)
+		if e != nil {
+			fmt.Printf("Failed verifying %s: %s\n", imagePath, e)
+			return 1
+		}
+		fmt.Printf("The image's content matches its stored hashes.\n")
+	}
 	mbr, e := fat.ParseMBR(imageFile)
 	if e != nil {
 		fmt.Printf("Failed parsing MBR in %s: %s\n", imagePath, e)
@@ -110,6 +349,55 @@ func run() int {
 		fmt.Printf("  %d: 0x%08x\n", i, fatFS.FAT[i])
 	}
 
+	if check || (repairedPath != "") {
+		e = checkFilesystem(imageFile, mbr, partitionIndex, repairedPath)
+		if e != nil {
+			fmt.Printf("Error checking filesystem: %s\n", e)
+			return 1
+		}
+	}
+
+	if rebuildFAT {
+		e = reconstructFAT(fatFS, includeDeleted)
+		if e != nil {
+			fmt.Printf("Error reconstructing FAT: %s\n", e)
+			return 1
+		}
+	}
+
+	if unallocatedPath != "" {
+		e = saveRegions(fatFS.GetUnallocatedReader(), unallocatedPath)
+		if e != nil {
+			fmt.Printf("Error saving unallocated space: %s\n", e)
+			return 1
+		}
+	}
+	if slackPath != "" {
+		slack, e := fatFS.GetSlackReader()
+		if e == nil {
+			e = saveRegions(slack, slackPath)
+		}
+		if e != nil {
+			fmt.Printf("Error saving file slack: %s\n", e)
+			return 1
+		}
+	}
+
+	stats, e := fatFS.Stats()
+	if e != nil {
+		fmt.Printf("Error computing FAT statistics: %s\n", e)
+		return 1
+	}
+	fmt.Printf("%s\n", stats.FormatHumanReadable())
+
+	if (mapImagePath != "") || (mapJSONPath != "") {
+		e = saveAllocationMap(fatFS, mapImagePath, mapJSONPath)
+		if e != nil {
+			fmt.Printf("Error saving allocation map: %s\n", e)
+			return 1
+		}
+	}
+
 	// Get chain info and save their content if requested.
 	chains, e := fatFS.GetAllChains()
 	if e != nil {
@@ -124,6 +412,11 @@ func run() int {
 	}
 	fmt.Printf("Found %d chains in the FAT, %d were on contiguous clusters.\n",
 		len(chains), contiguousCount)
+	fmt.Printf("%s\n", fat.GetFragmentationHistogram(chains).
+		FormatHumanReadable())
+	if (mapPath != "") || tolerantFlags.Enabled() {
+		printUnreadableChains(chains)
+	}
 	if outputDir != "" {
 		e = dumpChainContent(fatFS, outputDir, chains)
 		if e != nil {
@@ -135,6 +428,10 @@ func run() int {
 		fmt.Println("No output directory specified. Not dumping chain content")
 	}
 
+	if tolerant != nil {
+		fmt.Printf("%d bytes couldn't be read and were filled.\n",
+			tolerant.BadBytes())
+	}
 	return 0
 }
 
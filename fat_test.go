@@ -0,0 +1,168 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// Parameters of the small FAT32 images generated for testing.
+const (
+	testSectorCount     = 4096
+	testReservedSectors = 32
+	testSectorsPerFAT   = 32
+	testRootCluster     = 2
+)
+
+// Used to build tiny FAT32 images in memory for tests.
+type testImage struct {
+	data []byte
+}
+
+// Returns a new empty 2 MB FAT32 image with one sector per cluster, two FATs
+// and the root directory at cluster 2.
+func newTestImage() *testImage {
+	var header FAT32Header
+	header.BPB.JumpInstruction = [3]byte{0xeb, 0x58, 0x90}
+	copy(header.BPB.OEMID[:], "TESTFAT ")
+	header.BPB.BytesPerSector = SectorSize
+	header.BPB.SectorsPerCluster = 1
+	header.BPB.ReservedSectorCount = testReservedSectors
+	header.BPB.FATCount = 2
+	header.BPB.MediaDescriptorType = 0xf8
+	header.BPB.LargeSectorCount = testSectorCount
+	header.EBR.SectorsPerFAT = testSectorsPerFAT
+	header.EBR.RootDirClusterNumber = testRootCluster
+	header.EBR.FSInfoSector = 1
+	header.EBR.BackupBootSector = 6
+	header.EBR.Signature = 0x29
+	copy(header.EBR.VolumeLabel[:], "TEST       ")
+	copy(header.EBR.SystemID[:], "FAT32   ")
+	header.EBR.BootSignature = 0xaa55
+	info := FSInfo{
+		Signature1:                0x41615252,
+		Signature2:                0x61417272,
+		LastKnownFreeCluster:      0xffffffff,
+		FirstAvailableClusterHint: 0xffffffff,
+		Signature3:                0xaa550000,
+	}
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, &header)
+	binary.Write(&buffer, binary.LittleEndian, &info)
+	toReturn := &testImage{
+		data: make([]byte, testSectorCount*SectorSize),
+	}
+	copy(toReturn.data, buffer.Bytes())
+	toReturn.setFAT(0, 0x0ffffff8)
+	toReturn.setFAT(1, 0x0fffffff)
+	toReturn.setFAT(testRootCluster, 0x0fffffff)
+	return toReturn
+}
+
+// Sets the given entry in every copy of the FAT.
+func (m *testImage) setFAT(cluster, value uint32) {
+	for i := 0; i < 2; i++ {
+		offset := (testReservedSectors + (i * testSectorsPerFAT)) * SectorSize
+		offset += int(cluster) * 4
+		binary.LittleEndian.PutUint32(m.data[offset:], value)
+	}
+}
+
+// Returns the slice of the image holding the given cluster.
+func (m *testImage) cluster(c uint32) []byte {
+	start := (testReservedSectors + (2 * testSectorsPerFAT) +
+		int(c) - 2) * SectorSize
+	return m.data[start : start+SectorSize]
+}
+
+// Writes a directory entry at the given index in a directory cluster.
+func (m *testImage) setEntry(dirCluster uint32, index int,
+	entry *DirectoryEntry) {
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, entry)
+	copy(m.cluster(dirCluster)[index*DirectoryEntrySize:], buffer.Bytes())
+}
+
+// Adds a file to the image, stored in the given list of clusters, with a
+// directory entry at the given index of the given directory cluster. Each
+// cluster is filled with the byte at the corresponding position in the list.
+func (m *testImage) addFile(dirCluster uint32, index int, name string,
+	size uint32, clusters []uint32) *DirectoryEntry {
+	var entry DirectoryEntry
+	copy(entry.Name[:], "        ")
+	copy(entry.Extension[:], "   ")
+	copy(entry.Name[:], name)
+	entry.Attributes = AttributeArchive
+	entry.FileSize = size
+	if len(clusters) != 0 {
+		entry.ClusterHigh = uint16(clusters[0] >> 16)
+		entry.ClusterLow = uint16(clusters[0])
+	}
+	for i, c := range clusters {
+		if i == (len(clusters) - 1) {
+			m.setFAT(c, 0x0fffffff)
+		} else {
+			m.setFAT(c, clusters[i+1])
+		}
+		content := m.cluster(c)
+		for j := range content {
+			content[j] = byte(i + 1)
+		}
+	}
+	m.setEntry(dirCluster, index, &entry)
+	return &entry
+}
+
+// Parses the image as a FAT32 filesystem.
+func (m *testImage) open(t *testing.T) *FAT32Filesystem {
+	f, e := NewFAT32Filesystem(bytes.NewReader(m.data))
+	if e != nil {
+		t.Logf("Failed loading test image: %s\n", e)
+		t.FailNow()
+	}
+	return f
+}
+
+func TestGetAllChains(t *testing.T) {
+	m := newTestImage()
+	m.addFile(testRootCluster, 0, "A", 1000, []uint32{3, 4})
+	m.addFile(testRootCluster, 1, "B", 1500, []uint32{10, 5, 6})
+	f := m.open(t)
+	if f.ClusterCount() != 4002 {
+		t.Logf("Expected 4002 clusters, got %d\n", f.ClusterCount())
+		t.FailNow()
+	}
+	chains, e := f.GetAllChains()
+	if e != nil {
+		t.Logf("Failed getting chains: %s\n", e)
+		t.FailNow()
+	}
+	// Includes the root directory's chain.
+	if len(chains) != 3 {
+		t.Logf("Expected 3 chains, got %d\n", len(chains))
+		t.FailNow()
+	}
+	chain := &(chains[2])
+	if (chain.StartCluster != 10) || chain.Contiguous ||
+		(chain.Size != 3*SectorSize) {
+		t.Logf("Got incorrect chain for file B: %+v\n", *chain)
+		t.FailNow()
+	}
+	reader, e := f.GetChainReader(chain)
+	if e != nil {
+		t.Logf("Failed getting chain reader: %s\n", e)
+		t.FailNow()
+	}
+	content := make([]byte, chain.Size)
+	_, e = reader.Read(content)
+	if e != nil {
+		t.Logf("Failed reading chain content: %s\n", e)
+		t.FailNow()
+	}
+	for i := 0; i < 3; i++ {
+		if content[i*SectorSize] != byte(i+1) {
+			t.Logf("Read incorrect content from cluster %d in chain\n", i)
+			t.FailNow()
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package fat
+
+// This file contains a function for creating a new, empty, FAT32 filesystem,
+// i.e. the equivalent of mkfs.fat or the Windows "format" command.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Options for the Format function. The zero value of each field selects a
+// default.
+type FormatOptions struct {
+	// The volume label, up to 11 characters. Defaults to "NO NAME".
+	VolumeLabel string
+	// The volume serial number. Defaults to a value based on the current
+	// time.
+	VolumeID uint32
+	// The OEM name stored in the boot sector, up to 8 characters. Defaults to
+	// "MSWIN4.1", which is the most compatible value.
+	OEMID string
+	// The number of sectors per cluster; must be a power of two between 1
+	// and 128, and small enough for the volume to have at least 65525
+	// clusters. By default, this is chosen based on the size of the volume,
+	// following Microsoft's guidelines.
+	SectorsPerCluster uint8
+	// The number of sectors preceding the volume on the disk, i.e. the
+	// starting LBA of the partition containing it. Defaults to 0.
+	HiddenSectors uint32
+}
+
+// The number of reserved sectors at the start of volumes we create, which is
+// what Windows uses for FAT32.
+const formatReservedSectors = 32
+
+// The minimum number of clusters in a FAT32 volume. Drivers decide whether a
+// volume is FAT12, FAT16 or FAT32 from its cluster count alone, so a volume
+// with fewer clusters would be read as FAT16.
+const fat32MinClusters = 65525
+
+// The location of the FSInfo sector and backup boot sector in volumes we
+// create.
+const (
+	formatFSInfoSector     = 1
+	formatBackupBootSector = 6
+)
+
+// Returns the number of sectors per cluster recommended by Microsoft for a
+// FAT32 volume with the given number of 512-byte sectors. Returns an error if
+// the volume is too small to be formatted as FAT32.
+func defaultSectorsPerCluster(sectorCount uint64) (uint8, error) {
+	switch {
+	case sectorCount <= 66600:
+		return 0, fmt.Errorf("Volumes of %d sectors are too small for "+
+			"FAT32, which needs at least %d clusters", sectorCount,
+			fat32MinClusters)
+	case sectorCount <= 532480:
+		return 1, nil
+	case sectorCount <= 16777216:
+		return 8, nil
+	case sectorCount <= 33554432:
+		return 16, nil
+	case sectorCount <= 67108864:
+		return 32, nil
+	}
+	return 64, nil
+}
+
+// Returns the number of sectors needed for each copy of the FAT, using the
+// computation from Microsoft's FAT specification. Also returns the resulting
+// number of clusters in the data region.
+func formatFATSize(sectorCount uint32, sectorsPerCluster uint8,
+	fatCount uint32) (uint32, uint32) {
+	available := sectorCount - formatReservedSectors
+	divisor := ((256 * uint32(sectorsPerCluster)) + fatCount) / 2
+	fatSize := (available + divisor - 1) / divisor
+	// The specification's computation may slightly overestimate the size,
+	// but make sure it's never too small.
+	for {
+		dataSectors := available - (fatCount * fatSize)
+		clusterCount := dataSectors / uint32(sectorsPerCluster)
+		if ((clusterCount + 2) * 4) <= (fatSize * SectorSize) {
+			return fatSize, clusterCount
+		}
+		fatSize++
+	}
+}
+
+// Converts a volume label to the 11-byte format used on disk.
+func formatVolumeLabel(label string) ([11]byte, error) {
+	var toReturn [11]byte
+	copy(toReturn[:], "           ")
+	if label == "" {
+		copy(toReturn[:], "NO NAME")
+		return toReturn, nil
+	}
+	label = strings.ToUpper(label)
+	if len(label) > len(toReturn) {
+		return toReturn, fmt.Errorf("Volume label \"%s\" is longer than 11 "+
+			"characters", label)
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if (c != ' ') && ((c > 0x7e) || !isValidShortNameChar(c)) {
+			return toReturn, fmt.Errorf("Invalid character in volume label: "+
+				"'%c'", c)
+		}
+	}
+	copy(toReturn[:], label)
+	return toReturn, nil
+}
+
+// Writes the given number of zero bytes at the given offset.
+func writeZeros(w io.WriteSeeker, offset, size int64) error {
+	_, e := w.Seek(offset, io.SeekStart)
+	if e != nil {
+		return fmt.Errorf("Error seeking to offset %d: %w", offset, e)
+	}
+	zeros := make([]byte, 64*1024)
+	for size > 0 {
+		chunk := zeros
+		if size < int64(len(chunk)) {
+			chunk = chunk[:size]
+		}
+		_, e = w.Write(chunk)
+		if e != nil {
+			return fmt.Errorf("Error writing zeros: %w", e)
+		}
+		size -= int64(len(chunk))
+	}
+	return nil
+}
+
+// Writes the binary representation of each of the given values at the given
+// offset, one after another.
+func writeStructs(w io.WriteSeeker, offset int64,
+	values ...interface{}) error {
+	var buffer bytes.Buffer
+	for _, v := range values {
+		binary.Write(&buffer, binary.LittleEndian, v)
+	}
+	_, e := w.Seek(offset, io.SeekStart)
+	if e != nil {
+		return fmt.Errorf("Error seeking to offset %d: %w", offset, e)
+	}
+	_, e = w.Write(buffer.Bytes())
+	if e != nil {
+		return fmt.Errorf("Error writing at offset %d: %w", offset, e)
+	}
+	return nil
+}
+
+// Creates a new, empty, FAT32 filesystem of the given size in bytes, starting
+// at offset 0 of the given content. This writes the boot sector and its
+// backup, the FSInfo structure, zeroed copies of the FAT and an empty root
+// directory; the rest of the data region is not modified. If the content is
+// shorter than the given size (e.g. a new image file), it is extended. The
+// options may be nil to use the defaults.
+func Format(content io.WriteSeeker, size int64,
+	options *FormatOptions) error {
+	if options == nil {
+		options = &FormatOptions{}
+	}
+	sectorCount64 := uint64(size) / SectorSize
+	if (size <= 0) || (sectorCount64 > 0xffffffff) {
+		return fmt.Errorf("Invalid FAT32 volume size: %d bytes", size)
+	}
+	sectorCount := uint32(sectorCount64)
+	sectorsPerCluster := options.SectorsPerCluster
+	if sectorsPerCluster == 0 {
+		var e error
+		sectorsPerCluster, e = defaultSectorsPerCluster(sectorCount64)
+		if e != nil {
+			return e
+		}
+	}
+	if (sectorsPerCluster & (sectorsPerCluster - 1)) != 0 {
+		return fmt.Errorf("Sectors per cluster must be a power of two, got "+
+			"%d", sectorsPerCluster)
+	}
+	if sectorCount <= (formatReservedSectors + 2*uint32(sectorsPerCluster)) {
+		return fmt.Errorf("Volume of %d sectors is too small", sectorCount)
+	}
+	fatCount := uint32(2)
+	fatSize, clusterCount := formatFATSize(sectorCount, sectorsPerCluster,
+		fatCount)
+	if clusterCount < fat32MinClusters {
+		return fmt.Errorf("Volume of %d sectors would only have %d "+
+			"clusters, but FAT32 needs at least %d; use a smaller cluster "+
+			"size or a larger volume", sectorCount, clusterCount,
+			fat32MinClusters)
+	}
+	if clusterCount > 0x0ffffff5 {
+		return fmt.Errorf("Volume has too many clusters (%d); use a larger "+
+			"cluster size", clusterCount)
+	}
+	label, e := formatVolumeLabel(options.VolumeLabel)
+	if e != nil {
+		return e
+	}
+	oemID := options.OEMID
+	if oemID == "" {
+		oemID = "MSWIN4.1"
+	}
+	if len(oemID) > 8 {
+		return fmt.Errorf("OEM ID \"%s\" is longer than 8 characters", oemID)
+	}
+	volumeID := options.VolumeID
+	if volumeID == 0 {
+		volumeID = uint32(time.Now().UnixNano())
+	}
+
+	// Build the boot sector.
+	var header FAT32Header
+	bpb := &(header.BPB)
+	bpb.JumpInstruction = [3]byte{0xeb, 0x58, 0x90}
+	copy(bpb.OEMID[:], "        ")
+	copy(bpb.OEMID[:], oemID)
+	bpb.BytesPerSector = SectorSize
+	bpb.SectorsPerCluster = sectorsPerCluster
+	bpb.ReservedSectorCount = formatReservedSectors
+	bpb.FATCount = uint8(fatCount)
+	bpb.MediaDescriptorType = 0xf8
+	bpb.SectorsPerTrack = 63
+	bpb.MediaHeadCount = 255
+	bpb.HiddenSectorCount = options.HiddenSectors
+	bpb.LargeSectorCount = sectorCount
+	ebr := &(header.EBR)
+	ebr.SectorsPerFAT = fatSize
+	ebr.RootDirClusterNumber = 2
+	ebr.FSInfoSector = formatFSInfoSector
+	ebr.BackupBootSector = formatBackupBootSector
+	ebr.DriveNumber = 0x80
+	ebr.Signature = 0x29
+	ebr.VolumeID = volumeID
+	ebr.VolumeLabel = label
+	copy(ebr.SystemID[:], "FAT32   ")
+	// The volume isn't bootable, so the boot code just halts: cli, hlt, and
+	// jump back to the hlt.
+	copy(ebr.BootCode[:], []byte{0xfa, 0xf4, 0xeb, 0xfd})
+	ebr.BootSignature = 0xaa55
+
+	// The root directory occupies the first cluster.
+	info := FSInfo{
+		Signature1:                0x41615252,
+		Signature2:                0x61417272,
+		LastKnownFreeCluster:      clusterCount - 1,
+		FirstAvailableClusterHint: 3,
+		Signature3:                0xaa550000,
+	}
+
+	// Clear the reserved sectors, FATs and root directory, then fill them in.
+	dataStart := int64(formatReservedSectors+(fatCount*fatSize)) * SectorSize
+	clusterSize := int64(sectorsPerCluster) * SectorSize
+	e = writeZeros(content, 0, dataStart+clusterSize)
+	if e != nil {
+		return fmt.Errorf("Error clearing filesystem metadata: %w", e)
+	}
+	for _, sector := range []int64{0, formatBackupBootSector} {
+		e = writeStructs(content, sector*SectorSize, &header, &info)
+		if e != nil {
+			return fmt.Errorf("Error writing boot sector: %w", e)
+		}
+	}
+	firstEntries := []uint32{0x0fffff00 | uint32(bpb.MediaDescriptorType),
+		endOfChainMarker, endOfChainMarker}
+	for i := uint32(0); i < fatCount; i++ {
+		offset := int64(formatReservedSectors+(i*fatSize)) * SectorSize
+		e = writeStructs(content, offset, firstEntries)
+		if e != nil {
+			return fmt.Errorf("Error writing FAT %d: %w", i, e)
+		}
+	}
+	if options.VolumeLabel != "" {
+		entry := DirectoryEntry{
+			Attributes: AttributeVolumeID,
+		}
+		copy(entry.Name[:], label[0:8])
+		copy(entry.Extension[:], label[8:11])
+		entry.ModifyDate, entry.ModifyTime = fatTimestamp(time.Now())
+		e = writeStructs(content, dataStart, &entry)
+		if e != nil {
+			return fmt.Errorf("Error writing volume label entry: %w", e)
+		}
+	}
+
+	// Make sure the content is large enough to hold the whole volume by
+	// writing its last byte. Keep the byte's value if it can be read, since
+	// the data region isn't supposed to be modified. (We can't just compare
+	// the content's size, since a LimitedReadSeeker always reports its
+	// limit.)
+	volumeEnd := int64(sectorCount) * SectorSize
+	last := []byte{0}
+	reader, ok := content.(io.ReadSeeker)
+	if ok {
+		_, e = reader.Seek(volumeEnd-1, io.SeekStart)
+		if e == nil {
+			_, e = io.ReadFull(reader, last)
+		}
+		if e != nil {
+			last[0] = 0
+		}
+	}
+	e = writeStructs(content, volumeEnd-1, last)
+	if e != nil {
+		return fmt.Errorf("Error extending content: %w", e)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package fat
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The number of sectors in a volume that's only a little larger than the
+// smallest possible FAT32 volume using 1-sector clusters.
+const testSmallVolumeSectors = 67584
+
+func TestDefaultSectorsPerCluster(t *testing.T) {
+	_, e := defaultSectorsPerCluster(4096)
+	if e == nil {
+		t.Logf("Didn't get expected error for a tiny volume\n")
+		t.Fail()
+	}
+	sizes := []uint64{100000, 1000000, 20000000, 40000000, 100000000}
+	expected := []uint8{1, 8, 16, 32, 64}
+	for i, size := range sizes {
+		spc, e := defaultSectorsPerCluster(size)
+		if e != nil {
+			t.Logf("Failed getting cluster size for %d sectors: %s\n", size, e)
+			t.FailNow()
+		}
+		if spc != expected[i] {
+			t.Logf("Expected %d sectors per cluster for %d sectors, got %d\n",
+				expected[i], size, spc)
+			t.Fail()
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "format.img")
+	file, e := os.Create(path)
+	if e != nil {
+		t.Logf("Failed creating image: %s\n", e)
+		t.FailNow()
+	}
+	defer file.Close()
+	// This uses the default cluster size, so the volume must be larger than
+	// 32 MB. The file is sparse, so this doesn't use much space.
+	size := int64(300 * 1024 * 1024)
+	e = Format(file, size, &FormatOptions{
+		VolumeLabel: "Test Vol",
+		VolumeID:    0x12345678,
+	})
+	if e != nil {
+		t.Logf("Failed formatting image: %s\n", e)
+		t.FailNow()
+	}
+	info, e := file.Stat()
+	if e != nil {
+		t.Logf("Failed getting image size: %s\n", e)
+		t.FailNow()
+	}
+	if info.Size() != size {
+		t.Logf("Expected a %d-byte image, got %d bytes\n", size, info.Size())
+		t.Fail()
+	}
+
+	f, e := NewFAT32Filesystem(file)
+	if e != nil {
+		t.Logf("Failed opening formatted image: %s\n", e)
+		t.FailNow()
+	}
+	if f.Header.BPB.SectorsPerCluster != 8 {
+		t.Logf("Expected 8 sectors per cluster, got %d\n",
+			f.Header.BPB.SectorsPerCluster)
+		t.Fail()
+	}
+	ebr := &(f.Header.EBR)
+	if (ebr.VolumeID != 0x12345678) ||
+		(string(ebr.VolumeLabel[:]) != "TEST VOL   ") {
+		t.Logf("Got incorrect volume ID or label: 0x%08x, \"%s\"\n",
+			ebr.VolumeID, ebr.VolumeLabel[:])
+		t.Fail()
+	}
+	stats, e := f.Stats()
+	if e != nil {
+		t.Logf("Failed getting stats: %s\n", e)
+		t.FailNow()
+	}
+	if (stats.UsedClusters != 1) || (len(stats.InfoMismatches) != 0) {
+		t.Logf("Got unexpected stats for new volume:\n%s\n",
+			stats.FormatHumanReadable())
+		t.Fail()
+	}
+	entries, e := f.ReadDirectory(ebr.RootDirClusterNumber)
+	if e != nil {
+		t.Logf("Failed reading root directory: %s\n", e)
+		t.FailNow()
+	}
+	if (len(entries) != 1) || !entries[0].Entry.IsVolumeLabel() {
+		t.Logf("Expected only a volume label in the root directory, got %d "+
+			"entries\n", len(entries))
+		t.Fail()
+	}
+
+	// Make sure the new filesystem can be written to.
+	w, e := NewWritableFAT32Filesystem(file)
+	if e != nil {
+		t.Logf("Failed opening formatted image for writing: %s\n", e)
+		t.FailNow()
+	}
+	content := testContent(10000)
+	e = w.WriteFile("dir/new file.bin", content)
+	if e == nil {
+		t.Logf("Didn't get expected error writing to missing directory\n")
+		t.Fail()
+	}
+	e = w.MkdirAll("dir")
+	if e == nil {
+		e = w.WriteFile("dir/new file.bin", content)
+	}
+	if e != nil {
+		t.Logf("Failed writing to formatted image: %s\n", e)
+		t.FailNow()
+	}
+	e = w.Close()
+	if e != nil {
+		t.Logf("Failed closing writable filesystem: %s\n", e)
+		t.FailNow()
+	}
+	f, e = NewFAT32Filesystem(file)
+	if e != nil {
+		t.Logf("Failed reopening formatted image: %s\n", e)
+		t.FailNow()
+	}
+	data, e := f.ReadFile("DIR/NEW FILE.BIN")
+	if e != nil {
+		t.Logf("Failed reading file from formatted image: %s\n", e)
+		t.FailNow()
+	}
+	if !bytes.Equal(data, content) {
+		t.Logf("Read incorrect content from formatted image\n")
+		t.Fail()
+	}
+}
+
+func TestFormatSmallVolume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "small.img")
+	file, e := os.Create(path)
+	if e != nil {
+		t.Logf("Failed creating image: %s\n", e)
+		t.FailNow()
+	}
+	defer file.Close()
+	// Volumes with fewer than 65525 clusters would be read as FAT16, even
+	// with a manually chosen cluster size.
+	size := int64(2 * 1024 * 1024)
+	e = Format(file, size, nil)
+	if e == nil {
+		t.Logf("Didn't get expected error formatting a tiny volume\n")
+		t.Fail()
+	}
+	e = Format(file, size, &FormatOptions{SectorsPerCluster: 1})
+	if e == nil {
+		t.Logf("Didn't get expected error formatting a tiny volume with " +
+			"1-sector clusters\n")
+		t.Fail()
+	}
+	t.Logf("Got expected error formatting a tiny volume: %s\n", e)
+	size = int64(testSmallVolumeSectors * SectorSize)
+	e = Format(file, size, &FormatOptions{SectorsPerCluster: 2})
+	if e == nil {
+		t.Logf("Didn't get expected error formatting a small volume with " +
+			"large clusters\n")
+		t.Fail()
+	}
+
+	// This is about the smallest possible FAT32 volume.
+	e = Format(file, size, &FormatOptions{SectorsPerCluster: 1})
+	if e != nil {
+		t.Logf("Failed formatting small volume: %s\n", e)
+		t.FailNow()
+	}
+	f, e := NewFAT32Filesystem(file)
+	if e != nil {
+		t.Logf("Failed opening small volume: %s\n", e)
+		t.FailNow()
+	}
+	// 67584 sectors, minus 32 reserved and two 524-sector FATs.
+	if f.ClusterCount() != 66506 {
+		t.Logf("Expected 66506 clusters, got %d\n", f.ClusterCount())
+		t.Fail()
+	}
+	if string(f.Header.EBR.VolumeLabel[:]) != "NO NAME    " {
+		t.Logf("Got unexpected default label: \"%s\"\n",
+			f.Header.EBR.VolumeLabel[:])
+		t.Fail()
+	}
+}
+
+func TestFormatPartition(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	file, e := os.Create(path)
+	if e != nil {
+		t.Logf("Failed creating image: %s\n", e)
+		t.FailNow()
+	}
+	defer file.Close()
+	// Format a volume in a partition that extends past the end of the file.
+	// The file must be extended, as it would be when formatting a file
+	// directly.
+	baseOffset := int64(2048 * SectorSize)
+	size := int64(testSmallVolumeSectors * SectorSize)
+	partition, e := LimitReadSeeker(file, baseOffset, baseOffset+size)
+	if e != nil {
+		t.Logf("Failed limiting image to the partition: %s\n", e)
+		t.FailNow()
+	}
+	e = Format(partition.(io.WriteSeeker), size, &FormatOptions{
+		SectorsPerCluster: 1,
+	})
+	if e != nil {
+		t.Logf("Failed formatting partition: %s\n", e)
+		t.FailNow()
+	}
+	info, e := file.Stat()
+	if e != nil {
+		t.Logf("Failed getting image size: %s\n", e)
+		t.FailNow()
+	}
+	if info.Size() != (baseOffset + size) {
+		t.Logf("Formatting the partition didn't extend the image: got %d "+
+			"bytes\n", info.Size())
+		t.Fail()
+	}
+	_, e = NewFAT32Filesystem(partition)
+	if e != nil {
+		t.Logf("Failed loading formatted partition: %s\n", e)
+		t.Fail()
+	}
+}
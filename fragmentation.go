@@ -0,0 +1,117 @@
+package fat
+
+// This file contains functions for analyzing how fragmented the chains in a
+// FAT32 filesystem are. Fragmented files are difficult to recover using raw
+// carving, so this helps to predict which files need the FAT to be recovered.
+
+import (
+	"fmt"
+)
+
+// A run of consecutive clusters.
+type ClusterExtent struct {
+	StartCluster uint32
+	// The number of clusters in the run.
+	Length uint32
+}
+
+// Returns the cluster immediately after the end of the extent.
+func (x *ClusterExtent) EndCluster() uint32 {
+	return x.StartCluster + x.Length
+}
+
+// Splits an ordered list of clusters into runs of consecutive clusters.
+func clusterExtents(clusters []uint32) []ClusterExtent {
+	var toReturn []ClusterExtent
+	for i, c := range clusters {
+		if (i != 0) && (c == clusters[i-1]+1) {
+			toReturn[len(toReturn)-1].Length++
+			continue
+		}
+		toReturn = append(toReturn, ClusterExtent{
+			StartCluster: c,
+			Length:       1,
+		})
+	}
+	return toReturn
+}
+
+// Returns the largest distance, in clusters, between the end of one extent
+// and the start of the next. Backward jumps are counted by their absolute
+// distance.
+func largestGap(extents []ClusterExtent) uint32 {
+	toReturn := uint32(0)
+	for i := 1; i < len(extents); i++ {
+		end := extents[i-1].EndCluster()
+		start := extents[i].StartCluster
+		var gap uint32
+		if start >= end {
+			gap = start - end
+		} else {
+			gap = end - start
+		}
+		if gap > toReturn {
+			toReturn = gap
+		}
+	}
+	return toReturn
+}
+
+// A single bucket in a FragmentationHistogram.
+type FragmentationBucket struct {
+	// The range of fragment counts covered by this bucket, inclusive.
+	MinFragments int
+	MaxFragments int
+	// The number of chains with a fragment count in the range.
+	Chains int
+}
+
+// Counts how many chains are stored in a given number of fragments. The first
+// bucket holds chains with a single fragment (i.e. contiguous chains), and
+// each subsequent bucket covers twice the range of the last: 2, 3-4, 5-8, etc.
+type FragmentationHistogram []FragmentationBucket
+
+// Builds a histogram of the fragment counts of the given chains.
+func GetFragmentationHistogram(chains []FATChain) FragmentationHistogram {
+	var toReturn FragmentationHistogram
+	for i := range chains {
+		count := chains[i].FragmentCount()
+		if count < 1 {
+			continue
+		}
+		// Find the index of the bucket containing the count, adding buckets
+		// if necessary.
+		bucket := 0
+		for limit := 1; limit < count; limit *= 2 {
+			bucket++
+		}
+		for len(toReturn) <= bucket {
+			minFragments := 1
+			maxFragments := 1
+			if len(toReturn) != 0 {
+				minFragments = toReturn[len(toReturn)-1].MaxFragments + 1
+				maxFragments = toReturn[len(toReturn)-1].MaxFragments * 2
+			}
+			toReturn = append(toReturn, FragmentationBucket{
+				MinFragments: minFragments,
+				MaxFragments: maxFragments,
+			})
+		}
+		toReturn[bucket].Chains++
+	}
+	return toReturn
+}
+
+// Returns a multi-line string with one line per histogram bucket.
+func (h FragmentationHistogram) FormatHumanReadable() string {
+	toReturn := "Chains by number of fragments:"
+	for _, b := range h {
+		if b.MinFragments == b.MaxFragments {
+			toReturn += fmt.Sprintf("\n  %d: %d", b.MinFragments, b.Chains)
+			continue
+		}
+		toReturn += fmt.Sprintf("\n  %d-%d: %d", b.MinFragments,
+			b.MaxFragments, b.Chains)
+	}
+	return toReturn
+}
@@ -0,0 +1,53 @@
+package fat
+
+import (
+	"testing"
+)
+
+func TestChainExtents(t *testing.T) {
+	m := newTestImage()
+	m.addFile(testRootCluster, 0, "A", 1000, []uint32{3, 4})
+	m.addFile(testRootCluster, 1, "B", 2000, []uint32{20, 5, 6, 30})
+	m.addFile(testRootCluster, 2, "C", 1000, []uint32{7, 9})
+	f := m.open(t)
+	chains, e := f.GetAllChains()
+	if e != nil {
+		t.Logf("Failed getting chains: %s\n", e)
+		t.FailNow()
+	}
+	var b *FATChain
+	for i := range chains {
+		if chains[i].StartCluster == 20 {
+			b = &(chains[i])
+		}
+	}
+	if b == nil {
+		t.Logf("Didn't find chain starting at cluster 20\n")
+		t.FailNow()
+	}
+	expected := []ClusterExtent{{20, 1}, {5, 2}, {30, 1}}
+	if len(b.Extents) != len(expected) {
+		t.Logf("Expected %d extents, got %d\n", len(expected),
+			len(b.Extents))
+		t.FailNow()
+	}
+	for i := range expected {
+		if b.Extents[i] != expected[i] {
+			t.Logf("Expected extent %d to be %+v, got %+v\n", i,
+				expected[i], b.Extents[i])
+			t.FailNow()
+		}
+	}
+	if b.LargestGap != 23 {
+		t.Logf("Expected largest gap of 23 clusters, got %d\n", b.LargestGap)
+		t.FailNow()
+	}
+	h := GetFragmentationHistogram(chains)
+	t.Logf("%s\n", h.FormatHumanReadable())
+	// The root directory and A are contiguous, C has 2 fragments and B has 3.
+	if (len(h) != 3) || (h[0].Chains != 2) || (h[1].Chains != 1) ||
+		(h[2].Chains != 1) || (h[2].MaxFragments != 4) {
+		t.Logf("Got incorrect histogram: %+v\n", h)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,238 @@
+package fat
+
+// This file contains functions for parsing GUID partition tables (GPT).
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// The MBR partition type of the single "protective" partition covering a
+// disk that uses a GUID partition table.
+const ProtectivePartitionType = 0xee
+
+var gptSignature = []byte("EFI PART")
+
+// The header of a GUID partition table, found in the second sector of the
+// disk, with a backup copy in the last sector.
+type GPTHeader struct {
+	Signature                [8]byte
+	Revision                 uint32
+	HeaderSize               uint32
+	HeaderCRC32              uint32
+	Reserved                 uint32
+	CurrentLBA               uint64
+	BackupLBA                uint64
+	FirstUsableLBA           uint64
+	LastUsableLBA            uint64
+	DiskGUID                 [16]byte
+	PartitionEntryLBA        uint64
+	PartitionEntryCount      uint32
+	PartitionEntrySize       uint32
+	PartitionEntryArrayCRC32 uint32
+}
+
+// The size of the part of the GPT header covered by the structure above.
+const gptHeaderSize = 92
+
+// Limits on the partition array, so a corrupt header can't make us allocate
+// and read a huge amount of data. Real tables usually hold 128 entries of 128
+// bytes.
+const gptMaxEntryCount = 4096
+const gptMaxEntrySize = 4096
+const gptMaxArraySize = 4 * 1024 * 1024
+
+// A single entry in a GUID partition table.
+type GPTPartitionEntry struct {
+	TypeGUID   [16]byte
+	UniqueGUID [16]byte
+	FirstLBA   uint64
+	// The last sector in the partition, inclusive.
+	LastLBA    uint64
+	Attributes uint64
+	// The partition's name, in UTF-16LE.
+	RawName [36]uint16
+}
+
+// Formats a GUID stored in the mixed-endian layout used by GPT, e.g.
+// "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7".
+func FormatGUID(g [16]byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(g[0:4]),
+		binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]), g[8:10], g[10:16])
+}
+
+// Returns true if the entry doesn't describe a partition.
+func (p *GPTPartitionEntry) IsEmpty() bool {
+	return p.TypeGUID == [16]byte{}
+}
+
+// Returns the partition's name.
+func (p *GPTPartitionEntry) Name() string {
+	end := 0
+	for (end < len(p.RawName)) && (p.RawName[end] != 0) {
+		end++
+	}
+	return string(utf16.Decode(p.RawName[:end]))
+}
+
+// Returns the number of sectors in the partition.
+func (p *GPTPartitionEntry) SectorCount() uint64 {
+	if p.LastLBA < p.FirstLBA {
+		return 0
+	}
+	return p.LastLBA - p.FirstLBA + 1
+}
+
+func (p *GPTPartitionEntry) String() string {
+	sizeMB := (float64(p.SectorCount()) * SectorSize) / (1024.0 * 1024.0)
+	return fmt.Sprintf("Partition \"%s\" (type %s) starting at sector %d: "+
+		"%f MB", p.Name(), FormatGUID(p.TypeGUID), p.FirstLBA, sizeMB)
+}
+
+// A parsed GUID partition table.
+type GPT struct {
+	Header GPTHeader
+	// Every entry in the table, including empty ones, so that indices match
+	// the partition numbers used by other tools (minus one).
+	Partitions []GPTPartitionEntry
+	// Set if the primary header or partition array was damaged, so the
+	// backup copy at the end of the disk was used.
+	UsedBackup bool
+}
+
+// Returns true if the MBR is the protective MBR of a disk using a GUID
+// partition table.
+func (m *MBR) IsProtective() bool {
+	for i := range m.Partitions {
+		if m.Partitions[i].PartitionType == ProtectivePartitionType {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads and checks the GPT header and partition array in the given sector.
+func readGPTAt(image io.ReadSeeker, lba int64) (*GPT, error) {
+	_, e := image.Seek(lba*SectorSize, io.SeekStart)
+	if e != nil {
+		return nil, fmt.Errorf("Failed seeking to GPT header: %w", e)
+	}
+	var sector [SectorSize]byte
+	_, e = io.ReadFull(image, sector[:])
+	if e != nil {
+		return nil, fmt.Errorf("Failed reading GPT header: %w", e)
+	}
+	toReturn := &GPT{}
+	h := &(toReturn.Header)
+	e = binary.Read(bytes.NewReader(sector[:]), binary.LittleEndian, h)
+	if e != nil {
+		return nil, fmt.Errorf("Failed parsing GPT header: %w", e)
+	}
+	if !bytes.Equal(h.Signature[:], gptSignature) {
+		return nil, fmt.Errorf("Missing GPT signature in sector %d", lba)
+	}
+	if (h.HeaderSize < gptHeaderSize) || (h.HeaderSize > SectorSize) {
+		return nil, fmt.Errorf("Invalid GPT header size: %d", h.HeaderSize)
+	}
+	// The checksum is computed with its own field set to zero.
+	headerData := append([]byte{}, sector[:h.HeaderSize]...)
+	binary.LittleEndian.PutUint32(headerData[16:20], 0)
+	if crc32.ChecksumIEEE(headerData) != h.HeaderCRC32 {
+		return nil, fmt.Errorf("Bad GPT header checksum in sector %d", lba)
+	}
+	arraySize := int64(h.PartitionEntryCount) * int64(h.PartitionEntrySize)
+	if (h.PartitionEntrySize < 128) || ((h.PartitionEntrySize % 8) != 0) ||
+		(h.PartitionEntrySize > gptMaxEntrySize) ||
+		(h.PartitionEntryCount > gptMaxEntryCount) ||
+		(arraySize > gptMaxArraySize) {
+		return nil, fmt.Errorf("Invalid GPT partition array: %d entries of "+
+			"%d bytes", h.PartitionEntryCount, h.PartitionEntrySize)
+	}
+	arrayData := make([]byte, arraySize)
+	_, e = image.Seek(int64(h.PartitionEntryLBA)*SectorSize, io.SeekStart)
+	if e != nil {
+		return nil, fmt.Errorf("Failed seeking to GPT partitions: %w", e)
+	}
+	_, e = io.ReadFull(image, arrayData)
+	if e != nil {
+		return nil, fmt.Errorf("Failed reading GPT partitions: %w", e)
+	}
+	if crc32.ChecksumIEEE(arrayData) != h.PartitionEntryArrayCRC32 {
+		return nil, fmt.Errorf("Bad GPT partition array checksum")
+	}
+	toReturn.Partitions = make([]GPTPartitionEntry, h.PartitionEntryCount)
+	for i := range toReturn.Partitions {
+		start := int64(i) * int64(h.PartitionEntrySize)
+		e = binary.Read(bytes.NewReader(arrayData[start:]),
+			binary.LittleEndian, &(toReturn.Partitions[i]))
+		if e != nil {
+			return nil, fmt.Errorf("Failed parsing GPT entry %d: %w", i, e)
+		}
+	}
+	return toReturn, nil
+}
+
+// Parses the GUID partition table in the given image. If the primary copy
+// in the second sector is damaged, the backup copy in the last sector is
+// used instead.
+func ParseGPT(image io.ReadSeeker) (*GPT, error) {
+	toReturn, primaryError := readGPTAt(image, 1)
+	if primaryError == nil {
+		return toReturn, nil
+	}
+	size, e := contentSize(image)
+	if e != nil {
+		return nil, primaryError
+	}
+	toReturn, e = readGPTAt(image, (size/SectorSize)-1)
+	if e != nil {
+		return nil, fmt.Errorf("Primary GPT is invalid (%s), and so is the "+
+			"backup: %w", primaryError, e)
+	}
+	toReturn.UsedBackup = true
+	return toReturn, nil
+}
+
+// Returns an io.ReadSeeker corresponding to the GPT partition at the given
+// index in g.Partitions. Returns an error if the entry is empty.
+func GetGPTPartition(image io.ReadSeeker, g *GPT, partitionIndex int) (
+	io.ReadSeeker, error) {
+	if (partitionIndex < 0) || (partitionIndex >= len(g.Partitions)) {
+		return nil, fmt.Errorf("Invalid GPT partition index: %d",
+			partitionIndex)
+	}
+	entry := &(g.Partitions[partitionIndex])
+	if entry.IsEmpty() || (entry.SectorCount() == 0) {
+		return nil, fmt.Errorf("GPT partition %d is empty", partitionIndex)
+	}
+	startOffset := int64(entry.FirstLBA) * SectorSize
+	limit := startOffset + int64(entry.SectorCount())*SectorSize
+	return LimitReadSeeker(image, startOffset, limit)
+}
+
+// Returns a human-readable multi-line string listing the non-empty
+// partitions, along with their indices in g.Partitions.
+func (g *GPT) FormatHumanReadable() string {
+	var toReturn strings.Builder
+	toReturn.WriteString(fmt.Sprintf("GPT for disk %s",
+		FormatGUID(g.Header.DiskGUID)))
+	if g.UsedBackup {
+		toReturn.WriteString(" (using the backup table)")
+	}
+	toReturn.WriteString(":\n")
+	for i := range g.Partitions {
+		p := &(g.Partitions[i])
+		if p.IsEmpty() {
+			continue
+		}
+		toReturn.WriteString(fmt.Sprintf("  Partition %d: %s\n", i, p))
+	}
+	return toReturn.String()
+}
@@ -0,0 +1,203 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"testing"
+	"unicode/utf16"
+)
+
+// The number of sectors in the disk created by newTestGPTDisk.
+const testGPTSectors = 64
+
+// Returns a GPT header sector at the given LBA, pointing to a partition
+// array at entryLBA with entries of the given size.
+func testGPTHeader(lba, backupLBA, entryLBA uint64, entries []byte,
+	entryCount, entrySize uint32) []byte {
+	h := GPTHeader{
+		Revision:                 0x10000,
+		HeaderSize:               gptHeaderSize,
+		CurrentLBA:               lba,
+		BackupLBA:                backupLBA,
+		FirstUsableLBA:           8,
+		LastUsableLBA:            testGPTSectors - 8,
+		DiskGUID:                 [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+		PartitionEntryLBA:        entryLBA,
+		PartitionEntryCount:      entryCount,
+		PartitionEntrySize:       entrySize,
+		PartitionEntryArrayCRC32: crc32.ChecksumIEEE(entries),
+	}
+	copy(h.Signature[:], gptSignature)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &h)
+	sector := make([]byte, SectorSize)
+	copy(sector, buf.Bytes())
+	binary.LittleEndian.PutUint32(sector[16:20],
+		crc32.ChecksumIEEE(sector[:gptHeaderSize]))
+	return sector
+}
+
+// Returns a disk image with a protective MBR and a GPT containing a single
+// partition covering sectors 8 through 15, preceded by an empty entry.
+func newTestGPTDisk() []byte {
+	disk := make([]byte, testGPTSectors*SectorSize)
+	mbr := NewMBR(0)
+	mbr.SetPartition(0, ProtectivePartitionType, 1, testGPTSectors-1, false)
+	copy(disk, mbr.Bytes())
+	entry := GPTPartitionEntry{
+		TypeGUID: [16]byte{0xa2, 0xa0, 0xd0, 0xeb, 0xe5, 0xb9, 0x33, 0x44,
+			0x87, 0xc0, 0x68, 0xb6, 0xb7, 0x26, 0x99, 0xc7},
+		FirstLBA: 8,
+		LastLBA:  15,
+	}
+	copy(entry.RawName[:], utf16.Encode([]rune("Data")))
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 128))
+	binary.Write(&buf, binary.LittleEndian, &entry)
+	entries := make([]byte, 4*128)
+	copy(entries, buf.Bytes())
+	copy(disk[SectorSize:], testGPTHeader(1, testGPTSectors-1, 2, entries, 4,
+		128))
+	copy(disk[2*SectorSize:], entries)
+	backupEntryLBA := uint64(testGPTSectors - 2)
+	copy(disk[backupEntryLBA*SectorSize:], entries)
+	copy(disk[(testGPTSectors-1)*SectorSize:], testGPTHeader(
+		testGPTSectors-1, 1, backupEntryLBA, entries, 4, 128))
+	copy(disk[8*SectorSize:], []byte("partition content"))
+	return disk
+}
+
+func TestFormatGUID(t *testing.T) {
+	g := [16]byte{0xa2, 0xa0, 0xd0, 0xeb, 0xe5, 0xb9, 0x33, 0x44, 0x87, 0xc0,
+		0x68, 0xb6, 0xb7, 0x26, 0x99, 0xc7}
+	expected := "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7"
+	if FormatGUID(g) != expected {
+		t.Logf("Expected GUID %s, got %s\n", expected, FormatGUID(g))
+		t.Fail()
+	}
+}
+
+func TestParseGPT(t *testing.T) {
+	disk := newTestGPTDisk()
+	mbr, e := ParseMBR(bytes.NewReader(disk))
+	if e != nil {
+		t.Logf("Failed parsing protective MBR: %s\n", e)
+		t.FailNow()
+	}
+	if !mbr.IsProtective() {
+		t.Logf("Didn't detect protective MBR\n")
+		t.FailNow()
+	}
+	g, e := ParseGPT(bytes.NewReader(disk))
+	if e != nil {
+		t.Logf("Failed parsing GPT: %s\n", e)
+		t.FailNow()
+	}
+	t.Logf("%s", g.FormatHumanReadable())
+	if g.UsedBackup {
+		t.Logf("Used the backup GPT when the primary was valid\n")
+		t.Fail()
+	}
+	// Empty entries are kept, so indices match the entries' positions.
+	if len(g.Partitions) != 4 {
+		t.Logf("Expected 4 entries, got %d\n", len(g.Partitions))
+		t.FailNow()
+	}
+	if !g.Partitions[0].IsEmpty() {
+		t.Logf("Expected entry 0 to be empty, got %s\n", &(g.Partitions[0]))
+		t.FailNow()
+	}
+	p := &(g.Partitions[1])
+	if (p.Name() != "Data") || (p.SectorCount() != 8) {
+		t.Logf("Got incorrect partition: %s\n", p)
+		t.FailNow()
+	}
+	partition, e := GetGPTPartition(bytes.NewReader(disk), g, 1)
+	if e != nil {
+		t.Logf("Failed getting GPT partition: %s\n", e)
+		t.FailNow()
+	}
+	size, _ := partition.Seek(0, io.SeekEnd)
+	if size != 8*SectorSize {
+		t.Logf("Expected an %d-byte partition, got %d bytes\n",
+			8*SectorSize, size)
+		t.Fail()
+	}
+	partition.Seek(0, io.SeekStart)
+	data := make([]byte, 9)
+	_, e = io.ReadFull(partition, data)
+	if (e != nil) || (string(data) != "partition") {
+		t.Logf("Failed reading partition content: %v, %q\n", e, data)
+		t.Fail()
+	}
+	_, e = GetGPTPartition(bytes.NewReader(disk), g, 0)
+	if e == nil {
+		t.Logf("Didn't get expected error for an empty partition\n")
+		t.Fail()
+	}
+	_, e = GetGPTPartition(bytes.NewReader(disk), g, 4)
+	if e == nil {
+		t.Logf("Didn't get expected error for an invalid partition index\n")
+		t.Fail()
+	}
+
+	// Corrupt the primary header; the backup should be used instead.
+	disk[SectorSize+40]++
+	g, e = ParseGPT(bytes.NewReader(disk))
+	if e != nil {
+		t.Logf("Failed parsing GPT using the backup: %s\n", e)
+		t.FailNow()
+	}
+	if !g.UsedBackup || (g.Partitions[1].Name() != "Data") {
+		t.Logf("Didn't correctly use the backup GPT\n")
+		t.Fail()
+	}
+
+	// With both copies corrupted, parsing should fail.
+	disk[(testGPTSectors-2)*SectorSize+200]++
+	_, e = ParseGPT(bytes.NewReader(disk))
+	if e == nil {
+		t.Logf("Didn't get expected error for a corrupted GPT\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error for a corrupted GPT: %s\n", e)
+}
+
+func TestGPTEntrySizeLimit(t *testing.T) {
+	// Large entries are allowed, up to a limit, as long as the checksums
+	// match.
+	disk := make([]byte, testGPTSectors*SectorSize)
+	for _, entrySize := range []uint32{4096, 8192} {
+		entries := make([]byte, 16*SectorSize)
+		copy(entries, []byte("entry content"))
+		entryCount := uint32(len(entries)) / entrySize
+		copy(disk[SectorSize:], testGPTHeader(1, testGPTSectors-1, 2,
+			entries, entryCount, entrySize))
+		copy(disk[2*SectorSize:], entries)
+		g, e := readGPTAt(bytes.NewReader(disk), 1)
+		if entrySize > gptMaxEntrySize {
+			if e == nil {
+				t.Logf("Didn't get an error for %d-byte GPT entries\n",
+					entrySize)
+				t.Fail()
+				continue
+			}
+			t.Logf("Got expected error for %d-byte GPT entries: %s\n",
+				entrySize, e)
+			continue
+		}
+		if e != nil {
+			t.Logf("Failed reading GPT with %d-byte entries: %s\n",
+				entrySize, e)
+			t.Fail()
+			continue
+		}
+		if len(g.Partitions) != int(entryCount) {
+			t.Logf("Expected %d entries, got %d\n", entryCount,
+				len(g.Partitions))
+			t.Fail()
+		}
+	}
+}
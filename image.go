@@ -0,0 +1,389 @@
+package fat
+
+// This file contains functions for opening disk images, including images
+// split into several numbered segment files (e.g. disk.001, disk.002, ...).
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An opened disk image. Both io.ReadSeeker and io.ReaderAt are supported, so
+// an Image can be passed to ParseMBR, GetPartition or NewFAT32Filesystem.
+// Like the rest of this package, Images are not safe for concurrent use via
+// Read and Seek, but ReadAt may be called concurrently.
+type Image interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+	// Returns the size of the image's content, in bytes.
+	Size() int64
+}
+
+// Implements Read and Seek in terms of ReadAt, for any of our Image types.
+type readerAtSeeker struct {
+	r             io.ReaderAt
+	size          int64
+	currentOffset int64
+}
+
+func (s *readerAtSeeker) Seek(offset int64, whence int) (int64, error) {
+	newOffset := s.currentOffset
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset += offset
+	case io.SeekEnd:
+		newOffset = s.size + offset
+	default:
+		return s.currentOffset, fmt.Errorf("Invalid whence: %d", whence)
+	}
+	if newOffset < 0 {
+		return s.currentOffset, fmt.Errorf("Invalid offset: %d", newOffset)
+	}
+	s.currentOffset = newOffset
+	return newOffset, nil
+}
+
+func (s *readerAtSeeker) Read(dst []byte) (int, error) {
+	if s.currentOffset >= s.size {
+		return 0, io.EOF
+	}
+	if int64(len(dst)) > (s.size - s.currentOffset) {
+		dst = dst[:s.size-s.currentOffset]
+	}
+	n, e := s.r.ReadAt(dst, s.currentOffset)
+	s.currentOffset += int64(n)
+	if (e == io.EOF) && (n == len(dst)) {
+		e = nil
+	}
+	return n, e
+}
+
+// Reads from an image whose content is stored in fixed-size blocks, calling
+// readBlock with the part of dst belonging to each block. Returns io.EOF if
+// the read extends past the end of the image.
+func readBlocks(dst []byte, offset, size, blockSize int64,
+	readBlock func(dst []byte, block, blockOffset int64) error) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("Invalid offset: %d", offset)
+	}
+	bytesRead := 0
+	for bytesRead < len(dst) {
+		current := offset + int64(bytesRead)
+		if current >= size {
+			return bytesRead, io.EOF
+		}
+		blockOffset := current % blockSize
+		limit := blockSize - blockOffset
+		if (size - current) < limit {
+			limit = size - current
+		}
+		toRead := dst[bytesRead:]
+		if int64(len(toRead)) > limit {
+			toRead = toRead[:limit]
+		}
+		e := readBlock(toRead, current/blockSize, blockOffset)
+		if e != nil {
+			return bytesRead, e
+		}
+		bytesRead += len(toRead)
+	}
+	return bytesRead, nil
+}
+
+// Fills dst from the given offset, returning an error if it can't be filled
+// completely.
+func readFullAt(r io.ReaderAt, dst []byte, offset int64) error {
+	n, e := r.ReadAt(dst, offset)
+	if n == len(dst) {
+		return nil
+	}
+	if (e == nil) || (e == io.EOF) {
+		e = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("Error reading %d bytes at offset %d: %w", len(dst),
+		offset, e)
+}
+
+// Sets every byte in the slice to zero.
+func zeroBytes(dst []byte) {
+	for i := range dst {
+		dst[i] = 0
+	}
+}
+
+// Closes r if it implements io.Closer.
+func closeIfCloser(r interface{}) error {
+	c, ok := r.(io.Closer)
+	if !ok {
+		return nil
+	}
+	return c.Close()
+}
+
+// An Image backed by a single file.
+type fileImage struct {
+	*os.File
+	size int64
+}
+
+func (f *fileImage) Size() int64 {
+	return f.size
+}
+
+// A single file in a SplitImage.
+type imageSegment struct {
+	file *os.File
+	// The offset in the image at which this segment starts.
+	start int64
+	size  int64
+}
+
+// An Image made of several segment files, concatenated in order.
+type SplitImage struct {
+	readerAtSeeker
+	segments []imageSegment
+}
+
+// Returns the paths of the segment files, in order.
+func (s *SplitImage) Paths() []string {
+	toReturn := make([]string, len(s.segments))
+	for i := range s.segments {
+		toReturn[i] = s.segments[i].file.Name()
+	}
+	return toReturn
+}
+
+func (s *SplitImage) Size() int64 {
+	return s.size
+}
+
+// Reads from the segments containing the given range. Returns io.EOF if the
+// read extends past the end of the image.
+func (s *SplitImage) ReadAt(dst []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("Invalid offset: %d", offset)
+	}
+	// Find the first segment ending after the offset.
+	index := sort.Search(len(s.segments), func(i int) bool {
+		return (s.segments[i].start + s.segments[i].size) > offset
+	})
+	bytesRead := 0
+	for (bytesRead < len(dst)) && (index < len(s.segments)) {
+		segment := &(s.segments[index])
+		segmentOffset := offset + int64(bytesRead) - segment.start
+		toRead := dst[bytesRead:]
+		if int64(len(toRead)) > (segment.size - segmentOffset) {
+			toRead = toRead[:segment.size-segmentOffset]
+		}
+		n, e := segment.file.ReadAt(toRead, segmentOffset)
+		bytesRead += n
+		if (e != nil) && !((e == io.EOF) && (n == len(toRead))) {
+			return bytesRead, fmt.Errorf("Error reading %s: %w",
+				segment.file.Name(), e)
+		}
+		index++
+	}
+	if bytesRead < len(dst) {
+		return bytesRead, io.EOF
+	}
+	return bytesRead, nil
+}
+
+// Closes every segment file.
+func (s *SplitImage) Close() error {
+	var toReturn error
+	for i := range s.segments {
+		e := s.segments[i].file.Close()
+		if (e != nil) && (toReturn == nil) {
+			toReturn = e
+		}
+	}
+	return toReturn
+}
+
+// If the path ends in a numeric extension, e.g. ".001", returns the path
+// without the extension, the number, and the number of digits.
+func splitSegmentNumber(path string) (string, int, int, bool) {
+	extension := filepath.Ext(path)
+	digits := strings.TrimPrefix(extension, ".")
+	if (len(digits) < 2) || (len(digits) > 4) {
+		return "", 0, 0, false
+	}
+	number, e := strconv.Atoi(digits)
+	if (e != nil) || (number < 0) {
+		return "", 0, 0, false
+	}
+	return strings.TrimSuffix(path, extension), number, len(digits), true
+}
+
+// Opens a split image, given the path to any of its numbered segments (e.g.
+// "disk.001" or "disk.dd.000"). The segments are found by counting upward
+// from the first segment, which is numbered 0 or 1, until a number is
+// missing.
+func OpenSplitImage(path string) (*SplitImage, error) {
+	base, _, digits, ok := splitSegmentNumber(path)
+	if !ok {
+		return nil, fmt.Errorf("%s doesn't have a numbered extension", path)
+	}
+	segmentPath := func(n int) string {
+		return fmt.Sprintf("%s.%0*d", base, digits, n)
+	}
+	number := 0
+	_, e := os.Stat(segmentPath(number))
+	if e != nil {
+		number = 1
+	}
+	toReturn := &SplitImage{}
+	for {
+		f, e := os.Open(segmentPath(number))
+		if os.IsNotExist(e) {
+			break
+		}
+		if e != nil {
+			toReturn.Close()
+			return nil, fmt.Errorf("Error opening segment: %w", e)
+		}
+		info, e := f.Stat()
+		if e != nil {
+			f.Close()
+			toReturn.Close()
+			return nil, fmt.Errorf("Error getting size of %s: %w",
+				f.Name(), e)
+		}
+		toReturn.segments = append(toReturn.segments, imageSegment{
+			file:  f,
+			start: toReturn.size,
+			size:  info.Size(),
+		})
+		toReturn.size += info.Size()
+		number++
+	}
+	if len(toReturn.segments) == 0 {
+		return nil, fmt.Errorf("Couldn't find the first segment of %s", path)
+	}
+	toReturn.r = toReturn
+	return toReturn, nil
+}
+
+// Returns an Image for the virtual disk in the given file, if it's a VHD,
+// VHDX or QCOW2 file. Returns nil and no error if the file isn't in any of
+// these formats. The start argument holds the first few bytes of the file.
+func openVirtualDisk(f *os.File, start []byte, size int64) (Image, error) {
+	if bytes.HasPrefix(start, vhdxFileSignature) {
+		return NewVHDXImage(f)
+	}
+	if bytes.HasPrefix(start, qcow2Magic) {
+		return NewQCOW2Image(f)
+	}
+	// Dynamic VHDs start with a copy of the footer, but fixed VHDs only have
+	// the footer at the end.
+	if bytes.HasPrefix(start, vhdFooterCookie) {
+		return NewVHDImage(f, size)
+	}
+	if size >= SectorSize {
+		var cookie [8]byte
+		e := readFullAt(f, cookie[:], size-SectorSize)
+		if e != nil {
+			return nil, e
+		}
+		if bytes.Equal(cookie[:], vhdFooterCookie) {
+			return NewVHDImage(f, size)
+		}
+	}
+	return nil, nil
+}
+
+// Opens the disk image at the given path. If the path has a numbered
+// extension (e.g. ".001") and the first segment exists, it is treated as a
+// split image. Otherwise it is opened as a single image file, which may be
+// compressed (see CompressedImage), a VHD, VHDX or QCOW2 virtual disk, the
+// first of a set of EWF (E01 or Ex01) segment files, or a raw image.
+func OpenImage(path string) (Image, error) {
+	return OpenImageWithOptions(path, nil)
+}
+
+// Options for opening images. A nil *ImageOptions, or any zero-valued field,
+// selects the default behavior.
+type ImageOptions struct {
+	// A directory in which compressed images that can't be read efficiently
+	// in place may be decompressed to a temporary file, which needs as much
+	// space as the uncompressed image. If empty, opening such images fails
+	// with ErrNeedsDecompression instead.
+	TemporaryDirectory string
+}
+
+// Like OpenImage, but takes options controlling how the image is opened. The
+// options may be nil.
+func OpenImageWithOptions(path string, options *ImageOptions) (Image, error) {
+	_, _, _, numbered := splitSegmentNumber(path)
+	if numbered {
+		split, e := OpenSplitImage(path)
+		if e == nil {
+			return split, nil
+		}
+	}
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	size, e := contentSize(f)
+	if e != nil {
+		f.Close()
+		return nil, fmt.Errorf("Error getting size of %s: %w", path, e)
+	}
+	_, e = f.Seek(0, io.SeekStart)
+	if e != nil {
+		f.Close()
+		return nil, fmt.Errorf("Error seeking in %s: %w", path, e)
+	}
+	var start [8]byte
+	n, e := io.ReadFull(f, start[:])
+	if (e != nil) && (e != io.ErrUnexpectedEOF) && (e != io.EOF) {
+		f.Close()
+		return nil, fmt.Errorf("Error reading start of %s: %w", path, e)
+	}
+	if bytes.HasPrefix(start[:n], ewfSignature) ||
+		bytes.HasPrefix(start[:n], ewf2Signature) {
+		f.Close()
+		ewf, e := OpenEWFImage(path)
+		if e != nil {
+			return nil, e
+		}
+		return ewf, nil
+	}
+	format := detectCompression(start[:n])
+	if format != nil {
+		compressed, e := openCompressedImage(f, format, options)
+		if e != nil {
+			f.Close()
+			return nil, e
+		}
+		return compressed, nil
+	}
+	virtualDisk, e := openVirtualDisk(f, start[:n], size)
+	if e != nil {
+		f.Close()
+		return nil, fmt.Errorf("Error opening %s: %w", path, e)
+	}
+	if virtualDisk != nil {
+		return virtualDisk, nil
+	}
+	_, e = f.Seek(0, io.SeekStart)
+	if e != nil {
+		f.Close()
+		return nil, fmt.Errorf("Error seeking in %s: %w", path, e)
+	}
+	return &fileImage{
+		File: f,
+		size: size,
+	}, nil
+}
@@ -0,0 +1,166 @@
+package fat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes the given data to numbered segment files with the given sizes, and
+// returns the path of the first segment.
+func writeSegments(t *testing.T, data []byte, sizes []int) string {
+	dir := t.TempDir()
+	offset := 0
+	for i, size := range sizes {
+		path := filepath.Join(dir, fmt.Sprintf("disk.dd.%03d", i+1))
+		e := os.WriteFile(path, data[offset:offset+size], 0644)
+		if e != nil {
+			t.Logf("Failed writing segment %d: %s\n", i, e)
+			t.FailNow()
+		}
+		offset += size
+	}
+	return filepath.Join(dir, "disk.dd.001")
+}
+
+// Writes the file to a temporary directory and calls checkImagePath.
+func checkImageFile(t *testing.T, name string, file, expected []byte) Image {
+	path := filepath.Join(t.TempDir(), name)
+	e := os.WriteFile(path, file, 0644)
+	if e != nil {
+		t.Logf("Failed writing %s: %s\n", name, e)
+		t.FailNow()
+	}
+	return checkImagePath(t, path, expected)
+}
+
+// Opens the image at the path with OpenImage, and checks that its content
+// matches the expected data and the FAT32 test filesystem from
+// newTestVirtualDiskContent. Returns the opened image.
+func checkImagePath(t *testing.T, path string, expected []byte) Image {
+	name := filepath.Base(path)
+	img, e := OpenImage(path)
+	if e != nil {
+		t.Logf("Failed opening %s: %s\n", name, e)
+		t.FailNow()
+	}
+	t.Cleanup(func() { img.Close() })
+	if img.Size() != int64(len(expected)) {
+		t.Logf("Expected %s to contain %d bytes, got %d\n", name,
+			len(expected), img.Size())
+		t.FailNow()
+	}
+	data, e := io.ReadAll(img)
+	if (e != nil) || !bytes.Equal(data, expected) {
+		t.Logf("Failed reading the content of %s: %v\n", name, e)
+		t.FailNow()
+	}
+	img.Seek(0, io.SeekStart)
+	f, e := NewFAT32Filesystem(img)
+	if e != nil {
+		t.Logf("Failed loading filesystem from %s: %s\n", name, e)
+		t.FailNow()
+	}
+	content, e := f.ReadFile("TEST.TXT")
+	if (e != nil) || (len(content) != 3*SectorSize) {
+		t.Logf("Failed reading file from %s: %v\n", name, e)
+		t.Fail()
+	}
+	return img
+}
+
+// Returns the content of a FAT32 test image containing a file, TEST.TXT,
+// suitable for checkImageFile.
+func newTestVirtualDiskContent() []byte {
+	m := newTestImage()
+	m.addFile(testRootCluster, 0, "TEST.TXT", 3*SectorSize, []uint32{3, 4, 5})
+	return m.data
+}
+
+func TestSplitImage(t *testing.T) {
+	m := newTestImage()
+	m.addFile(testRootCluster, 0, "SPANNING", 3*SectorSize, []uint32{3, 4,
+		5})
+	// Use uneven segment sizes, so that clusters span segments.
+	sizes := []int{40000, 1000, 700000}
+	sizes = append(sizes, len(m.data)-(sizes[0]+sizes[1]+sizes[2]))
+	firstPath := writeSegments(t, m.data, sizes)
+	// Any segment should work.
+	secondPath := firstPath[:len(firstPath)-1] + "2"
+	img, e := OpenImage(secondPath)
+	if e != nil {
+		t.Logf("Failed opening split image: %s\n", e)
+		t.FailNow()
+	}
+	defer img.Close()
+	split, ok := img.(*SplitImage)
+	if !ok {
+		t.Logf("Didn't get a split image for %s\n", secondPath)
+		t.FailNow()
+	}
+	if (len(split.Paths()) != 4) || (img.Size() != int64(len(m.data))) {
+		t.Logf("Got %d segments and %d bytes, expected 4 and %d\n",
+			len(split.Paths()), img.Size(), len(m.data))
+		t.FailNow()
+	}
+	data, e := io.ReadAll(img)
+	if (e != nil) || !bytes.Equal(data, m.data) {
+		t.Logf("Failed reading the full split image: %v\n", e)
+		t.Fail()
+	}
+	buffer := make([]byte, 5000)
+	n, e := img.ReadAt(buffer, 38000)
+	if (e != nil) || (n != len(buffer)) ||
+		!bytes.Equal(buffer, m.data[38000:43000]) {
+		t.Logf("ReadAt across segments failed: %d bytes, %v\n", n, e)
+		t.Fail()
+	}
+	n, e = img.ReadAt(buffer, int64(len(m.data)-100))
+	if (e != io.EOF) || (n != 100) {
+		t.Logf("Expected a 100-byte read and EOF at the end, got %d, %v\n",
+			n, e)
+		t.Fail()
+	}
+
+	img.Seek(0, io.SeekStart)
+	f, e := NewFAT32Filesystem(img)
+	if e != nil {
+		t.Logf("Failed loading filesystem from split image: %s\n", e)
+		t.FailNow()
+	}
+	content, e := f.ReadFile("SPANNING")
+	if (e != nil) || (len(content) != 3*SectorSize) || (content[0] != 1) ||
+		(content[len(content)-1] != 3) {
+		t.Logf("Failed reading file from split image: %v\n", e)
+		t.Fail()
+	}
+}
+
+func TestOpenImage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.2023")
+	data := testContent(3000)
+	e := os.WriteFile(path, data, 0644)
+	if e != nil {
+		t.Logf("Failed writing image: %s\n", e)
+		t.FailNow()
+	}
+	// The numbered extension doesn't matter if there are no other segments.
+	img, e := OpenImage(path)
+	if e != nil {
+		t.Logf("Failed opening image: %s\n", e)
+		t.FailNow()
+	}
+	defer img.Close()
+	if img.Size() != int64(len(data)) {
+		t.Logf("Expected a %d-byte image, got %d\n", len(data), img.Size())
+		t.Fail()
+	}
+	read, e := io.ReadAll(img)
+	if (e != nil) || !bytes.Equal(read, data) {
+		t.Logf("Failed reading image: %v\n", e)
+		t.Fail()
+	}
+}
@@ -0,0 +1,552 @@
+package fat
+
+// This file contains a DEFLATE (RFC 1951) decoder. Unlike compress/flate, it
+// reports where each block starts and can resume decompressing from a block
+// boundary given the preceding 32 KB of output, which allows random access to
+// gzip-compressed images in the same way as zlib's zran example.
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// The maximum distance a DEFLATE match can refer back to.
+const deflateWindowSize = 32 * 1024
+
+// The amount of decompressed data buffered beyond the window.
+const inflateBufferSize = 256 * 1024
+
+// The length of the longest Huffman code, and of the codes that are decoded
+// using a single table lookup.
+const (
+	huffmanMaxBits  = 15
+	huffmanFastBits = 9
+)
+
+// The longest match a single DEFLATE symbol can produce.
+const deflateMaxMatch = 258
+
+var errCorruptDeflate = errors.New("Corrupt DEFLATE data")
+
+var deflateLengthBase = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17,
+	19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+
+var deflateLengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2,
+	2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+
+var deflateDistanceBase = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49,
+	65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145,
+	8193, 12289, 16385, 24577}
+
+var deflateDistanceExtra = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5,
+	5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+
+// The order in which code length code lengths are stored in a dynamic block.
+var deflateCodeLengthOrder = [19]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11,
+	4, 12, 3, 13, 2, 14, 1, 15}
+
+// Reads DEFLATE data one bit at a time, least significant bit first, keeping
+// track of its position in the underlying file.
+type bitReader struct {
+	r *bufio.Reader
+	// Bits that have been read from r but not yet consumed.
+	bits  uint64
+	count uint
+	// The offset in the file of the next byte to read from r.
+	offset int64
+	// The error, if any, encountered when reading from r.
+	err error
+}
+
+// Returns a bitReader reading from r, which is at the given offset in the
+// file.
+func newBitReader(r *bufio.Reader, offset int64) *bitReader {
+	return &bitReader{
+		r:      r,
+		offset: offset,
+	}
+}
+
+// Returns the position of the next bit to be consumed, in bits from the start
+// of the file.
+func (b *bitReader) bitOffset() int64 {
+	return b.offset*8 - int64(b.count)
+}
+
+// Reads as many bytes as will fit into b.bits.
+func (b *bitReader) refill() {
+	for b.count <= 56 {
+		c, e := b.r.ReadByte()
+		if e != nil {
+			b.err = e
+			return
+		}
+		b.bits |= uint64(c) << b.count
+		b.count += 8
+		b.offset++
+	}
+}
+
+// Returns the error to report when running out of bits.
+func (b *bitReader) eofError() error {
+	if (b.err == nil) || (b.err == io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return b.err
+}
+
+// Consumes n bits, where n is at most 32.
+func (b *bitReader) readBits(n uint) (uint32, error) {
+	if b.count < n {
+		b.refill()
+		if b.count < n {
+			return 0, b.eofError()
+		}
+	}
+	v := uint32(b.bits & ((1 << n) - 1))
+	b.bits >>= n
+	b.count -= n
+	return v, nil
+}
+
+// Discards bits up to the next byte boundary.
+func (b *bitReader) alignToByte() {
+	n := b.count % 8
+	b.bits >>= n
+	b.count -= n
+}
+
+// Reads a byte, which must start at a byte boundary. Returns io.EOF if there
+// is no more data.
+func (b *bitReader) readByte() (byte, error) {
+	if b.count >= 8 {
+		v := byte(b.bits)
+		b.bits >>= 8
+		b.count -= 8
+		return v, nil
+	}
+	c, e := b.r.ReadByte()
+	if e != nil {
+		return 0, e
+	}
+	b.offset++
+	return c, nil
+}
+
+// Fills dst with bytes starting at a byte boundary.
+func (b *bitReader) readFull(dst []byte) error {
+	i := 0
+	for (i < len(dst)) && (b.count >= 8) {
+		dst[i], _ = b.readByte()
+		i++
+	}
+	n, e := io.ReadFull(b.r, dst[i:])
+	b.offset += int64(n)
+	if e == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return e
+}
+
+// A canonical Huffman code.
+type huffman struct {
+	// Indexed by the next huffmanFastBits bits of input. Each entry holds a
+	// symbol shifted left by 4, ORed with the length of its code, or 0 if the
+	// code is longer than huffmanFastBits.
+	fast [1 << huffmanFastBits]uint16
+	// The number of codes of each length.
+	count [huffmanMaxBits + 1]uint16
+	// The symbols, ordered by their codes.
+	symbol [288]uint16
+}
+
+// Reverses the lowest n bits of v.
+func reverseBits(v uint16, n uint) uint16 {
+	r := uint16(0)
+	for i := uint(0); i < n; i++ {
+		r = (r << 1) | (v & 1)
+		v >>= 1
+	}
+	return r
+}
+
+// Builds the code with the given code length for each symbol. Incomplete
+// codes are allowed, but reading an unused code is an error.
+func (h *huffman) init(lengths []uint8) error {
+	h.fast = [1 << huffmanFastBits]uint16{}
+	h.count = [huffmanMaxBits + 1]uint16{}
+	for _, n := range lengths {
+		h.count[n]++
+	}
+	h.count[0] = 0
+	left := 1
+	for i := 1; i <= huffmanMaxBits; i++ {
+		left <<= 1
+		left -= int(h.count[i])
+		if left < 0 {
+			return errCorruptDeflate
+		}
+	}
+	var offsets [huffmanMaxBits + 2]uint16
+	for i := 1; i <= huffmanMaxBits; i++ {
+		offsets[i+1] = offsets[i] + h.count[i]
+	}
+	for symbol, n := range lengths {
+		if n != 0 {
+			h.symbol[offsets[n]] = uint16(symbol)
+			offsets[n]++
+		}
+	}
+	code := uint16(0)
+	index := 0
+	for n := uint(1); n <= huffmanFastBits; n++ {
+		for i := 0; i < int(h.count[n]); i++ {
+			entry := (h.symbol[index] << 4) | uint16(n)
+			j := reverseBits(code, n)
+			for ; j < (1 << huffmanFastBits); j += 1 << n {
+				h.fast[j] = entry
+			}
+			code++
+			index++
+		}
+		code <<= 1
+	}
+	return nil
+}
+
+// Reads a symbol using the given code.
+func (b *bitReader) decode(h *huffman) (int, error) {
+	if b.count < huffmanMaxBits {
+		b.refill()
+	}
+	entry := h.fast[b.bits&((1<<huffmanFastBits)-1)]
+	n := uint(entry & 15)
+	if (entry != 0) && (n <= b.count) {
+		b.bits >>= n
+		b.count -= n
+		return int(entry >> 4), nil
+	}
+	// The code is longer than huffmanFastBits, or unused. Decode it one bit
+	// at a time, as in zlib's "puff" decoder.
+	code, first, index := 0, 0, 0
+	for n = 1; n <= huffmanMaxBits; n++ {
+		if n > b.count {
+			return 0, b.eofError()
+		}
+		code |= int((b.bits >> (n - 1)) & 1)
+		count := int(h.count[n])
+		if (code - count) < first {
+			b.bits >>= n
+			b.count -= n
+			return int(h.symbol[index+(code-first)]), nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+	return 0, errCorruptDeflate
+}
+
+// The codes used by blocks with fixed Huffman codes.
+var fixedLiteralCode, fixedDistanceCode huffman
+
+func init() {
+	var lengths [288]uint8
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	fixedLiteralCode.init(lengths[:])
+	for i := 0; i < 30; i++ {
+		lengths[i] = 5
+	}
+	fixedDistanceCode.init(lengths[:30])
+}
+
+// Decompresses a DEFLATE stream, which may be resumed at any block boundary.
+type inflater struct {
+	br *bitReader
+	// The decompressed data. Holds up to deflateWindowSize bytes of data that
+	// has already been returned, followed by any data that hasn't.
+	output []byte
+	// The offset in output of the first byte that hasn't been returned.
+	readOffset int
+	// The total number of bytes decompressed.
+	total int64
+	// Set while decompressing a block.
+	inBlock bool
+	// Set once the header of the last block in the stream has been read.
+	final bool
+	// The number of bytes left in the current block, if it's stored.
+	storedLeft int
+	// The codes used by the current block, if it's compressed.
+	literalCode, distanceCode *huffman
+	// Storage for the codes used by blocks with dynamic Huffman codes.
+	dynamicLiteral, dynamicDistance huffman
+	// If not nil, called at the start of every block, before its header is
+	// read.
+	onBlock func(f *inflater)
+}
+
+// Returns an inflater reading from br. The window holds the data preceding
+// the point at which decompression starts, and may be empty.
+func newInflater(br *bitReader, window []byte) *inflater {
+	toReturn := &inflater{
+		br:     br,
+		output: make([]byte, 0, deflateWindowSize+inflateBufferSize),
+	}
+	toReturn.output = append(toReturn.output, window...)
+	toReturn.readOffset = len(toReturn.output)
+	return toReturn
+}
+
+// Returns up to deflateWindowSize bytes preceding the next byte to be
+// decompressed.
+func (f *inflater) window() []byte {
+	if len(f.output) <= deflateWindowSize {
+		return f.output
+	}
+	return f.output[len(f.output)-deflateWindowSize:]
+}
+
+// Prepares to decompress another DEFLATE stream, e.g. in the next member of a
+// gzip file.
+func (f *inflater) restart() {
+	f.inBlock = false
+	f.final = false
+}
+
+// Reads the header of a block with dynamic Huffman codes, and builds them.
+func (f *inflater) readDynamicCodes() error {
+	v, e := f.br.readBits(14)
+	if e != nil {
+		return e
+	}
+	literalCount := int(v&0x1f) + 257
+	distanceCount := int((v>>5)&0x1f) + 1
+	codeLengthCount := int(v>>10) + 4
+	if (literalCount > 286) || (distanceCount > 30) {
+		return errCorruptDeflate
+	}
+	var lengths [286 + 30]uint8
+	for i := 0; i < codeLengthCount; i++ {
+		v, e = f.br.readBits(3)
+		if e != nil {
+			return e
+		}
+		lengths[deflateCodeLengthOrder[i]] = uint8(v)
+	}
+	var codeLengthCode huffman
+	e = codeLengthCode.init(lengths[:19])
+	if e != nil {
+		return e
+	}
+	lengths = [286 + 30]uint8{}
+	total := literalCount + distanceCount
+	for i := 0; i < total; {
+		symbol, e := f.br.decode(&codeLengthCode)
+		if e != nil {
+			return e
+		}
+		if symbol < 16 {
+			lengths[i] = uint8(symbol)
+			i++
+			continue
+		}
+		value := uint8(0)
+		var repeat uint32
+		switch symbol {
+		case 16:
+			if i == 0 {
+				return errCorruptDeflate
+			}
+			value = lengths[i-1]
+			repeat, e = f.br.readBits(2)
+			repeat += 3
+		case 17:
+			repeat, e = f.br.readBits(3)
+			repeat += 3
+		default:
+			repeat, e = f.br.readBits(7)
+			repeat += 11
+		}
+		if e != nil {
+			return e
+		}
+		if (i + int(repeat)) > total {
+			return errCorruptDeflate
+		}
+		for ; repeat > 0; repeat-- {
+			lengths[i] = value
+			i++
+		}
+	}
+	if lengths[256] == 0 {
+		// The block can't end without an end-of-block code.
+		return errCorruptDeflate
+	}
+	e = f.dynamicLiteral.init(lengths[:literalCount])
+	if e != nil {
+		return e
+	}
+	e = f.dynamicDistance.init(lengths[literalCount:total])
+	if e != nil {
+		return e
+	}
+	f.literalCode = &f.dynamicLiteral
+	f.distanceCode = &f.dynamicDistance
+	return nil
+}
+
+// Reads the header of the next block.
+func (f *inflater) readBlockHeader() error {
+	if f.onBlock != nil {
+		f.onBlock(f)
+	}
+	v, e := f.br.readBits(3)
+	if e != nil {
+		return e
+	}
+	f.final = (v & 1) != 0
+	switch v >> 1 {
+	case 0:
+		f.br.alignToByte()
+		var lengths [4]byte
+		e = f.br.readFull(lengths[:])
+		if e != nil {
+			return e
+		}
+		length := uint16(lengths[0]) | (uint16(lengths[1]) << 8)
+		inverse := uint16(lengths[2]) | (uint16(lengths[3]) << 8)
+		if length != ^inverse {
+			return errCorruptDeflate
+		}
+		f.storedLeft = int(length)
+		f.literalCode = nil
+	case 1:
+		f.literalCode = &fixedLiteralCode
+		f.distanceCode = &fixedDistanceCode
+	case 2:
+		e = f.readDynamicCodes()
+		if e != nil {
+			return e
+		}
+	default:
+		return errCorruptDeflate
+	}
+	f.inBlock = true
+	return nil
+}
+
+// Decompresses data from the current block until it ends or the output
+// buffer is full.
+func (f *inflater) decompressBlock() error {
+	limit := cap(f.output)
+	if f.literalCode == nil {
+		n := f.storedLeft
+		if n > (limit - len(f.output)) {
+			n = limit - len(f.output)
+		}
+		start := len(f.output)
+		f.output = f.output[:start+n]
+		e := f.br.readFull(f.output[start:])
+		if e != nil {
+			f.output = f.output[:start]
+			return e
+		}
+		f.storedLeft -= n
+		f.total += int64(n)
+		f.inBlock = f.storedLeft != 0
+		return nil
+	}
+	limit -= deflateMaxMatch
+	for len(f.output) < limit {
+		symbol, e := f.br.decode(f.literalCode)
+		if e != nil {
+			return e
+		}
+		if symbol < 256 {
+			f.output = append(f.output, byte(symbol))
+			f.total++
+			continue
+		}
+		if symbol == 256 {
+			f.inBlock = false
+			return nil
+		}
+		symbol -= 257
+		if symbol >= len(deflateLengthBase) {
+			return errCorruptDeflate
+		}
+		extra, e := f.br.readBits(uint(deflateLengthExtra[symbol]))
+		if e != nil {
+			return e
+		}
+		length := int(deflateLengthBase[symbol]) + int(extra)
+		symbol, e = f.br.decode(f.distanceCode)
+		if e != nil {
+			return e
+		}
+		if symbol >= len(deflateDistanceBase) {
+			return errCorruptDeflate
+		}
+		extra, e = f.br.readBits(uint(deflateDistanceExtra[symbol]))
+		if e != nil {
+			return e
+		}
+		distance := int(deflateDistanceBase[symbol]) + int(extra)
+		start := len(f.output)
+		if distance > start {
+			return errCorruptDeflate
+		}
+		f.output = f.output[:start+length]
+		if distance >= length {
+			copy(f.output[start:], f.output[start-distance:start])
+		} else {
+			// The match overlaps the data it produces.
+			for i := start; i < (start + length); i++ {
+				f.output[i] = f.output[i-distance]
+			}
+		}
+		f.total += int64(length)
+	}
+	return nil
+}
+
+// Reads decompressed data. Returns io.EOF at the end of the DEFLATE stream,
+// leaving the bitReader at the bit following the last block.
+func (f *inflater) Read(dst []byte) (int, error) {
+	for f.readOffset == len(f.output) {
+		if !f.inBlock && f.final {
+			return 0, io.EOF
+		}
+		if len(f.output) >= (cap(f.output) - deflateMaxMatch) {
+			// Everything has been returned; keep only the window.
+			n := copy(f.output, f.window())
+			f.output = f.output[:n]
+			f.readOffset = n
+		}
+		var e error
+		if f.inBlock {
+			e = f.decompressBlock()
+		} else {
+			e = f.readBlockHeader()
+		}
+		if e != nil {
+			return 0, e
+		}
+	}
+	n := copy(dst, f.output[f.readOffset:])
+	f.readOffset += n
+	return n, nil
+}
@@ -0,0 +1,120 @@
+package fat
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// Returns data containing a mix of text, random bytes and runs of zeros, so
+// that the compressor uses literals, matches and all block types.
+func mixedTestData(size int) []byte {
+	rng := rand.New(rand.NewSource(1337))
+	words := []string{"FAT32 ", "cluster ", "directory ", "\x00\x00\x00\x00",
+		"sector ", "TEST.TXT ", "\xff\xff\xff\x0f"}
+	data := make([]byte, 0, size)
+	for len(data) < size {
+		n := rng.Intn(20000)
+		switch rng.Intn(3) {
+		case 0:
+			for i := 0; i < n; i += 8 {
+				data = append(data, words[rng.Intn(len(words))]...)
+			}
+		case 1:
+			start := len(data)
+			data = append(data, make([]byte, n)...)
+			rng.Read(data[start:])
+		default:
+			data = append(data, make([]byte, n*10)...)
+		}
+	}
+	return data[:size]
+}
+
+func TestInflate(t *testing.T) {
+	data := mixedTestData(3 * 1024 * 1024)
+	levels := []int{flate.NoCompression, flate.BestSpeed,
+		flate.DefaultCompression, flate.BestCompression, flate.HuffmanOnly}
+	for _, level := range levels {
+		var compressed bytes.Buffer
+		w, _ := flate.NewWriter(&compressed, level)
+		w.Write(data)
+		w.Close()
+		br := newBitReader(bufio.NewReader(bytes.NewReader(
+			compressed.Bytes())), 0)
+		f := newInflater(br, nil)
+		// Record a checkpoint at every block boundary.
+		type checkpoint struct {
+			bitOffset int64
+			total     int64
+			window    []byte
+		}
+		var checkpoints []checkpoint
+		f.onBlock = func(f *inflater) {
+			checkpoints = append(checkpoints, checkpoint{
+				bitOffset: f.br.bitOffset(),
+				total:     f.total,
+				window:    bytes.Clone(f.window()),
+			})
+		}
+		result, e := io.ReadAll(f)
+		if e != nil {
+			t.Logf("Failed decompressing level %d data: %s\n", level, e)
+			t.FailNow()
+		}
+		if !bytes.Equal(result, data) {
+			t.Logf("Incorrect decompressed data at level %d\n", level)
+			t.FailNow()
+		}
+		if len(checkpoints) < 2 {
+			t.Logf("Expected several blocks at level %d, got %d\n", level,
+				len(checkpoints))
+			t.FailNow()
+		}
+		// Resume from a few of the block boundaries.
+		for i := 1; i < len(checkpoints); i += len(checkpoints)/4 + 1 {
+			c := &(checkpoints[i])
+			input := bytes.NewReader(compressed.Bytes()[c.bitOffset/8:])
+			br = newBitReader(bufio.NewReader(input), c.bitOffset/8)
+			br.readBits(uint(c.bitOffset % 8))
+			result, e = io.ReadAll(newInflater(br, c.window))
+			if e != nil {
+				t.Logf("Failed resuming level %d data at bit %d: %s\n", level,
+					c.bitOffset, e)
+				t.FailNow()
+			}
+			if !bytes.Equal(result, data[c.total:]) {
+				t.Logf("Incorrect data resuming level %d data at bit %d\n",
+					level, c.bitOffset)
+				t.FailNow()
+			}
+		}
+	}
+}
+
+func TestInflateCorrupt(t *testing.T) {
+	data := mixedTestData(200000)
+	var compressed bytes.Buffer
+	w, _ := flate.NewWriter(&compressed, flate.DefaultCompression)
+	w.Write(data)
+	w.Close()
+	// A truncated stream must produce an error rather than short output.
+	truncated := compressed.Bytes()[:compressed.Len()/2]
+	br := newBitReader(bufio.NewReader(bytes.NewReader(truncated)), 0)
+	_, e := io.ReadAll(newInflater(br, nil))
+	if e != io.ErrUnexpectedEOF {
+		t.Logf("Expected io.ErrUnexpectedEOF for truncated data, got %v\n", e)
+		t.Fail()
+	}
+	// Block type 3 is invalid.
+	br = newBitReader(bufio.NewReader(bytes.NewReader([]byte{0x07})), 0)
+	_, e = io.ReadAll(newInflater(br, nil))
+	if e != errCorruptDeflate {
+		t.Logf("Expected errCorruptDeflate for an invalid block, got %v\n",
+			e)
+		t.Fail()
+	}
+}
@@ -0,0 +1,20 @@
+package cmdflags
+
+import (
+	"flag"
+	"github.com/yalue/fat"
+)
+
+// Adds the -temp_dir flag to the default command-line flag set. The returned
+// options are filled in when the flags are parsed, and can be passed to
+// fat.OpenImageWithOptions.
+func AddImageOptionFlags() *fat.ImageOptions {
+	options := &fat.ImageOptions{}
+	flag.StringVar(&options.TemporaryDirectory, "temp_dir", "",
+		"If set, compressed images that can't be read in place, such as "+
+			"zstd files with a single frame, are decompressed to a "+
+			"temporary file in this directory, which needs room for the "+
+			"whole decompressed image. Otherwise, such images must be "+
+			"decompressed before running this.")
+	return options
+}
@@ -0,0 +1,106 @@
+// Package cmdflags contains command-line flags shared by the tools in this
+// repository.
+package cmdflags
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/yalue/fat"
+)
+
+// Holds the values of the flags controlling how a fat.TolerantImage handles
+// read errors.
+type ReadRetryFlags struct {
+	retries     int
+	fillPattern string
+}
+
+// Adds the -read_retries and -fill_pattern flags to the default command-line
+// flag set. The condition, if not empty, is appended to the flags' help,
+// e.g. "if -tolerate_read_errors is set".
+func addReadRetryFlags(f *ReadRetryFlags, condition string) {
+	if condition != "" {
+		condition = ", " + condition
+	}
+	flag.IntVar(&f.retries, "read_retries", fat.DefaultReadRetries,
+		"The number of times to retry reading each failed sector"+
+			condition+".")
+	flag.StringVar(&f.fillPattern, "fill_pattern", "",
+		"A pattern, in hex, repeated to fill sectors that can't be read"+
+			condition+". Defaults to zeros.")
+}
+
+// Adds the -read_retries and -fill_pattern flags to the default command-line
+// flag set, for tools that always read using a fat.TolerantImage.
+func AddReadRetryFlags() *ReadRetryFlags {
+	f := &ReadRetryFlags{}
+	addReadRetryFlags(f, "")
+	return f
+}
+
+// Returns false if -read_retries is invalid. An invalid -fill_pattern is
+// reported by FillPattern.
+func (f *ReadRetryFlags) Valid() bool {
+	return f.retries >= 0
+}
+
+// Returns the value of -read_retries, to use as fat.TolerantImage.Retries.
+func (f *ReadRetryFlags) Retries() int {
+	return f.retries
+}
+
+// Decodes -fill_pattern, to use as fat.TolerantImage.FillPattern.
+func (f *ReadRetryFlags) FillPattern() ([]byte, error) {
+	fill, e := hex.DecodeString(f.fillPattern)
+	if e != nil {
+		return nil, fmt.Errorf("Invalid fill pattern: %w", e)
+	}
+	return fill, nil
+}
+
+// Holds the values of the flags used to read images from failing media. See
+// fat.TolerantImage.
+type TolerantImageFlags struct {
+	ReadRetryFlags
+	tolerateErrors bool
+	errorMapPath   string
+}
+
+// Adds the -tolerate_read_errors, -error_map, -read_retries and -fill_pattern
+// flags to the default command-line flag set.
+func AddTolerantImageFlags() *TolerantImageFlags {
+	f := &TolerantImageFlags{}
+	flag.BoolVar(&f.tolerateErrors, "tolerate_read_errors", false,
+		"If set, the image is read as a raw disk, e.g. a failing device, "+
+			"and failed reads are retried one sector at a time. Sectors "+
+			"that still can't be read are filled rather than stopping.")
+	flag.StringVar(&f.errorMapPath, "error_map", "",
+		"If set, log the ranges that couldn't be read to this GNU "+
+			"ddrescue-format mapfile. Implies -tolerate_read_errors.")
+	addReadRetryFlags(&f.ReadRetryFlags, "if -tolerate_read_errors is set")
+	return f
+}
+
+// Returns true if the image should be opened using Open, i.e. if
+// -tolerate_read_errors or -error_map was given.
+func (f *TolerantImageFlags) Enabled() bool {
+	return f.tolerateErrors || (f.errorMapPath != "")
+}
+
+// Opens the disk or image at the given path using the settings from the
+// flags, retrying failed reads and filling sectors that can't be read instead
+// of stopping.
+func (f *TolerantImageFlags) Open(path string) (*fat.TolerantImage, error) {
+	fill, e := f.FillPattern()
+	if e != nil {
+		return nil, e
+	}
+	img, e := fat.OpenTolerantImage(path, f.errorMapPath)
+	if e != nil {
+		return nil, e
+	}
+	img.Retries = f.retries
+	img.FillPattern = fill
+	return img, nil
+}
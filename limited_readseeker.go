@@ -25,7 +25,7 @@ type LimitedReadSeeker struct {
 // just use the original wrapped object and adjust the offsets.
 func nestedReadSeekerOptimization(input *LimitedReadSeeker, baseOffset,
 	limit int64) (io.ReadSeeker, error) {
-	if (baseOffset + limit) > input.size {
+	if limit > input.size {
 		return nil, fmt.Errorf("Size of nested LimitedReadSeeker exceeds " +
 			"the limit of the original instance")
 	}
@@ -117,3 +117,91 @@ func (s *LimitedReadSeeker) Read(dst []byte) (int, error) {
 	// Return the underlying error returned by the wrapped read.
 	return bytesRead, e
 }
+
+// Writes to the underlying ReadSeeker, which must also implement io.Writer.
+// Like Read, this will not write past the limit. This allows a partition
+// returned by GetPartition to be used as an io.ReadWriteSeeker, if the image
+// containing it is writable. Note: this is *not* thread safe when using
+// multiple wrapped ReadSeekers with the same underlying source!
+func (s *LimitedReadSeeker) Write(data []byte) (int, error) {
+	writer, ok := s.wrapped.(io.Writer)
+	if !ok {
+		return 0, fmt.Errorf("The underlying ReadSeeker isn't writable")
+	}
+	writeSize := len(data)
+	var resultErr error
+	writeEndOffset := s.currentOffset + int64(writeSize)
+	if writeEndOffset > s.size {
+		resultErr = io.ErrShortWrite
+		writeSize -= int(writeEndOffset - s.size)
+		if writeSize < 0 {
+			writeSize = 0
+		}
+	}
+	_, e := s.wrapped.Seek(s.currentOffset+s.baseOffset, io.SeekStart)
+	if e != nil {
+		return 0, fmt.Errorf("Error seeking in underlying ReadSeeker: %w", e)
+	}
+	bytesWritten, e := writer.Write(data[0:writeSize])
+	s.currentOffset += int64(bytesWritten)
+	if e == nil {
+		return bytesWritten, resultErr
+	}
+	return bytesWritten, e
+}
+
+// Returns the parts of the given range that couldn't be read when the image
+// was acquired, if the underlying ReadSeeker implements
+// UnreadableRangeReporter. Offsets are relative to the start of this
+// LimitedReadSeeker.
+func (s *LimitedReadSeeker) UnreadableRanges(offset,
+	size int64) []RescueBlock {
+	reporter, ok := s.wrapped.(UnreadableRangeReporter)
+	if !ok {
+		return nil
+	}
+	if (offset + size) > s.size {
+		size = s.size - offset
+	}
+	if size <= 0 {
+		return nil
+	}
+	toReturn := reporter.UnreadableRanges(offset+s.baseOffset, size)
+	for i := range toReturn {
+		toReturn[i].Offset -= s.baseOffset
+	}
+	return toReturn
+}
+
+// Returns the size of the region, in bytes.
+func (s *LimitedReadSeeker) Size() int64 {
+	return s.size
+}
+
+// Reads from the given offset, relative to the start of the region, without
+// modifying the current offset. The underlying ReadSeeker must implement
+// io.ReaderAt. Unlike Read, this is safe to call concurrently if the
+// underlying ReadAt is.
+func (s *LimitedReadSeeker) ReadAt(dst []byte, offset int64) (int, error) {
+	readerAt, ok := s.wrapped.(io.ReaderAt)
+	if !ok {
+		return 0, fmt.Errorf("The underlying ReadSeeker doesn't implement " +
+			"io.ReaderAt")
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Invalid read offset: %d", offset)
+	}
+	if offset >= s.size {
+		return 0, io.EOF
+	}
+	var resultErr error
+	if (offset + int64(len(dst))) > s.size {
+		dst = dst[:s.size-offset]
+		resultErr = io.EOF
+	}
+	bytesRead, e := readerAt.ReadAt(dst, offset+s.baseOffset)
+	if e == nil {
+		return bytesRead, resultErr
+	}
+	return bytesRead, e
+}
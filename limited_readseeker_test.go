@@ -3,6 +3,7 @@ package fat
 import (
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -77,4 +78,89 @@ func TestNestedLimiting(t *testing.T) {
 			expected, dst)
 		t.FailNow()
 	}
+	// A nested range ending at the original limit should be allowed.
+	limited, e = LimitReadSeeker(getTestFile(t), 3, 30)
+	if e != nil {
+		t.Logf("Failed creating LimitedReadSeeker: %s\n", e)
+		t.FailNow()
+	}
+	limited, e = LimitReadSeeker(limited, 20, 27)
+	if e != nil {
+		t.Logf("Failed limiting to the end of a LimitedReadSeeker: %s\n", e)
+		t.FailNow()
+	}
+}
+
+func TestLimitedWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alphabet.txt")
+	e := os.WriteFile(path, []byte("abcdefghijklmnopqrstuvwxyz"), 0644)
+	if e != nil {
+		t.Logf("Failed creating test file: %s\n", e)
+		t.FailNow()
+	}
+	underlying, e := os.OpenFile(path, os.O_RDWR, 0)
+	if e != nil {
+		t.Logf("Failed opening test file: %s\n", e)
+		t.FailNow()
+	}
+	defer underlying.Close()
+	limited, e := LimitReadSeeker(underlying, 3, 6)
+	if e != nil {
+		t.Logf("Failed getting limited reader: %s\n", e)
+		t.FailNow()
+	}
+	writer := limited.(io.ReadWriteSeeker)
+	amount, e := writer.Write([]byte("DEFGH"))
+	if e == nil {
+		t.Logf("Didn't get an error when writing beyond the limit.\n")
+		t.FailNow()
+	}
+	if amount != 3 {
+		t.Logf("Expected to write 3 bytes, wrote %d.\n", amount)
+		t.FailNow()
+	}
+	content, e := os.ReadFile(path)
+	if e != nil {
+		t.Logf("Failed reading test file: %s\n", e)
+		t.FailNow()
+	}
+	expected := "abcDEFghijklmnopqrstuvwxyz"
+	if string(content) != expected {
+		t.Logf("Expected \"%s\", got \"%s\".\n", expected, content)
+		t.FailNow()
+	}
+}
+
+func TestLimitedReadAt(t *testing.T) {
+	underlying := getTestFile(t)
+	limited, e := LimitReadSeeker(underlying, 3, 30)
+	if e != nil {
+		t.Logf("Failed getting limited reader: %s\n", e)
+		t.FailNow()
+	}
+	readerAt := limited.(io.ReaderAt)
+	dst := make([]byte, 4)
+	_, e = readerAt.ReadAt(dst, 1)
+	if e != nil {
+		t.Logf("Failed reading from LimitedReadSeeker: %s\n", e)
+		t.FailNow()
+	}
+	if string(dst) != "efgh" {
+		t.Logf("Expected \"efgh\", got \"%s\".\n", dst)
+		t.FailNow()
+	}
+	amount, e := readerAt.ReadAt(dst, 25)
+	if e != io.EOF {
+		t.Logf("Didn't get EOF when reading beyond the limit: %v\n", e)
+		t.FailNow()
+	}
+	if string(dst[:amount]) != "CD" {
+		t.Logf("Expected \"CD\" at the end, got \"%s\".\n", dst[:amount])
+		t.FailNow()
+	}
+	offset, _ := limited.Seek(0, io.SeekCurrent)
+	if offset != 0 {
+		t.Logf("ReadAt changed the current offset to %d\n", offset)
+		t.Fail()
+	}
 }
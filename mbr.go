@@ -0,0 +1,145 @@
+package fat
+
+// This file contains functions for building or modifying an MBR partition
+// table, and writing it to an image.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Partition type bytes for FAT32 partitions. The LBA variant is preferred for
+// new partitions.
+const (
+	PartitionTypeFAT32    = 0x0b
+	PartitionTypeFAT32LBA = 0x0c
+)
+
+// The bit in PartitionTableEntry.Attributes marking the active (bootable)
+// partition.
+const PartitionActiveFlag = 0x80
+
+// The disk geometry assumed when converting LBAs to CHS addresses. This is the
+// geometry used by virtually every modern partitioning tool.
+const (
+	mbrHeadCount       = 255
+	mbrSectorsPerTrack = 63
+)
+
+// Returns true if the partition table entry is unused.
+func (n *PartitionTableEntry) IsEmpty() bool {
+	return (n.PartitionType == 0) || (n.SectorCount == 0)
+}
+
+// Returns true if the partition is marked as active.
+func (n *PartitionTableEntry) IsActive() bool {
+	return (n.Attributes & PartitionActiveFlag) != 0
+}
+
+// Returns the LBA of the sector after the last sector in the partition.
+func (n *PartitionTableEntry) EndLBA() uint64 {
+	return uint64(n.LBAStartAddress) + uint64(n.SectorCount)
+}
+
+// Converts the given LBA to the 3-byte CHS address format used in partition
+// table entries, assuming 255 heads and 63 sectors per track. LBAs beyond the
+// range of CHS addressing are converted to the maximum CHS address, as is
+// conventional.
+func LBAToCHS(lba uint32) [3]byte {
+	sectorsPerCylinder := uint32(mbrHeadCount * mbrSectorsPerTrack)
+	cylinder := lba / sectorsPerCylinder
+	if cylinder > 1023 {
+		return [3]byte{0xfe, 0xff, 0xff}
+	}
+	head := (lba / mbrSectorsPerTrack) % mbrHeadCount
+	// CHS sector numbers start at 1.
+	sector := (lba % mbrSectorsPerTrack) + 1
+	return [3]byte{
+		byte(head),
+		byte(sector) | byte((cylinder>>2)&0xc0),
+		byte(cylinder),
+	}
+}
+
+// Returns a new, empty MBR with the given disk ID and a valid signature.
+func NewMBR(diskID uint32) *MBR {
+	var toReturn MBR
+	binary.LittleEndian.PutUint32(toReturn.DiskID[:], diskID)
+	toReturn.Signature = [2]byte{0x55, 0xaa}
+	return &toReturn
+}
+
+// Sets the partition table entry at the given index, filling in the CHS
+// addresses from the LBA range. If active is true, the partition is marked as
+// active, and the active flag is cleared from every other partition. Returns
+// an error if the new partition would overlap another one. A sector count of
+// 0 clears the entry.
+func (m *MBR) SetPartition(index int, partitionType byte, startLBA,
+	sectorCount uint32, active bool) error {
+	if (index < 0) || (index >= len(m.Partitions)) {
+		return fmt.Errorf("Invalid partition index: %d", index)
+	}
+	if sectorCount == 0 {
+		m.Partitions[index] = PartitionTableEntry{}
+		return nil
+	}
+	if partitionType == 0 {
+		return fmt.Errorf("Partition type 0 is reserved for empty entries")
+	}
+	if startLBA == 0 {
+		return fmt.Errorf("A partition can't start at the MBR's sector")
+	}
+	endLBA := uint64(startLBA) + uint64(sectorCount)
+	if endLBA > 0x100000000 {
+		return fmt.Errorf("Partition ends beyond the last sector addressable "+
+			"by an MBR (sector %d)", endLBA)
+	}
+	for i := range m.Partitions {
+		other := &(m.Partitions[i])
+		if (i == index) || other.IsEmpty() {
+			continue
+		}
+		if (uint64(startLBA) < other.EndLBA()) &&
+			(uint64(other.LBAStartAddress) < endLBA) {
+			return fmt.Errorf("New partition %d would overlap partition %d",
+				index, i)
+		}
+	}
+	entry := PartitionTableEntry{
+		CHSStartAddress: LBAToCHS(startLBA),
+		PartitionType:   partitionType,
+		CHSEndAddress:   LBAToCHS(uint32(endLBA - 1)),
+		LBAStartAddress: startLBA,
+		SectorCount:     sectorCount,
+	}
+	if active {
+		for i := range m.Partitions {
+			m.Partitions[i].Attributes &^= PartitionActiveFlag
+		}
+		entry.Attributes = PartitionActiveFlag
+	}
+	m.Partitions[index] = entry
+	return nil
+}
+
+// Returns the 512-byte on-disk representation of the MBR.
+func (m *MBR) Bytes() []byte {
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, m)
+	return buffer.Bytes()
+}
+
+// Writes the MBR to the first sector of the given image.
+func WriteMBR(image io.WriteSeeker, mbr *MBR) error {
+	_, e := image.Seek(0, io.SeekStart)
+	if e != nil {
+		return fmt.Errorf("Failed seeking to start of image: %w", e)
+	}
+	_, e = image.Write(mbr.Bytes())
+	if e != nil {
+		return fmt.Errorf("Failed writing MBR: %w", e)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package fat
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLBAToCHS(t *testing.T) {
+	lbas := []uint32{0, 63, 2048, 16450559, 16450560, 0xffffffff}
+	expected := [][3]byte{
+		{0, 1, 0},
+		{1, 1, 0},
+		{0x20, 0x21, 0},
+		{0xfe, 0xff, 0xff},
+		{0xfe, 0xff, 0xff},
+		{0xfe, 0xff, 0xff},
+	}
+	for i, lba := range lbas {
+		chs := LBAToCHS(lba)
+		if chs != expected[i] {
+			t.Logf("Expected CHS % x for LBA %d, got % x\n", expected[i][:],
+				lba, chs[:])
+			t.Fail()
+		}
+	}
+}
+
+func TestSetPartition(t *testing.T) {
+	mbr := NewMBR(0x1234)
+	e := mbr.SetPartition(0, PartitionTypeFAT32LBA, 2048, 1000, true)
+	if e != nil {
+		t.Logf("Failed setting partition 0: %s\n", e)
+		t.FailNow()
+	}
+	e = mbr.SetPartition(1, PartitionTypeFAT32LBA, 2500, 1000, false)
+	if e == nil {
+		t.Logf("Didn't get expected error for overlapping partitions\n")
+		t.Fail()
+	}
+	e = mbr.SetPartition(1, PartitionTypeFAT32LBA, 3048, 1000, true)
+	if e != nil {
+		t.Logf("Failed setting partition 1: %s\n", e)
+		t.FailNow()
+	}
+	if mbr.Partitions[0].IsActive() || !mbr.Partitions[1].IsActive() {
+		t.Logf("Setting an active partition didn't clear the old one\n")
+		t.Fail()
+	}
+	e = mbr.SetPartition(4, PartitionTypeFAT32LBA, 5000, 1000, false)
+	if e == nil {
+		t.Logf("Didn't get expected error for invalid partition index\n")
+		t.Fail()
+	}
+	e = mbr.SetPartition(0, 0, 0, 0, false)
+	if (e != nil) || !mbr.Partitions[0].IsEmpty() {
+		t.Logf("Failed clearing partition 0: %v\n", e)
+		t.Fail()
+	}
+	data := mbr.Bytes()
+	if (len(data) != SectorSize) || (data[510] != 0x55) ||
+		(data[511] != 0xaa) {
+		t.Logf("Got invalid serialized MBR\n")
+		t.Fail()
+	}
+}
+
+func TestMultiPartitionDisk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	file, e := os.Create(path)
+	if e != nil {
+		t.Logf("Failed creating disk image: %s\n", e)
+		t.FailNow()
+	}
+	defer file.Close()
+	mbr := NewMBR(0xdeadbeef)
+	starts := []uint32{2048, 2048 + testSmallVolumeSectors}
+	sizes := []uint32{testSmallVolumeSectors, testSmallVolumeSectors + 1024}
+	for i := range starts {
+		e = mbr.SetPartition(i, PartitionTypeFAT32LBA, starts[i], sizes[i],
+			i == 0)
+		if e != nil {
+			t.Logf("Failed setting partition %d: %s\n", i, e)
+			t.FailNow()
+		}
+	}
+	e = WriteMBR(file, mbr)
+	if e != nil {
+		t.Logf("Failed writing MBR: %s\n", e)
+		t.FailNow()
+	}
+	for i := range starts {
+		partition, e := GetPartition(file, mbr, i)
+		if e != nil {
+			t.Logf("Failed getting partition %d: %s\n", i, e)
+			t.FailNow()
+		}
+		e = Format(partition.(io.WriteSeeker), int64(sizes[i])*SectorSize,
+			&FormatOptions{
+				SectorsPerCluster: 1,
+				HiddenSectors:     starts[i],
+			})
+		if e != nil {
+			t.Logf("Failed formatting partition %d: %s\n", i, e)
+			t.FailNow()
+		}
+	}
+
+	parsed, e := ParseMBR(file)
+	if e != nil {
+		t.Logf("Failed parsing written MBR: %s\n", e)
+		t.FailNow()
+	}
+	if *parsed != *mbr {
+		t.Logf("Parsed MBR doesn't match the one that was written\n")
+		t.Fail()
+	}
+	for i := range starts {
+		partition, e := GetPartition(file, parsed, i)
+		if e != nil {
+			t.Logf("Failed getting parsed partition %d: %s\n", i, e)
+			t.FailNow()
+		}
+		f, e := NewFAT32Filesystem(partition)
+		if e != nil {
+			t.Logf("Failed opening filesystem in partition %d: %s\n", i, e)
+			t.FailNow()
+		}
+		if f.Header.BPB.HiddenSectorCount != starts[i] {
+			t.Logf("Partition %d has incorrect hidden sector count: %d\n", i,
+				f.Header.BPB.HiddenSectorCount)
+			t.Fail()
+		}
+	}
+}
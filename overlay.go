@@ -0,0 +1,422 @@
+package fat
+
+// This file contains a copy-on-write overlay, allowing images to be modified
+// (e.g. when experimenting with repairs) without ever writing to the original.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Returns the size of the given seekable content. Unlike seeking to the end
+// directly, this doesn't treat the io.EOF returned by LimitedReadSeeker as an
+// error.
+func contentSize(s io.Seeker) (int64, error) {
+	size, e := s.Seek(0, io.SeekEnd)
+	if (e != nil) && !errors.Is(e, io.EOF) {
+		return 0, e
+	}
+	return size, nil
+}
+
+// Holds a single modified sector, as returned by Overlay.Diff.
+type SectorChange struct {
+	// The index of the sector in the underlying content.
+	Sector int64
+	// The content of the sector in the underlying content.
+	Original []byte
+	// The content of the sector in the overlay.
+	Modified []byte
+}
+
+// Returns the offset of the changed sector in the underlying content.
+func (c *SectorChange) Offset() int64 {
+	return c.Sector * SectorSize
+}
+
+// The size of each record in an overlay's sidecar file: an 8-byte sector
+// number, followed by the sector's content.
+const overlayRecordSize = 8 + SectorSize
+
+// Implements io.ReadWriteSeeker on top of an underlying io.ReadSeeker, which
+// is never written to. Instead, modified sectors are stored in memory or in a
+// sidecar file. The overlay has the same size as the underlying content;
+// writes past the end fail. Like LimitedReadSeeker, this will modify the
+// offset of the underlying ReadSeeker when used.
+type Overlay struct {
+	wrapped       io.ReadSeeker
+	size          int64
+	currentOffset int64
+	// Maps sector numbers to their modified content, if there's no sidecar.
+	sectors map[int64][]byte
+	// The sidecar file, or nil if modified sectors are kept in memory.
+	sidecar *os.File
+	// Maps sector numbers to the offset of their record in the sidecar.
+	sidecarOffsets map[int64]int64
+}
+
+// Returns a new Overlay over the given content, holding modified sectors in
+// memory.
+func NewOverlay(wrapped io.ReadSeeker) (*Overlay, error) {
+	size, e := contentSize(wrapped)
+	if e != nil {
+		return nil, fmt.Errorf("Error getting size of underlying content: %w",
+			e)
+	}
+	return &Overlay{
+		wrapped: wrapped,
+		size:    size,
+		sectors: make(map[int64][]byte),
+	}, nil
+}
+
+// Returns a new Overlay over the given content, storing modified sectors in
+// the sidecar file at the given path. If the sidecar file already exists, the
+// modifications it contains are loaded, so that an overlay can be reused
+// across runs. Close must be called to close the sidecar file.
+func NewFileOverlay(wrapped io.ReadSeeker, sidecarPath string) (*Overlay,
+	error) {
+	toReturn, e := NewOverlay(wrapped)
+	if e != nil {
+		return nil, e
+	}
+	toReturn.sectors = nil
+	toReturn.sidecarOffsets = make(map[int64]int64)
+	f, e := os.OpenFile(sidecarPath, os.O_RDWR|os.O_CREATE, 0644)
+	if e != nil {
+		return nil, fmt.Errorf("Error opening overlay sidecar file: %w", e)
+	}
+	toReturn.sidecar = f
+	e = toReturn.loadSidecar()
+	if e != nil {
+		f.Close()
+		return nil, fmt.Errorf("Error loading %s: %w", sidecarPath, e)
+	}
+	return toReturn, nil
+}
+
+// Reads the sector numbers of each record in the sidecar file.
+func (o *Overlay) loadSidecar() error {
+	size, e := contentSize(o.sidecar)
+	if e != nil {
+		return e
+	}
+	if (size % overlayRecordSize) != 0 {
+		return fmt.Errorf("Invalid sidecar file size: %d bytes", size)
+	}
+	var sectorNumber int64
+	for offset := int64(0); offset < size; offset += overlayRecordSize {
+		_, e = o.sidecar.Seek(offset, io.SeekStart)
+		if e != nil {
+			return e
+		}
+		e = binary.Read(o.sidecar, binary.LittleEndian, &sectorNumber)
+		if e != nil {
+			return e
+		}
+		if (sectorNumber < 0) || ((sectorNumber * SectorSize) >= o.size) {
+			return fmt.Errorf("Sidecar contains invalid sector %d",
+				sectorNumber)
+		}
+		o.sidecarOffsets[sectorNumber] = offset
+	}
+	return nil
+}
+
+// Returns the size of the overlay, which is the same as the size of the
+// underlying content.
+func (o *Overlay) Size() int64 {
+	return o.size
+}
+
+// Returns the number of modified sectors in the overlay.
+func (o *Overlay) ModifiedSectorCount() int {
+	if o.sidecar != nil {
+		return len(o.sidecarOffsets)
+	}
+	return len(o.sectors)
+}
+
+// Returns the sorted list of modified sector numbers.
+func (o *Overlay) modifiedSectors() []int64 {
+	toReturn := make([]int64, 0, o.ModifiedSectorCount())
+	if o.sidecar != nil {
+		for s := range o.sidecarOffsets {
+			toReturn = append(toReturn, s)
+		}
+	} else {
+		for s := range o.sectors {
+			toReturn = append(toReturn, s)
+		}
+	}
+	sort.Slice(toReturn, func(a, b int) bool {
+		return toReturn[a] < toReturn[b]
+	})
+	return toReturn
+}
+
+// Copies the modified content of the given sector into dst, which must be
+// SectorSize bytes. Returns false if the sector hasn't been modified.
+func (o *Overlay) getSector(sector int64, dst []byte) (bool, error) {
+	if o.sidecar == nil {
+		data, ok := o.sectors[sector]
+		if ok {
+			copy(dst, data)
+		}
+		return ok, nil
+	}
+	offset, ok := o.sidecarOffsets[sector]
+	if !ok {
+		return false, nil
+	}
+	_, e := o.sidecar.ReadAt(dst[:SectorSize], offset+8)
+	if e != nil {
+		return false, fmt.Errorf("Error reading sector %d from sidecar: %w",
+			sector, e)
+	}
+	return true, nil
+}
+
+// Stores new content for the given sector.
+func (o *Overlay) putSector(sector int64, data []byte) error {
+	if o.sidecar == nil {
+		stored, ok := o.sectors[sector]
+		if !ok {
+			stored = make([]byte, SectorSize)
+			o.sectors[sector] = stored
+		}
+		copy(stored, data)
+		return nil
+	}
+	offset, ok := o.sidecarOffsets[sector]
+	if !ok {
+		var e error
+		offset, e = contentSize(o.sidecar)
+		if e != nil {
+			return fmt.Errorf("Error getting sidecar size: %w", e)
+		}
+	}
+	record := make([]byte, overlayRecordSize)
+	binary.LittleEndian.PutUint64(record, uint64(sector))
+	copy(record[8:], data)
+	_, e := o.sidecar.WriteAt(record, offset)
+	if e != nil {
+		return fmt.Errorf("Error writing sector %d to sidecar: %w", sector, e)
+	}
+	o.sidecarOffsets[sector] = offset
+	return nil
+}
+
+// Reads from the underlying content, without applying any modifications.
+// Fills any part of dst past the end of the content with zeros.
+func (o *Overlay) readOriginal(dst []byte, offset int64) error {
+	_, e := o.wrapped.Seek(offset, io.SeekStart)
+	if e != nil {
+		return fmt.Errorf("Error seeking in underlying content: %w", e)
+	}
+	n, e := io.ReadFull(o.wrapped, dst)
+	if (e != nil) && (e != io.ErrUnexpectedEOF) && (e != io.EOF) {
+		return fmt.Errorf("Error reading underlying content: %w", e)
+	}
+	for i := n; i < len(dst); i++ {
+		dst[i] = 0
+	}
+	return nil
+}
+
+func (o *Overlay) Seek(offset int64, whence int) (int64, error) {
+	newOffset := o.currentOffset
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset += offset
+	case io.SeekEnd:
+		newOffset = o.size + offset
+	default:
+		return o.currentOffset, fmt.Errorf("Invalid whence: %d", whence)
+	}
+	if newOffset < 0 {
+		return o.currentOffset, fmt.Errorf("Invalid offset: %d", newOffset)
+	}
+	o.currentOffset = newOffset
+	return newOffset, nil
+}
+
+func (o *Overlay) Read(dst []byte) (int, error) {
+	if o.currentOffset >= o.size {
+		return 0, io.EOF
+	}
+	if int64(len(dst)) > (o.size - o.currentOffset) {
+		dst = dst[:o.size-o.currentOffset]
+	}
+	e := o.readOriginal(dst, o.currentOffset)
+	if e != nil {
+		return 0, e
+	}
+	// Replace the parts of any modified sectors overlapping the read.
+	sectorData := make([]byte, SectorSize)
+	end := o.currentOffset + int64(len(dst))
+	for s := o.currentOffset / SectorSize; (s * SectorSize) < end; s++ {
+		modified, e := o.getSector(s, sectorData)
+		if e != nil {
+			return 0, e
+		}
+		if !modified {
+			continue
+		}
+		sectorStart := s * SectorSize
+		if sectorStart >= o.currentOffset {
+			copy(dst[sectorStart-o.currentOffset:], sectorData)
+		} else {
+			copy(dst, sectorData[o.currentOffset-sectorStart:])
+		}
+	}
+	o.currentOffset = end
+	return len(dst), nil
+}
+
+// Writes to the overlay. The underlying content is never modified. Returns
+// io.ErrShortWrite if the write would extend past the end of the content.
+func (o *Overlay) Write(data []byte) (int, error) {
+	var resultErr error
+	if int64(len(data)) > (o.size - o.currentOffset) {
+		resultErr = io.ErrShortWrite
+		if o.currentOffset >= o.size {
+			return 0, resultErr
+		}
+		data = data[:o.size-o.currentOffset]
+	}
+	sectorData := make([]byte, SectorSize)
+	written := 0
+	for written < len(data) {
+		offset := o.currentOffset + int64(written)
+		sector := offset / SectorSize
+		sectorOffset := int(offset % SectorSize)
+		toCopy := len(data) - written
+		if toCopy > (SectorSize - sectorOffset) {
+			toCopy = SectorSize - sectorOffset
+		}
+		// Partial sectors need to be read first.
+		if toCopy != SectorSize {
+			modified, e := o.getSector(sector, sectorData)
+			if e == nil && !modified {
+				e = o.readOriginal(sectorData, sector*SectorSize)
+			}
+			if e != nil {
+				o.currentOffset += int64(written)
+				return written, e
+			}
+		}
+		copy(sectorData[sectorOffset:], data[written:written+toCopy])
+		e := o.putSector(sector, sectorData)
+		if e != nil {
+			o.currentOffset += int64(written)
+			return written, e
+		}
+		written += toCopy
+	}
+	o.currentOffset += int64(written)
+	return written, resultErr
+}
+
+// Returns every sector in which the overlay differs from the underlying
+// content, in order. Sectors that were written with their original content
+// aren't included.
+func (o *Overlay) Diff() ([]SectorChange, error) {
+	var toReturn []SectorChange
+	for _, s := range o.modifiedSectors() {
+		original := make([]byte, SectorSize)
+		modified := make([]byte, SectorSize)
+		_, e := o.getSector(s, modified)
+		if e != nil {
+			return nil, e
+		}
+		e = o.readOriginal(original, s*SectorSize)
+		if e != nil {
+			return nil, fmt.Errorf("Error reading original sector %d: %w", s,
+				e)
+		}
+		// Don't report the bytes past the end of the content.
+		limit := o.size - (s * SectorSize)
+		if limit < SectorSize {
+			original = original[:limit]
+			modified = modified[:limit]
+		}
+		if bytes.Equal(original, modified) {
+			continue
+		}
+		toReturn = append(toReturn, SectorChange{
+			Sector:   s,
+			Original: original,
+			Modified: modified,
+		})
+	}
+	return toReturn, nil
+}
+
+// Drops every modification, so that the overlay matches the underlying
+// content again. If a sidecar file is used, it is truncated.
+func (o *Overlay) Discard() error {
+	if o.sidecar == nil {
+		o.sectors = make(map[int64][]byte)
+		return nil
+	}
+	o.sidecarOffsets = make(map[int64]int64)
+	e := o.sidecar.Truncate(0)
+	if e != nil {
+		return fmt.Errorf("Error truncating sidecar file: %w", e)
+	}
+	return nil
+}
+
+// Writes the full content of the overlay, including modifications, to the
+// given writer, e.g. to create a new, repaired, image.
+func (o *Overlay) Commit(w io.Writer) error {
+	savedOffset := o.currentOffset
+	defer func() { o.currentOffset = savedOffset }()
+	o.currentOffset = 0
+	buffer := make([]byte, 1024*1024)
+	for o.currentOffset < o.size {
+		n, e := o.Read(buffer)
+		if e != nil {
+			return fmt.Errorf("Error reading overlay at offset %d: %w",
+				o.currentOffset, e)
+		}
+		_, e = w.Write(buffer[:n])
+		if e != nil {
+			return fmt.Errorf("Error writing committed image: %w", e)
+		}
+	}
+	return nil
+}
+
+// Writes the full content of the overlay to a new file at the given path.
+// Fails if the file already exists, to avoid overwriting an image.
+func (o *Overlay) CommitToFile(path string) error {
+	f, e := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if e != nil {
+		return fmt.Errorf("Error creating %s: %w", path, e)
+	}
+	e = o.Commit(f)
+	if e != nil {
+		f.Close()
+		return e
+	}
+	return f.Close()
+}
+
+// Closes the sidecar file, if there is one. The overlay must not be used
+// afterwards. The underlying content isn't closed.
+func (o *Overlay) Close() error {
+	if o.sidecar == nil {
+		o.sectors = nil
+		return nil
+	}
+	return o.sidecar.Close()
+}
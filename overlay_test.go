@@ -0,0 +1,165 @@
+package fat
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOverlay(t *testing.T) {
+	original := testContent(4 * SectorSize)
+	originalCopy := append([]byte{}, original...)
+	o, e := NewOverlay(bytes.NewReader(original))
+	if e != nil {
+		t.Logf("Failed creating overlay: %s\n", e)
+		t.FailNow()
+	}
+	// Write a range spanning a sector boundary.
+	_, e = o.Seek(SectorSize-10, io.SeekStart)
+	if e != nil {
+		t.Logf("Failed seeking in overlay: %s\n", e)
+		t.FailNow()
+	}
+	patch := bytes.Repeat([]byte{0xaa}, 20)
+	n, e := o.Write(patch)
+	if (e != nil) || (n != len(patch)) {
+		t.Logf("Failed writing to overlay: %d bytes, %v\n", n, e)
+		t.FailNow()
+	}
+	expected := append([]byte{}, original...)
+	copy(expected[SectorSize-10:], patch)
+	if !bytes.Equal(original, originalCopy) {
+		t.Logf("Writing to the overlay modified the underlying content\n")
+		t.FailNow()
+	}
+	var committed bytes.Buffer
+	e = o.Commit(&committed)
+	if e != nil {
+		t.Logf("Failed committing overlay: %s\n", e)
+		t.FailNow()
+	}
+	if !bytes.Equal(committed.Bytes(), expected) {
+		t.Logf("Committed overlay has incorrect content\n")
+		t.Fail()
+	}
+
+	// Writing past the end should be clipped.
+	o.Seek(-5, io.SeekEnd)
+	n, e = o.Write(patch)
+	if (e != io.ErrShortWrite) || (n != 5) {
+		t.Logf("Expected a 5-byte short write at the end, got %d, %v\n", n, e)
+		t.Fail()
+	}
+	copy(expected[len(expected)-5:], patch)
+
+	// Rewriting a sector with its original content shouldn't appear in the
+	// diff.
+	o.Seek(2*SectorSize, io.SeekStart)
+	o.Write(original[2*SectorSize : 3*SectorSize])
+	changes, e := o.Diff()
+	if e != nil {
+		t.Logf("Failed getting diff: %s\n", e)
+		t.FailNow()
+	}
+	if (len(changes) != 3) || (changes[0].Sector != 0) ||
+		(changes[1].Sector != 1) || (changes[2].Sector != 3) {
+		t.Logf("Got incorrect diff: %d changes\n", len(changes))
+		t.FailNow()
+	}
+	if !bytes.Equal(changes[2].Modified, expected[3*SectorSize:]) {
+		t.Logf("Got incorrect modified content for sector 3\n")
+		t.Fail()
+	}
+
+	e = o.Discard()
+	if e != nil {
+		t.Logf("Failed discarding changes: %s\n", e)
+		t.FailNow()
+	}
+	o.Seek(0, io.SeekStart)
+	data, e := io.ReadAll(o)
+	if (e != nil) || !bytes.Equal(data, original) {
+		t.Logf("Overlay doesn't match the original after Discard: %v\n", e)
+		t.Fail()
+	}
+}
+
+func TestOverlayFilesystem(t *testing.T) {
+	m := newTestImage()
+	m.addFile(testRootCluster, 0, "EXISTING", 1000, []uint32{3, 4})
+	originalImage := append([]byte{}, m.data...)
+	sidecarPath := filepath.Join(t.TempDir(), "changes.overlay")
+	o, e := NewFileOverlay(bytes.NewReader(m.data), sidecarPath)
+	if e != nil {
+		t.Logf("Failed creating overlay: %s\n", e)
+		t.FailNow()
+	}
+	w, e := NewWritableFAT32Filesystem(o)
+	if e != nil {
+		t.Logf("Failed opening overlaid filesystem: %s\n", e)
+		t.FailNow()
+	}
+	content := testContent(3000)
+	e = w.WriteFile("new.bin", content)
+	if e == nil {
+		e = w.Remove("EXISTING")
+	}
+	if e == nil {
+		e = w.Close()
+	}
+	if e != nil {
+		t.Logf("Failed modifying overlaid filesystem: %s\n", e)
+		t.FailNow()
+	}
+	e = o.Close()
+	if e != nil {
+		t.Logf("Failed closing overlay: %s\n", e)
+		t.FailNow()
+	}
+	if !bytes.Equal(m.data, originalImage) {
+		t.Logf("Modifying the filesystem changed the underlying image\n")
+		t.FailNow()
+	}
+
+	// Reopen the sidecar and make sure the changes are still there.
+	o, e = NewFileOverlay(bytes.NewReader(m.data), sidecarPath)
+	if e != nil {
+		t.Logf("Failed reopening overlay: %s\n", e)
+		t.FailNow()
+	}
+	defer o.Close()
+	committedPath := filepath.Join(t.TempDir(), "committed.img")
+	e = o.CommitToFile(committedPath)
+	if e != nil {
+		t.Logf("Failed committing overlay: %s\n", e)
+		t.FailNow()
+	}
+	committed, e := os.Open(committedPath)
+	if e != nil {
+		t.Logf("Failed opening committed image: %s\n", e)
+		t.FailNow()
+	}
+	defer committed.Close()
+	f, e := NewFAT32Filesystem(committed)
+	if e != nil {
+		t.Logf("Failed opening committed filesystem: %s\n", e)
+		t.FailNow()
+	}
+	data, e := f.ReadFile("NEW.BIN")
+	if (e != nil) || !bytes.Equal(data, content) {
+		t.Logf("Failed reading new file from committed image: %v\n", e)
+		t.Fail()
+	}
+	_, e = f.Lookup("EXISTING")
+	if e == nil {
+		t.Logf("Removed file still exists in the committed image\n")
+		t.Fail()
+	}
+	e = o.CommitToFile(committedPath)
+	if e == nil {
+		t.Logf("Didn't get expected error overwriting an existing image\n")
+		t.Fail()
+	}
+}
@@ -0,0 +1,252 @@
+package fat
+
+// This file contains a reader for QCOW2 virtual disk images, as used by QEMU.
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// The magic number at the start of every QCOW2 file.
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+// Bits in L1 and L2 table entries.
+const (
+	qcow2OffsetMask     = 0x00fffffffffffe00
+	qcow2CompressedFlag = 1 << 62
+	qcow2ZeroFlag       = 1
+)
+
+// Incompatible feature bits from version 3 headers.
+const (
+	qcow2FeatureDirty           = 1
+	qcow2FeatureCorrupt         = 2
+	qcow2FeatureExternalData    = 4
+	qcow2FeatureCompressionType = 8
+	qcow2FeatureExtendedL2      = 16
+)
+
+// The maximum number of L2 tables cached by each QCOW2Image.
+const qcow2L2CacheSize = 64
+
+// The version 2 QCOW2 header. All fields are big-endian.
+type qcow2Header struct {
+	Magic                 [4]byte
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	SnapshotCount         uint32
+	SnapshotsOffset       uint64
+}
+
+// Follows the version 2 header in version 3 images.
+type qcow2HeaderV3 struct {
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+	CompressionType      uint8
+}
+
+// An Image containing the virtual disk stored in a QCOW2 file. Images with a
+// backing file, encryption or external data files aren't supported.
+type QCOW2Image struct {
+	readerAtSeeker
+	file        io.ReaderAt
+	header      qcow2Header
+	clusterSize int64
+	l1          []uint64
+	// Protects the caches, so that ReadAt can be used concurrently.
+	lock sync.Mutex
+	// Maps file offsets of L2 tables to their content.
+	l2Cache map[uint64][]uint64
+	// The most recently decompressed cluster, and its L2 entry.
+	compressedEntry   uint64
+	compressedCluster []byte
+}
+
+func (q *QCOW2Image) Size() int64 {
+	return q.size
+}
+
+// Closes the underlying file, if it implements io.Closer.
+func (q *QCOW2Image) Close() error {
+	return closeIfCloser(q.file)
+}
+
+// Returns a QCOW2Image reading the QCOW2 file from r.
+func NewQCOW2Image(r io.ReaderAt) (*QCOW2Image, error) {
+	data := make([]byte, 112)
+	e := readFullAt(r, data[:72], 0)
+	if e != nil {
+		return nil, fmt.Errorf("Error reading QCOW2 header: %w", e)
+	}
+	toReturn := &QCOW2Image{
+		file:    r,
+		l2Cache: make(map[uint64][]uint64),
+	}
+	header := &(toReturn.header)
+	binary.Read(bytes.NewReader(data), binary.BigEndian, header)
+	if !bytes.Equal(header.Magic[:], qcow2Magic) {
+		return nil, fmt.Errorf("Didn't find the QCOW2 magic number")
+	}
+	if (header.Version != 2) && (header.Version != 3) {
+		return nil, fmt.Errorf("Unsupported QCOW2 version %d: %w",
+			header.Version, ErrUnsupportedFormat)
+	}
+	if header.Version == 3 {
+		// The optional compression type is the only field we need beyond
+		// the header length, so ignore errors reading it.
+		r.ReadAt(data[72:], 72)
+		var v3 qcow2HeaderV3
+		binary.Read(bytes.NewReader(data[72:]), binary.BigEndian, &v3)
+		known := uint64(qcow2FeatureDirty | qcow2FeatureCorrupt |
+			qcow2FeatureCompressionType)
+		if (v3.IncompatibleFeatures & ^known) != 0 {
+			return nil, fmt.Errorf("The QCOW2 image uses unsupported "+
+				"features (0x%x): %w", v3.IncompatibleFeatures,
+				ErrUnsupportedFormat)
+		}
+		if ((v3.IncompatibleFeatures & qcow2FeatureCompressionType) != 0) &&
+			(v3.HeaderLength > 104) && (v3.CompressionType != 0) {
+			return nil, fmt.Errorf("The QCOW2 image uses an unsupported "+
+				"compression type: %w", ErrUnsupportedFormat)
+		}
+	}
+	if header.BackingFileOffset != 0 {
+		return nil, fmt.Errorf("QCOW2 images with a backing file aren't "+
+			"supported; convert it to a standalone image first: %w",
+			ErrUnsupportedFormat)
+	}
+	if header.CryptMethod != 0 {
+		return nil, fmt.Errorf("Encrypted QCOW2 images aren't supported: %w",
+			ErrUnsupportedFormat)
+	}
+	if (header.ClusterBits < 9) || (header.ClusterBits > 21) {
+		return nil, fmt.Errorf("Invalid cluster bits: %d",
+			header.ClusterBits)
+	}
+	toReturn.clusterSize = int64(1) << header.ClusterBits
+	toReturn.size = int64(header.Size)
+	if toReturn.size < 0 {
+		return nil, fmt.Errorf("Invalid virtual disk size: %d", header.Size)
+	}
+	// Each L1 entry covers an L2 table's worth of clusters.
+	clustersPerL1 := toReturn.clusterSize / 8
+	needed := (toReturn.size + clustersPerL1*toReturn.clusterSize - 1) /
+		(clustersPerL1 * toReturn.clusterSize)
+	if int64(header.L1Size) < needed {
+		return nil, fmt.Errorf("The L1 table has %d entries, %d are needed",
+			header.L1Size, needed)
+	}
+	l1Data := make([]byte, int64(header.L1Size)*8)
+	e = readFullAt(r, l1Data, int64(header.L1TableOffset))
+	if e != nil {
+		return nil, fmt.Errorf("Error reading L1 table: %w", e)
+	}
+	toReturn.l1 = make([]uint64, header.L1Size)
+	for i := range toReturn.l1 {
+		toReturn.l1[i] = binary.BigEndian.Uint64(l1Data[i*8:])
+	}
+	toReturn.r = toReturn
+	return toReturn, nil
+}
+
+// Returns the L2 table at the given file offset. The caller must hold the
+// lock.
+func (q *QCOW2Image) getL2Table(offset uint64) ([]uint64, error) {
+	table, ok := q.l2Cache[offset]
+	if ok {
+		return table, nil
+	}
+	data := make([]byte, q.clusterSize)
+	e := readFullAt(q.file, data, int64(offset))
+	if e != nil {
+		return nil, fmt.Errorf("Error reading L2 table: %w", e)
+	}
+	table = make([]uint64, q.clusterSize/8)
+	for i := range table {
+		table[i] = binary.BigEndian.Uint64(data[i*8:])
+	}
+	if len(q.l2Cache) >= qcow2L2CacheSize {
+		q.l2Cache = make(map[uint64][]uint64)
+	}
+	q.l2Cache[offset] = table
+	return table, nil
+}
+
+// Returns the content of the compressed cluster with the given L2 entry. The
+// caller must hold the lock.
+func (q *QCOW2Image) getCompressedCluster(entry uint64) ([]byte, error) {
+	if (q.compressedCluster != nil) && (q.compressedEntry == entry) {
+		return q.compressedCluster, nil
+	}
+	offsetBits := 62 - (q.header.ClusterBits - 8)
+	offset := int64(entry & ((uint64(1) << offsetBits) - 1))
+	sectors := int64((entry&(qcow2CompressedFlag-1))>>offsetBits) + 1
+	compressed := make([]byte, sectors*SectorSize-(offset%SectorSize))
+	// The compressed data may end before the last sector it claims, at the
+	// end of the file.
+	n, e := q.file.ReadAt(compressed, offset)
+	if (e != nil) && (e != io.EOF) {
+		return nil, fmt.Errorf("Error reading compressed cluster: %w", e)
+	}
+	cluster := make([]byte, q.clusterSize)
+	decompressor := flate.NewReader(bytes.NewReader(compressed[:n]))
+	_, e = io.ReadFull(decompressor, cluster)
+	if e != nil {
+		return nil, fmt.Errorf("Error decompressing cluster at offset %d: %w",
+			offset, e)
+	}
+	q.compressedEntry = entry
+	q.compressedCluster = cluster
+	return cluster, nil
+}
+
+// Reads part of a single virtual cluster. The caller must hold the lock.
+func (q *QCOW2Image) readCluster(dst []byte, cluster, offset int64) error {
+	entriesPerTable := q.clusterSize / 8
+	l1Index := cluster / entriesPerTable
+	l2Offset := q.l1[l1Index] & qcow2OffsetMask
+	if l2Offset == 0 {
+		zeroBytes(dst)
+		return nil
+	}
+	table, e := q.getL2Table(l2Offset)
+	if e != nil {
+		return e
+	}
+	entry := table[cluster%entriesPerTable]
+	if (entry & qcow2CompressedFlag) != 0 {
+		data, e := q.getCompressedCluster(entry)
+		if e != nil {
+			return e
+		}
+		copy(dst, data[offset:])
+		return nil
+	}
+	dataOffset := entry & qcow2OffsetMask
+	if (dataOffset == 0) || ((entry & qcow2ZeroFlag) != 0) {
+		zeroBytes(dst)
+		return nil
+	}
+	return readFullAt(q.file, dst, int64(dataOffset)+offset)
+}
+
+func (q *QCOW2Image) ReadAt(dst []byte, offset int64) (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return readBlocks(dst, offset, q.size, q.clusterSize, q.readCluster)
+}
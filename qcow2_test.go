@@ -0,0 +1,92 @@
+package fat
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"testing"
+)
+
+// Returns a version 3 QCOW2 file with 64KB clusters containing the given
+// data. The first cluster is compressed, clusters containing only zeros are
+// either unallocated or use the zero flag, and the rest are stored normally.
+func newTestQCOW2(data []byte) []byte {
+	const clusterBits = 16
+	const clusterSize = 1 << clusterBits
+	const l1Offset = clusterSize
+	const l2Offset = 2 * clusterSize
+	clusterCount := (len(data) + clusterSize - 1) / clusterSize
+	file := make([]byte, 3*clusterSize)
+	header := qcow2Header{
+		Version:       3,
+		ClusterBits:   clusterBits,
+		Size:          uint64(len(data)),
+		L1Size:        1,
+		L1TableOffset: l1Offset,
+	}
+	copy(header.Magic[:], qcow2Magic)
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.BigEndian, &header)
+	binary.Write(&buffer, binary.BigEndian, &qcow2HeaderV3{
+		RefcountOrder: 4,
+		HeaderLength:  104,
+	})
+	copy(file, buffer.Bytes())
+	binary.BigEndian.PutUint64(file[l1Offset:], l2Offset|(1<<63))
+
+	zeros := make([]byte, clusterSize)
+	offsetBits := 62 - (clusterBits - 8)
+	for i := 0; i < clusterCount; i++ {
+		cluster := make([]byte, clusterSize)
+		copy(cluster, data[i*clusterSize:])
+		entry := uint64(0)
+		switch {
+		case i == 0:
+			buffer.Reset()
+			w, _ := flate.NewWriter(&buffer, flate.BestCompression)
+			w.Write(cluster)
+			w.Close()
+			// Deliberately start the compressed data mid-sector.
+			file = append(file, make([]byte, 100)...)
+			offset := len(file)
+			sectors := (offset%SectorSize + buffer.Len() + SectorSize - 1) /
+				SectorSize
+			entry = qcow2CompressedFlag |
+				(uint64(sectors-1) << offsetBits) | uint64(offset)
+			file = append(file, buffer.Bytes()...)
+			file = append(file, make([]byte, (SectorSize-
+				len(file)%SectorSize)%SectorSize)...)
+		case bytes.Equal(cluster, zeros) && ((i % 2) == 0):
+		case bytes.Equal(cluster, zeros):
+			entry = qcow2ZeroFlag
+		default:
+			entry = uint64(len(file)) | (1 << 63)
+			file = append(file, cluster...)
+		}
+		binary.BigEndian.PutUint64(file[l2Offset+i*8:], entry)
+	}
+	return file
+}
+
+func TestQCOW2(t *testing.T) {
+	data := newTestVirtualDiskContent()
+	file := newTestQCOW2(data)
+	img := checkImageFile(t, "disk.qcow2", file, data)
+	if _, ok := img.(*QCOW2Image); !ok {
+		t.Logf("Didn't get a QCOW2Image for disk.qcow2\n")
+		t.Fail()
+	}
+	if len(file) >= len(data) {
+		t.Logf("The QCOW2 image doesn't contain any unallocated clusters\n")
+		t.Fail()
+	}
+
+	// Images with a backing file need the backing file to be read.
+	binary.BigEndian.PutUint64(file[8:], 1000)
+	binary.BigEndian.PutUint32(file[16:], 10)
+	_, e := NewQCOW2Image(bytes.NewReader(file))
+	if e == nil {
+		t.Logf("Didn't get expected error for a QCOW2 with a backing file\n")
+		t.Fail()
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Used when checking for avi files; don't want to re-allocate them every
+// time.
+var aviHeader1 []byte = []byte("RIFF")
+var aviHeader2 []byte = []byte("AVI ")
+
+// Carves .avi videos, using the size in the RIFF header.
+type aviCarver struct{}
+
+func init() {
+	registerCarver(aviCarver{})
+}
+
+func (c aviCarver) Name() string {
+	return "avi"
+}
+
+func (c aviCarver) Signatures() []Signature {
+	return []Signature{{Offset: 8, Magic: aviHeader2}}
+}
+
+// Reads the 12-byte RIFF header at the given offset.
+func readAviHeader(src io.ReadSeeker, offset int64) ([]byte, error) {
+	_, e := src.Seek(offset, io.SeekStart)
+	if e != nil {
+		return nil, fmt.Errorf("Error seeking to offset %d: %s", offset, e)
+	}
+	data := make([]byte, 12)
+	_, e = io.ReadFull(src, data)
+	if (e == io.EOF) || (e == io.ErrUnexpectedEOF) {
+		return nil, nil
+	}
+	if e != nil {
+		return nil, fmt.Errorf("Error reading start of sector: %s", e)
+	}
+	return data, nil
+}
+
+func (c aviCarver) Match(src io.ReadSeeker, offset int64) (bool, error) {
+	data, e := readAviHeader(src, offset)
+	if (e != nil) || (data == nil) {
+		return false, e
+	}
+	return bytes.Equal(data[0:4], aviHeader1) &&
+		bytes.Equal(data[8:12], aviHeader2), nil
+}
+
+func (c aviCarver) Size(src io.ReadSeeker, offset int64) (int64, error) {
+	data, e := readAviHeader(src, offset)
+	if (e != nil) || (data == nil) {
+		return 0, e
+	}
+	return int64(binary.LittleEndian.Uint32(data[4:8])), nil
+}
+
+func (c aviCarver) Filename(offset int64) string {
+	return fmt.Sprintf("video_%012d.avi", offset)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// A sequence of bytes found at a fixed offset from the start of a file.
+type Signature struct {
+	Offset int
+	Magic  []byte
+}
+
+// Recognizes and extracts one type of file. To add support for a new type of
+// file, implement this interface and pass an instance to registerCarver in an
+// init function.
+type Carver interface {
+	// A short, unique name for the carver, used to select it on the command
+	// line.
+	Name() string
+	// Returns the signatures that may identify the start of a file this
+	// carver recognizes. The scanner only calls Match for offsets where at
+	// least one of these is found. The signatures must fit within the first
+	// sector of a file.
+	Signatures() []Signature
+	// Returns true if the data at the given offset in src looks like the
+	// start of a file this carver recognizes. This should only check the
+	// file's header. May change src's current offset.
+	Match(src io.ReadSeeker, offset int64) (bool, error)
+	// Returns the size of the file starting at the given offset, or 0 if it
+	// turns out not to be a valid file. Only called if Match returned true.
+	// May change src's current offset.
+	Size(src io.ReadSeeker, offset int64) (int64, error)
+	// Returns the name of the file that a file found at the given offset
+	// should be saved to.
+	Filename(offset int64) string
+}
+
+// All registered carvers, in the order they were registered.
+var carvers []Carver
+
+// Adds a carver to the list of those available. Panics if a carver with the
+// same name is already registered.
+func registerCarver(c Carver) {
+	for _, existing := range carvers {
+		if existing.Name() == c.Name() {
+			panic(fmt.Sprintf("Carver %s registered twice", c.Name()))
+		}
+	}
+	carvers = append(carvers, c)
+}
+
+// Returns the names of all registered carvers, sorted alphabetically.
+func carverNames() []string {
+	toReturn := make([]string, len(carvers))
+	for i, c := range carvers {
+		toReturn[i] = c.Name()
+	}
+	sort.Strings(toReturn)
+	return toReturn
+}
+
+// Parses a comma-separated list of carver names into a set, returning an
+// error if any name isn't registered.
+func parseCarverNames(list string) (map[string]bool, error) {
+	toReturn := make(map[string]bool)
+	known := make(map[string]bool)
+	for _, c := range carvers {
+		known[c.Name()] = true
+	}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known[name] {
+			return nil, fmt.Errorf("Unknown carver: %s (available carvers: "+
+				"%s)", name, strings.Join(carverNames(), ", "))
+		}
+		toReturn[name] = true
+	}
+	return toReturn, nil
+}
+
+// Returns the registered carvers, in registration order, that are named in
+// the comma-separated enabled list (or all of them if it's empty) and aren't
+// named in the comma-separated disabled list.
+func selectCarvers(enabled, disabled string) ([]Carver, error) {
+	enabledNames, e := parseCarverNames(enabled)
+	if e != nil {
+		return nil, e
+	}
+	disabledNames, e := parseCarverNames(disabled)
+	if e != nil {
+		return nil, e
+	}
+	var toReturn []Carver
+	for _, c := range carvers {
+		name := c.Name()
+		if (len(enabledNames) != 0) && !enabledNames[name] {
+			continue
+		}
+		if disabledNames[name] {
+			continue
+		}
+		toReturn = append(toReturn, c)
+	}
+	if len(toReturn) == 0 {
+		return nil, fmt.Errorf("No carvers are enabled")
+	}
+	return toReturn, nil
+}
+
+// Returns true if the data at the given offset in src starts with any of the
+// given signatures.
+func matchSignatures(src io.ReadSeeker, offset int64,
+	signatures [][]byte) (bool, error) {
+	longest := 0
+	for _, s := range signatures {
+		if len(s) > longest {
+			longest = len(s)
+		}
+	}
+	_, e := src.Seek(offset, io.SeekStart)
+	if e != nil {
+		return false, fmt.Errorf("Error seeking to offset %d: %s", offset, e)
+	}
+	header := make([]byte, longest)
+	n, e := io.ReadFull(src, header)
+	if (e != nil) && (e != io.EOF) && (e != io.ErrUnexpectedEOF) {
+		return false, fmt.Errorf("Error reading offset %d: %s", offset, e)
+	}
+	for _, s := range signatures {
+		if bytes.HasPrefix(header[:n], s) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+// This file contains support for saving the progress of a scan, so that it
+// can be resumed after being interrupted.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// The minimum time between saving a scan's progress.
+const checkpointInterval = 30 * time.Second
+
+// A file found by a scan, as recorded in its state file.
+type scanStateFile struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Carver string `json:"carver"`
+	// The path the file was saved to, or empty if it wasn't saved.
+	Path string `json:"path,omitempty"`
+}
+
+// The content of a scan's state file.
+type scanState struct {
+	ImagePath  string `json:"image_path"`
+	ImageSize  int64  `json:"image_size"`
+	SectorSize int    `json:"sector_size"`
+	RegionSize int64  `json:"region_size"`
+	// Describes the part of the image being scanned, or is empty if the
+	// entire image is scanned. Offsets are relative to this part.
+	ScanRange string `json:"scan_range,omitempty"`
+	// The carvers used by the scan, in the order they're tried.
+	Carvers []string `json:"carvers"`
+	// Everything before this offset has been scanned.
+	Position int64 `json:"position"`
+	Complete bool  `json:"complete"`
+	// The files found before Position, in order of their offsets.
+	Files []scanStateFile `json:"files"`
+	Stats scanStats       `json:"stats"`
+}
+
+// Saves the progress of a scan to a state file at most once per
+// checkpointInterval.
+type scanCheckpoint struct {
+	path     string
+	state    scanState
+	lastSave time.Time
+}
+
+// Returns the names of the given carvers, in order.
+func selectedCarverNames(selected []Carver) []string {
+	toReturn := make([]string, len(selected))
+	for i, c := range selected {
+		toReturn[i] = c.Name()
+	}
+	return toReturn
+}
+
+// Returns a scanCheckpoint that saves the progress of a new scan to the
+// given path.
+func newScanCheckpoint(path, imagePath, scanRange string, size int64,
+	sectorSize int, selected []Carver) *scanCheckpoint {
+	return &scanCheckpoint{
+		path: path,
+		state: scanState{
+			ImagePath:  imagePath,
+			ImageSize:  size,
+			SectorSize: sectorSize,
+			RegionSize: scanRegionSize,
+			ScanRange:  scanRange,
+			Carvers:    selectedCarverNames(selected),
+			Files:      make([]scanStateFile, 0),
+		},
+		lastSave: time.Now(),
+	}
+}
+
+// Loads the state file at the given path, to resume a scan. Returns an error
+// if the state was saved by a scan with different settings, since the
+// regions or detections wouldn't match.
+func loadScanCheckpoint(path, scanRange string, size int64, sectorSize int,
+	selected []Carver) (*scanCheckpoint, error) {
+	data, e := os.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+	toReturn := &scanCheckpoint{
+		path:     path,
+		lastSave: time.Now(),
+	}
+	e = json.Unmarshal(data, &toReturn.state)
+	if e != nil {
+		return nil, fmt.Errorf("Error parsing %s: %w", path, e)
+	}
+	state := &(toReturn.state)
+	if state.ScanRange != scanRange {
+		return nil, fmt.Errorf("%s is for a scan of %q, not %q", path,
+			state.ScanRange, scanRange)
+	}
+	if state.ImageSize != size {
+		return nil, fmt.Errorf("%s is for a %d-byte image, but the image "+
+			"contains %d bytes", path, state.ImageSize, size)
+	}
+	if (state.SectorSize != sectorSize) ||
+		(state.RegionSize != scanRegionSize) {
+		return nil, fmt.Errorf("%s was saved with a different sector size "+
+			"or region size", path)
+	}
+	names := selectedCarverNames(selected)
+	if fmt.Sprint(state.Carvers) != fmt.Sprint(names) {
+		return nil, fmt.Errorf("%s was saved using carvers %v, but the "+
+			"selected carvers are %v", path, state.Carvers, names)
+	}
+	if state.Files == nil {
+		state.Files = make([]scanStateFile, 0)
+	}
+	return toReturn, nil
+}
+
+// Writes the state to the state file. The state is written to a temporary
+// file first, so the existing state file isn't lost if this is interrupted.
+func (c *scanCheckpoint) save() error {
+	data, e := json.MarshalIndent(&c.state, "", "  ")
+	if e != nil {
+		return fmt.Errorf("Error encoding scan state: %w", e)
+	}
+	tmpPath := c.path + ".tmp"
+	e = os.WriteFile(tmpPath, data, 0644)
+	if e != nil {
+		return fmt.Errorf("Error writing %s: %w", tmpPath, e)
+	}
+	e = os.Rename(tmpPath, c.path)
+	if e != nil {
+		return fmt.Errorf("Error replacing %s: %w", c.path, e)
+	}
+	c.lastSave = time.Now()
+	return nil
+}
+
+// Records that everything before the given position has been scanned, and
+// saves the state if enough time has passed since it was last saved.
+func (c *scanCheckpoint) update(position int64, stats *scanStats) error {
+	c.state.Position = position
+	c.state.Stats = *stats
+	if time.Since(c.lastSave) < checkpointInterval {
+		return nil
+	}
+	return c.save()
+}
+
+// Returns the offset of the last file found, or -1 if none were found.
+func (c *scanCheckpoint) lastFileOffset() int64 {
+	if len(c.state.Files) == 0 {
+		return -1
+	}
+	return c.state.Files[len(c.state.Files)-1].Offset
+}
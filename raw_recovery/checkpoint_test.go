@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResumeScan(t *testing.T) {
+	img := fakeScanImage()
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "scan.json")
+	outputDir := filepath.Join(dir, "output")
+	e := os.Mkdir(outputDir, 0755)
+	if e != nil {
+		t.Logf("Failed creating %s: %s\n", outputDir, e)
+		t.FailNow()
+	}
+
+	// Interrupt the scan in the last region, after the file in its first
+	// sector was saved by the previous region.
+	carver := newFakeCarver()
+	carver.failOffset = 2*scanRegionSize + 1536
+	checkpoint := newScanCheckpoint(statePath, "fake.img", "", img.size, 512,
+		[]Carver{carver})
+	e = scanForFiles(img, img.size, 512, outputDir, []Carver{carver}, 3,
+		checkpoint)
+	if e == nil {
+		t.Logf("Didn't get an error from the interrupted scan\n")
+		t.FailNow()
+	}
+	t.Logf("Interrupted scan failed as expected: %s\n", e)
+
+	resumedCarver := newFakeCarver()
+	checkpoint, e = loadScanCheckpoint(statePath, "", img.size, 512,
+		[]Carver{resumedCarver})
+	if e != nil {
+		t.Logf("Failed loading the interrupted scan's state: %s\n", e)
+		t.FailNow()
+	}
+	if checkpoint.state.Complete ||
+		(checkpoint.state.Position != 2*scanRegionSize) {
+		t.Logf("Expected the interrupted scan to stop at offset %d, got "+
+			"%d (complete = %v)\n", 2*scanRegionSize,
+			checkpoint.state.Position, checkpoint.state.Complete)
+		t.FailNow()
+	}
+	if checkpoint.lastFileOffset() != 2*scanRegionSize {
+		t.Logf("Expected the last saved file to be at offset %d, got %d\n",
+			2*scanRegionSize, checkpoint.lastFileOffset())
+		t.Fail()
+	}
+	e = scanForFiles(img, img.size, 512, outputDir,
+		[]Carver{resumedCarver}, 3, checkpoint)
+	if e != nil {
+		t.Logf("Failed resuming the scan: %s\n", e)
+		t.FailNow()
+	}
+	checkSavedOnce(t, carver, resumedCarver)
+	checkSavedFiles(t, img, outputDir)
+
+	// The state must match that of a scan that wasn't interrupted.
+	checkpoint, e = loadScanCheckpoint(statePath, "", img.size, 512,
+		[]Carver{resumedCarver})
+	if e != nil {
+		t.Logf("Failed loading the resumed scan's state: %s\n", e)
+		t.FailNow()
+	}
+	uninterrupted := newScanCheckpoint(filepath.Join(dir, "other.json"),
+		"fake.img", "", img.size, 512, []Carver{newFakeCarver()})
+	e = scanForFiles(img, img.size, 512, outputDir,
+		[]Carver{newFakeCarver()}, 1, uninterrupted)
+	if e != nil {
+		t.Logf("Failed scanning without interruption: %s\n", e)
+		t.FailNow()
+	}
+	resumed := describeScanState(&checkpoint.state)
+	expected := describeScanState(&uninterrupted.state)
+	if !checkpoint.state.Complete || (resumed != expected) {
+		t.Logf("Expected the resumed scan to find %s, got %s\n", expected,
+			resumed)
+		t.Fail()
+	}
+
+	// Resuming a complete scan does nothing.
+	resumedCarver = newFakeCarver()
+	e = scanForFiles(img, img.size, 512, outputDir,
+		[]Carver{resumedCarver}, 1, checkpoint)
+	if e != nil {
+		t.Logf("Failed resuming a complete scan: %s\n", e)
+		t.FailNow()
+	}
+	if len(resumedCarver.saved) != 0 {
+		t.Logf("Resuming a complete scan saved %d files\n",
+			len(resumedCarver.saved))
+		t.Fail()
+	}
+}
+
+func TestLoadScanCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scan.json")
+	selected := []Carver{newFakeCarver()}
+	checkpoint := newScanCheckpoint(path, "disk.img", "partition 1", 1000000,
+		512, selected)
+	checkpoint.state.Position = 4096
+	checkpoint.state.Files = append(checkpoint.state.Files, scanStateFile{
+		Offset: 1024,
+		Size:   1000,
+		Carver: "fake",
+		Path:   "1024.fake",
+	})
+	e := checkpoint.save()
+	if e != nil {
+		t.Logf("Failed saving scan state: %s\n", e)
+		t.FailNow()
+	}
+	loaded, e := loadScanCheckpoint(path, "partition 1", 1000000, 512,
+		selected)
+	if e != nil {
+		t.Logf("Failed loading scan state: %s\n", e)
+		t.FailNow()
+	}
+	if (loaded.state.ImagePath != "disk.img") ||
+		(loaded.state.Position != 4096) || (loaded.lastFileOffset() != 1024) {
+		t.Logf("Incorrect scan state loaded: %+v\n", loaded.state)
+		t.Fail()
+	}
+
+	// The state can't be used to resume a scan with different settings.
+	_, e = loadScanCheckpoint(path, "partition 2", 1000000, 512, selected)
+	if e == nil {
+		t.Logf("Didn't get an error loading a different scan range\n")
+		t.Fail()
+	}
+	_, e = loadScanCheckpoint(path, "partition 1", 2000000, 512, selected)
+	if e == nil {
+		t.Logf("Didn't get an error loading a different image size\n")
+		t.Fail()
+	}
+	_, e = loadScanCheckpoint(path, "partition 1", 1000000, 4096, selected)
+	if e == nil {
+		t.Logf("Didn't get an error loading a different sector size\n")
+		t.Fail()
+	}
+	_, e = loadScanCheckpoint(path, "partition 1", 1000000, 512, nil)
+	if e == nil {
+		t.Logf("Didn't get an error loading different carvers\n")
+		t.Fail()
+	}
+}
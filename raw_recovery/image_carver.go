@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+)
+
+// Carves image files that can be decoded by Go's image package.
+type imageCarver struct {
+	// The format name used by the image package.
+	format     string
+	extension  string
+	signatures [][]byte
+}
+
+func init() {
+	registerCarver(&imageCarver{
+		format:     "jpeg",
+		extension:  "jpg",
+		signatures: [][]byte{{0xff, 0xd8, 0xff}},
+	})
+	registerCarver(&imageCarver{
+		format:     "png",
+		extension:  "png",
+		signatures: [][]byte{[]byte("\x89PNG\r\n\x1a\n")},
+	})
+	registerCarver(&imageCarver{
+		format:     "gif",
+		extension:  "gif",
+		signatures: [][]byte{[]byte("GIF87a"), []byte("GIF89a")},
+	})
+}
+
+func (c *imageCarver) Name() string {
+	return c.format
+}
+
+func (c *imageCarver) Signatures() []Signature {
+	toReturn := make([]Signature, len(c.signatures))
+	for i, magic := range c.signatures {
+		toReturn[i] = Signature{
+			Offset: 0,
+			Magic:  magic,
+		}
+	}
+	return toReturn
+}
+
+func (c *imageCarver) Match(src io.ReadSeeker, offset int64) (bool, error) {
+	return matchSignatures(src, offset, c.signatures)
+}
+
+// Decodes the entire image to make sure it's valid, and returns the number
+// of bytes the decoder consumed.
+func (c *imageCarver) Size(src io.ReadSeeker, offset int64) (int64, error) {
+	_, e := src.Seek(offset, io.SeekStart)
+	if e != nil {
+		return 0, fmt.Errorf("Error seeking to offset %d: %s", offset, e)
+	}
+	_, format, e := image.Decode(src)
+	if (e != nil) || (format != c.format) {
+		return 0, nil
+	}
+	newOffset, e := src.Seek(0, io.SeekCurrent)
+	if e != nil {
+		return 0, fmt.Errorf("Error determining size of image: %s", e)
+	}
+	return newOffset - offset, nil
+}
+
+func (c *imageCarver) Filename(offset int64) string {
+	return fmt.Sprintf("pic_%012d.%s", offset, c.extension)
+}
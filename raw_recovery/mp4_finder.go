@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"os"
 )
 
 // An mp4 file is a sequence of "Boxes" that follow this format.
@@ -73,53 +72,52 @@ func Mp4FileSize(src io.ReadSeeker) (int64, error) {
 			return currentFileSize, fmt.Errorf("Error seeking past box: %s", e)
 		}
 	}
-	return 0, fmt.Errorf("Internal error: unreachable")
 }
 
-// A utility function used to save a .mp4 file to disk once one has been
-// identified. Requires src to be at the start of the .mp4 file (so rewind it
-// after Mp4FileSize returns!)
-func SaveMp4Data(src io.Reader, size int64, outputDir string, tag int) error {
-	outputPath := fmt.Sprintf("%s/video_%d.mp4", outputDir, tag)
-	f, e := os.Create(outputPath)
-	if e != nil {
-		return fmt.Errorf("Error creating %s: %s", outputPath, e)
-	}
-	defer f.Close()
-	_, e = io.CopyN(f, src, size)
-	if e != nil {
-		return fmt.Errorf("Error writing data to %s: %s", outputPath, e)
-	}
-	fmt.Printf("Saved video %s OK!\n", outputPath)
-	return nil
+// Carves .mp4 videos by following the chain of boxes from the initial 'ftyp'
+// box.
+type mp4Carver struct{}
+
+func init() {
+	registerCarver(mp4Carver{})
 }
 
-// Attempts to save a .mp4 file if src is at the start of one. Returns
-// false, nil if not at the start of a .mp4 file. Returns true if a file was
-// found. May modify the offset in src arbitrarily.
-func TrySavingMp4(src io.ReadSeeker, outputDir string, tag int) (bool, error) {
-	startOffset, e := src.Seek(0, io.SeekCurrent)
-	if e != nil {
-		return false, fmt.Errorf("Error determining current offset: %s", e)
-	}
-	size, e := Mp4FileSize(src)
+func (c mp4Carver) Name() string {
+	return "mp4"
+}
+
+func (c mp4Carver) Signatures() []Signature {
+	return []Signature{{Offset: 4, Magic: []byte("ftyp")}}
+}
+
+func (c mp4Carver) Match(src io.ReadSeeker, offset int64) (bool, error) {
+	var header Mp4BoxHeader
+	_, e := src.Seek(offset, io.SeekStart)
 	if e != nil {
-		return false, fmt.Errorf("Error checking for mp4 file: %s", e)
+		return false, fmt.Errorf("Error seeking to offset %d: %s", offset, e)
 	}
-	if size == 0 {
+	e = binary.Read(src, binary.BigEndian, &header)
+	if (e == io.EOF) || (e == io.ErrUnexpectedEOF) {
 		return false, nil
 	}
-	_, e = src.Seek(startOffset, io.SeekStart)
 	if e != nil {
-		return true, fmt.Errorf("Error returning to start of mp4 file: %s", e)
+		return false, fmt.Errorf("Error reading box header: %s", e)
 	}
-	if outputDir == "" {
-		fmt.Printf("Found mp4 file %d, not saving.\n", tag)
-		return true, nil
+	return (header.Size >= 8) && (string(header.Type[:]) == "ftyp"), nil
+}
+
+func (c mp4Carver) Size(src io.ReadSeeker, offset int64) (int64, error) {
+	_, e := src.Seek(offset, io.SeekStart)
+	if e != nil {
+		return 0, fmt.Errorf("Error seeking to offset %d: %s", offset, e)
 	}
-	e = SaveMp4Data(src, size, outputDir, tag)
+	size, e := Mp4FileSize(src)
 	if e != nil {
-		return true, fmt.Errorf("Error saving .mp4 file: %s", e)
+		return 0, fmt.Errorf("Error checking for mp4 file: %s", e)
 	}
-	return true, nil
+	return size, nil
+}
+
+func (c mp4Carver) Filename(offset int64) string {
+	return fmt.Sprintf("video_%012d.mp4", offset)
 }
@@ -0,0 +1,134 @@
+package main
+
+// This file contains a matcher for finding many byte patterns at once in a
+// stream of data, such as the signatures of file types when carving files
+// from a raw image.
+
+import (
+	"fmt"
+)
+
+// A node in a PatternMatcher's automaton.
+type matcherNode struct {
+	// The node to move to after each possible byte.
+	next [256]int32
+	// The indices of the patterns ending at this node, including those that
+	// are suffixes of other patterns.
+	outputs []int
+}
+
+// Finds occurrences of a set of byte patterns in data, in a single pass,
+// using the Aho-Corasick algorithm. A PatternMatcher isn't modified after
+// it's created, so it can be shared by PatternScanners in several goroutines.
+type PatternMatcher struct {
+	patterns [][]byte
+	nodes    []matcherNode
+}
+
+// Returns a PatternMatcher that finds the given patterns, which must not be
+// empty.
+func NewPatternMatcher(patterns [][]byte) (*PatternMatcher, error) {
+	toReturn := &PatternMatcher{
+		patterns: make([][]byte, len(patterns)),
+		nodes:    make([]matcherNode, 1, 64),
+	}
+	// Build the trie. Missing transitions are -1 until they're filled in
+	// below.
+	for i := range toReturn.nodes[0].next {
+		toReturn.nodes[0].next[i] = -1
+	}
+	for i, pattern := range patterns {
+		if len(pattern) == 0 {
+			return nil, fmt.Errorf("Pattern %d is empty", i)
+		}
+		toReturn.patterns[i] = append([]byte{}, pattern...)
+		current := int32(0)
+		for _, b := range pattern {
+			if toReturn.nodes[current].next[b] < 0 {
+				var node matcherNode
+				for j := range node.next {
+					node.next[j] = -1
+				}
+				toReturn.nodes = append(toReturn.nodes, node)
+				toReturn.nodes[current].next[b] = int32(len(toReturn.nodes) - 1)
+			}
+			current = toReturn.nodes[current].next[b]
+		}
+		toReturn.nodes[current].outputs = append(
+			toReturn.nodes[current].outputs, i)
+	}
+
+	// Visit the nodes in breadth-first order, computing each node's failure
+	// link (the node for its longest proper suffix that's also in the trie)
+	// and replacing missing transitions with those of the failure node. This
+	// turns the trie into a DFA.
+	failure := make([]int32, len(toReturn.nodes))
+	queue := make([]int32, 0, len(toReturn.nodes))
+	root := &(toReturn.nodes[0])
+	for b := range root.next {
+		if root.next[b] < 0 {
+			root.next[b] = 0
+			continue
+		}
+		queue = append(queue, root.next[b])
+	}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		node := &(toReturn.nodes[current])
+		fallback := &(toReturn.nodes[failure[current]])
+		node.outputs = append(node.outputs, fallback.outputs...)
+		for b := range node.next {
+			child := node.next[b]
+			if child < 0 {
+				node.next[b] = fallback.next[b]
+				continue
+			}
+			failure[child] = fallback.next[b]
+			queue = append(queue, child)
+		}
+	}
+	return toReturn, nil
+}
+
+// Returns the pattern at the given index.
+func (m *PatternMatcher) Pattern(index int) []byte {
+	return m.patterns[index]
+}
+
+// Returns a new PatternScanner that finds this matcher's patterns.
+func (m *PatternMatcher) NewScanner() *PatternScanner {
+	return &PatternScanner{
+		matcher: m,
+	}
+}
+
+// Finds patterns in a stream of data passed to Scan in consecutive pieces,
+// including patterns that span more than one piece.
+type PatternScanner struct {
+	matcher *PatternMatcher
+	state   int32
+}
+
+// Scans the next piece of the stream. For each occurrence of a pattern ending
+// in data, calls found with the pattern's index and the offset in data just
+// past the end of the occurrence. The occurrence may have started in an
+// earlier piece, so the offset may be less than the pattern's length.
+// Occurrences are reported in the order they end.
+func (s *PatternScanner) Scan(data []byte, found func(pattern, end int)) {
+	nodes := s.matcher.nodes
+	state := s.state
+	for i, b := range data {
+		state = nodes[state].next[b]
+		for _, pattern := range nodes[state].outputs {
+			found(pattern, i+1)
+		}
+	}
+	s.state = state
+}
+
+// Forgets any partial occurrence at the end of the previous piece, e.g. if
+// the next piece of data won't directly follow it.
+func (s *PatternScanner) Reset() {
+	s.state = 0
+}
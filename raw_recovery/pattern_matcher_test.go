@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestPatternMatcher(t *testing.T) {
+	patterns := [][]byte{
+		[]byte("he"),
+		[]byte("she"),
+		[]byte("his"),
+		[]byte("hers"),
+		{0xff, 0xd8, 0xff},
+	}
+	m, e := NewPatternMatcher(patterns)
+	if e != nil {
+		t.Logf("Failed creating matcher: %s\n", e)
+		t.FailNow()
+	}
+	var found []string
+	record := func(pattern, end int) {
+		found = append(found, fmt.Sprintf("%s@%d", m.Pattern(pattern), end))
+	}
+	s := m.NewScanner()
+	s.Scan([]byte("ushers"), record)
+	expected := "[she@4 he@4 hers@6]"
+	if fmt.Sprint(found) != expected {
+		t.Logf("Expected matches %s, got %v\n", expected, found)
+		t.Fail()
+	}
+
+	// Matches spanning pieces are reported at their end in the later piece,
+	// unless the scanner is reset.
+	found = nil
+	s.Scan([]byte("xxhi"), record)
+	s.Scan([]byte("s"), record)
+	expected = "[his@1]"
+	if fmt.Sprint(found) != expected {
+		t.Logf("Expected matches %s, got %v\n", expected, found)
+		t.Fail()
+	}
+	found = nil
+	s.Scan([]byte("xxhi"), record)
+	s.Reset()
+	s.Scan([]byte("s"), record)
+	if len(found) != 0 {
+		t.Logf("Got matches %v after resetting the scanner\n", found)
+		t.Fail()
+	}
+
+	_, e = NewPatternMatcher([][]byte{[]byte("a"), nil})
+	if e == nil {
+		t.Logf("Didn't get an error for an empty pattern\n")
+		t.Fail()
+	}
+}
+
+func TestPatternMatcherRandom(t *testing.T) {
+	// Compare against a naive search, using a small alphabet so patterns
+	// overlap often.
+	rng := rand.New(rand.NewSource(1337))
+	randomBytes := func(n int) []byte {
+		toReturn := make([]byte, n)
+		for i := range toReturn {
+			toReturn[i] = byte('a' + rng.Intn(3))
+		}
+		return toReturn
+	}
+	patterns := make([][]byte, 20)
+	for i := range patterns {
+		patterns[i] = randomBytes(1 + rng.Intn(5))
+	}
+	m, e := NewPatternMatcher(patterns)
+	if e != nil {
+		t.Logf("Failed creating matcher: %s\n", e)
+		t.FailNow()
+	}
+	data := randomBytes(10000)
+	counts := make([]int, len(patterns))
+	s := m.NewScanner()
+	for start := 0; start < len(data); start += 777 {
+		end := start + 777
+		if end > len(data) {
+			end = len(data)
+		}
+		piece := data[start:end]
+		s.Scan(piece, func(pattern, pieceEnd int) {
+			matchEnd := start + pieceEnd
+			p := patterns[pattern]
+			if !bytes.Equal(data[matchEnd-len(p):matchEnd], p) {
+				t.Logf("Pattern %d reported at incorrect offset %d\n",
+					pattern, matchEnd)
+				t.FailNow()
+			}
+			counts[pattern]++
+		})
+	}
+	for i, p := range patterns {
+		expected := 0
+		for j := 0; (j + len(p)) <= len(data); j++ {
+			if bytes.Equal(data[j:j+len(p)], p) {
+				expected++
+			}
+		}
+		if counts[i] != expected {
+			t.Logf("Expected %d matches of pattern %d (%s), got %d\n",
+				expected, i, p, counts[i])
+			t.Fail()
+		}
+	}
+}
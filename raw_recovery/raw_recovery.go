@@ -6,207 +6,168 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
 	"flag"
 	"fmt"
-	"image"
-	_ "image/gif"
-	_ "image/jpeg"
-	_ "image/png"
-	"io"
+	"github.com/yalue/fat"
+	"github.com/yalue/fat/internal/cmdflags"
 	"os"
+	"runtime"
+	"strings"
 )
 
-// Used within the checkForAvi function; don't want to re-allocate them every
-// time.
-var aviHeader1 []byte = []byte("RIFF")
-var aviHeader2 []byte = []byte("AVI ")
-
-// Saves an image to the output directory if the given reader is at the start
-// of a recognized image file. Simply prints a message if outputDir is an empty
-// string. Returns false, nil if not at an image.
-func checkForImage(src io.ReadSeeker, outputDir string, tag int) (bool, error) {
-	startOffset, e := src.Seek(0, io.SeekCurrent)
-	if e != nil {
-		return false, fmt.Errorf("Error getting current offset: %s", e)
-	}
-	_, format, e := image.Decode(src)
-	if e != nil {
-		return false, nil
-	}
-	if outputDir == "" {
-		fmt.Printf("Found %s-format image %d, not saving.\n", format, tag)
-		return true, nil
-	}
-
-	// Determine the number of bytes of the image file so we can save it.
-	newOffset, e := src.Seek(0, io.SeekCurrent)
-	if e != nil {
-		return true, fmt.Errorf("Error determining size of image: %s", e)
-	}
-	sizeBytes := newOffset - startOffset
-	_, e = src.Seek(startOffset, io.SeekStart)
-	if e != nil {
-		return true, fmt.Errorf("Error rewinding to start of image: %s", e)
-	}
-
-	var outputPath string
-	if format == "jpeg" {
-		// Strip the 'e' from jpeg file extensions because I prefer to.
-		outputPath = fmt.Sprintf("%s/pic_%d.jpg", outputDir, tag)
-	} else {
-		outputPath = fmt.Sprintf("%s/pic_%d.%s", outputDir, tag, format)
-	}
-	f, e := os.Create(outputPath)
-	if e != nil {
-		return true, fmt.Errorf("Error creating output file %s: %s",
-			outputPath, e)
-	}
-	defer f.Close()
-	_, e = io.CopyN(f, src, sizeBytes)
-	if e != nil {
-		return true, fmt.Errorf("Error writing %s: %s", outputPath, e)
-	}
-	fmt.Printf("Image %s saved OK!\n", outputPath)
-	return true, nil
-}
-
-// Checks for an avi-format file and saves it if found.
-func checkForAvi(src io.ReadSeeker, outputDir string, tag int) (bool, error) {
-	startOffset, e := src.Seek(0, io.SeekCurrent)
-	if e != nil {
-		return false, fmt.Errorf("Error getting current offset: %s", e)
-	}
-	var buffer [12]byte
-	data := buffer[:]
-	_, e = src.Read(data)
-	if e != nil {
-		return false, fmt.Errorf("Error reading start of sector: %s", e)
-	}
-	if !bytes.Equal(data[0:4], aviHeader1) {
-		return false, nil
-	}
-	if !bytes.Equal(data[8:12], aviHeader2) {
-		return false, nil
-	}
-	contentSize := binary.LittleEndian.Uint32(data[4:8])
-	_, e = src.Seek(startOffset, io.SeekStart)
-	if e != nil {
-		return true, fmt.Errorf("Error seeking to start of avi file: %s", e)
-	}
-	if outputDir == "" {
-		fmt.Printf("Found .avi file %d, not saving.\n", tag)
-		return true, nil
-	}
-	outputPath := fmt.Sprintf("%s/video_%d.avi", outputDir, tag)
-	f, e := os.Create(outputPath)
-	if e != nil {
-		return true, fmt.Errorf("Error creating %s: %s", outputPath, e)
-	}
-	defer f.Close()
-	_, e = io.CopyN(f, src, int64(contentSize))
-	if e != nil {
-		return true, fmt.Errorf("Error writing %s: %s", outputPath, e)
-	}
-	fmt.Printf("Wrote file %s OK.\n", outputPath)
-	return true, nil
-}
-
-// The top level function that checks whether each sector begins a new file.
-func scanForFiles(src io.ReadSeeker, sectorSize int, outputDir string) error {
-	endOffset, e := src.Seek(0, io.SeekEnd)
-	if e != nil {
-		return fmt.Errorf("Error determining size of disk image: %s", e)
-	}
-	numSectors := endOffset / int64(sectorSize)
-	sectorsPerStatus := numSectors / 25
-	sectorsThisStatus := int64(0)
-	currentTag := 1
-	for i := int64(0); i < numSectors; i++ {
-		if sectorsThisStatus >= sectorsPerStatus {
-			fmt.Printf("Now scanning sector %d/%d (%.02f%%).\n", i+1,
-				numSectors, 100.0*(float32(i+1)/float32(numSectors)))
-			sectorsThisStatus = 0
-		}
-		sectorsThisStatus++
-		offset := i * int64(sectorSize)
-		_, e = src.Seek(offset, io.SeekStart)
-		if e != nil {
-			return fmt.Errorf("Error seeking to offset %d: %s", offset, e)
-		}
-
-		// First, check for image files
-		imageFound, e := checkForImage(src, outputDir, currentTag)
-		if e != nil {
-			return fmt.Errorf("Error checking for image at offset %d: %s",
-				offset, e)
-		}
-		if imageFound {
-			currentTag++
-		}
-
-		// Next, check for .mp4 videos
-		_, e = src.Seek(offset, io.SeekStart)
-		if e != nil {
-			return fmt.Errorf("Error returning to offset %d: %s", offset, e)
-		}
-		mp4Found, e := TrySavingMp4(src, outputDir, currentTag)
-		if e != nil {
-			return fmt.Errorf("Error checking for mp4 at offset %d: %s",
-				offset, e)
-		}
-		if mp4Found {
-			currentTag++
-		}
-
-		// Next, check for .avi videos
-		_, e = src.Seek(offset, io.SeekStart)
-		if e != nil {
-			return fmt.Errorf("Error returning to offset %d: %s", offset, e)
-		}
-		aviFound, e := checkForAvi(src, outputDir, currentTag)
-		if e != nil {
-			return fmt.Errorf("Error checking for avi at offset %d: %s",
-				offset, e)
-		}
-		if aviFound {
-			currentTag++
-		}
-
-		// TODO: Rewind to current offset before checking for other file types
-	}
-	return nil
-}
-
 func run() int {
 	var imagePath string
 	var outputDir string
 	var sectorSize int
+	var mapPath string
+	var enabledCarvers, disabledCarvers string
+	var workerCount int
+	var statePath string
+	var resume bool
+	var startOffset, endOffset int64
+	var partitionIndex int
+	var unallocatedOnly bool
+	var verify bool
 	flag.StringVar(&imagePath, "image", "", "The path to the raw disk or "+
-		"disk image to scan.")
+		"disk image to scan. For split images, give the path to any "+
+		"numbered segment, e.g. disk.001 or disk.E01. gzip, xz or "+
+		"zstd-compressed images, and VHD, VHDX and QCOW2 virtual disks, "+
+		"are also supported.")
 	flag.StringVar(&outputDir, "output_directory", "",
 		"Dump discovered content into this directory, if specified.")
 	flag.IntVar(&sectorSize, "sector_size", 512,
 		"The size of a \"sector\" in bytes. Sector boundaries will be "+
 			"checked for file starts, so smaller sectors may do a finer-"+
 			"grained search at the cost of longer execution time.")
+	flag.StringVar(&mapPath, "mapfile", "",
+		"The path to the GNU ddrescue mapfile for the image, if it was "+
+			"created by ddrescue. Sectors that weren't read successfully "+
+			"will be skipped.")
+	tolerantFlags := cmdflags.AddTolerantImageFlags()
+	imageOptions := cmdflags.AddImageOptionFlags()
+	flag.StringVar(&enabledCarvers, "carvers", "",
+		"A comma-separated list of the carvers to use. Defaults to all "+
+			"available carvers: "+strings.Join(carverNames(), ", ")+".")
+	flag.StringVar(&disabledCarvers, "disable_carvers", "",
+		"A comma-separated list of carvers not to use.")
+	flag.IntVar(&workerCount, "workers", runtime.NumCPU(),
+		"The number of regions of the image to scan in parallel.")
+	flag.StringVar(&statePath, "state_file", "",
+		"If set, periodically save the scan's progress and the files "+
+			"found so far to this file, so the scan can be resumed using "+
+			"-resume.")
+	flag.BoolVar(&resume, "resume", false,
+		"If set, continue the scan saved in the -state_file, without "+
+			"saving files it already found again. The other arguments "+
+			"must match those of the original scan.")
+	flag.Int64Var(&startOffset, "start_offset", 0,
+		"The offset, in bytes, at which to start scanning. If -partition "+
+			"is given, this is relative to the start of the partition. "+
+			"Must be a multiple of -sector_size, since files are only "+
+			"searched for at the start of each sector.")
+	flag.Int64Var(&endOffset, "end_offset", 0,
+		"The offset, in bytes, at which to stop scanning. Relative to the "+
+			"start of the partition if -partition is given. Defaults to "+
+			"the end of the image or partition.")
+	flag.IntVar(&partitionIndex, "partition", -1,
+		"If set, only scan the partition at this index in the image's "+
+			"MBR (0 to 3), or in its GUID partition table if it has one. "+
+			"GPT indices count every entry in the table, including empty "+
+			"ones, starting at 0, so GPT partition N as listed by tools "+
+			"such as gdisk is index N-1.")
+	flag.BoolVar(&unallocatedOnly, "unallocated_only", false,
+		"If set, only scan the free clusters of the FAT32 volume in the "+
+			"image or partition. Can't be combined with -start_offset or "+
+			"-end_offset.")
+	flag.BoolVar(&verify, "verify", false,
+		"If set, check the image's content against the MD5 and SHA1 "+
+			"hashes stored in it when it was acquired before scanning. "+
+			"Only EWF (E01 or Ex01) images store hashes.")
 	flag.Parse()
-	if (imagePath == "") || (sectorSize < 1) {
+	if (imagePath == "") || (sectorSize < 1) || !tolerantFlags.Valid() ||
+		(workerCount < 1) || (tolerantFlags.Enabled() && (mapPath != "")) ||
+		(resume && (statePath == "")) || (startOffset < 0) ||
+		(endOffset < 0) || ((endOffset != 0) && (endOffset <= startOffset)) ||
+		(unallocatedOnly && ((startOffset != 0) || (endOffset != 0))) {
 		fmt.Println("Invalid arguments. Run with -help for more information.")
 		return 1
 	}
-	imageFile, e := os.Open(imagePath)
+	if (startOffset % int64(sectorSize)) != 0 {
+		fmt.Printf("The start offset (%d) must be a multiple of the sector "+
+			"size (%d).\n", startOffset, sectorSize)
+		return 1
+	}
+	selected, e := selectCarvers(enabledCarvers, disabledCarvers)
+	if e != nil {
+		fmt.Printf("%s\n", e)
+		return 1
+	}
+	var imageFile fat.Image
+	var tolerant *fat.TolerantImage
+	if tolerantFlags.Enabled() {
+		tolerant, e = tolerantFlags.Open(imagePath)
+		imageFile = tolerant
+	} else if mapPath == "" {
+		imageFile, e = fat.OpenImageWithOptions(imagePath, imageOptions)
+	} else {
+		var rescued *fat.RescuedImage
+		rescued, e = fat.OpenRescuedImage(imagePath, mapPath)
+		if e == nil {
+			// Carved files may extend into unreadable regions; they'll just
+			// contain filler there.
+			rescued.AllowUnreadable = true
+			imageFile = rescued
+		}
+	}
 	if e != nil {
 		fmt.Printf("Failed opening %s: %s\n", imagePath, e)
 		return 1
 	}
 	defer imageFile.Close()
-	e = scanForFiles(imageFile, sectorSize, outputDir)
+	if verify {
+		fmt.Printf("Verifying the hashes stored in %s.\n", imagePath)
+		e = fat.VerifyImage(imageFile)
+		if e != nil {
+			fmt.Printf("Failed verifying %s: %s\n", imagePath, e)
+			return 1
+		}
+		fmt.Printf("The image's content matches its stored hashes.\n")
+	}
+	src, scanRange, e := selectScanSource(imageFile, startOffset, endOffset,
+		partitionIndex, unallocatedOnly)
+	if e != nil {
+		fmt.Printf("Failed selecting the part of %s to scan: %s\n",
+			imagePath, e)
+		return 1
+	}
+	var checkpoint *scanCheckpoint
+	if resume {
+		checkpoint, e = loadScanCheckpoint(statePath, scanRange,
+			src.Size(), sectorSize, selected)
+		if e != nil {
+			fmt.Printf("Failed loading scan state: %s\n", e)
+			return 1
+		}
+	} else if statePath != "" {
+		_, e = os.Stat(statePath)
+		if e == nil {
+			fmt.Printf("%s already exists. Use -resume to continue its "+
+				"scan, or delete it to start again.\n", statePath)
+			return 1
+		}
+		checkpoint = newScanCheckpoint(statePath, imagePath, scanRange,
+			src.Size(), sectorSize, selected)
+	}
+	e = scanForFiles(src, src.Size(), sectorSize, outputDir, selected,
+		workerCount, checkpoint)
 	if e != nil {
 		fmt.Printf("Error scanning for files: %s\n", e)
 		return 1
 	}
+	if tolerant != nil {
+		fmt.Printf("%d bytes couldn't be read and were filled.\n",
+			tolerant.BadBytes())
+	}
 	return 0
 }
 
@@ -0,0 +1,115 @@
+package main
+
+// This file contains functions for restricting a scan to part of an image: a
+// range of offsets, a single partition, or the free clusters of a FAT32
+// volume.
+
+import (
+	"fmt"
+	"github.com/yalue/fat"
+	"io"
+	"strings"
+)
+
+// The part of an image to scan.
+type scanSource interface {
+	io.ReadSeeker
+	io.ReaderAt
+	Size() int64
+}
+
+// Returns the partition at the given index in the image's partition table.
+// Uses the GUID partition table if the image has a protective MBR.
+func openPartition(img fat.Image, index int) (*fat.LimitedReadSeeker,
+	error) {
+	mbr, e := fat.ParseMBR(img)
+	if e != nil {
+		return nil, fmt.Errorf("Error reading MBR: %w", e)
+	}
+	var partition io.ReadSeeker
+	if mbr.IsProtective() {
+		gpt, e := fat.ParseGPT(img)
+		if e != nil {
+			return nil, fmt.Errorf("Error reading GPT: %w", e)
+		}
+		if gpt.UsedBackup {
+			fmt.Printf("The primary GPT is damaged; using the backup.\n")
+		}
+		partition, e = fat.GetGPTPartition(img, gpt, index)
+		if e != nil {
+			return nil, e
+		}
+		fmt.Printf("Scanning GPT partition %d: %s\n", index,
+			&(gpt.Partitions[index]))
+	} else {
+		if (index < 0) || (index >= len(mbr.Partitions)) {
+			return nil, fmt.Errorf("Invalid MBR partition index: %d", index)
+		}
+		entry := &(mbr.Partitions[index])
+		if entry.IsEmpty() {
+			return nil, fmt.Errorf("MBR partition %d is empty", index)
+		}
+		partition, e = fat.GetPartition(img, mbr, index)
+		if e != nil {
+			return nil, e
+		}
+		fmt.Printf("Scanning MBR partition %d: %s\n", index, entry)
+	}
+	return partition.(*fat.LimitedReadSeeker), nil
+}
+
+// Returns the part of the image to scan, along with a description of it that
+// is recorded in the scan's state file. The description is empty if the
+// entire image is scanned. If partitionIndex is nonnegative, only that
+// partition is scanned. startOffset and endOffset are relative to the
+// partition, if one is given, and endOffset may be 0 to scan to the end. If
+// unallocatedOnly is set, only the free clusters of the FAT32 volume are
+// scanned, concatenated into a single stream.
+func selectScanSource(img fat.Image, startOffset, endOffset int64,
+	partitionIndex int, unallocatedOnly bool) (scanSource, string, error) {
+	var src scanSource = img
+	description := ""
+	if partitionIndex >= 0 {
+		partition, e := openPartition(img, partitionIndex)
+		if e != nil {
+			return nil, "", e
+		}
+		src = partition
+		description = fmt.Sprintf("partition %d", partitionIndex)
+	}
+	if (startOffset != 0) || (endOffset != 0) {
+		if endOffset == 0 {
+			endOffset = src.Size()
+		}
+		if endOffset > src.Size() {
+			return nil, "", fmt.Errorf("The end offset (%d) is past the "+
+				"end of the %d-byte image or partition", endOffset,
+				src.Size())
+		}
+		limited, e := fat.LimitReadSeeker(src, startOffset, endOffset)
+		if e != nil {
+			return nil, "", e
+		}
+		src = limited.(*fat.LimitedReadSeeker)
+		description += fmt.Sprintf(" bytes %d-%d", startOffset, endOffset)
+		fmt.Printf("Scanning bytes %d to %d. Offsets in file names are "+
+			"relative to byte %d.\n", startOffset, endOffset, startOffset)
+	}
+	if unallocatedOnly {
+		f, e := fat.NewFAT32Filesystem(src)
+		if e != nil {
+			return nil, "", fmt.Errorf("Error loading FAT32 volume: %w", e)
+		}
+		unallocated := f.GetUnallocatedReader()
+		fmt.Printf("Scanning %d bytes of unallocated clusters in %d "+
+			"regions. Offsets in file names are relative to the start of "+
+			"the first free cluster, skipping allocated clusters.\n",
+			unallocated.Size(), len(unallocated.Regions()))
+		src = unallocated
+		description += " unallocated"
+	}
+	if src.Size() <= 0 {
+		return nil, "", fmt.Errorf("There is nothing to scan")
+	}
+	return src, strings.TrimSpace(description), nil
+}
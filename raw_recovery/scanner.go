@@ -0,0 +1,561 @@
+package main
+
+// This file contains scanForFiles, which searches an image for files using
+// several worker goroutines.
+
+import (
+	"fmt"
+	"github.com/yalue/fat"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// The number of bytes each worker reads at a time.
+const scanBufferSize = 4 * 1024 * 1024
+
+// The size of the regions of the image given to each worker, not including
+// the overlap with the following region.
+const scanRegionSize = 64 * 1024 * 1024
+
+// Matches the signatures of a list of carvers.
+type signatureSet struct {
+	matcher *PatternMatcher
+	// The index of the carver, and the offset of the signature within a
+	// file, for each of the matcher's patterns.
+	carverIndices    []int
+	signatureOffsets []int
+}
+
+// Returns a signatureSet for the given carvers. Returns an error if any of
+// the signatures don't fit within a sector.
+func newSignatureSet(selected []Carver, sectorSize int) (*signatureSet,
+	error) {
+	toReturn := &signatureSet{}
+	var patterns [][]byte
+	for i, c := range selected {
+		for _, s := range c.Signatures() {
+			if (s.Offset < 0) || ((s.Offset + len(s.Magic)) > sectorSize) {
+				return nil, fmt.Errorf("A signature for the %s carver "+
+					"doesn't fit within a %d-byte sector", c.Name(),
+					sectorSize)
+			}
+			patterns = append(patterns, s.Magic)
+			toReturn.carverIndices = append(toReturn.carverIndices, i)
+			toReturn.signatureOffsets = append(toReturn.signatureOffsets,
+				s.Offset)
+		}
+	}
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("None of the carvers have any signatures")
+	}
+	var e error
+	toReturn.matcher, e = NewPatternMatcher(patterns)
+	if e != nil {
+		return nil, fmt.Errorf("Error building signature matcher: %w", e)
+	}
+	return toReturn, nil
+}
+
+// An offset where one of a carver's signatures was found.
+type carveCandidate struct {
+	offset int64
+	carver int
+}
+
+// A file found by a worker.
+type carvedFile struct {
+	offset int64
+	size   int64
+	carver int
+}
+
+// Counts the sectors skipped while scanning.
+type scanStats struct {
+	UnreadableSectors int64 `json:"unreadable_sectors"`
+	HoleBytes         int64 `json:"hole_bytes"`
+	ZeroBytes         int64 `json:"zero_bytes"`
+	ErasedBytes       int64 `json:"erased_bytes"`
+}
+
+func (s *scanStats) add(other *scanStats) {
+	s.UnreadableSectors += other.UnreadableSectors
+	s.HoleBytes += other.HoleBytes
+	s.ZeroBytes += other.ZeroBytes
+	s.ErasedBytes += other.ErasedBytes
+}
+
+// A part of the image scanned by a single worker.
+type scanRegion struct {
+	index int
+	// The part of the image belonging to this region.
+	start int64
+	end   int64
+	// The end of the part of the image that's scanned. Regions overlap by a
+	// sector, so detections never depend on where the boundaries fall.
+	// Files found in the overlap are found by both regions, and the
+	// duplicates are removed when the results are merged.
+	scanEnd int64
+}
+
+// The outcome of scanning a region.
+type regionResult struct {
+	region scanRegion
+	// The files found, sorted by offset.
+	files []carvedFile
+	// Only counts sectors within the region's own part of the image.
+	stats scanStats
+	err   error
+}
+
+// Splits the first scanEnd bytes of an image into regions.
+func makeScanRegions(scanEnd int64, sectorSize int) []scanRegion {
+	size := int64(sectorSize)
+	regionSize := int64(scanRegionSize)
+	if regionSize < size {
+		regionSize = size
+	}
+	regionSize -= regionSize % size
+	var toReturn []scanRegion
+	for start := int64(0); start < scanEnd; start += regionSize {
+		r := scanRegion{
+			index:   len(toReturn),
+			start:   start,
+			end:     start + regionSize,
+			scanEnd: start + regionSize + size,
+		}
+		if r.end > scanEnd {
+			r.end = scanEnd
+		}
+		if r.scanEnd > scanEnd {
+			r.scanEnd = scanEnd
+		}
+		toReturn = append(toReturn, r)
+	}
+	return toReturn
+}
+
+// Holds the state used by a single worker goroutine.
+type scanWorker struct {
+	src        io.ReaderAt
+	sectorSize int
+	selected   []Carver
+	signatures *signatureSet
+	// Used by the carvers, which need an io.ReadSeeker.
+	reader  io.ReadSeeker
+	scanner *PatternScanner
+	// Files can't start in sectors that weren't read when the image was
+	// acquired, since they only contain filler. They also can't start in
+	// blank sectors, so holes in sparse images and sectors containing only
+	// 0x00 or 0xff bytes are skipped.
+	reporter   fat.UnreadableRangeReporter
+	holes      fat.HoleReporter
+	buffer     []byte
+	unreadable []bool
+	candidates []carveCandidate
+}
+
+func newScanWorker(src io.ReaderAt, size int64, sectorSize int,
+	selected []Carver, signatures *signatureSet) *scanWorker {
+	bufferSize := sectorSize
+	if bufferSize < scanBufferSize {
+		bufferSize = scanBufferSize - (scanBufferSize % sectorSize)
+	}
+	toReturn := &scanWorker{
+		src:        src,
+		sectorSize: sectorSize,
+		selected:   selected,
+		signatures: signatures,
+		reader:     io.NewSectionReader(src, 0, size),
+		scanner:    signatures.matcher.NewScanner(),
+		buffer:     make([]byte, bufferSize),
+		unreadable: make([]bool, bufferSize/sectorSize),
+	}
+	toReturn.reporter, _ = src.(fat.UnreadableRangeReporter)
+	toReturn.holes, _ = src.(fat.HoleReporter)
+	return toReturn
+}
+
+// Returns the size of the file the carver finds at the given offset, or 0
+// if it doesn't find one.
+func findFile(c Carver, src io.ReadSeeker, offset int64) (int64, error) {
+	matched, e := c.Match(src, offset)
+	if (e != nil) || !matched {
+		return 0, e
+	}
+	return c.Size(src, offset)
+}
+
+// Scans a single block of the region, starting at the given offset. Returns
+// the number of bytes scanned.
+func (w *scanWorker) scanBlock(r *scanRegion, offset int64,
+	result *regionResult) (int64, error) {
+	size := int64(w.sectorSize)
+	stats := &(result.stats)
+	if w.holes != nil {
+		nextData, e := w.holes.NextData(offset)
+		if e != nil {
+			return 0, fmt.Errorf("Error finding data after offset %d: %s",
+				offset, e)
+		}
+		// Skip sectors that lie entirely within the hole.
+		nextData -= nextData % size
+		if nextData > r.scanEnd {
+			nextData = r.scanEnd
+		}
+		if nextData > offset {
+			if offset < r.end {
+				end := nextData
+				if end > r.end {
+					end = r.end
+				}
+				stats.HoleBytes += end - offset
+			}
+			w.scanner.Reset()
+			return nextData - offset, nil
+		}
+	}
+	block := w.buffer
+	if int64(len(block)) > (r.scanEnd - offset) {
+		block = block[:r.scanEnd-offset]
+	}
+	n, e := w.src.ReadAt(block, offset)
+	if (e != nil) && (e != io.EOF) {
+		return 0, fmt.Errorf("Error reading offset %d: %s", offset, e)
+	}
+	block = block[:n-(n%w.sectorSize)]
+	if len(block) == 0 {
+		return 0, fmt.Errorf("The image ended unexpectedly at offset %d",
+			offset)
+	}
+	// Check this after reading the block, in case reading it found new bad
+	// sectors.
+	sectorCount := len(block) / w.sectorSize
+	unreadable := w.unreadable[:sectorCount]
+	for i := range unreadable {
+		unreadable[i] = false
+	}
+	if w.reporter != nil {
+		for _, u := range w.reporter.UnreadableRanges(offset,
+			int64(len(block))) {
+			first := (u.Offset - offset) / size
+			last := (u.End() - 1 - offset) / size
+			for i := first; i <= last; i++ {
+				unreadable[i] = true
+			}
+		}
+	}
+
+	w.candidates = w.candidates[:0]
+	for i := 0; i < sectorCount; i++ {
+		sectorOffset := offset + int64(i)*size
+		// Only count sectors in the overlap with the next region once.
+		count := sectorOffset < r.end
+		if unreadable[i] {
+			if count {
+				stats.UnreadableSectors++
+			}
+			w.scanner.Reset()
+			continue
+		}
+		sector := block[i*w.sectorSize : (i+1)*w.sectorSize]
+		fill, blank := fat.BlankFill(sector)
+		if blank {
+			if count && (fill == 0) {
+				stats.ZeroBytes += size
+			} else if count {
+				stats.ErasedBytes += size
+			}
+			w.scanner.Reset()
+			continue
+		}
+		w.scanner.Scan(sector, func(pattern, end int) {
+			start := sectorOffset + int64(end) -
+				int64(len(w.signatures.matcher.Pattern(pattern))) -
+				int64(w.signatures.signatureOffsets[pattern])
+			if (start < 0) || ((start % size) != 0) {
+				return
+			}
+			w.candidates = append(w.candidates, carveCandidate{
+				offset: start,
+				carver: w.signatures.carverIndices[pattern],
+			})
+		})
+	}
+
+	// Signatures are matched in the order they end, so sort them by offset,
+	// and then carver, so carvers are tried in order.
+	candidates := w.candidates
+	sort.Slice(candidates, func(a, b int) bool {
+		if candidates[a].offset != candidates[b].offset {
+			return candidates[a].offset < candidates[b].offset
+		}
+		return candidates[a].carver < candidates[b].carver
+	})
+	foundOffset := int64(-1)
+	for i, c := range candidates {
+		// Skip duplicates, and stop at the first carver that finds a file
+		// at each offset, since files can't overlap.
+		if (i > 0) && (candidates[i-1] == c) {
+			continue
+		}
+		if c.offset == foundOffset {
+			continue
+		}
+		carver := w.selected[c.carver]
+		fileSize, e := findFile(carver, w.reader, c.offset)
+		if e != nil {
+			return 0, fmt.Errorf("Error checking for %s file at offset %d: "+
+				"%s", carver.Name(), c.offset, e)
+		}
+		if fileSize <= 0 {
+			continue
+		}
+		result.files = append(result.files, carvedFile{
+			offset: c.offset,
+			size:   fileSize,
+			carver: c.carver,
+		})
+		foundOffset = c.offset
+	}
+	return int64(len(block)), nil
+}
+
+// Scans the given region of the image for files.
+func (w *scanWorker) scan(r scanRegion) regionResult {
+	result := regionResult{
+		region: r,
+	}
+	// Signatures fit within a sector, so none can span the region's start.
+	w.scanner.Reset()
+	for offset := r.start; offset < r.scanEnd; {
+		n, e := w.scanBlock(&r, offset, &result)
+		if e != nil {
+			result.err = e
+			return result
+		}
+		offset += n
+	}
+	return result
+}
+
+// Saves a file found by a worker to outputDir, or just prints a message if
+// outputDir is empty. Returns the path the file was saved to, if any. If
+// skipExisting is set, and a file of the right size already exists at the
+// path, it's assumed to have been saved by an earlier, interrupted scan.
+func saveCarvedFile(c Carver, src io.ReadSeeker, f *carvedFile,
+	outputDir string, skipExisting bool) (string, error) {
+	if outputDir == "" {
+		fmt.Printf("Found %s file at offset %d (%d bytes), not saving.\n",
+			c.Name(), f.offset, f.size)
+		return "", nil
+	}
+	outputPath := filepath.Join(outputDir, c.Filename(f.offset))
+	if skipExisting {
+		info, e := os.Stat(outputPath)
+		if (e == nil) && (info.Size() == f.size) {
+			fmt.Printf("%s was already saved.\n", outputPath)
+			return outputPath, nil
+		}
+	}
+	_, e := src.Seek(f.offset, io.SeekStart)
+	if e != nil {
+		return "", fmt.Errorf("Error seeking to start of file: %s", e)
+	}
+	output, e := os.Create(outputPath)
+	if e != nil {
+		return "", fmt.Errorf("Error creating %s: %s", outputPath, e)
+	}
+	defer output.Close()
+	_, e = io.CopyN(output, src, f.size)
+	if e != nil {
+		return "", fmt.Errorf("Error writing %s: %s", outputPath, e)
+	}
+	fmt.Printf("Saved %s OK!\n", outputPath)
+	return outputPath, nil
+}
+
+// The top level function that finds files starting on sector boundaries in
+// the first size bytes of src, using the selected carvers. The image is
+// split into regions, which are scanned by workerCount goroutines. Each
+// worker reads its region in large blocks, searching every sector that isn't
+// blank or unreadable for all of the carvers' signatures at once. A carver
+// is only asked to check an offset where one of its signatures was found.
+// Files are named after their offsets, so the output doesn't depend on the
+// number of workers. If checkpoint isn't nil, the scan's progress is saved
+// to it, and the scan continues from the position it contains.
+func scanForFiles(src io.ReaderAt, size int64, sectorSize int,
+	outputDir string, selected []Carver, workerCount int,
+	checkpoint *scanCheckpoint) error {
+	if workerCount < 1 {
+		return fmt.Errorf("Invalid number of workers: %d", workerCount)
+	}
+	signatures, e := newSignatureSet(selected, sectorSize)
+	if e != nil {
+		return e
+	}
+	scanEnd := (size / int64(sectorSize)) * int64(sectorSize)
+	regions := makeScanRegions(scanEnd, sectorSize)
+	lastOffset := int64(-1)
+	var stats scanStats
+	resuming := false
+	if checkpoint != nil {
+		if checkpoint.state.Complete {
+			fmt.Printf("The scan in %s is already complete.\n",
+				checkpoint.path)
+			return nil
+		}
+		// Skip the regions that were already scanned. Files found in the
+		// overlap with the next region were also saved already, so don't
+		// save them again.
+		resuming = checkpoint.state.Position > 0
+		for (len(regions) > 0) &&
+			(regions[0].end <= checkpoint.state.Position) {
+			regions = regions[1:]
+		}
+		lastOffset = checkpoint.lastFileOffset()
+		stats = checkpoint.state.Stats
+		if resuming {
+			fmt.Printf("Resuming the scan at offset %d, after %d files.\n",
+				checkpoint.state.Position, len(checkpoint.state.Files))
+		}
+	}
+
+	// Hand out regions in order until they run out or an error occurs.
+	regionChannel := make(chan scanRegion)
+	stop := make(chan struct{})
+	go func() {
+		defer close(regionChannel)
+		for _, r := range regions {
+			select {
+			case regionChannel <- r:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	results := make(chan regionResult)
+	var wg sync.WaitGroup
+	for i := 0; i < workerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := newScanWorker(src, size, sectorSize, selected, signatures)
+			for r := range regionChannel {
+				results <- w.scan(r)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Merge the results in the order of the regions, so files are saved in
+	// order of their offsets.
+	reader := io.NewSectionReader(src, 0, size)
+	pending := make(map[int]regionResult)
+	nextRegion := 0
+	if len(regions) > 0 {
+		nextRegion = regions[0].index
+	}
+	var scanError error
+	bytesPerStatus := scanEnd / 25
+	nextStatus := int64(0)
+	for result := range results {
+		if scanError != nil {
+			// Keep draining results until the workers have stopped.
+			continue
+		}
+		pending[result.region.index] = result
+		for {
+			current, ok := pending[nextRegion]
+			if !ok {
+				break
+			}
+			delete(pending, nextRegion)
+			nextRegion++
+			if current.err != nil {
+				scanError = current.err
+				close(stop)
+				break
+			}
+			for i := range current.files {
+				f := &(current.files[i])
+				// Files in the overlap were also found by the previous
+				// region.
+				if f.offset <= lastOffset {
+					continue
+				}
+				lastOffset = f.offset
+				carver := selected[f.carver]
+				path, e := saveCarvedFile(carver, reader, f, outputDir,
+					resuming)
+				if e != nil {
+					scanError = e
+					close(stop)
+					break
+				}
+				if checkpoint != nil {
+					checkpoint.state.Files = append(checkpoint.state.Files,
+						scanStateFile{
+							Offset: f.offset,
+							Size:   f.size,
+							Carver: carver.Name(),
+							Path:   path,
+						})
+				}
+			}
+			if scanError != nil {
+				break
+			}
+			stats.add(&current.stats)
+			if checkpoint != nil {
+				e = checkpoint.update(current.region.end, &stats)
+				if e != nil {
+					scanError = e
+					close(stop)
+					break
+				}
+			}
+			if current.region.end >= nextStatus {
+				fmt.Printf("Scanned %d/%d bytes (%.02f%%).\n",
+					current.region.end, scanEnd,
+					100.0*float32(current.region.end)/float32(scanEnd))
+				nextStatus = current.region.end + bytesPerStatus
+			}
+		}
+	}
+	if checkpoint != nil {
+		// Save the progress even if an error occurred, so the scan can be
+		// resumed from the last region that was finished.
+		checkpoint.state.Complete = scanError == nil
+		e = checkpoint.save()
+		if e != nil {
+			if scanError == nil {
+				scanError = e
+			} else {
+				fmt.Printf("Failed saving scan state: %s\n", e)
+			}
+		}
+	}
+	if scanError != nil {
+		return scanError
+	}
+
+	if stats.UnreadableSectors > 0 {
+		fmt.Printf("Skipped %d unreadable sectors.\n",
+			stats.UnreadableSectors)
+	}
+	blankBytes := stats.HoleBytes + stats.ZeroBytes + stats.ErasedBytes
+	percentBlank := 0.0
+	if size > 0 {
+		percentBlank = 100.0 * float64(blankBytes) / float64(size)
+	}
+	fmt.Printf("Skipped %d blank bytes (%.02f%% of the data scanned): %d "+
+		"in sparse file holes, %d all zeros, %d all 0xff.\n", blankBytes,
+		percentBlank, stats.HoleBytes, stats.ZeroBytes, stats.ErasedBytes)
+	return nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The signature at the start of the files recognized by fakeCarver. It's
+// followed by the file's size, as a 4-byte little-endian integer.
+var fakeFileMagic = []byte("FAKEFILE")
+
+// An image containing fake files, and zeros everywhere else. The zeros aren't
+// stored, so the image can span several scan regions without using much
+// memory.
+type fakeImage struct {
+	size  int64
+	files map[int64][]byte
+}
+
+// Returns a fakeImage of the given size containing a file of the given size
+// at each of the given offsets.
+func newFakeImage(size int64, offsets []int64, fileSize int) *fakeImage {
+	toReturn := &fakeImage{
+		size:  size,
+		files: make(map[int64][]byte),
+	}
+	for _, offset := range offsets {
+		// Fill each file with a different non-blank value.
+		fill := byte((offset/512)%200) + 1
+		data := bytes.Repeat([]byte{fill}, fileSize)
+		copy(data, fakeFileMagic)
+		binary.LittleEndian.PutUint32(data[len(fakeFileMagic):],
+			uint32(fileSize))
+		toReturn.files[offset] = data
+	}
+	return toReturn
+}
+
+func (m *fakeImage) ReadAt(dst []byte, offset int64) (int, error) {
+	if offset >= m.size {
+		return 0, io.EOF
+	}
+	n := len(dst)
+	if int64(n) > (m.size - offset) {
+		n = int(m.size - offset)
+	}
+	requested := len(dst)
+	dst = dst[:n]
+	clear(dst)
+	for start, data := range m.files {
+		end := start + int64(len(data))
+		if (end <= offset) || (start >= (offset + int64(n))) {
+			continue
+		}
+		if start >= offset {
+			copy(dst[start-offset:], data)
+		} else {
+			copy(dst, data[offset-start:])
+		}
+	}
+	if n < requested {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Finds the files in a fakeImage, and counts how many times each one is
+// saved.
+type fakeCarver struct {
+	// The number of times Filename was called for each offset, which happens
+	// once each time a file is saved.
+	saved map[int64]int
+	// If this isn't negative, Size fails for a file at this offset.
+	failOffset int64
+}
+
+func newFakeCarver() *fakeCarver {
+	return &fakeCarver{
+		saved:      make(map[int64]int),
+		failOffset: -1,
+	}
+}
+
+func (c *fakeCarver) Name() string {
+	return "fake"
+}
+
+func (c *fakeCarver) Signatures() []Signature {
+	return []Signature{{Offset: 0, Magic: fakeFileMagic}}
+}
+
+func (c *fakeCarver) Match(src io.ReadSeeker, offset int64) (bool, error) {
+	return matchSignatures(src, offset, [][]byte{fakeFileMagic})
+}
+
+func (c *fakeCarver) Size(src io.ReadSeeker, offset int64) (int64, error) {
+	if offset == c.failOffset {
+		return 0, fmt.Errorf("Simulated failure at offset %d", offset)
+	}
+	_, e := src.Seek(offset+int64(len(fakeFileMagic)), io.SeekStart)
+	if e != nil {
+		return 0, e
+	}
+	var size uint32
+	e = binary.Read(src, binary.LittleEndian, &size)
+	if e != nil {
+		return 0, e
+	}
+	return int64(size), nil
+}
+
+func (c *fakeCarver) Filename(offset int64) string {
+	c.saved[offset]++
+	return fmt.Sprintf("%d.fake", offset)
+}
+
+// The offsets of the files in the image used by the scanner tests. Some are
+// in the sector at the start of a region, which is also scanned by the
+// previous region.
+var fakeFileOffsets = []int64{
+	1024,
+	scanRegionSize - 2048,
+	scanRegionSize,
+	scanRegionSize + 4096,
+	2 * scanRegionSize,
+	2*scanRegionSize + 1536,
+	3*scanRegionSize - 2048,
+}
+
+// Returns the image used by the scanner tests, which spans three regions.
+// Each file covers two 512-byte sectors.
+func fakeScanImage() *fakeImage {
+	return newFakeImage(3*scanRegionSize, fakeFileOffsets, 1000)
+}
+
+// Checks that the files saved to dir are exactly the files in img.
+func checkSavedFiles(t *testing.T, img *fakeImage, dir string) {
+	entries, e := os.ReadDir(dir)
+	if e != nil {
+		t.Logf("Failed reading %s: %s\n", dir, e)
+		t.FailNow()
+	}
+	if len(entries) != len(img.files) {
+		t.Logf("Expected %d files in %s, got %d\n", len(img.files), dir,
+			len(entries))
+		t.Fail()
+	}
+	for offset, expected := range img.files {
+		path := filepath.Join(dir, fmt.Sprintf("%d.fake", offset))
+		data, e := os.ReadFile(path)
+		if e != nil {
+			t.Logf("Failed reading %s: %s\n", path, e)
+			t.Fail()
+			continue
+		}
+		if !bytes.Equal(data, expected) {
+			t.Logf("Incorrect content in %s\n", path)
+			t.Fail()
+		}
+	}
+}
+
+// Checks that every file was saved exactly once, across all of the given
+// carvers.
+func checkSavedOnce(t *testing.T, carvers ...*fakeCarver) {
+	for _, offset := range fakeFileOffsets {
+		count := 0
+		for _, c := range carvers {
+			count += c.saved[offset]
+		}
+		if count != 1 {
+			t.Logf("The file at offset %d was saved %d times\n", offset,
+				count)
+			t.Fail()
+		}
+	}
+}
+
+// Returns a short description of the files and stats recorded in a scan's
+// state, which doesn't depend on where the files were saved.
+func describeScanState(state *scanState) string {
+	var files []string
+	for _, f := range state.Files {
+		files = append(files, fmt.Sprintf("%s@%d:%d %s", f.Carver, f.Offset,
+			f.Size, filepath.Base(f.Path)))
+	}
+	return fmt.Sprintf("%v %+v", files, state.Stats)
+}
+
+func TestMakeScanRegions(t *testing.T) {
+	scanEnd := int64(2*scanRegionSize + 4096)
+	regions := makeScanRegions(scanEnd, 512)
+	if len(regions) != 3 {
+		t.Logf("Expected 3 regions, got %d\n", len(regions))
+		t.FailNow()
+	}
+	for i, r := range regions {
+		start := int64(i) * scanRegionSize
+		end := start + scanRegionSize
+		if end > scanEnd {
+			end = scanEnd
+		}
+		// Every region but the last also scans the next region's first
+		// sector.
+		overlapEnd := end + 512
+		if overlapEnd > scanEnd {
+			overlapEnd = scanEnd
+		}
+		if (r.index != i) || (r.start != start) || (r.end != end) ||
+			(r.scanEnd != overlapEnd) {
+			t.Logf("Incorrect region %d: %+v\n", i, r)
+			t.Fail()
+		}
+	}
+
+	// Regions must hold a whole number of sectors.
+	regions = makeScanRegions(3000*50000, 3000)
+	for _, r := range regions {
+		if ((r.end - r.start) % 3000) != 0 {
+			t.Logf("Region %+v doesn't contain whole sectors\n", r)
+			t.Fail()
+		}
+	}
+}
+
+func TestScanForFiles(t *testing.T) {
+	img := fakeScanImage()
+	var states []string
+	for _, workerCount := range []int{1, 4} {
+		dir := t.TempDir()
+		carver := newFakeCarver()
+		checkpoint := newScanCheckpoint(filepath.Join(dir, "scan.json"),
+			"fake.img", "", img.size, 512, []Carver{carver})
+		outputDir := filepath.Join(dir, "output")
+		e := os.Mkdir(outputDir, 0755)
+		if e != nil {
+			t.Logf("Failed creating %s: %s\n", outputDir, e)
+			t.FailNow()
+		}
+		e = scanForFiles(img, img.size, 512, outputDir, []Carver{carver},
+			workerCount, checkpoint)
+		if e != nil {
+			t.Logf("Failed scanning with %d workers: %s\n", workerCount, e)
+			t.FailNow()
+		}
+		// Files in the overlap between regions are found twice, but must
+		// only be saved once.
+		checkSavedOnce(t, carver)
+		checkSavedFiles(t, img, outputDir)
+		state := &(checkpoint.state)
+		if !state.Complete || (state.Position != img.size) {
+			t.Logf("Expected a complete scan with %d workers, got position "+
+				"%d\n", workerCount, state.Position)
+			t.Fail()
+		}
+		// Sectors in the overlap must only be counted once.
+		expectedZeros := img.size - int64(len(img.files))*1024
+		if state.Stats.ZeroBytes != expectedZeros {
+			t.Logf("Expected %d zero bytes with %d workers, got %d\n",
+				expectedZeros, workerCount, state.Stats.ZeroBytes)
+			t.Fail()
+		}
+		states = append(states, describeScanState(state))
+	}
+	if states[0] != states[1] {
+		t.Logf("Scanning with 1 worker found %s, but scanning with 4 "+
+			"found %s\n", states[0], states[1])
+		t.Fail()
+	}
+}
@@ -0,0 +1,211 @@
+package fat
+
+// This file contains functions for rebuilding a FAT using only directory
+// entries. This is useful after a "quick format", which zeroes the FAT but
+// usually leaves the directory clusters in the data region untouched.
+
+import (
+	"fmt"
+	"sort"
+)
+
+// The value we use to mark the end of a chain in a reconstructed FAT.
+const endOfChainMarker = 0x0fffffff
+
+// Describes a cluster that was claimed by more than one directory entry while
+// reconstructing a FAT.
+type ReconstructionConflict struct {
+	// The cluster that was claimed more than once.
+	Cluster uint32
+	// The entry that was given the cluster. This is nil if the cluster
+	// belongs to the root directory.
+	Owner *FoundDirectoryEntry
+	// The entry that also claimed the cluster. Its chain is truncated so that
+	// it ends immediately before the conflicting cluster.
+	Rejected *FoundDirectoryEntry
+}
+
+func (c *ReconstructionConflict) String() string {
+	ownerName := "the root directory"
+	if c.Owner != nil {
+		ownerName = c.Owner.Name()
+	}
+	return fmt.Sprintf("Cluster %d is claimed by both %s (kept) and %s "+
+		"(truncated)", c.Cluster, ownerName, c.Rejected.Name())
+}
+
+// Holds the result of reconstructing a FAT from directory entries.
+type FATReconstruction struct {
+	// The synthetic FAT. It can be assigned to FAT32Filesystem.FAT in order to
+	// use GetAllChains or GetChainReader with the reconstructed chains.
+	FAT []uint32
+	// Holds one chain for each entry that was given at least one cluster.
+	Chains []FATChain
+	// The entries corresponding to each chain. Entries[i] produced Chains[i].
+	// The root directory has no entry, and is represented by a nil pointer.
+	Entries []*FoundDirectoryEntry
+	// A list of clusters claimed by more than one entry.
+	Conflicts []ReconstructionConflict
+}
+
+// Returns a multi-line string summarizing the reconstruction.
+func (r *FATReconstruction) FormatHumanReadable() string {
+	toReturn := fmt.Sprintf("Reconstructed %d chains, with %d conflicts.",
+		len(r.Chains), len(r.Conflicts))
+	for i := range r.Conflicts {
+		toReturn += "\n  " + r.Conflicts[i].String()
+	}
+	return toReturn
+}
+
+// Tracks a single request for a contiguous run of clusters while rebuilding
+// the FAT.
+type clusterClaim struct {
+	entry        *FoundDirectoryEntry
+	startCluster uint32
+	clusterCount uint32
+}
+
+// Returns true if the claim was made by a deleted entry.
+func (c *clusterClaim) isDeleted() bool {
+	return (c.entry != nil) && c.entry.Entry.IsDeleted()
+}
+
+// Returns the number of clusters a directory starting at the given cluster is
+// likely to occupy. We assume directories are contiguous, and continue for as
+// long as subsequent clusters look like directory data but aren't the start of
+// a different directory.
+func directoryClusterCount(start uint32, directoryClusters,
+	directoryStarts map[uint32]bool) uint32 {
+	toReturn := uint32(1)
+	for {
+		next := start + toReturn
+		if !directoryClusters[next] || directoryStarts[next] {
+			break
+		}
+		toReturn++
+	}
+	return toReturn
+}
+
+// Builds a synthetic FAT from the given directory entries, which are usually
+// obtained using ScanForDirectoryEntries. Each file is assumed to be stored
+// contiguously, starting at its start cluster and continuing for as many
+// clusters as needed to hold its size. Deleted entries are only used if
+// includeDeleted is true, and never take clusters away from entries that
+// haven't been deleted. This does not modify f.FAT.
+func (f *FAT32Filesystem) ReconstructFAT(entries []FoundDirectoryEntry,
+	includeDeleted bool) (*FATReconstruction, error) {
+	clusterCount := f.ClusterCount()
+	rootCluster := f.Header.EBR.RootDirClusterNumber
+	if (rootCluster < 2) || (rootCluster >= clusterCount) {
+		return nil, fmt.Errorf("Invalid root directory cluster: %d",
+			rootCluster)
+	}
+
+	// Figure out which clusters contain directory data, and which of them are
+	// the first cluster in a directory (subdirectories start with ".").
+	directoryClusters := make(map[uint32]bool)
+	directoryStarts := make(map[uint32]bool)
+	directoryStarts[rootCluster] = true
+	for i := range entries {
+		entry := &(entries[i])
+		directoryClusters[entry.Cluster] = true
+		if (entry.Index == 0) && entry.Entry.IsDotEntry() {
+			directoryStarts[entry.Cluster] = true
+		}
+	}
+
+	// Determine the clusters each entry wants.
+	claims := []clusterClaim{
+		{
+			entry:        nil,
+			startCluster: rootCluster,
+			clusterCount: directoryClusterCount(rootCluster,
+				directoryClusters, directoryStarts),
+		},
+	}
+	for i := range entries {
+		entry := &(entries[i])
+		d := &(entry.Entry)
+		if d.IsVolumeLabel() || d.IsDotEntry() {
+			continue
+		}
+		if d.IsDeleted() && !includeDeleted {
+			continue
+		}
+		start := d.StartCluster()
+		if (start < 2) || (start >= clusterCount) {
+			continue
+		}
+		var count uint32
+		if d.IsDirectory() {
+			count = directoryClusterCount(start, directoryClusters,
+				directoryStarts)
+		} else {
+			count = uint32((uint64(d.FileSize) + uint64(f.ClusterSize) - 1) /
+				uint64(f.ClusterSize))
+		}
+		if count == 0 {
+			continue
+		}
+		claims = append(claims, clusterClaim{
+			entry:        entry,
+			startCluster: start,
+			clusterCount: count,
+		})
+	}
+	// Entries that haven't been deleted get first pick of clusters.
+	sort.SliceStable(claims, func(a, b int) bool {
+		return !claims[a].isDeleted() && claims[b].isDeleted()
+	})
+
+	// Build the FAT, keeping track of the claim that owns each cluster.
+	fat := make([]uint32, len(f.FAT))
+	fat[0] = 0x0fffff00 | uint32(f.Header.BPB.MediaDescriptorType)
+	fat[1] = endOfChainMarker
+	owners := make(map[uint32]*FoundDirectoryEntry)
+	toReturn := &FATReconstruction{
+		FAT: fat,
+	}
+	for i := range claims {
+		claim := &(claims[i])
+		var allocated uint32
+		for ; allocated < claim.clusterCount; allocated++ {
+			c := claim.startCluster + allocated
+			if c >= clusterCount {
+				break
+			}
+			if fat[c] != 0 {
+				toReturn.Conflicts = append(toReturn.Conflicts,
+					ReconstructionConflict{
+						Cluster:  c,
+						Owner:    owners[c],
+						Rejected: claim.entry,
+					})
+				break
+			}
+			if allocated != 0 {
+				fat[c-1] = c
+			}
+			fat[c] = endOfChainMarker
+			owners[c] = claim.entry
+		}
+		if allocated == 0 {
+			continue
+		}
+		toReturn.Chains = append(toReturn.Chains, FATChain{
+			StartCluster: claim.startCluster,
+			Contiguous:   true,
+			Size:         uint64(allocated) * uint64(f.ClusterSize),
+			Extents: []ClusterExtent{
+				{
+					StartCluster: claim.startCluster,
+					Length:       allocated,
+				},
+			},
+		})
+		toReturn.Entries = append(toReturn.Entries, claim.entry)
+	}
+	return toReturn, nil
+}
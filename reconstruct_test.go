@@ -0,0 +1,93 @@
+package fat
+
+import (
+	"testing"
+)
+
+func TestReconstructFAT(t *testing.T) {
+	m := newTestImage()
+	m.addFile(testRootCluster, 0, "A", 1000, []uint32{3, 4})
+	m.addFile(testRootCluster, 1, "B", 1500, []uint32{5, 6, 7})
+	// This deleted file overlaps D, so it should only get cluster 8.
+	deleted := m.addFile(testRootCluster, 2, "C", 1024, []uint32{8, 9})
+	deleted.Name[0] = DeletedEntryMarker
+	m.setEntry(testRootCluster, 2, deleted)
+	m.addFile(testRootCluster, 3, "D", 100, []uint32{9})
+	f := m.open(t)
+	// Simulate a quick format, which zeroes the FAT.
+	for i := range f.FAT {
+		f.FAT[i] = 0
+	}
+
+	entries, e := f.ScanForDirectoryEntries()
+	if e != nil {
+		t.Logf("Failed scanning for directory entries: %s\n", e)
+		t.FailNow()
+	}
+	if len(entries) != 4 {
+		t.Logf("Expected to find 4 directory entries, got %d\n", len(entries))
+		t.FailNow()
+	}
+	r, e := f.ReconstructFAT(entries, true)
+	if e != nil {
+		t.Logf("Failed reconstructing FAT: %s\n", e)
+		t.FailNow()
+	}
+	t.Logf("%s\n", r.FormatHumanReadable())
+	if len(r.Chains) != 5 {
+		t.Logf("Expected 5 reconstructed chains, got %d\n", len(r.Chains))
+		t.FailNow()
+	}
+	if len(r.Conflicts) != 1 {
+		t.Logf("Expected 1 conflict, got %d\n", len(r.Conflicts))
+		t.FailNow()
+	}
+	if r.Conflicts[0].Cluster != 9 {
+		t.Logf("Expected conflict at cluster 9, got %d\n",
+			r.Conflicts[0].Cluster)
+		t.FailNow()
+	}
+	expected := map[uint32]uint32{
+		3: 4,
+		4: endOfChainMarker,
+		5: 6,
+		6: 7,
+		7: endOfChainMarker,
+		8: endOfChainMarker,
+		9: endOfChainMarker,
+	}
+	for c, v := range expected {
+		if r.FAT[c] != v {
+			t.Logf("Expected FAT[%d] = 0x%x, got 0x%x\n", c, v, r.FAT[c])
+			t.FailNow()
+		}
+	}
+
+	// Make sure the synthetic FAT can be used to read file content.
+	f.FAT = r.FAT
+	chains, e := f.GetAllChains()
+	if e != nil {
+		t.Logf("Failed getting chains from reconstructed FAT: %s\n", e)
+		t.FailNow()
+	}
+	if len(chains) != len(r.Chains) {
+		t.Logf("Expected %d chains in reconstructed FAT, got %d\n",
+			len(r.Chains), len(chains))
+		t.FailNow()
+	}
+	reader, e := f.GetChainReader(&(r.Chains[2]))
+	if e != nil {
+		t.Logf("Failed getting reader for reconstructed chain: %s\n", e)
+		t.FailNow()
+	}
+	content := make([]byte, 3*SectorSize)
+	_, e = reader.Read(content)
+	if e != nil {
+		t.Logf("Failed reading reconstructed chain: %s\n", e)
+		t.FailNow()
+	}
+	if content[2*SectorSize] != 3 {
+		t.Logf("Read incorrect content from reconstructed chain\n")
+		t.FailNow()
+	}
+}
@@ -0,0 +1,650 @@
+package fat
+
+// This file contains a consistency checker and repair tool for FAT32
+// filesystems, similar to chkdsk or fsck.fat. It checks every chain reachable
+// from the root directory, and saves any allocated chains that aren't
+// reachable as files in a FOUND.000 directory.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+)
+
+// Identifies the kind of change made by a RepairAction.
+type RepairActionKind uint8
+
+const (
+	// A copy of the FAT differed from the first copy, and was overwritten
+	// with it.
+	RepairResyncFAT RepairActionKind = iota
+	// A chain was cyclic, contained an invalid cluster, or was longer than
+	// the file using it, so it was truncated.
+	RepairTruncateChain
+	// Two chains shared clusters, so the shared clusters were copied.
+	RepairSplitCrossLink
+	// An allocated chain wasn't used by any file, so it was saved as a new
+	// file in a FOUND.000 directory.
+	RepairSaveLostChain
+	// The size in a directory entry didn't match the entry's chain.
+	RepairFixSize
+	// A directory entry was unusable, so it was removed.
+	RepairRemoveEntry
+	// The FSInfo structure's free cluster count or hint was incorrect.
+	RepairWriteFSInfo
+)
+
+var repairActionKindNames = [...]string{
+	"resync FAT",
+	"truncate chain",
+	"split cross-link",
+	"save lost chain",
+	"fix size",
+	"remove entry",
+	"write FSInfo",
+}
+
+func (k RepairActionKind) String() string {
+	if int(k) >= len(repairActionKindNames) {
+		return fmt.Sprintf("unknown repair action %d", k)
+	}
+	return repairActionKindNames[k]
+}
+
+// Describes a single change made (or, in dry-run mode, that would be made) by
+// Repair.
+type RepairAction struct {
+	Kind RepairActionKind
+	// The absolute path of the affected file or directory, e.g. "/" for the
+	// root directory or "/DIR/FILE.TXT". Empty if the action doesn't affect
+	// a particular file.
+	Path string
+	// The cluster at which the problem was found, if any.
+	Cluster     uint32
+	Description string
+}
+
+func (a *RepairAction) String() string {
+	return fmt.Sprintf("%s: %s", a.Kind, a.Description)
+}
+
+// Options for the Repair function.
+type RepairOptions struct {
+	// If true, the content isn't modified. The repairs are instead made to an
+	// in-memory Overlay, which is discarded afterwards.
+	DryRun bool
+	// If set, this is called with each action before it is applied.
+	OnAction func(a *RepairAction)
+}
+
+// Holds the state of a repair in progress.
+type repairer struct {
+	w       *WritableFAT32Filesystem
+	options *RepairOptions
+	actions []RepairAction
+	// Maps every cluster reachable from the root directory to the path of
+	// the file or directory it belongs to.
+	owners map[uint32]string
+}
+
+// Records an action, which the caller must then apply.
+func (r *repairer) record(kind RepairActionKind, filePath string,
+	cluster uint32, format string, args ...interface{}) {
+	r.actions = append(r.actions, RepairAction{
+		Kind:        kind,
+		Path:        filePath,
+		Cluster:     cluster,
+		Description: fmt.Sprintf(format, args...),
+	})
+	if r.options.OnAction != nil {
+		r.options.OnAction(&(r.actions[len(r.actions)-1]))
+	}
+}
+
+// Compares every copy of the FAT against the first, and marks any sectors
+// that differ as dirty so that they will be overwritten.
+func (r *repairer) resyncFATs() error {
+	w := r.w
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, w.FAT)
+	first := buffer.Bytes()
+	other := make([]byte, len(first))
+	for i := 1; i < int(w.Header.BPB.FATCount); i++ {
+		offset := (int64(w.Header.BPB.ReservedSectorCount) +
+			int64(i)*int64(w.Header.EBR.SectorsPerFAT)) * SectorSize
+		_, e := w.Content.Seek(offset, io.SeekStart)
+		if e != nil {
+			return fmt.Errorf("Error seeking to FAT %d: %w", i, e)
+		}
+		_, e = io.ReadFull(w.Content, other)
+		if e != nil {
+			return fmt.Errorf("Error reading FAT %d: %w", i, e)
+		}
+		var differing []uint32
+		for s := 0; s < len(first); s += SectorSize {
+			if !bytes.Equal(first[s:s+SectorSize], other[s:s+SectorSize]) {
+				differing = append(differing, uint32(s/SectorSize))
+			}
+		}
+		if len(differing) == 0 {
+			continue
+		}
+		r.record(RepairResyncFAT, "", 0, "FAT %d differs from FAT 0 in %d "+
+			"sectors; overwriting it with FAT 0", i, len(differing))
+		for _, s := range differing {
+			w.dirtyFATSectors[s] = true
+		}
+	}
+	return nil
+}
+
+// Follows the chain starting at the given cluster, stopping at the end of the
+// chain or at the first cluster that isn't part of a valid chain. The start
+// cluster must be valid.
+func (r *repairer) followTail(start uint32) []uint32 {
+	clusterCount := r.w.ClusterCount()
+	visited := make(map[uint32]bool)
+	var toReturn []uint32
+	c := start
+	for {
+		toReturn = append(toReturn, c)
+		visited[c] = true
+		v := r.w.FAT[c] & 0x0fffffff
+		if (v < 2) || (v >= clusterCount) || visited[v] ||
+			((r.w.FAT[v] & 0x0fffffff) == 0) {
+			return toReturn
+		}
+		c = v
+	}
+}
+
+// Copies the chain starting at the given cluster, which belongs to another
+// file, to newly allocated clusters. Returns the new clusters, or nil if
+// there isn't enough free space (in which case nothing is changed).
+func (r *repairer) copyTail(start uint32, filePath string) ([]uint32,
+	error) {
+	w := r.w
+	tail := r.followTail(start)
+	if uint32(len(tail)) > w.freeClusters {
+		return nil, nil
+	}
+	r.record(RepairSplitCrossLink, filePath, start, "%s shares %d clusters "+
+		"starting at cluster %d with %s; copying them", filePath, len(tail),
+		start, r.owners[start])
+	copied, e := w.allocateChain(uint32(len(tail)))
+	if e != nil {
+		return nil, e
+	}
+	buffer := make([]byte, w.ClusterSize)
+	for i, c := range tail {
+		e = w.ReadCluster(c, buffer)
+		if e != nil {
+			return nil, e
+		}
+		e = w.writeAt(w.GetDataOffset(copied[i], 0), buffer)
+		if e != nil {
+			return nil, fmt.Errorf("Error copying cluster %d: %w", c, e)
+		}
+		r.owners[copied[i]] = filePath
+	}
+	return copied, nil
+}
+
+// Follows the chain starting at the given cluster, which must be valid and
+// not owned by any other file, fixing any problems along the way. If
+// copyCrossLinks is false, chains that run into another file's clusters are
+// truncated rather than copied. Returns the clusters in the repaired chain.
+func (r *repairer) repairChain(start uint32, filePath string,
+	copyCrossLinks bool) ([]uint32, error) {
+	w := r.w
+	clusterCount := w.ClusterCount()
+	inChain := make(map[uint32]bool)
+	var clusters []uint32
+	c := start
+	for {
+		clusters = append(clusters, c)
+		inChain[c] = true
+		r.owners[c] = filePath
+		v := w.FAT[c] & 0x0fffffff
+		if IsEndOfChain(v) {
+			return clusters, nil
+		}
+		reason := ""
+		if (v < 2) || (v >= clusterCount) {
+			reason = fmt.Sprintf("it contains invalid cluster 0x%x", v)
+		} else if inChain[v] {
+			reason = fmt.Sprintf("it loops back to cluster %d", v)
+		} else if (w.FAT[v] & 0x0fffffff) == 0 {
+			reason = fmt.Sprintf("the next cluster (%d) is marked free", v)
+		} else if owner, owned := r.owners[v]; owned {
+			if copyCrossLinks {
+				copied, e := r.copyTail(v, filePath)
+				if e != nil {
+					return nil, e
+				}
+				if copied != nil {
+					w.setFAT(c, copied[0])
+					return append(clusters, copied...), nil
+				}
+			}
+			reason = fmt.Sprintf("the next cluster (%d) belongs to %s", v,
+				owner)
+		}
+		if reason != "" {
+			r.record(RepairTruncateChain, filePath, c, "Truncating the chain "+
+				"of %s at cluster %d, because %s", filePath, c, reason)
+			w.setFAT(c, endOfChainMarker)
+			return clusters, nil
+		}
+		c = v
+	}
+}
+
+// Returns true if the entry's name or attributes are invalid, meaning that
+// it's likely to be garbage rather than an entry that can be repaired.
+// Problems with the entry's size or clusters are fixed by repairEntry
+// instead.
+func isGarbageEntry(d *DirectoryEntry, clusterCount uint32) bool {
+	tmp := *d
+	tmp.FileSize = 0
+	tmp.SetStartCluster(0)
+	return !tmp.LooksValid(clusterCount)
+}
+
+// Checks that the given directory mostly contains valid directory entries, so
+// that we don't interpret random data as a directory. A few invalid entries
+// are tolerated; repairDirectory removes them individually.
+func (r *repairer) looksLikeDirectory(start uint32) bool {
+	clusters, data, e := r.w.readDirectoryData(start)
+	if e != nil {
+		return false
+	}
+	entries, e := r.w.parseDirectoryData(clusters, data, false)
+	if e != nil {
+		return false
+	}
+	clusterCount := r.w.ClusterCount()
+	valid := 0
+	invalid := 0
+	for i := range entries {
+		entry := &(entries[i].Entry)
+		if entry.IsDeleted() {
+			continue
+		}
+		if isGarbageEntry(entry, clusterCount) {
+			invalid++
+		} else {
+			valid++
+		}
+	}
+	// Require at least one valid entry for every four invalid ones.
+	return (valid * 4) >= invalid
+}
+
+// Checks and repairs a single entry in the given directory. Returns true if
+// the entry is a subdirectory that should be checked.
+func (r *repairer) repairEntry(d *writableDirectory, index int,
+	dirPath string) (bool, error) {
+	w := r.w
+	entry := &(d.entries[index])
+	filePath := path.Join(dirPath, entry.Name())
+	updated := entry.Entry
+	isDirectory := updated.IsDirectory()
+	start := updated.StartCluster()
+	clusterCount := w.ClusterCount()
+
+	// Start by making sure the start cluster is usable.
+	removeReason := ""
+	var clusters []uint32
+	var e error
+	if start == 0 {
+		removeReason = "it has no clusters"
+	} else if (start < 2) || (start >= clusterCount) ||
+		((w.FAT[start] & 0x0fffffff) == BadClusterMarker) {
+		removeReason = fmt.Sprintf("its start cluster (0x%x) is invalid",
+			start)
+	} else if owner, owned := r.owners[start]; owned {
+		if isDirectory {
+			removeReason = fmt.Sprintf("its start cluster (%d) belongs to %s",
+				start, owner)
+		} else {
+			clusters, e = r.copyTail(start, filePath)
+			if e != nil {
+				return false, e
+			}
+			if clusters == nil {
+				removeReason = fmt.Sprintf("its start cluster (%d) belongs "+
+					"to %s, and there isn't space to copy it", start, owner)
+			} else {
+				updated.SetStartCluster(clusters[0])
+			}
+		}
+	} else {
+		if (w.FAT[start] & 0x0fffffff) == 0 {
+			r.record(RepairTruncateChain, filePath, start, "The start "+
+				"cluster of %s (%d) is marked free; marking it as the end of "+
+				"a chain", filePath, start)
+			w.setFAT(start, endOfChainMarker)
+		}
+		clusters, e = r.repairChain(start, filePath, true)
+		if e != nil {
+			return false, e
+		}
+		if isDirectory && !r.looksLikeDirectory(start) {
+			removeReason = "its content isn't a valid directory"
+			for _, c := range clusters {
+				delete(r.owners, c)
+			}
+		}
+	}
+
+	// Files without clusters are fine, so long as they're empty. Other
+	// entries with unusable start clusters are removed; any clusters they
+	// had will be saved as lost chains.
+	if (removeReason != "") && !isDirectory && (start == 0) {
+		removeReason = ""
+		if updated.FileSize != 0 {
+			r.record(RepairFixSize, filePath, 0, "%s has no clusters; "+
+				"changing its size from %d to 0", filePath, updated.FileSize)
+			updated.FileSize = 0
+		}
+	}
+	if removeReason != "" {
+		r.record(RepairRemoveEntry, filePath, start, "Removing the directory "+
+			"entry for %s, because %s", filePath, removeReason)
+		return false, w.deleteEntry(d, entry)
+	}
+
+	// Make sure the size matches the chain.
+	if isDirectory && (updated.FileSize != 0) {
+		r.record(RepairFixSize, filePath, 0, "Directory %s has a size of "+
+			"%d; changing it to 0", filePath, updated.FileSize)
+		updated.FileSize = 0
+	}
+	if !isDirectory && (start != 0) {
+		needed := int(w.clustersNeeded(uint64(updated.FileSize)))
+		if needed == 0 {
+			r.record(RepairFixSize, filePath, start, "%s is empty, but has "+
+				"%d clusters; detaching them", filePath, len(clusters))
+			updated.SetStartCluster(0)
+		} else if needed < len(clusters) {
+			r.record(RepairTruncateChain, filePath, clusters[needed-1],
+				"%s is %d bytes, but its chain has %d clusters; detaching "+
+					"the extra clusters", filePath, updated.FileSize,
+				len(clusters))
+			w.setFAT(clusters[needed-1], endOfChainMarker)
+		} else if needed > len(clusters) {
+			newSize := uint64(len(clusters)) * uint64(w.ClusterSize)
+			r.record(RepairFixSize, filePath, 0, "%s is %d bytes, but its "+
+				"chain only holds %d; reducing its size", filePath,
+				updated.FileSize, newSize)
+			updated.FileSize = uint32(newSize)
+			needed = len(clusters)
+		}
+		// Detached clusters will be saved as lost chains.
+		for _, c := range clusters[needed:] {
+			delete(r.owners, c)
+		}
+	}
+	if updated != entry.Entry {
+		e = w.updateEntry(d, entry, &updated)
+		if e != nil {
+			return false, e
+		}
+	}
+	return isDirectory, nil
+}
+
+// Checks and repairs every entry in the directory starting at the given
+// cluster, and every directory beneath it. The directory's own chain must
+// already have been repaired.
+func (r *repairer) repairDirectory(start uint32, dirPath string) error {
+	d, e := r.w.loadDirectory(start)
+	if e != nil {
+		return fmt.Errorf("Error reading directory %s: %w", dirPath, e)
+	}
+	clusterCount := r.w.ClusterCount()
+	var subdirectories []int
+	for i := range d.entries {
+		entry := &(d.entries[i].Entry)
+		if entry.IsDeleted() || entry.IsDotEntry() {
+			continue
+		}
+		// Remove invalid entries individually, so that one corrupt entry
+		// doesn't cause the rest of the directory to be discarded. Any
+		// clusters they used will be saved as lost chains.
+		if isGarbageEntry(entry, clusterCount) {
+			filePath := path.Join(dirPath, d.entries[i].Name())
+			r.record(RepairRemoveEntry, filePath, entry.StartCluster(),
+				"Removing the directory entry for %s, because its name or "+
+					"attributes are invalid", filePath)
+			e = r.w.deleteEntry(d, &(d.entries[i]))
+			if e != nil {
+				return fmt.Errorf("Error removing invalid entry in %s: %w",
+					dirPath, e)
+			}
+			continue
+		}
+		if entry.IsVolumeLabel() {
+			continue
+		}
+		isDirectory, e := r.repairEntry(d, i, dirPath)
+		if e != nil {
+			return fmt.Errorf("Error repairing %s: %w",
+				path.Join(dirPath, d.entries[i].Name()), e)
+		}
+		if isDirectory {
+			subdirectories = append(subdirectories, i)
+		}
+	}
+	for _, i := range subdirectories {
+		entry := &(d.entries[i])
+		e = r.repairDirectory(entry.Entry.StartCluster(),
+			path.Join(dirPath, entry.Name()))
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Returns the name of the first FOUND.nnn directory that doesn't exist yet.
+func (r *repairer) lostDirectoryName() (string, error) {
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("FOUND.%03d", i)
+		_, e := r.w.Lookup(name)
+		if e != nil {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("Every name from FOUND.000 to FOUND.999 is in use")
+}
+
+// Saves every allocated chain that isn't reachable from the root directory
+// as a file in a new FOUND.nnn directory.
+func (r *repairer) saveLostChains() error {
+	w := r.w
+	clusterCount := w.ClusterCount()
+	var lost []uint32
+	isLost := make(map[uint32]bool)
+	for c := uint32(2); c < clusterCount; c++ {
+		v := w.FAT[c] & 0x0fffffff
+		if (v == 0) || (v == BadClusterMarker) {
+			continue
+		}
+		if _, owned := r.owners[c]; !owned {
+			lost = append(lost, c)
+			isLost[c] = true
+		}
+	}
+	if len(lost) == 0 {
+		return nil
+	}
+	// Start with the clusters that no other lost cluster points to. Any lost
+	// clusters left after that are in cycles.
+	pointedTo := make(map[uint32]bool)
+	for _, c := range lost {
+		v := w.FAT[c] & 0x0fffffff
+		if isLost[v] {
+			pointedTo[v] = true
+		}
+	}
+	var heads []uint32
+	for _, c := range lost {
+		if !pointedTo[c] {
+			heads = append(heads, c)
+		}
+	}
+	heads = append(heads, lost...)
+
+	var d *writableDirectory
+	dirName := ""
+	fileNumber := 0
+	for _, head := range heads {
+		if _, owned := r.owners[head]; owned {
+			continue
+		}
+		// Each FOUND directory holds up to 10000 files.
+		if (d == nil) || (fileNumber > 9999) {
+			name, e := r.lostDirectoryName()
+			if e != nil {
+				return e
+			}
+			e = w.Mkdir(name)
+			if e != nil {
+				return fmt.Errorf("Error creating %s: %w", name, e)
+			}
+			d, e = w.openDirectory(name)
+			if e != nil {
+				return fmt.Errorf("Error opening %s: %w", name, e)
+			}
+			dirName = name
+			fileNumber = 0
+		}
+		name := fmt.Sprintf("FILE%04d.CHK", fileNumber)
+		filePath := path.Join("/", dirName, name)
+		fileNumber++
+		clusters, e := r.repairChain(head, filePath, false)
+		if e != nil {
+			return e
+		}
+		size := uint64(len(clusters)) * uint64(w.ClusterSize)
+		if size > 0xffffffff {
+			// This can only happen with a corrupt FAT; keep as much as a
+			// file can hold.
+			size = 0xffffffff
+		}
+		r.record(RepairSaveLostChain, filePath, head, "Saving lost chain of "+
+			"%d clusters starting at cluster %d as %s", len(clusters), head,
+			filePath)
+		entry := DirectoryEntry{
+			Attributes: AttributeArchive,
+			FileSize:   uint32(size),
+		}
+		entry.SetStartCluster(head)
+		e = w.addEntry(d, name, &entry)
+		if e != nil {
+			return fmt.Errorf("Error adding entry for %s: %w", filePath, e)
+		}
+	}
+	return nil
+}
+
+// Makes sure the FSInfo structure is correct, and writes all changes.
+func (r *repairer) writeFSInfo() error {
+	w := r.w
+	clusterCount := w.ClusterCount()
+	w.nextFreeCluster = unknownFSInfoValue
+	for c := uint32(2); c < clusterCount; c++ {
+		if (w.FAT[c] & 0x0fffffff) == 0 {
+			w.nextFreeCluster = c
+			break
+		}
+	}
+	if (w.Info.LastKnownFreeCluster != w.freeClusters) ||
+		(w.Info.FirstAvailableClusterHint != w.nextFreeCluster) {
+		r.record(RepairWriteFSInfo, "", 0, "Updating FSInfo: free cluster "+
+			"count %d -> %d, next free cluster hint %d -> %d",
+			w.Info.LastKnownFreeCluster, w.freeClusters,
+			w.Info.FirstAvailableClusterHint, w.nextFreeCluster)
+	}
+	return w.Flush()
+}
+
+// Runs every check and repair, in order.
+func (r *repairer) run() error {
+	w := r.w
+	e := r.resyncFATs()
+	if e != nil {
+		return e
+	}
+	root := w.Header.EBR.RootDirClusterNumber
+	if (root < 2) || (root >= w.ClusterCount()) {
+		return fmt.Errorf("Invalid root directory cluster: %d", root)
+	}
+	if (w.FAT[root] & 0x0fffffff) == 0 {
+		r.record(RepairTruncateChain, "/", root, "The root directory's "+
+			"cluster (%d) is marked free; marking it as the end of a chain",
+			root)
+		w.setFAT(root, endOfChainMarker)
+	}
+	_, e = r.repairChain(root, "/", true)
+	if e != nil {
+		return e
+	}
+	e = r.repairDirectory(root, "/")
+	if e != nil {
+		return e
+	}
+	e = r.saveLostChains()
+	if e != nil {
+		return e
+	}
+	return r.writeFSInfo()
+}
+
+// Checks the FAT32 filesystem in the given content, and fixes any problems:
+// out-of-sync FAT copies, invalid or cyclic chains, cross-linked chains,
+// incorrect file sizes, lost chains and an incorrect FSInfo structure.
+// Returns every action taken, in order. Unless options.DryRun is set, the
+// content must implement io.ReadWriteSeeker. The options may be nil.
+func Repair(content io.ReadSeeker, options *RepairOptions) ([]RepairAction,
+	error) {
+	if options == nil {
+		options = &RepairOptions{}
+	}
+	var target io.ReadWriteSeeker
+	if options.DryRun {
+		overlay, e := NewOverlay(content)
+		if e != nil {
+			return nil, e
+		}
+		target = overlay
+	} else {
+		writable, ok := content.(io.ReadWriteSeeker)
+		if !ok {
+			return nil, fmt.Errorf("The content isn't writable")
+		}
+		target = writable
+	}
+	w, e := NewWritableFAT32Filesystem(target)
+	if e != nil {
+		return nil, e
+	}
+	r := &repairer{
+		w:       w,
+		options: options,
+		owners:  make(map[uint32]string),
+	}
+	e = r.run()
+	if e != nil {
+		return r.actions, fmt.Errorf("Error repairing filesystem: %w", e)
+	}
+	e = w.Close()
+	if e != nil {
+		return r.actions, e
+	}
+	return r.actions, nil
+}
@@ -0,0 +1,238 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Returns a test image containing several kinds of damage.
+func newDamagedImage() *testImage {
+	m := newTestImage()
+	// A chain that loops back on itself.
+	m.addFile(testRootCluster, 0, "CYCLE", 1500, []uint32{3, 4, 5})
+	m.setFAT(5, 4)
+	// Two files sharing their last cluster.
+	m.addFile(testRootCluster, 1, "CROSS1", 1000, []uint32{6, 7})
+	m.addFile(testRootCluster, 2, "CROSS2", 1000, []uint32{8, 7})
+	// A chain that isn't used by any file.
+	m.setFAT(10, 11)
+	m.setFAT(11, 0x0fffffff)
+	// A chain longer than its file, and a file larger than its chain.
+	m.addFile(testRootCluster, 3, "TOOBIG", 100, []uint32{12, 13})
+	m.addFile(testRootCluster, 4, "TOOSMALL", 5000, []uint32{14})
+	// Make the second FAT differ from the first.
+	offset := (testReservedSectors + testSectorsPerFAT) * SectorSize
+	binary.LittleEndian.PutUint32(m.data[offset+20*4:], 0x1234)
+	return m
+}
+
+func TestRepairDryRun(t *testing.T) {
+	m := newDamagedImage()
+	original := append([]byte{}, m.data...)
+	var logged []RepairAction
+	actions, e := Repair(bytes.NewReader(m.data), &RepairOptions{
+		DryRun: true,
+		OnAction: func(a *RepairAction) {
+			logged = append(logged, *a)
+		},
+	})
+	if e != nil {
+		t.Logf("Failed dry-run repair: %s\n", e)
+		t.FailNow()
+	}
+	if !bytes.Equal(m.data, original) {
+		t.Logf("Dry-run repair modified the image\n")
+		t.FailNow()
+	}
+	if len(logged) != len(actions) {
+		t.Logf("Only %d/%d actions were passed to OnAction\n", len(logged),
+			len(actions))
+		t.Fail()
+	}
+	counts := make(map[RepairActionKind]int)
+	for i := range actions {
+		t.Logf("Action: %s\n", &(actions[i]))
+		counts[actions[i].Kind]++
+	}
+	expected := map[RepairActionKind]int{
+		RepairResyncFAT:      1,
+		RepairTruncateChain:  2,
+		RepairSplitCrossLink: 1,
+		RepairSaveLostChain:  2,
+		RepairFixSize:        1,
+		RepairWriteFSInfo:    1,
+	}
+	for kind, count := range expected {
+		if counts[kind] != count {
+			t.Logf("Expected %d %s actions, got %d\n", count, kind,
+				counts[kind])
+			t.Fail()
+		}
+	}
+}
+
+func TestRepair(t *testing.T) {
+	m := newDamagedImage()
+	file := m.openFile(t)
+	_, e := Repair(file, nil)
+	if e != nil {
+		t.Logf("Failed repairing image: %s\n", e)
+		t.FailNow()
+	}
+	// A second pass shouldn't find anything to do.
+	actions, e := Repair(file, nil)
+	if e != nil {
+		t.Logf("Failed repairing image a second time: %s\n", e)
+		t.FailNow()
+	}
+	for i := range actions {
+		t.Logf("Unexpected action after repairing: %s\n", &(actions[i]))
+		t.Fail()
+	}
+
+	file.Seek(0, io.SeekStart)
+	f, e := NewFAT32Filesystem(file)
+	if e != nil {
+		t.Logf("Failed opening repaired image: %s\n", e)
+		t.FailNow()
+	}
+	stats, e := f.Stats()
+	if e != nil {
+		t.Logf("Failed getting stats: %s\n", e)
+		t.FailNow()
+	}
+	if len(stats.InfoMismatches) != 0 {
+		t.Logf("Repaired image has incorrect FSInfo:\n%s\n",
+			stats.FormatHumanReadable())
+		t.Fail()
+	}
+	cross1, e := f.ReadFile("CROSS1")
+	if e != nil {
+		t.Logf("Failed reading CROSS1: %s\n", e)
+		t.FailNow()
+	}
+	cross2, e := f.ReadFile("CROSS2")
+	if e != nil {
+		t.Logf("Failed reading CROSS2: %s\n", e)
+		t.FailNow()
+	}
+	if !bytes.Equal(cross1[SectorSize:], cross2[SectorSize:]) ||
+		(cross2[0] != 1) {
+		t.Logf("Cross-linked data wasn't copied correctly\n")
+		t.Fail()
+	}
+	clusters, e := f.ChainClusters(8)
+	if (e != nil) || (len(clusters) != 2) || (clusters[1] == 7) {
+		t.Logf("CROSS2 still shares clusters with CROSS1: %v, %v\n",
+			clusters, e)
+		t.Fail()
+	}
+	entry, e := f.Lookup("TOOSMALL")
+	if (e != nil) || (entry.Entry.FileSize != SectorSize) {
+		t.Logf("TOOSMALL's size wasn't fixed: %v\n", e)
+		t.Fail()
+	}
+	names := []string{"FOUND.000/FILE0000.CHK", "FOUND.000/FILE0001.CHK"}
+	starts := []uint32{10, 13}
+	sizes := []uint32{2 * SectorSize, SectorSize}
+	for i, name := range names {
+		entry, e := f.Lookup(name)
+		if e != nil {
+			t.Logf("Failed finding %s: %s\n", name, e)
+			t.FailNow()
+		}
+		if (entry.Entry.StartCluster() != starts[i]) ||
+			(entry.Entry.FileSize != sizes[i]) {
+			t.Logf("%s has incorrect start cluster or size: %s\n", name,
+				&(entry.Entry))
+			t.Fail()
+		}
+	}
+}
+
+func TestRepairInvalidEntry(t *testing.T) {
+	m := newTestImage()
+	dir := dotEntry("SUBDIR", 20, 0, 0)
+	m.setEntry(testRootCluster, 0, &dir)
+	m.setFAT(20, 0x0fffffff)
+	dot := dotEntry(".", 20, 0, 0)
+	dotDot := dotEntry("..", 0, 0, 0)
+	m.setEntry(20, 0, &dot)
+	m.setEntry(20, 1, &dotDot)
+	m.addFile(20, 2, "GOOD1", 100, []uint32{21})
+	m.addFile(20, 3, "GOOD2", 100, []uint32{22})
+	// An entry with an invalid name among the valid ones.
+	garbage := DirectoryEntry{
+		Name:      [8]byte{'B', 'A', 'D', 0x01, ' ', ' ', ' ', ' '},
+		Extension: [3]byte{' ', ' ', ' '},
+	}
+	m.setEntry(20, 4, &garbage)
+	m.addFile(20, 5, "GOOD3", 100, []uint32{23})
+	file := m.openFile(t)
+	actions, e := Repair(file, nil)
+	if e != nil {
+		t.Logf("Failed repairing image: %s\n", e)
+		t.FailNow()
+	}
+	removed := 0
+	for i := range actions {
+		a := &(actions[i])
+		t.Logf("Action: %s (path %q)\n", a, a.Path)
+		if a.Kind == RepairRemoveEntry {
+			removed++
+			if !strings.HasPrefix(a.Path, "/SUBDIR/") {
+				t.Logf("Got unexpected path for removed entry: %s\n", a.Path)
+				t.Fail()
+			}
+		}
+	}
+	if removed != 1 {
+		t.Logf("Expected to remove 1 entry, removed %d\n", removed)
+		t.Fail()
+	}
+	file.Seek(0, io.SeekStart)
+	f, e := NewFAT32Filesystem(file)
+	if e != nil {
+		t.Logf("Failed opening repaired image: %s\n", e)
+		t.FailNow()
+	}
+	for _, name := range []string{"GOOD1", "GOOD2", "GOOD3"} {
+		content, e := f.ReadFile("SUBDIR/" + name)
+		if (e != nil) || (len(content) != 100) {
+			t.Logf("Failed reading %s after repair: %v\n", name, e)
+			t.Fail()
+		}
+	}
+}
+
+func TestRepairPaths(t *testing.T) {
+	m := newDamagedImage()
+	// Mark the root directory's cluster as free, so an action refers to it.
+	m.setFAT(testRootCluster, 0)
+	actions, e := Repair(bytes.NewReader(m.data), &RepairOptions{
+		DryRun: true,
+	})
+	if e != nil {
+		t.Logf("Failed dry-run repair: %s\n", e)
+		t.FailNow()
+	}
+	expected := map[string]bool{
+		"/":                       false,
+		"/CYCLE":                  false,
+		"/FOUND.000/FILE0000.CHK": false,
+	}
+	for i := range actions {
+		if _, ok := expected[actions[i].Path]; ok {
+			expected[actions[i].Path] = true
+		}
+	}
+	for p, found := range expected {
+		if !found {
+			t.Logf("Didn't find an action with path %s\n", p)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package fat
+
+// This file contains functions for finding blank regions of an image, which
+// can be skipped when scanning for content.
+
+import (
+	"bytes"
+	"io"
+)
+
+// If every byte in data has the same value, and that value is 0x00 or 0xff,
+// returns the value and true. Unwritten regions of most media read as zeros,
+// and erased flash memory reads as 0xff.
+func BlankFill(data []byte) (byte, bool) {
+	if len(data) == 0 {
+		return 0, false
+	}
+	fill := data[0]
+	if (fill != 0) && (fill != 0xff) {
+		return 0, false
+	}
+	// Every byte is equal to the next one if and only if they're all equal.
+	if !bytes.Equal(data[1:], data[:len(data)-1]) {
+		return 0, false
+	}
+	return fill, true
+}
+
+// Implemented by images that can find regions known to contain only zeros
+// without reading them, e.g. holes in sparse files.
+type HoleReporter interface {
+	// Returns the offset of the first byte at or after the given offset
+	// that may contain data. Returns the image's size if only holes follow
+	// the offset.
+	NextData(offset int64) (int64, error)
+}
+
+// Uses SEEK_DATA to find the next data in the file, if the OS supports it.
+// The file's current offset is preserved.
+func (f *fileImage) NextData(offset int64) (int64, error) {
+	if offset >= f.size {
+		return f.size, nil
+	}
+	current, e := f.File.Seek(0, io.SeekCurrent)
+	if e != nil {
+		return offset, e
+	}
+	next, e := seekData(f.File, offset)
+	_, restoreError := f.File.Seek(current, io.SeekStart)
+	if restoreError != nil {
+		return offset, restoreError
+	}
+	if e != nil {
+		// The OS or filesystem doesn't support SEEK_DATA, so assume
+		// everything contains data.
+		return offset, nil
+	}
+	if (next < 0) || (next > f.size) {
+		return f.size, nil
+	}
+	return next, nil
+}
+
+// Returns the offset of the next data at or after the given offset, relative
+// to the start of this LimitedReadSeeker, if the underlying ReadSeeker
+// implements HoleReporter. Otherwise, returns the offset unchanged.
+func (s *LimitedReadSeeker) NextData(offset int64) (int64, error) {
+	if offset >= s.size {
+		return s.size, nil
+	}
+	reporter, ok := s.wrapped.(HoleReporter)
+	if !ok {
+		return offset, nil
+	}
+	next, e := reporter.NextData(offset + s.baseOffset)
+	if e != nil {
+		return offset, e
+	}
+	next -= s.baseOffset
+	if next > s.size {
+		next = s.size
+	}
+	return next, nil
+}
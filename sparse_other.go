@@ -0,0 +1,13 @@
+//go:build !linux && !freebsd && !darwin
+
+package fat
+
+import (
+	"fmt"
+	"os"
+)
+
+// SEEK_DATA isn't available on this OS, so holes can't be detected.
+func seekData(f *os.File, offset int64) (int64, error) {
+	return offset, fmt.Errorf("SEEK_DATA isn't supported on this OS")
+}
@@ -0,0 +1,121 @@
+package fat
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlankFill(t *testing.T) {
+	tests := []struct {
+		data  []byte
+		fill  byte
+		blank bool
+	}{
+		{nil, 0, false},
+		{make([]byte, SectorSize), 0, true},
+		{bytes.Repeat([]byte{0xff}, SectorSize), 0xff, true},
+		{bytes.Repeat([]byte{0x55}, SectorSize), 0, false},
+		{append(make([]byte, SectorSize-1), 1), 0, false},
+		{append(bytes.Repeat([]byte{0xff}, SectorSize-1), 0), 0, false},
+	}
+	for i, test := range tests {
+		fill, blank := BlankFill(test.data)
+		if (fill != test.fill) || (blank != test.blank) {
+			t.Logf("Test %d: expected %d, %v, got %d, %v\n", i, test.fill,
+				test.blank, fill, blank)
+			t.Fail()
+		}
+	}
+}
+
+func TestNextData(t *testing.T) {
+	// Create a sparse file with data only in the first and last 64KB.
+	path := filepath.Join(t.TempDir(), "sparse.img")
+	f, e := os.Create(path)
+	if e != nil {
+		t.Logf("Failed creating file: %s\n", e)
+		t.FailNow()
+	}
+	data := bytes.Repeat([]byte{0xaa}, 64*1024)
+	dataOffset := int64(8 * 1024 * 1024)
+	_, e = f.Write(data)
+	if e == nil {
+		_, e = f.WriteAt(data, dataOffset)
+	}
+	f.Close()
+	if e != nil {
+		t.Logf("Failed writing file: %s\n", e)
+		t.FailNow()
+	}
+	img, e := OpenImage(path)
+	if e != nil {
+		t.Logf("Failed opening image: %s\n", e)
+		t.FailNow()
+	}
+	defer img.Close()
+	reporter, ok := img.(HoleReporter)
+	if !ok {
+		t.Logf("The image doesn't implement HoleReporter\n")
+		t.FailNow()
+	}
+	_, e = img.Seek(100, io.SeekStart)
+	if e != nil {
+		t.Logf("Failed seeking image: %s\n", e)
+		t.FailNow()
+	}
+
+	// Filesystems without SEEK_DATA support report no holes, so only check
+	// that any reported hole is really empty.
+	offset := int64(len(data))
+	next, e := reporter.NextData(offset)
+	if e != nil {
+		t.Logf("Failed finding data: %s\n", e)
+		t.FailNow()
+	}
+	if (next < offset) || (next > dataOffset) {
+		t.Logf("Expected data between %d and %d, got %d\n", offset,
+			dataOffset, next)
+		t.FailNow()
+	}
+	t.Logf("Skipped a %d-byte hole\n", next-offset)
+	hole := make([]byte, next-offset)
+	_, e = img.ReadAt(hole, offset)
+	if e != nil {
+		t.Logf("Failed reading hole: %s\n", e)
+		t.FailNow()
+	}
+	if _, blank := BlankFill(hole); (len(hole) != 0) && !blank {
+		t.Logf("The reported hole contained data\n")
+		t.Fail()
+	}
+	end, e := reporter.NextData(img.Size())
+	if (e != nil) || (end != img.Size()) {
+		t.Logf("Expected next data at the end of the image, got %d, %v\n",
+			end, e)
+		t.Fail()
+	}
+
+	// NextData mustn't change the image's current offset.
+	current, e := img.Seek(0, io.SeekCurrent)
+	if (e != nil) || (current != 100) {
+		t.Logf("Expected the current offset to be 100, got %d, %v\n",
+			current, e)
+		t.Fail()
+	}
+
+	// Check the same through a LimitedReadSeeker.
+	limited, e := LimitReadSeeker(img, 4096, img.Size()-4096)
+	if e != nil {
+		t.Logf("Failed limiting image: %s\n", e)
+		t.FailNow()
+	}
+	limitedNext, e := limited.(HoleReporter).NextData(offset - 4096)
+	if (e != nil) || (limitedNext != (next - 4096)) {
+		t.Logf("Expected LimitedReadSeeker data at %d, got %d, %v\n",
+			next-4096, limitedNext, e)
+		t.Fail()
+	}
+}
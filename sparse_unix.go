@@ -0,0 +1,26 @@
+//go:build linux || freebsd || darwin
+
+package fat
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// Returns the offset of the next data at or after the given offset in f,
+// using lseek's SEEK_DATA. Returns -1 if only holes follow the offset. This
+// changes f's current offset.
+func seekData(f *os.File, offset int64) (int64, error) {
+	// SEEK_DATA isn't in the syscall package, and differs on macOS.
+	whence := 3
+	if runtime.GOOS == "darwin" {
+		whence = 4
+	}
+	next, e := f.Seek(offset, whence)
+	if errors.Is(e, syscall.ENXIO) {
+		return -1, nil
+	}
+	return next, e
+}
@@ -0,0 +1,133 @@
+package fat
+
+// This file contains functions for computing allocation statistics from the
+// FAT, and for checking them against the hints stored in the FSInfo block.
+
+import (
+	"fmt"
+)
+
+// The value marking a bad cluster in the FAT.
+const BadClusterMarker = 0x0ffffff7
+
+// Indicates that a field in the FSInfo structure is not set.
+const unknownFSInfoValue = 0xffffffff
+
+// Holds statistics about cluster allocation in a FAT32 filesystem, computed
+// from the FAT itself.
+type FATStats struct {
+	// The number of clusters in the data region.
+	TotalClusters uint32
+	FreeClusters  uint32
+	UsedClusters  uint32
+	BadClusters   uint32
+	// The length, in clusters, of the longest run of free clusters, and the
+	// first cluster in the run.
+	LargestFreeRun      uint32
+	LargestFreeRunStart uint32
+	// The number of chains in the FAT, and the number of them that are not
+	// stored on consecutive clusters.
+	ChainCount      int
+	FragmentedFiles int
+	// The percentage of chains that are fragmented.
+	FragmentationPercent float64
+	// Describes each way in which the FSInfo hints disagree with the FAT. This
+	// is empty if the FSInfo structure is consistent with the FAT.
+	InfoMismatches []string
+}
+
+// Returns a multi-line string containing the statistics.
+func (s *FATStats) FormatHumanReadable() string {
+	toReturn := "FAT allocation statistics:\n"
+	toReturn += fmt.Sprintf("  Total clusters: %d\n", s.TotalClusters)
+	toReturn += fmt.Sprintf("  Free clusters: %d\n", s.FreeClusters)
+	toReturn += fmt.Sprintf("  Used clusters: %d\n", s.UsedClusters)
+	toReturn += fmt.Sprintf("  Bad clusters: %d\n", s.BadClusters)
+	toReturn += fmt.Sprintf("  Largest free run: %d clusters, starting at "+
+		"cluster %d\n", s.LargestFreeRun, s.LargestFreeRunStart)
+	toReturn += fmt.Sprintf("  Chains: %d, %d fragmented (%.02f%%)\n",
+		s.ChainCount, s.FragmentedFiles, s.FragmentationPercent)
+	if len(s.InfoMismatches) == 0 {
+		toReturn += "  FSInfo hints are consistent with the FAT."
+		return toReturn
+	}
+	toReturn += fmt.Sprintf("  FSInfo hints have %d mismatches:",
+		len(s.InfoMismatches))
+	for _, m := range s.InfoMismatches {
+		toReturn += "\n    " + m
+	}
+	return toReturn
+}
+
+// Fills in s.InfoMismatches by comparing the statistics with the hints in the
+// given FSInfo structure.
+func (s *FATStats) checkFSInfo(info *FSInfo, clusterCount uint32) {
+	// Note that despite the field name, this holds the FSInfo free cluster
+	// count.
+	freeCount := info.LastKnownFreeCluster
+	if (freeCount != unknownFSInfoValue) && (freeCount != s.FreeClusters) {
+		message := fmt.Sprintf("FSInfo free cluster count is %d, but the "+
+			"FAT has %d free clusters", freeCount, s.FreeClusters)
+		if freeCount > s.TotalClusters {
+			message += fmt.Sprintf(" (the count exceeds the total of %d "+
+				"clusters)", s.TotalClusters)
+		}
+		s.InfoMismatches = append(s.InfoMismatches, message)
+	}
+	// The next free cluster hint is only advisory: it's where a driver
+	// starts searching, and is often just the last cluster allocated, so
+	// free or allocated clusters on either side of it are normal. It just
+	// needs to be a valid cluster.
+	hint := info.FirstAvailableClusterHint
+	if (hint != unknownFSInfoValue) && ((hint < 2) || (hint >= clusterCount)) {
+		s.InfoMismatches = append(s.InfoMismatches, fmt.Sprintf(
+			"FSInfo next free cluster hint (%d) is outside of the valid "+
+				"range [2, %d)", hint, clusterCount))
+	}
+}
+
+// Computes allocation statistics from f.FAT, and compares them against the
+// hints in f.Info.
+func (f *FAT32Filesystem) Stats() (*FATStats, error) {
+	clusterCount := f.ClusterCount()
+	toReturn := &FATStats{
+		TotalClusters: clusterCount - 2,
+	}
+	currentRun := uint32(0)
+	for c := uint32(2); c < clusterCount; c++ {
+		v := f.FAT[c] & 0x0fffffff
+		if v != 0 {
+			currentRun = 0
+			if v == BadClusterMarker {
+				toReturn.BadClusters++
+			} else {
+				toReturn.UsedClusters++
+			}
+			continue
+		}
+		toReturn.FreeClusters++
+		currentRun++
+		if currentRun > toReturn.LargestFreeRun {
+			toReturn.LargestFreeRun = currentRun
+			toReturn.LargestFreeRunStart = c - currentRun + 1
+		}
+	}
+	chains, e := f.GetAllChains()
+	if e != nil {
+		return nil, fmt.Errorf("Error getting chains: %w", e)
+	}
+	toReturn.ChainCount = len(chains)
+	for i := range chains {
+		if !chains[i].Contiguous {
+			toReturn.FragmentedFiles++
+		}
+	}
+	if len(chains) != 0 {
+		toReturn.FragmentationPercent = 100.0 *
+			float64(toReturn.FragmentedFiles) / float64(len(chains))
+	}
+	if f.Info != nil {
+		toReturn.checkFSInfo(f.Info, clusterCount)
+	}
+	return toReturn, nil
+}
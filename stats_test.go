@@ -0,0 +1,65 @@
+package fat
+
+import (
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	m := newTestImage()
+	m.addFile(testRootCluster, 0, "A", 1000, []uint32{3, 4})
+	m.addFile(testRootCluster, 1, "B", 1000, []uint32{6, 8})
+	m.setFAT(10, BadClusterMarker)
+	f := m.open(t)
+	f.Info.LastKnownFreeCluster = 5
+	f.Info.FirstAvailableClusterHint = f.ClusterCount()
+	s, e := f.Stats()
+	if e != nil {
+		t.Logf("Failed getting stats: %s\n", e)
+		t.FailNow()
+	}
+	t.Logf("%s\n", s.FormatHumanReadable())
+	if (s.UsedClusters != 5) || (s.BadClusters != 1) ||
+		(s.FreeClusters != (s.TotalClusters - 6)) {
+		t.Logf("Got incorrect cluster counts\n")
+		t.FailNow()
+	}
+	if (s.ChainCount != 3) || (s.FragmentedFiles != 1) {
+		t.Logf("Got incorrect chain counts\n")
+		t.FailNow()
+	}
+	if s.LargestFreeRunStart != 11 {
+		t.Logf("Expected largest free run to start at 11, got %d\n",
+			s.LargestFreeRunStart)
+		t.FailNow()
+	}
+	// Both the free count and the hint (past the last cluster) are wrong.
+	if len(s.InfoMismatches) != 2 {
+		t.Logf("Expected 2 FSInfo mismatches, got %d\n",
+			len(s.InfoMismatches))
+		t.FailNow()
+	}
+	// The hint is only advisory, so free clusters before it (cluster 5) are
+	// fine.
+	f.Info.LastKnownFreeCluster = s.FreeClusters
+	f.Info.FirstAvailableClusterHint = 9
+	s, e = f.Stats()
+	if e != nil {
+		t.Logf("Failed getting stats: %s\n", e)
+		t.FailNow()
+	}
+	if len(s.InfoMismatches) != 0 {
+		t.Logf("Got unexpected FSInfo mismatches: %v\n", s.InfoMismatches)
+		t.FailNow()
+	}
+	// A free count larger than the volume is reported as one mismatch.
+	f.Info.LastKnownFreeCluster = s.TotalClusters + 1
+	s, e = f.Stats()
+	if e != nil {
+		t.Logf("Failed getting stats: %s\n", e)
+		t.FailNow()
+	}
+	if len(s.InfoMismatches) != 1 {
+		t.Logf("Expected 1 FSInfo mismatch, got %v\n", s.InfoMismatches)
+		t.FailNow()
+	}
+}
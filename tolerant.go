@@ -0,0 +1,279 @@
+package fat
+
+// This file contains TolerantImage, which allows reading from failing media
+// without aborting on the first read error.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// The default number of times a TolerantImage retries reading a sector that
+// fails.
+const DefaultReadRetries = 2
+
+// Wraps an Image on unreliable media, such as a failing disk read directly
+// through its device file. If a read fails, the range is re-read one sector
+// at a time, retrying each failed sector, and sectors that still can't be
+// read are filled with FillPattern instead of returning an error. The outcome
+// of every read is recorded in a ddrescue-style map, so the bad ranges can be
+// found using UnreadableRanges and saved as a mapfile.
+type TolerantImage struct {
+	readerAtSeeker
+	image      Image
+	sectorSize int64
+	// The number of additional attempts made to read each failed sector.
+	Retries int
+	// Repeated, starting at the beginning of the image, to fill sectors that
+	// can't be read. Zeros are used if this is empty.
+	FillPattern []byte
+	// If set, the map is saved to this path after any read finding new bad
+	// sectors, and when the image is closed.
+	MapPath string
+	// Protects rescueMap and newBadSectors.
+	lock          sync.Mutex
+	rescueMap     *RescueMap
+	newBadSectors bool
+}
+
+// Returns a TolerantImage reading from the given image, retrying failed reads
+// one sector at a time.
+func NewTolerantImage(image Image, sectorSize int) (*TolerantImage, error) {
+	if sectorSize <= 0 {
+		return nil, fmt.Errorf("Invalid sector size: %d", sectorSize)
+	}
+	toReturn := &TolerantImage{
+		image:      image,
+		sectorSize: int64(sectorSize),
+		Retries:    DefaultReadRetries,
+		rescueMap: &RescueMap{
+			CurrentStatus: RescueNonTried,
+			CurrentPass:   1,
+		},
+	}
+	toReturn.r = toReturn
+	toReturn.size = image.Size()
+	toReturn.rescueMap.SetStatus(0, toReturn.size, RescueNonTried)
+	return toReturn, nil
+}
+
+// Opens the disk or image file at the given path as a raw image, without
+// attempting to detect its format, since the start of a failing disk may not
+// be readable. If mapPath is set, bad ranges are logged to it. If a mapfile
+// already exists at mapPath, it's loaded and updated, so ranges it lists as
+// bad will be reported as such until they're read successfully.
+func OpenTolerantImage(path, mapPath string) (*TolerantImage, error) {
+	var m *RescueMap
+	if mapPath != "" {
+		var e error
+		m, e = LoadRescueMap(mapPath)
+		if (e != nil) && !os.IsNotExist(e) {
+			return nil, e
+		}
+	}
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	size, e := contentSize(f)
+	if e != nil {
+		f.Close()
+		return nil, fmt.Errorf("Error getting size of %s: %w", path, e)
+	}
+	_, e = f.Seek(0, io.SeekStart)
+	if e != nil {
+		f.Close()
+		return nil, fmt.Errorf("Error seeking in %s: %w", path, e)
+	}
+	toReturn, e := NewTolerantImage(&fileImage{
+		File: f,
+		size: size,
+	}, SectorSize)
+	if e != nil {
+		f.Close()
+		return nil, e
+	}
+	if m != nil {
+		toReturn.rescueMap = m
+	}
+	toReturn.MapPath = mapPath
+	return toReturn, nil
+}
+
+func (t *TolerantImage) underlyingImage() Image {
+	return t.image
+}
+
+func (t *TolerantImage) Size() int64 {
+	return t.size
+}
+
+// Saves the map if MapPath is set, and closes the underlying image.
+func (t *TolerantImage) Close() error {
+	e := t.SaveMap()
+	closeError := t.image.Close()
+	if e != nil {
+		return e
+	}
+	return closeError
+}
+
+// Writes the map of the image's read results to MapPath, if it's set. The
+// map is written to a temporary file first, so an existing mapfile won't be
+// left incomplete if writing fails.
+func (t *TolerantImage) SaveMap() error {
+	if t.MapPath == "" {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	tmpPath := t.MapPath + ".tmp"
+	f, e := os.Create(tmpPath)
+	if e != nil {
+		return fmt.Errorf("Error creating %s: %w", tmpPath, e)
+	}
+	e = t.rescueMap.Write(f)
+	closeError := f.Close()
+	if e == nil {
+		e = closeError
+	}
+	if e != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Error writing %s: %w", tmpPath, e)
+	}
+	e = os.Rename(tmpPath, t.MapPath)
+	if e != nil {
+		return fmt.Errorf("Error replacing %s: %w", t.MapPath, e)
+	}
+	t.newBadSectors = false
+	return nil
+}
+
+// Writes the map of the image's read results, in ddrescue's format.
+func (t *TolerantImage) WriteMap(w io.Writer) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.rescueMap.Write(w)
+}
+
+// Returns the number of bytes that couldn't be read and were filled instead.
+func (t *TolerantImage) BadBytes() int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.rescueMap.StatusSize(RescueBadSector)
+}
+
+// Returns the parts of the given range, clipped to the image's size, that
+// have failed to be read. Ranges that haven't been read yet aren't included.
+func (t *TolerantImage) UnreadableRanges(offset, size int64) []RescueBlock {
+	if (offset + size) > t.size {
+		size = t.size - offset
+	}
+	if size <= 0 {
+		return nil
+	}
+	t.lock.Lock()
+	ranges := t.rescueMap.UnreadableRanges(offset, size)
+	t.lock.Unlock()
+	toReturn := ranges[:0]
+	for _, r := range ranges {
+		if r.Status == RescueBadSector {
+			toReturn = append(toReturn, r)
+		}
+	}
+	return toReturn
+}
+
+// Records the result of reading the given range.
+func (t *TolerantImage) setStatus(offset, size int64, status byte) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.rescueMap.SetStatus(offset, size, status)
+	t.rescueMap.CurrentPosition = offset
+	if status == RescueBadSector {
+		t.newBadSectors = true
+	}
+}
+
+// Fills dst, which starts at the given offset in the image, with the fill
+// pattern.
+func (t *TolerantImage) fill(dst []byte, offset int64) {
+	if len(t.FillPattern) == 0 {
+		zeroBytes(dst)
+		return
+	}
+	patternSize := int64(len(t.FillPattern))
+	for i := range dst {
+		dst[i] = t.FillPattern[(offset+int64(i))%patternSize]
+	}
+}
+
+// Reads the given range one sector at a time, filling sectors that can't be
+// read.
+func (t *TolerantImage) readSectors(dst []byte, offset int64) {
+	for len(dst) > 0 {
+		limit := t.sectorSize - (offset % t.sectorSize)
+		if limit > int64(len(dst)) {
+			limit = int64(len(dst))
+		}
+		sector := dst[:limit]
+		status := byte(RescueBadSector)
+		for attempt := 0; attempt <= t.Retries; attempt++ {
+			n, _ := t.image.ReadAt(sector, offset)
+			if n == len(sector) {
+				status = RescueFinished
+				break
+			}
+		}
+		if status == RescueBadSector {
+			t.fill(sector, offset)
+		}
+		t.setStatus(offset, limit, status)
+		dst = dst[limit:]
+		offset += limit
+	}
+}
+
+// Never returns an error other than io.EOF, since failed reads are retried
+// and then filled. Use UnreadableRanges to find out which parts were filled.
+func (t *TolerantImage) ReadAt(dst []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("Invalid offset: %d", offset)
+	}
+	if offset >= t.size {
+		return 0, io.EOF
+	}
+	toRead := dst
+	if int64(len(toRead)) > (t.size - offset) {
+		toRead = toRead[:t.size-offset]
+	}
+	n, e := t.image.ReadAt(toRead, offset)
+	if n == len(toRead) {
+		t.setStatus(offset, int64(n), RescueFinished)
+	} else {
+		// Keep what was read, up to the start of the sector containing the
+		// failure, and retry the rest one sector at a time.
+		failed := offset + int64(n)
+		failed -= failed % t.sectorSize
+		if failed < offset {
+			failed = offset
+		}
+		t.setStatus(offset, failed-offset, RescueFinished)
+		t.readSectors(toRead[failed-offset:], failed)
+		t.lock.Lock()
+		save := t.newBadSectors
+		t.lock.Unlock()
+		if save {
+			e = t.SaveMap()
+			if e != nil {
+				return len(toRead), e
+			}
+		}
+	}
+	if len(toRead) < len(dst) {
+		return len(toRead), io.EOF
+	}
+	return len(toRead), nil
+}
@@ -0,0 +1,216 @@
+package fat
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// An in-memory Image where reads covering certain sectors fail, simulating a
+// failing disk.
+type flakyImage struct {
+	readerAtSeeker
+	data []byte
+	// Maps sector numbers to the number of reads covering them that will
+	// fail before they succeed. Negative values always fail.
+	failures map[int64]int
+}
+
+func newFlakyImage(data []byte) *flakyImage {
+	toReturn := &flakyImage{
+		data:     data,
+		failures: make(map[int64]int),
+	}
+	toReturn.r = toReturn
+	toReturn.size = int64(len(data))
+	return toReturn
+}
+
+func (f *flakyImage) Size() int64 {
+	return f.size
+}
+
+func (f *flakyImage) Close() error {
+	return nil
+}
+
+func (f *flakyImage) ReadAt(dst []byte, offset int64) (int, error) {
+	end := offset + int64(len(dst))
+	for sector := offset / SectorSize; (sector * SectorSize) < end; sector++ {
+		remaining, bad := f.failures[sector]
+		if !bad || (remaining == 0) {
+			continue
+		}
+		if remaining > 0 {
+			f.failures[sector] = remaining - 1
+		}
+		// Like os.File, return the data before the failed sector.
+		n := 0
+		if (sector * SectorSize) > offset {
+			n = copy(dst, f.data[offset:sector*SectorSize])
+		}
+		return n, fmt.Errorf("Input/output error reading sector %d", sector)
+	}
+	n := copy(dst, f.data[offset:])
+	return n, nil
+}
+
+func TestRescueMapSetStatus(t *testing.T) {
+	m := &RescueMap{}
+	m.SetStatus(0, 0x1000, RescueNonTried)
+	m.SetStatus(0, 0x200, RescueFinished)
+	m.SetStatus(0x400, 0x200, RescueBadSector)
+	m.SetStatus(0x200, 0x200, RescueFinished)
+	m.SetStatus(0x800, 0x800, RescueFinished)
+	expected := []RescueBlock{
+		{0, 0x400, RescueFinished},
+		{0x400, 0x200, RescueBadSector},
+		{0x600, 0x200, RescueNonTried},
+		{0x800, 0x800, RescueFinished},
+	}
+	if fmt.Sprint(m.Blocks) != fmt.Sprint(expected) {
+		t.Logf("Expected blocks %v, got %v\n", expected, m.Blocks)
+		t.FailNow()
+	}
+	m.SetStatus(0x300, 0x600, RescueFinished)
+	expected = []RescueBlock{{0, 0x1000, RescueFinished}}
+	if fmt.Sprint(m.Blocks) != fmt.Sprint(expected) {
+		t.Logf("Expected blocks %v, got %v\n", expected, m.Blocks)
+		t.FailNow()
+	}
+	m.SetStatus(0x100, 0x100, RescueBadSector)
+	expected = []RescueBlock{
+		{0, 0x100, RescueFinished},
+		{0x100, 0x100, RescueBadSector},
+		{0x200, 0xe00, RescueFinished},
+	}
+	if fmt.Sprint(m.Blocks) != fmt.Sprint(expected) {
+		t.Logf("Expected blocks %v, got %v\n", expected, m.Blocks)
+		t.Fail()
+	}
+}
+
+func TestTolerantImage(t *testing.T) {
+	data := make([]byte, 16*SectorSize)
+	for i := range data {
+		data[i] = byte(i / SectorSize)
+	}
+	flaky := newFlakyImage(data)
+	// Sector 3 is bad, and sector 9 fails twice before being read.
+	flaky.failures[3] = -1
+	flaky.failures[9] = 2
+	img, e := NewTolerantImage(flaky, SectorSize)
+	if e != nil {
+		t.Logf("Failed creating tolerant image: %s\n", e)
+		t.FailNow()
+	}
+	img.FillPattern = []byte("BAD!")
+	img.MapPath = filepath.Join(t.TempDir(), "errors.map")
+
+	content := make([]byte, len(data))
+	n, e := img.ReadAt(content, 0)
+	if (e != nil) || (n != len(content)) {
+		t.Logf("Failed reading tolerant image: %d, %v\n", n, e)
+		t.FailNow()
+	}
+	expected := append([]byte{}, data...)
+	copy(expected[3*SectorSize:4*SectorSize],
+		bytes.Repeat([]byte("BAD!"), SectorSize/4))
+	if !bytes.Equal(content, expected) {
+		t.Logf("Didn't get the expected content from the tolerant image\n")
+		t.Fail()
+	}
+	bad := img.UnreadableRanges(0, img.Size())
+	if (len(bad) != 1) || (bad[0].Offset != 3*SectorSize) ||
+		(bad[0].Size != SectorSize) {
+		t.Logf("Got incorrect unreadable ranges: %v\n", bad)
+		t.Fail()
+	}
+	if img.BadBytes() != SectorSize {
+		t.Logf("Expected %d bad bytes, got %d\n", SectorSize, img.BadBytes())
+		t.Fail()
+	}
+
+	// The mapfile should have been written when the bad sector was found.
+	m, e := LoadRescueMap(img.MapPath)
+	if e != nil {
+		t.Logf("Failed loading saved mapfile: %s\n", e)
+		t.FailNow()
+	}
+	ranges := m.UnreadableRanges(0, img.Size())
+	if fmt.Sprint(ranges) != fmt.Sprint(bad) {
+		t.Logf("Saved mapfile has unreadable ranges %v, expected %v\n",
+			ranges, bad)
+		t.Fail()
+	}
+
+	// Reads through Read and Seek, and reads in the middle of a sector,
+	// should be filled the same way.
+	_, e = img.Seek(3*SectorSize+2, 0)
+	if e != nil {
+		t.Logf("Failed seeking: %s\n", e)
+		t.FailNow()
+	}
+	partial := make([]byte, 4)
+	_, e = img.Read(partial)
+	if (e != nil) || (string(partial) != "D!BA") {
+		t.Logf("Expected to read \"D!BA\", got %q, %v\n", partial, e)
+		t.Fail()
+	}
+	e = img.Close()
+	if e != nil {
+		t.Logf("Failed closing image: %s\n", e)
+		t.Fail()
+	}
+}
+
+func TestOpenTolerantImage(t *testing.T) {
+	dir := t.TempDir()
+	imagePath := filepath.Join(dir, "disk.img")
+	e := os.WriteFile(imagePath, make([]byte, 8*SectorSize), 0644)
+	if e != nil {
+		t.Logf("Failed writing image: %s\n", e)
+		t.FailNow()
+	}
+	// An existing mapfile's bad sectors are reported until they're read.
+	mapPath := filepath.Join(dir, "disk.map")
+	e = os.WriteFile(mapPath, []byte("0 +\n0 0x400 +\n0x400 0x200 -\n"+
+		"0x600 0xa00 +\n"), 0644)
+	if e != nil {
+		t.Logf("Failed writing mapfile: %s\n", e)
+		t.FailNow()
+	}
+	img, e := OpenTolerantImage(imagePath, mapPath)
+	if e != nil {
+		t.Logf("Failed opening tolerant image: %s\n", e)
+		t.FailNow()
+	}
+	if len(img.UnreadableRanges(0, img.Size())) != 1 {
+		t.Logf("The existing mapfile's bad sector wasn't reported\n")
+		t.Fail()
+	}
+	buffer := make([]byte, img.Size())
+	_, e = img.ReadAt(buffer, 0)
+	if e != nil {
+		t.Logf("Failed reading image: %s\n", e)
+		t.FailNow()
+	}
+	if len(img.UnreadableRanges(0, img.Size())) != 0 {
+		t.Logf("The bad sector was still reported after reading it\n")
+		t.Fail()
+	}
+	e = img.Close()
+	if e != nil {
+		t.Logf("Failed closing image: %s\n", e)
+		t.FailNow()
+	}
+	saved, e := os.ReadFile(mapPath)
+	if (e != nil) || !strings.Contains(string(saved),
+		"0x00000000  0x00001000  +") {
+		t.Logf("The updated mapfile is incorrect: %s, %v\n", saved, e)
+		t.Fail()
+	}
+}
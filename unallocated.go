@@ -0,0 +1,289 @@
+package fat
+
+// This file contains functions for reading the parts of a FAT32 filesystem
+// that aren't claimed by any file: free clusters, and the "slack" at the end
+// of each file's last cluster. Both are useful targets for carving deleted
+// data.
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// A contiguous range of bytes within a filesystem's content.
+type ImageRegion struct {
+	// The offset of the region in the filesystem's content.
+	Offset int64
+	// The size of the region, in bytes.
+	Size int64
+	// The cluster containing the start of the region.
+	Cluster uint32
+	// For slack regions, this is the path of the file that owns the cluster.
+	// It is empty for regions of free clusters.
+	Path string
+}
+
+// Implements io.ReadSeeker, presenting several regions of an underlying
+// ReadSeeker as a single contiguous stream. Like LimitedReadSeeker, this will
+// modify the offset of the underlying ReadSeeker when used.
+type RegionReader struct {
+	wrapped io.ReadSeeker
+	regions []ImageRegion
+	// Holds the offset in the stream at which each region starts.
+	starts        []int64
+	size          int64
+	currentOffset int64
+}
+
+// Returns a new RegionReader concatenating the given regions of the wrapped
+// ReadSeeker, in the order given. Empty regions are skipped.
+func NewRegionReader(wrapped io.ReadSeeker,
+	regions []ImageRegion) *RegionReader {
+	toReturn := &RegionReader{
+		wrapped: wrapped,
+	}
+	for _, r := range regions {
+		if r.Size <= 0 {
+			continue
+		}
+		toReturn.regions = append(toReturn.regions, r)
+		toReturn.starts = append(toReturn.starts, toReturn.size)
+		toReturn.size += r.Size
+	}
+	return toReturn
+}
+
+// Returns the list of regions making up the stream.
+func (r *RegionReader) Regions() []ImageRegion {
+	return r.regions
+}
+
+// Returns the total size of the stream, in bytes.
+func (r *RegionReader) Size() int64 {
+	return r.size
+}
+
+// Returns the index of the region containing the given offset in the stream,
+// or -1 if the offset is past the end of the stream.
+func (r *RegionReader) regionIndex(offset int64) int {
+	if (offset < 0) || (offset >= r.size) {
+		return -1
+	}
+	// Find the first region starting after the offset; the one before it
+	// contains the offset.
+	return sort.Search(len(r.starts), func(i int) bool {
+		return r.starts[i] > offset
+	}) - 1
+}
+
+// Maps an offset in the stream back to the region containing it. Returns the
+// region and the corresponding offset in the underlying ReadSeeker. Returns
+// an error if the offset is outside of the stream.
+func (r *RegionReader) MapOffset(offset int64) (*ImageRegion, int64, error) {
+	i := r.regionIndex(offset)
+	if i < 0 {
+		return nil, 0, fmt.Errorf("Offset %d is outside of the %d-byte "+
+			"stream", offset, r.size)
+	}
+	region := &(r.regions[i])
+	return region, region.Offset + (offset - r.starts[i]), nil
+}
+
+func (r *RegionReader) Seek(offset int64, whence int) (int64, error) {
+	newOffset := r.currentOffset
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset += offset
+	case io.SeekEnd:
+		newOffset = r.size + offset
+	default:
+		return r.currentOffset, fmt.Errorf("Invalid whence: %d", whence)
+	}
+	if newOffset < 0 {
+		return r.currentOffset, fmt.Errorf("Can't seek to negative offset %d",
+			newOffset)
+	}
+	r.currentOffset = newOffset
+	return newOffset, nil
+}
+
+func (r *RegionReader) Read(dst []byte) (int, error) {
+	bytesRead := 0
+	for bytesRead < len(dst) {
+		i := r.regionIndex(r.currentOffset)
+		if i < 0 {
+			return bytesRead, io.EOF
+		}
+		region := &(r.regions[i])
+		offsetInRegion := r.currentOffset - r.starts[i]
+		toRead := region.Size - offsetInRegion
+		if toRead > int64(len(dst)-bytesRead) {
+			toRead = int64(len(dst) - bytesRead)
+		}
+		_, e := r.wrapped.Seek(region.Offset+offsetInRegion, io.SeekStart)
+		if e != nil {
+			return bytesRead, fmt.Errorf("Error seeking in underlying "+
+				"ReadSeeker: %w", e)
+		}
+		n, e := io.ReadFull(r.wrapped, dst[bytesRead:bytesRead+int(toRead)])
+		bytesRead += n
+		r.currentOffset += int64(n)
+		if e != nil {
+			return bytesRead, fmt.Errorf("Error reading region at offset "+
+				"%d: %w", region.Offset, e)
+		}
+	}
+	return bytesRead, nil
+}
+
+// Returns a RegionReader over the content of every free cluster in the
+// filesystem, according to f.FAT. Adjacent free clusters are combined into a
+// single region, so each region's Cluster field and the cluster size can be
+// used to map offsets back to cluster numbers; see ClusterAtOffset.
+func (f *FAT32Filesystem) GetUnallocatedReader() *RegionReader {
+	clusterCount := f.ClusterCount()
+	clusterSize := int64(f.ClusterSize)
+	var regions []ImageRegion
+	var current *ImageRegion
+	for c := uint32(2); c < clusterCount; c++ {
+		if (f.FAT[c] & 0x0fffffff) != 0 {
+			current = nil
+			continue
+		}
+		if current != nil {
+			current.Size += clusterSize
+			continue
+		}
+		regions = append(regions, ImageRegion{
+			Offset:  f.GetDataOffset(c, 0),
+			Size:    clusterSize,
+			Cluster: c,
+		})
+		current = &(regions[len(regions)-1])
+	}
+	return NewRegionReader(f.Content, regions)
+}
+
+// Returns a RegionReader over the slack space of every file reachable from
+// the root directory: the bytes between the end of each file's content and
+// the end of its last cluster. Files that exactly fill their last cluster
+// have no slack and are omitted.
+func (f *FAT32Filesystem) GetSlackReader() (*RegionReader, error) {
+	clusterSize := uint64(f.ClusterSize)
+	var regions []ImageRegion
+	e := f.WalkFiles(func(path string, entry *FoundDirectoryEntry) error {
+		d := &(entry.Entry)
+		if d.IsDirectory() || (d.FileSize == 0) {
+			return nil
+		}
+		usedInLastCluster := uint64(d.FileSize) % clusterSize
+		if usedInLastCluster == 0 {
+			return nil
+		}
+		clusters, e := f.ChainClusters(d.StartCluster())
+		if e != nil {
+			// Skip files with broken chains rather than giving up.
+			return nil
+		}
+		clustersNeeded := (uint64(d.FileSize) + clusterSize - 1) / clusterSize
+		if uint64(len(clusters)) < clustersNeeded {
+			return nil
+		}
+		last := clusters[clustersNeeded-1]
+		regions = append(regions, ImageRegion{
+			Offset:  f.GetDataOffset(last, uint32(usedInLastCluster)),
+			Size:    int64(clusterSize - usedInLastCluster),
+			Cluster: last,
+			Path:    path,
+		})
+		return nil
+	})
+	if e != nil {
+		return nil, fmt.Errorf("Error walking files: %w", e)
+	}
+	return NewRegionReader(f.Content, regions), nil
+}
+
+// Maps an offset in a RegionReader returned by GetUnallocatedReader or
+// GetSlackReader back to the cluster containing it.
+func (f *FAT32Filesystem) ClusterAtOffset(r *RegionReader,
+	offset int64) (uint32, error) {
+	region, imageOffset, e := r.MapOffset(offset)
+	if e != nil {
+		return 0, e
+	}
+	clusterStart := f.GetDataOffset(region.Cluster, 0)
+	return region.Cluster +
+		uint32((imageOffset-clusterStart)/int64(f.ClusterSize)), nil
+}
+
+// Reads from the given offset in the stream without modifying the current
+// offset. The underlying ReadSeeker must implement io.ReaderAt. Unlike Read,
+// this is safe to call concurrently if the underlying ReadAt is.
+func (r *RegionReader) ReadAt(dst []byte, offset int64) (int, error) {
+	readerAt, ok := r.wrapped.(io.ReaderAt)
+	if !ok {
+		return 0, fmt.Errorf("The underlying ReadSeeker doesn't implement " +
+			"io.ReaderAt")
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Invalid read offset: %d", offset)
+	}
+	bytesRead := 0
+	for bytesRead < len(dst) {
+		i := r.regionIndex(offset)
+		if i < 0 {
+			return bytesRead, io.EOF
+		}
+		region := &(r.regions[i])
+		offsetInRegion := offset - r.starts[i]
+		toRead := region.Size - offsetInRegion
+		if toRead > int64(len(dst)-bytesRead) {
+			toRead = int64(len(dst) - bytesRead)
+		}
+		n, e := readerAt.ReadAt(dst[bytesRead:bytesRead+int(toRead)],
+			region.Offset+offsetInRegion)
+		bytesRead += n
+		offset += int64(n)
+		if (e != nil) && ((e != io.EOF) || (int64(n) != toRead)) {
+			return bytesRead, fmt.Errorf("Error reading region at offset "+
+				"%d: %w", region.Offset, e)
+		}
+	}
+	return bytesRead, nil
+}
+
+// Returns the parts of the given range of the stream that couldn't be read
+// when the image was acquired, if the underlying ReadSeeker implements
+// UnreadableRangeReporter. Offsets are relative to the start of the stream.
+func (r *RegionReader) UnreadableRanges(offset, size int64) []RescueBlock {
+	reporter, ok := r.wrapped.(UnreadableRangeReporter)
+	if !ok {
+		return nil
+	}
+	var toReturn []RescueBlock
+	end := offset + size
+	for offset < end {
+		i := r.regionIndex(offset)
+		if i < 0 {
+			break
+		}
+		region := &(r.regions[i])
+		offsetInRegion := offset - r.starts[i]
+		toCheck := region.Size - offsetInRegion
+		if toCheck > (end - offset) {
+			toCheck = end - offset
+		}
+		ranges := reporter.UnreadableRanges(region.Offset+offsetInRegion,
+			toCheck)
+		for _, b := range ranges {
+			b.Offset += offset - (region.Offset + offsetInRegion)
+			toReturn = append(toReturn, b)
+		}
+		offset += toCheck
+	}
+	return toReturn
+}
@@ -0,0 +1,102 @@
+package fat
+
+import (
+	"io"
+	"testing"
+)
+
+func TestUnallocatedReader(t *testing.T) {
+	m := newTestImage()
+	m.addFile(testRootCluster, 0, "A", 1000, []uint32{3, 4})
+	m.addFile(testRootCluster, 1, "B", 1500, []uint32{6, 7, 8})
+	f := m.open(t)
+	r := f.GetUnallocatedReader()
+	expectedSize := int64(f.ClusterCount()-8) * int64(f.ClusterSize)
+	if r.Size() != expectedSize {
+		t.Logf("Expected %d unallocated bytes, got %d\n", expectedSize,
+			r.Size())
+		t.FailNow()
+	}
+	if len(r.Regions()) != 2 {
+		t.Logf("Expected 2 free regions, got %d\n", len(r.Regions()))
+		t.FailNow()
+	}
+	// The second free cluster should be cluster 9, following cluster 5.
+	c, e := f.ClusterAtOffset(r, SectorSize+10)
+	if e != nil {
+		t.Logf("Failed mapping offset to cluster: %s\n", e)
+		t.FailNow()
+	}
+	if c != 9 {
+		t.Logf("Expected offset to map to cluster 9, got %d\n", c)
+		t.FailNow()
+	}
+	// Mark cluster 5 so we can check reading across regions.
+	m.cluster(5)[SectorSize-1] = 0xaa
+	m.cluster(9)[0] = 0xbb
+	r.Seek(SectorSize-1, io.SeekStart)
+	data := make([]byte, 2)
+	_, e = io.ReadFull(r, data)
+	if e != nil {
+		t.Logf("Failed reading unallocated data: %s\n", e)
+		t.FailNow()
+	}
+	if (data[0] != 0xaa) || (data[1] != 0xbb) {
+		t.Logf("Read incorrect unallocated data: % x\n", data)
+		t.FailNow()
+	}
+	// ReadAt should give the same result without moving the offset.
+	data[0], data[1] = 0, 0
+	_, e = r.ReadAt(data, SectorSize-1)
+	if e != nil {
+		t.Logf("Failed reading unallocated data using ReadAt: %s\n", e)
+		t.FailNow()
+	}
+	if (data[0] != 0xaa) || (data[1] != 0xbb) {
+		t.Logf("ReadAt read incorrect unallocated data: % x\n", data)
+		t.FailNow()
+	}
+	offset, _ := r.Seek(0, io.SeekCurrent)
+	if offset != SectorSize+1 {
+		t.Logf("ReadAt changed the current offset to %d\n", offset)
+		t.Fail()
+	}
+	_, e = r.ReadAt(data, r.Size()-1)
+	if e != io.EOF {
+		t.Logf("Didn't get EOF from ReadAt past the end: %v\n", e)
+		t.Fail()
+	}
+}
+
+func TestSlackReader(t *testing.T) {
+	m := newTestImage()
+	m.addFile(testRootCluster, 0, "A", 1000, []uint32{3, 4})
+	// This file has no slack.
+	m.addFile(testRootCluster, 1, "B", 1024, []uint32{6, 7})
+	f := m.open(t)
+	r, e := f.GetSlackReader()
+	if e != nil {
+		t.Logf("Failed getting slack reader: %s\n", e)
+		t.FailNow()
+	}
+	regions := r.Regions()
+	if len(regions) != 1 {
+		t.Logf("Expected 1 slack region, got %d\n", len(regions))
+		t.FailNow()
+	}
+	if (regions[0].Cluster != 4) || (regions[0].Size != 24) ||
+		(regions[0].Path != "A") {
+		t.Logf("Got incorrect slack region: %+v\n", regions[0])
+		t.FailNow()
+	}
+	data, e := io.ReadAll(r)
+	if e != nil {
+		t.Logf("Failed reading slack: %s\n", e)
+		t.FailNow()
+	}
+	// The test image fills the second cluster of the file with 2s.
+	if (len(data) != 24) || (data[0] != 2) {
+		t.Logf("Read incorrect slack data: % x\n", data)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,187 @@
+package fat
+
+// This file contains support for restoring deleted files and directories in a
+// writable FAT32 filesystem. Combined with an Overlay, this can be used to
+// recover files without modifying the original image.
+
+import (
+	"fmt"
+	"io/fs"
+)
+
+// Returns the first cluster of the directory containing the given cluster,
+// by following the FAT backwards. Returns an error if the cluster isn't
+// allocated, since it must belong to a live directory.
+func (w *WritableFAT32Filesystem) directoryStart(cluster uint32) (uint32,
+	error) {
+	clusterCount := w.ClusterCount()
+	if (cluster < 2) || (cluster >= clusterCount) {
+		return 0, fmt.Errorf("Invalid directory cluster: %d", cluster)
+	}
+	if (w.FAT[cluster] & 0x0fffffff) == 0 {
+		return 0, fmt.Errorf("Cluster %d isn't allocated, so the directory "+
+			"containing it must be undeleted first", cluster)
+	}
+	previous := make(map[uint32]uint32)
+	for c := uint32(2); c < clusterCount; c++ {
+		v := w.FAT[c] & 0x0fffffff
+		if (v >= 2) && (v < clusterCount) {
+			previous[v] = c
+		}
+	}
+	visited := make(map[uint32]bool)
+	current := cluster
+	for {
+		p, ok := previous[current]
+		if !ok {
+			return current, nil
+		}
+		if visited[p] {
+			return 0, fmt.Errorf("The chain containing cluster %d contains "+
+				"a cycle", cluster)
+		}
+		visited[p] = true
+		current = p
+	}
+}
+
+// Returns the clusters that a deleted entry's content is assumed to occupy.
+// FAT32 doesn't record the chain of a deleted file, so we assume it was
+// contiguous. Deleted directories don't record their size, so they are
+// assumed to occupy a single cluster.
+func (w *WritableFAT32Filesystem) deletedEntryClusters(
+	d *DirectoryEntry) ([]uint32, error) {
+	start := d.StartCluster()
+	count := uint32(1)
+	if !d.IsDirectory() {
+		count = w.clustersNeeded(uint64(d.FileSize))
+	}
+	if start < 2 {
+		if d.IsDirectory() || (d.FileSize != 0) {
+			return nil, fmt.Errorf("Invalid start cluster: %d", start)
+		}
+		return nil, nil
+	}
+	if (uint64(start) + uint64(count)) > uint64(w.ClusterCount()) {
+		return nil, fmt.Errorf("%d clusters starting at cluster %d extend "+
+			"past the end of the volume", count, start)
+	}
+	toReturn := make([]uint32, count)
+	for i := range toReturn {
+		toReturn[i] = start + uint32(i)
+	}
+	return toReturn, nil
+}
+
+// Restores a deleted file or directory, found using ReadDirectory or
+// ScanForDirectoryEntries. This restores the first character of the short
+// name, the long name entries, and the cluster chain, which is assumed to be
+// contiguous. If the entry has long name entries, the first character of the
+// short name is determined from their checksum. Otherwise, the given
+// character is used, or '_' if it is 0. Returns an error without making any
+// changes if any of the needed clusters have been reallocated, or if the
+// name is now used by another entry. The directory containing the entry must
+// not itself be deleted. Every copy of the FAT and the FSInfo structure are
+// updated.
+func (w *WritableFAT32Filesystem) Undelete(found *FoundDirectoryEntry,
+	firstCharacter byte) error {
+	e := w.checkClosed()
+	if e != nil {
+		return e
+	}
+	if !found.Entry.IsDeleted() {
+		return fmt.Errorf("%s isn't deleted", found.Name())
+	}
+	start, e := w.directoryStart(found.Cluster)
+	if e != nil {
+		return fmt.Errorf("Error finding directory containing %s: %w",
+			found.Name(), e)
+	}
+	d, e := w.loadDirectory(start)
+	if e != nil {
+		return fmt.Errorf("Error reading directory containing %s: %w",
+			found.Name(), e)
+	}
+	var current *FoundDirectoryEntry
+	for i := range d.entries {
+		entry := &(d.entries[i])
+		if (entry.Cluster == found.Cluster) && (entry.Index == found.Index) {
+			current = entry
+			break
+		}
+	}
+	if (current == nil) || (current.Entry != found.Entry) {
+		return fmt.Errorf("The directory entry for %s has changed",
+			found.Name())
+	}
+	slot, e := d.slotIndex(current, w.ClusterSize)
+	if e != nil {
+		return e
+	}
+
+	// Restore the name, and make sure it doesn't conflict with anything.
+	restored := current.Entry
+	longNameCount := current.LongNameEntries
+	if longNameCount != 0 {
+		checksum := d.data[(slot-1)*DirectoryEntrySize+13]
+		c, ok := restored.firstCharacterForChecksum(checksum)
+		if !ok {
+			return fmt.Errorf("Internal error: invalid long name checksum "+
+				"for %s", current.Name())
+		}
+		firstCharacter = c
+	}
+	if firstCharacter == 0 {
+		firstCharacter = '_'
+	}
+	if (firstCharacter == ' ') || (firstCharacter == DeletedEntryMarker) ||
+		!isValidShortNameChar(firstCharacter) {
+		return fmt.Errorf("Invalid first character for short name: 0x%02x",
+			firstCharacter)
+	}
+	restored.Name[0] = firstCharacter
+	if d.hasShortName(restored.Name, restored.Extension) ||
+		((current.LongName != "") &&
+			(findEntry(d.entries, current.LongName) != nil)) {
+		return fmt.Errorf("%s: %w", restored.ShortName(), fs.ErrExist)
+	}
+
+	// Make sure that none of the clusters have been reused.
+	clusters, e := w.deletedEntryClusters(&restored)
+	if e != nil {
+		return fmt.Errorf("Can't restore content of %s: %w", current.Name(),
+			e)
+	}
+	for _, c := range clusters {
+		if (w.FAT[c] & 0x0fffffff) != 0 {
+			return fmt.Errorf("Can't restore content of %s: cluster %d has "+
+				"been reallocated", current.Name(), c)
+		}
+	}
+	for i, c := range clusters {
+		if i == (len(clusters) - 1) {
+			w.setFAT(c, endOfChainMarker)
+		} else {
+			w.setFAT(c, clusters[i+1])
+		}
+	}
+
+	// The long name entries are stored in reverse order, so the one
+	// immediately before the short name entry is the first part of the name.
+	for i := 1; i <= longNameCount; i++ {
+		sequence := byte(i)
+		if i == longNameCount {
+			sequence |= 0x40
+		}
+		d.data[(slot-i)*DirectoryEntrySize] = sequence
+	}
+	copy(d.data[slot*DirectoryEntrySize:],
+		entryBytes([]DirectoryEntry{restored}))
+	e = w.writeSlots(d, slot-longNameCount, longNameCount+1)
+	if e != nil {
+		return fmt.Errorf("Error restoring directory entry for %s: %w",
+			current.Name(), e)
+	}
+	found.Entry = restored
+	return w.Flush()
+}
@@ -0,0 +1,130 @@
+package fat
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Returns the deleted entry with the given name in the root directory, or
+// nil if there isn't one.
+func findDeletedEntry(t *testing.T, f *FAT32Filesystem,
+	name string) *FoundDirectoryEntry {
+	entries, e := f.ReadDirectory(f.Header.EBR.RootDirClusterNumber)
+	if e != nil {
+		t.Logf("Failed reading root directory: %s\n", e)
+		t.FailNow()
+	}
+	for i := range entries {
+		if entries[i].Entry.IsDeleted() && (entries[i].Name() == name) {
+			return &(entries[i])
+		}
+	}
+	return nil
+}
+
+func TestUndelete(t *testing.T) {
+	m := newTestImage()
+	w, e := NewWritableFAT32Filesystem(m.openFile(t))
+	if e != nil {
+		t.Logf("Failed opening writable filesystem: %s\n", e)
+		t.FailNow()
+	}
+	longContent := testContent(3000)
+	shortContent := testContent(700)
+	e = w.WriteFile("A long file name.txt", longContent)
+	if e == nil {
+		e = w.WriteFile("SHORT.BIN", shortContent)
+	}
+	if e == nil {
+		e = w.Remove("A long file name.txt")
+	}
+	if e == nil {
+		e = w.Remove("SHORT.BIN")
+	}
+	if e != nil {
+		t.Logf("Failed setting up deleted files: %s\n", e)
+		t.FailNow()
+	}
+
+	// The long name should be found even though the entry is deleted.
+	deletedLong := findDeletedEntry(t, w.FAT32Filesystem,
+		"A long file name.txt")
+	if deletedLong == nil {
+		t.Logf("Couldn't find the long name of a deleted entry\n")
+		t.FailNow()
+	}
+	e = w.Undelete(deletedLong, 0)
+	if e != nil {
+		t.Logf("Failed undeleting file with a long name: %s\n", e)
+		t.FailNow()
+	}
+	deletedShort := findDeletedEntry(t, w.FAT32Filesystem, "?HORT.BIN")
+	if deletedShort == nil {
+		t.Logf("Couldn't find deleted short-name entry\n")
+		t.FailNow()
+	}
+	e = w.Undelete(deletedShort, 'S')
+	if e != nil {
+		t.Logf("Failed undeleting short-name file: %s\n", e)
+		t.FailNow()
+	}
+	e = w.Undelete(deletedShort, 'S')
+	if e == nil {
+		t.Logf("Didn't get expected error undeleting a live file\n")
+		t.Fail()
+	}
+
+	names := []string{"A long file name.txt", "SHORT.BIN"}
+	contents := [][]byte{longContent, shortContent}
+	for i := range names {
+		data, e := w.ReadFile(names[i])
+		if e != nil {
+			t.Logf("Failed reading undeleted %s: %s\n", names[i], e)
+			t.FailNow()
+		}
+		if !bytes.Equal(data, contents[i]) {
+			t.Logf("Got incorrect content for undeleted %s\n", names[i])
+			t.Fail()
+		}
+	}
+	stats, e := w.Stats()
+	if e != nil {
+		t.Logf("Failed getting stats: %s\n", e)
+		t.FailNow()
+	}
+	if len(stats.InfoMismatches) != 0 {
+		t.Logf("FSInfo wasn't updated correctly:\n%s\n",
+			stats.FormatHumanReadable())
+		t.Fail()
+	}
+
+	// Undeleting must fail once the clusters have been reused. The new file
+	// goes in a subdirectory so that it doesn't reuse the deleted entry.
+	e = w.Mkdir("dir")
+	if e == nil {
+		e = w.Remove("SHORT.BIN")
+	}
+	if e == nil {
+		e = w.WriteFile("dir/new.bin", testContent(100))
+	}
+	if e != nil {
+		t.Logf("Failed reusing clusters: %s\n", e)
+		t.FailNow()
+	}
+	deletedShort = findDeletedEntry(t, w.FAT32Filesystem, "?HORT.BIN")
+	if deletedShort == nil {
+		t.Logf("Couldn't find deleted short-name entry again\n")
+		t.FailNow()
+	}
+	e = w.Undelete(deletedShort, 'S')
+	if e == nil {
+		t.Logf("Didn't get expected error undeleting reallocated file\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error undeleting reallocated file: %s\n", e)
+	_, e = w.Lookup("SHORT.BIN")
+	if e == nil {
+		t.Logf("A failed undelete restored the directory entry\n")
+		t.Fail()
+	}
+}
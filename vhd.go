@@ -0,0 +1,222 @@
+package fat
+
+// This file contains a reader for fixed and dynamic VHD virtual disk images,
+// as used by Virtual PC and older versions of Hyper-V.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The cookie at the start of a VHD footer.
+var vhdFooterCookie = []byte("conectix")
+
+// The cookie at the start of a dynamic VHD's header.
+var vhdDynamicCookie = []byte("cxsparse")
+
+// Disk types found in VHD footers.
+const (
+	vhdTypeFixed        = 2
+	vhdTypeDynamic      = 3
+	vhdTypeDifferencing = 4
+)
+
+// Marks a block that isn't allocated in a dynamic VHD's block allocation
+// table. Such blocks read as zeros.
+const vhdUnallocatedBlock = 0xffffffff
+
+// The 512-byte footer at the end of every VHD file. For dynamic VHDs, a copy
+// is also at the start of the file. All fields are big-endian.
+type vhdFooter struct {
+	Cookie             [8]byte
+	Features           uint32
+	FormatVersion      uint32
+	DataOffset         uint64
+	Timestamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      uint32
+	OriginalSize       uint64
+	CurrentSize        uint64
+	DiskGeometry       uint32
+	DiskType           uint32
+	Checksum           uint32
+	UniqueID           [16]byte
+	SavedState         uint8
+	Reserved           [427]byte
+}
+
+// The 1024-byte header following the footer copy in dynamic VHDs.
+type vhdDynamicHeader struct {
+	Cookie            [8]byte
+	DataOffset        uint64
+	TableOffset       uint64
+	HeaderVersion     uint32
+	MaxTableEntries   uint32
+	BlockSize         uint32
+	Checksum          uint32
+	ParentUniqueID    [16]byte
+	ParentTimestamp   uint32
+	Reserved          uint32
+	ParentUnicodeName [512]byte
+	ParentLocators    [192]byte
+	Reserved2         [256]byte
+}
+
+// Returns the one's complement of the sum of the bytes in data, skipping the
+// 4-byte checksum field at the given offset.
+func vhdChecksum(data []byte, checksumOffset int) uint32 {
+	sum := uint32(0)
+	for i, b := range data {
+		if (i >= checksumOffset) && (i < (checksumOffset + 4)) {
+			continue
+		}
+		sum += uint32(b)
+	}
+	return ^sum
+}
+
+// Reads a big-endian structure from the given offset, verifying the VHD
+// checksum at checksumOffset within it.
+func readVHDStructure(r io.ReaderAt, offset int64, size, checksumOffset int,
+	dst interface{}) error {
+	data := make([]byte, size)
+	e := readFullAt(r, data, offset)
+	if e != nil {
+		return e
+	}
+	expected := binary.BigEndian.Uint32(data[checksumOffset:])
+	if vhdChecksum(data, checksumOffset) != expected {
+		return fmt.Errorf("Bad checksum at offset %d", offset)
+	}
+	return binary.Read(bytes.NewReader(data), binary.BigEndian, dst)
+}
+
+// An Image containing the virtual disk stored in a fixed or dynamic VHD file.
+type VHDImage struct {
+	readerAtSeeker
+	file   io.ReaderAt
+	footer vhdFooter
+	// The remaining fields are only used by dynamic VHDs.
+	blockSize int64
+	// The size of the sector bitmap preceding each block's data.
+	bitmapSize int64
+	// Holds the sector offset of each block, or vhdUnallocatedBlock.
+	bat []uint32
+}
+
+// Returns true if the VHD is dynamic (sparse), and false if it's fixed.
+func (v *VHDImage) Dynamic() bool {
+	return v.footer.DiskType == vhdTypeDynamic
+}
+
+func (v *VHDImage) Size() int64 {
+	return v.size
+}
+
+// Closes the underlying file, if it implements io.Closer.
+func (v *VHDImage) Close() error {
+	return closeIfCloser(v.file)
+}
+
+// Loads a dynamic VHD's header and block allocation table.
+func (v *VHDImage) loadDynamic() error {
+	var header vhdDynamicHeader
+	e := readVHDStructure(v.file, int64(v.footer.DataOffset), 1024, 36,
+		&header)
+	if e != nil {
+		return fmt.Errorf("Error reading dynamic disk header: %w", e)
+	}
+	if !bytes.Equal(header.Cookie[:], vhdDynamicCookie) {
+		return fmt.Errorf("Invalid dynamic disk header cookie")
+	}
+	blockSize := int64(header.BlockSize)
+	if (blockSize < SectorSize) || ((blockSize % SectorSize) != 0) {
+		return fmt.Errorf("Invalid block size: %d", blockSize)
+	}
+	blockCount := (v.size + blockSize - 1) / blockSize
+	if int64(header.MaxTableEntries) < blockCount {
+		return fmt.Errorf("The block allocation table only has %d entries, "+
+			"%d are needed", header.MaxTableEntries, blockCount)
+	}
+	data := make([]byte, blockCount*4)
+	e = readFullAt(v.file, data, int64(header.TableOffset))
+	if e != nil {
+		return fmt.Errorf("Error reading block allocation table: %w", e)
+	}
+	v.bat = make([]uint32, blockCount)
+	for i := range v.bat {
+		v.bat[i] = binary.BigEndian.Uint32(data[i*4:])
+	}
+	v.blockSize = blockSize
+	// One bit per sector, padded to a full sector.
+	v.bitmapSize = ((blockSize/SectorSize + 8*SectorSize - 1) /
+		(8 * SectorSize)) * SectorSize
+	return nil
+}
+
+// Returns a VHDImage reading the VHD file with the given size from r.
+// Differencing VHDs aren't supported, since they require the parent image.
+func NewVHDImage(r io.ReaderAt, fileSize int64) (*VHDImage, error) {
+	if fileSize < SectorSize {
+		return nil, fmt.Errorf("The file is too small to be a VHD")
+	}
+	toReturn := &VHDImage{
+		file: r,
+	}
+	// Prefer the footer at the end of the file, but fall back to the copy at
+	// the start if it's damaged.
+	e := readVHDStructure(r, fileSize-SectorSize, SectorSize, 64,
+		&toReturn.footer)
+	if (e != nil) || !bytes.Equal(toReturn.footer.Cookie[:], vhdFooterCookie) {
+		e = readVHDStructure(r, 0, SectorSize, 64, &toReturn.footer)
+		if e != nil {
+			return nil, fmt.Errorf("Error reading VHD footer: %w", e)
+		}
+		if !bytes.Equal(toReturn.footer.Cookie[:], vhdFooterCookie) {
+			return nil, fmt.Errorf("Didn't find a VHD footer")
+		}
+	}
+	toReturn.size = int64(toReturn.footer.CurrentSize)
+	switch toReturn.footer.DiskType {
+	case vhdTypeFixed:
+		if toReturn.size > (fileSize - SectorSize) {
+			return nil, fmt.Errorf("The VHD is truncated: the disk is %d "+
+				"bytes, but the file is only %d", toReturn.size, fileSize)
+		}
+	case vhdTypeDynamic:
+		e = toReturn.loadDynamic()
+		if e != nil {
+			return nil, e
+		}
+	case vhdTypeDifferencing:
+		return nil, fmt.Errorf("Differencing VHDs aren't supported; merge "+
+			"it with its parent first: %w", ErrUnsupportedFormat)
+	default:
+		return nil, fmt.Errorf("Unknown VHD disk type: %d",
+			toReturn.footer.DiskType)
+	}
+	toReturn.r = toReturn
+	return toReturn, nil
+}
+
+func (v *VHDImage) ReadAt(dst []byte, offset int64) (int, error) {
+	if !v.Dynamic() {
+		return readBlocks(dst, offset, v.size, v.size,
+			func(dst []byte, block, blockOffset int64) error {
+				return readFullAt(v.file, dst, blockOffset)
+			})
+	}
+	return readBlocks(dst, offset, v.size, v.blockSize,
+		func(dst []byte, block, blockOffset int64) error {
+			sector := v.bat[block]
+			if sector == vhdUnallocatedBlock {
+				zeroBytes(dst)
+				return nil
+			}
+			return readFullAt(v.file, dst, int64(sector)*SectorSize+
+				v.bitmapSize+blockOffset)
+		})
+}
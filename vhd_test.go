@@ -0,0 +1,100 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// Returns the bytes of a VHD structure, with its checksum filled in.
+func vhdStructureBytes(value interface{}, checksumOffset int) []byte {
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.BigEndian, value)
+	data := buffer.Bytes()
+	binary.BigEndian.PutUint32(data[checksumOffset:],
+		vhdChecksum(data, checksumOffset))
+	return data
+}
+
+// Returns a VHD footer for a disk with the given type and size.
+func newTestVHDFooter(diskType uint32, size, dataOffset uint64) []byte {
+	footer := vhdFooter{
+		Features:      2,
+		FormatVersion: 0x10000,
+		DataOffset:    dataOffset,
+		OriginalSize:  size,
+		CurrentSize:   size,
+		DiskType:      diskType,
+	}
+	copy(footer.Cookie[:], vhdFooterCookie)
+	return vhdStructureBytes(&footer, 64)
+}
+
+// Returns a dynamic VHD containing the given data, leaving blocks that only
+// contain zeros unallocated.
+func newTestDynamicVHD(data []byte, blockSize int) []byte {
+	blockCount := (len(data) + blockSize - 1) / blockSize
+	footer := newTestVHDFooter(vhdTypeDynamic, uint64(len(data)), 512)
+	header := vhdDynamicHeader{
+		DataOffset:      0xffffffffffffffff,
+		TableOffset:     1536,
+		HeaderVersion:   0x10000,
+		MaxTableEntries: uint32(blockCount),
+		BlockSize:       uint32(blockSize),
+	}
+	copy(header.Cookie[:], vhdDynamicCookie)
+	bat := make([]byte, ((blockCount*4+SectorSize-1)/SectorSize)*SectorSize)
+	file := append([]byte{}, footer...)
+	file = append(file, vhdStructureBytes(&header, 36)...)
+	blocksStart := len(file) + len(bat)
+	var blocks []byte
+	zeros := make([]byte, blockSize)
+	for i := 0; i < blockCount; i++ {
+		block := data[i*blockSize:]
+		if len(block) > blockSize {
+			block = block[:blockSize]
+		}
+		if bytes.Equal(block, zeros[:len(block)]) {
+			binary.BigEndian.PutUint32(bat[i*4:], vhdUnallocatedBlock)
+			continue
+		}
+		sector := (blocksStart + len(blocks)) / SectorSize
+		binary.BigEndian.PutUint32(bat[i*4:], uint32(sector))
+		// The sector bitmap, with every sector present.
+		blocks = append(blocks, bytes.Repeat([]byte{0xff}, SectorSize)...)
+		blocks = append(blocks, block...)
+		blocks = append(blocks, zeros[len(block):]...)
+	}
+	file = append(file, bat...)
+	file = append(file, blocks...)
+	return append(file, footer...)
+}
+
+func TestVHD(t *testing.T) {
+	data := newTestVirtualDiskContent()
+	fixed := append(append([]byte{}, data...),
+		newTestVHDFooter(vhdTypeFixed, uint64(len(data)),
+			0xffffffffffffffff)...)
+	img := checkImageFile(t, "fixed.vhd", fixed, data)
+	vhd, ok := img.(*VHDImage)
+	if !ok || vhd.Dynamic() {
+		t.Logf("Didn't get a fixed VHDImage for fixed.vhd\n")
+		t.Fail()
+	}
+
+	dynamic := newTestDynamicVHD(data, 64*1024)
+	if len(dynamic) >= len(data) {
+		t.Logf("The dynamic VHD doesn't contain any unallocated blocks\n")
+		t.Fail()
+	}
+	img = checkImageFile(t, "dynamic.vhd", dynamic, data)
+	vhd, ok = img.(*VHDImage)
+	if !ok || !vhd.Dynamic() {
+		t.Logf("Didn't get a dynamic VHDImage for dynamic.vhd\n")
+		t.Fail()
+	}
+
+	// Corrupt the footer at the end; the copy at the start should be used.
+	dynamic[len(dynamic)-100]++
+	checkImageFile(t, "damaged.vhd", dynamic, data)
+}
@@ -0,0 +1,369 @@
+package fat
+
+// This file contains a reader for VHDX virtual disk images, as used by newer
+// versions of Hyper-V.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// The signature at the start of every VHDX file.
+var vhdxFileSignature = []byte("vhdxfile")
+
+// GUIDs identifying VHDX regions and metadata items, in their on-disk byte
+// order.
+var (
+	vhdxBATRegion = [16]byte{0x66, 0x77, 0xc2, 0x2d, 0x23, 0xf6, 0x00, 0x42,
+		0x9d, 0x64, 0x11, 0x5e, 0x9b, 0xfd, 0x4a, 0x08}
+	vhdxMetadataRegion = [16]byte{0x06, 0xa2, 0x7c, 0x8b, 0x90, 0x47, 0x9a,
+		0x4b, 0xb8, 0xfe, 0x57, 0x5f, 0x05, 0x0f, 0x88, 0x6e}
+	vhdxFileParameters = [16]byte{0x37, 0x67, 0xa1, 0xca, 0x36, 0xfa, 0x43,
+		0x4d, 0xb3, 0xb6, 0x33, 0xf0, 0xaa, 0x44, 0xe7, 0x6b}
+	vhdxVirtualDiskSize = [16]byte{0x24, 0x42, 0xa5, 0x2f, 0x1b, 0xcd, 0x76,
+		0x48, 0xb2, 0x11, 0x5d, 0xbe, 0xd8, 0x3b, 0xf4, 0xb8}
+	vhdxLogicalSectorSize = [16]byte{0x1d, 0xbf, 0x41, 0x81, 0x6f, 0xa9, 0x09,
+		0x47, 0xba, 0x47, 0xf2, 0x33, 0xa8, 0xfa, 0xab, 0x5f}
+)
+
+// The offsets and sizes of structures at fixed locations in VHDX files.
+const (
+	vhdxHeader1Offset     = 64 * 1024
+	vhdxHeader2Offset     = 128 * 1024
+	vhdxHeaderSize        = 4 * 1024
+	vhdxRegionTable1      = 192 * 1024
+	vhdxRegionTable2      = 256 * 1024
+	vhdxRegionTableSize   = 64 * 1024
+	vhdxMetadataTableSize = 64 * 1024
+)
+
+// Payload block states, in the low 3 bits of each BAT entry.
+const (
+	vhdxBlockNotPresent       = 0
+	vhdxBlockUndefined        = 1
+	vhdxBlockZero             = 2
+	vhdxBlockUnmapped         = 3
+	vhdxBlockFullyPresent     = 6
+	vhdxBlockPartiallyPresent = 7
+)
+
+// The flag in the file parameters metadata item indicating that the disk is
+// a differencing disk.
+const vhdxHasParentFlag = 2
+
+// All VHDX checksums are CRC-32C.
+var vhdxCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// One of the two copies of the VHDX header. All VHDX fields are
+// little-endian.
+type vhdxHeader struct {
+	Signature      [4]byte
+	Checksum       uint32
+	SequenceNumber uint64
+	FileWriteGUID  [16]byte
+	DataWriteGUID  [16]byte
+	LogGUID        [16]byte
+	LogVersion     uint16
+	Version        uint16
+	LogLength      uint32
+	LogOffset      uint64
+}
+
+type vhdxRegionTableHeader struct {
+	Signature  [4]byte
+	Checksum   uint32
+	EntryCount uint32
+	Reserved   uint32
+}
+
+type vhdxRegionTableEntry struct {
+	GUID       [16]byte
+	FileOffset uint64
+	Length     uint32
+	Required   uint32
+}
+
+type vhdxMetadataTableHeader struct {
+	Signature  [8]byte
+	Reserved   uint16
+	EntryCount uint16
+	Reserved2  [20]byte
+}
+
+type vhdxMetadataTableEntry struct {
+	ItemID   [16]byte
+	Offset   uint32
+	Length   uint32
+	Flags    uint32
+	Reserved uint32
+}
+
+// Reads size bytes at the given offset, returning an error if the CRC-32C
+// checksum at offset 4 doesn't match. The returned data has the checksum
+// field zeroed.
+func readVHDXChecksummed(r io.ReaderAt, offset int64, size int) ([]byte,
+	error) {
+	data := make([]byte, size)
+	e := readFullAt(r, data, offset)
+	if e != nil {
+		return nil, e
+	}
+	expected := binary.LittleEndian.Uint32(data[4:])
+	zeroBytes(data[4:8])
+	if crc32.Checksum(data, vhdxCRCTable) != expected {
+		return nil, fmt.Errorf("Bad checksum at offset %d", offset)
+	}
+	return data, nil
+}
+
+// An Image containing the virtual disk stored in a VHDX file.
+type VHDXImage struct {
+	readerAtSeeker
+	file       io.ReaderAt
+	blockSize  int64
+	sectorSize int64
+	// The number of payload blocks between each sector bitmap block in the
+	// BAT.
+	chunkRatio int64
+	bat        []uint64
+}
+
+func (v *VHDXImage) Size() int64 {
+	return v.size
+}
+
+// Returns the virtual disk's logical sector size, either 512 or 4096.
+func (v *VHDXImage) LogicalSectorSize() int64 {
+	return v.sectorSize
+}
+
+// Closes the underlying file, if it implements io.Closer.
+func (v *VHDXImage) Close() error {
+	return closeIfCloser(v.file)
+}
+
+// Returns the current header: the valid one with the highest sequence number.
+func readVHDXHeader(r io.ReaderAt) (*vhdxHeader, error) {
+	var toReturn *vhdxHeader
+	for _, offset := range []int64{vhdxHeader1Offset, vhdxHeader2Offset} {
+		data, e := readVHDXChecksummed(r, offset, vhdxHeaderSize)
+		if e != nil {
+			continue
+		}
+		var header vhdxHeader
+		e = binary.Read(bytes.NewReader(data), binary.LittleEndian, &header)
+		if (e != nil) || (string(header.Signature[:]) != "head") {
+			continue
+		}
+		if (toReturn == nil) ||
+			(header.SequenceNumber > toReturn.SequenceNumber) {
+			toReturn = &header
+		}
+	}
+	if toReturn == nil {
+		return nil, fmt.Errorf("Didn't find a valid VHDX header")
+	}
+	return toReturn, nil
+}
+
+// Returns the entries from the first valid region table.
+func readVHDXRegions(r io.ReaderAt) ([]vhdxRegionTableEntry, error) {
+	var e error
+	for _, offset := range []int64{vhdxRegionTable1, vhdxRegionTable2} {
+		var data []byte
+		data, e = readVHDXChecksummed(r, offset, vhdxRegionTableSize)
+		if e != nil {
+			continue
+		}
+		reader := bytes.NewReader(data)
+		var header vhdxRegionTableHeader
+		binary.Read(reader, binary.LittleEndian, &header)
+		if (string(header.Signature[:]) != "regi") ||
+			(header.EntryCount > 2047) {
+			e = fmt.Errorf("Invalid region table at offset %d", offset)
+			continue
+		}
+		toReturn := make([]vhdxRegionTableEntry, header.EntryCount)
+		e = binary.Read(reader, binary.LittleEndian, toReturn)
+		if e != nil {
+			continue
+		}
+		return toReturn, nil
+	}
+	return nil, fmt.Errorf("Didn't find a valid region table: %w", e)
+}
+
+// Reads the metadata region, filling in the block size, sector size and
+// virtual disk size.
+func (v *VHDXImage) loadMetadata(region *vhdxRegionTableEntry) error {
+	if region.Length < vhdxMetadataTableSize {
+		return fmt.Errorf("The metadata region is too small")
+	}
+	data := make([]byte, region.Length)
+	e := readFullAt(v.file, data, int64(region.FileOffset))
+	if e != nil {
+		return e
+	}
+	reader := bytes.NewReader(data)
+	var header vhdxMetadataTableHeader
+	binary.Read(reader, binary.LittleEndian, &header)
+	if (string(header.Signature[:]) != "metadata") ||
+		(header.EntryCount > 2047) {
+		return fmt.Errorf("Invalid metadata table")
+	}
+	entries := make([]vhdxMetadataTableEntry, header.EntryCount)
+	e = binary.Read(reader, binary.LittleEndian, entries)
+	if e != nil {
+		return e
+	}
+	// Returns the content of the item with the given ID, which must be at
+	// least minSize bytes.
+	getItem := func(id [16]byte, minSize uint32) ([]byte, error) {
+		for i := range entries {
+			entry := &(entries[i])
+			if entry.ItemID != id {
+				continue
+			}
+			end := uint64(entry.Offset) + uint64(entry.Length)
+			if (entry.Length < minSize) || (end > uint64(len(data))) {
+				return nil, fmt.Errorf("Invalid metadata item")
+			}
+			return data[entry.Offset:end], nil
+		}
+		return nil, fmt.Errorf("Missing required metadata item")
+	}
+	item, e := getItem(vhdxFileParameters, 8)
+	if e != nil {
+		return fmt.Errorf("Error reading file parameters: %w", e)
+	}
+	v.blockSize = int64(binary.LittleEndian.Uint32(item))
+	if (binary.LittleEndian.Uint32(item[4:]) & vhdxHasParentFlag) != 0 {
+		return fmt.Errorf("Differencing VHDX images aren't supported; "+
+			"merge it with its parent first: %w", ErrUnsupportedFormat)
+	}
+	item, e = getItem(vhdxVirtualDiskSize, 8)
+	if e != nil {
+		return fmt.Errorf("Error reading virtual disk size: %w", e)
+	}
+	v.size = int64(binary.LittleEndian.Uint64(item))
+	item, e = getItem(vhdxLogicalSectorSize, 4)
+	if e != nil {
+		return fmt.Errorf("Error reading logical sector size: %w", e)
+	}
+	v.sectorSize = int64(binary.LittleEndian.Uint32(item))
+	if (v.sectorSize != 512) && (v.sectorSize != 4096) {
+		return fmt.Errorf("Invalid logical sector size: %d", v.sectorSize)
+	}
+	// The block size must be a power of two between 1MB and 256MB.
+	if (v.blockSize < (1024 * 1024)) || (v.blockSize > (256 * 1024 * 1024)) ||
+		((v.blockSize & (v.blockSize - 1)) != 0) {
+		return fmt.Errorf("Invalid block size: %d", v.blockSize)
+	}
+	if v.size < 0 {
+		return fmt.Errorf("Invalid virtual disk size: %d", v.size)
+	}
+	return nil
+}
+
+// Reads the block allocation table. Must be called after loadMetadata.
+func (v *VHDXImage) loadBAT(region *vhdxRegionTableEntry) error {
+	v.chunkRatio = ((1 << 23) * v.sectorSize) / v.blockSize
+	blockCount := (v.size + v.blockSize - 1) / v.blockSize
+	entryCount := blockCount
+	if blockCount > 0 {
+		entryCount += (blockCount - 1) / v.chunkRatio
+	}
+	if (entryCount * 8) > int64(region.Length) {
+		return fmt.Errorf("The BAT region is too small: it needs %d entries",
+			entryCount)
+	}
+	data := make([]byte, entryCount*8)
+	e := readFullAt(v.file, data, int64(region.FileOffset))
+	if e != nil {
+		return e
+	}
+	v.bat = make([]uint64, entryCount)
+	for i := range v.bat {
+		v.bat[i] = binary.LittleEndian.Uint64(data[i*8:])
+	}
+	return nil
+}
+
+// Returns a VHDXImage reading the VHDX file from r. Differencing images, and
+// images with a log that hasn't been replayed, aren't supported.
+func NewVHDXImage(r io.ReaderAt) (*VHDXImage, error) {
+	var signature [8]byte
+	e := readFullAt(r, signature[:], 0)
+	if e != nil {
+		return nil, e
+	}
+	if !bytes.Equal(signature[:], vhdxFileSignature) {
+		return nil, fmt.Errorf("Didn't find the VHDX file signature")
+	}
+	header, e := readVHDXHeader(r)
+	if e != nil {
+		return nil, e
+	}
+	if header.LogGUID != [16]byte{} {
+		return nil, fmt.Errorf("The VHDX log must be replayed, e.g. by "+
+			"mounting the image in Windows, before it can be read: %w",
+			ErrUnsupportedFormat)
+	}
+	regions, e := readVHDXRegions(r)
+	if e != nil {
+		return nil, e
+	}
+	var batRegion, metadataRegion *vhdxRegionTableEntry
+	for i := range regions {
+		region := &(regions[i])
+		switch region.GUID {
+		case vhdxBATRegion:
+			batRegion = region
+		case vhdxMetadataRegion:
+			metadataRegion = region
+		default:
+			if region.Required != 0 {
+				return nil, fmt.Errorf("Unknown required VHDX region: %w",
+					ErrUnsupportedFormat)
+			}
+		}
+	}
+	if (batRegion == nil) || (metadataRegion == nil) {
+		return nil, fmt.Errorf("The VHDX is missing its BAT or metadata " +
+			"region")
+	}
+	toReturn := &VHDXImage{
+		file: r,
+	}
+	e = toReturn.loadMetadata(metadataRegion)
+	if e != nil {
+		return nil, fmt.Errorf("Error reading VHDX metadata: %w", e)
+	}
+	e = toReturn.loadBAT(batRegion)
+	if e != nil {
+		return nil, fmt.Errorf("Error reading VHDX BAT: %w", e)
+	}
+	toReturn.r = toReturn
+	return toReturn, nil
+}
+
+func (v *VHDXImage) ReadAt(dst []byte, offset int64) (int, error) {
+	return readBlocks(dst, offset, v.size, v.blockSize,
+		func(dst []byte, block, blockOffset int64) error {
+			entry := v.bat[block+block/v.chunkRatio]
+			switch entry & 7 {
+			case vhdxBlockNotPresent, vhdxBlockUndefined, vhdxBlockZero,
+				vhdxBlockUnmapped:
+				zeroBytes(dst)
+				return nil
+			case vhdxBlockFullyPresent, vhdxBlockPartiallyPresent:
+				fileOffset := int64(entry>>20) * 1024 * 1024
+				return readFullAt(v.file, dst, fileOffset+blockOffset)
+			}
+			return fmt.Errorf("Invalid state for block %d: %d", block,
+				entry&7)
+		})
+}
@@ -0,0 +1,121 @@
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+// Writes the structure to the file at the given offset, storing its CRC-32C
+// checksum at offset 4 if checksumSize is nonzero.
+func putVHDXStructure(file []byte, offset, checksumSize int,
+	values ...interface{}) {
+	var buffer bytes.Buffer
+	for _, v := range values {
+		binary.Write(&buffer, binary.LittleEndian, v)
+	}
+	copy(file[offset:], buffer.Bytes())
+	if checksumSize != 0 {
+		checksum := crc32.Checksum(file[offset:offset+checksumSize],
+			vhdxCRCTable)
+		binary.LittleEndian.PutUint32(file[offset+4:], checksum)
+	}
+}
+
+// Returns a VHDX file with 1MB blocks containing the given data. Blocks
+// containing only zeros are marked as zero blocks rather than stored.
+func newTestVHDX(data []byte) []byte {
+	const mb = 1024 * 1024
+	const metadataOffset = 2 * mb
+	const batOffset = 3 * mb
+	const blocksOffset = 4 * mb
+	blockCount := (len(data) + mb - 1) / mb
+	file := make([]byte, blocksOffset)
+	copy(file, vhdxFileSignature)
+
+	// Only provide the first header; the second is left invalid.
+	header := vhdxHeader{
+		SequenceNumber: 1,
+		Version:        1,
+	}
+	copy(header.Signature[:], "head")
+	putVHDXStructure(file, vhdxHeader1Offset, vhdxHeaderSize, &header)
+
+	regionHeader := vhdxRegionTableHeader{
+		EntryCount: 2,
+	}
+	copy(regionHeader.Signature[:], "regi")
+	putVHDXStructure(file, vhdxRegionTable1, vhdxRegionTableSize,
+		&regionHeader,
+		&vhdxRegionTableEntry{
+			GUID:       vhdxBATRegion,
+			FileOffset: batOffset,
+			Length:     mb,
+			Required:   1,
+		},
+		&vhdxRegionTableEntry{
+			GUID:       vhdxMetadataRegion,
+			FileOffset: metadataOffset,
+			Length:     mb,
+			Required:   1,
+		})
+
+	metadataHeader := vhdxMetadataTableHeader{
+		EntryCount: 3,
+	}
+	copy(metadataHeader.Signature[:], "metadata")
+	itemsOffset := uint32(vhdxMetadataTableSize)
+	putVHDXStructure(file, metadataOffset, 0, &metadataHeader,
+		&vhdxMetadataTableEntry{
+			ItemID: vhdxFileParameters,
+			Offset: itemsOffset,
+			Length: 8,
+		},
+		&vhdxMetadataTableEntry{
+			ItemID: vhdxVirtualDiskSize,
+			Offset: itemsOffset + 8,
+			Length: 8,
+		},
+		&vhdxMetadataTableEntry{
+			ItemID: vhdxLogicalSectorSize,
+			Offset: itemsOffset + 16,
+			Length: 4,
+		})
+	putVHDXStructure(file, metadataOffset+int(itemsOffset), 0,
+		uint32(mb), uint32(0), uint64(len(data)), uint32(512))
+
+	zeros := make([]byte, mb)
+	for i := 0; i < blockCount; i++ {
+		block := data[i*mb:]
+		if len(block) > mb {
+			block = block[:mb]
+		}
+		entry := uint64(vhdxBlockZero)
+		if !bytes.Equal(block, zeros[:len(block)]) {
+			entry = (uint64(len(file)/mb) << 20) | vhdxBlockFullyPresent
+			file = append(file, block...)
+			file = append(file, zeros[len(block):]...)
+		}
+		binary.LittleEndian.PutUint64(file[batOffset+i*8:], entry)
+	}
+	return file
+}
+
+func TestVHDX(t *testing.T) {
+	data := newTestVirtualDiskContent()
+	// Make the image span three blocks, with the middle one unallocated.
+	data = append(data, make([]byte, 1024*1024)...)
+	data = append(data, testContent(5000)...)
+	file := newTestVHDX(data)
+	img := checkImageFile(t, "disk.vhdx", file, data)
+	vhdx, ok := img.(*VHDXImage)
+	if !ok || (vhdx.LogicalSectorSize() != 512) {
+		t.Logf("Didn't get a VHDXImage with 512-byte sectors\n")
+		t.Fail()
+	}
+	if len(file) >= (4*1024*1024 + len(data)) {
+		t.Logf("The VHDX doesn't contain any unallocated blocks\n")
+		t.Fail()
+	}
+}
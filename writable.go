@@ -0,0 +1,794 @@
+package fat
+
+// This file contains support for modifying FAT32 images: creating,
+// overwriting and deleting files. Like the rest of this package, it is not
+// thread safe, and is intended for building or repairing images rather than
+// for use as a general-purpose filesystem driver.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Wraps a FAT32Filesystem, adding functions to modify it. Changes to the FAT
+// are written to every copy of the FAT after each operation, and the FSInfo
+// structure is updated by Flush or Close.
+type WritableFAT32Filesystem struct {
+	*FAT32Filesystem
+	// The same object as FAT32Filesystem.Content, but writable.
+	writer io.ReadWriteSeeker
+	// Sectors in the FAT that have been modified since they were last written
+	// to disk, relative to the start of the FAT.
+	dirtyFATSectors map[uint32]bool
+	// The number of free clusters, which we keep up to date ourselves rather
+	// than trusting the FSInfo hint.
+	freeClusters uint32
+	// The cluster at which to start looking for free clusters.
+	nextFreeCluster uint32
+	closed          bool
+}
+
+// Loads a FAT32 filesystem from the given content, and allows modifying it.
+// The content must outlive the returned object, and Close must be called
+// after the last modification in order to update the FSInfo structure. Note
+// that the partitions returned by GetPartition implement io.ReadWriteSeeker,
+// so long as the underlying image is writable.
+func NewWritableFAT32Filesystem(content io.ReadWriteSeeker) (
+	*WritableFAT32Filesystem, error) {
+	f, e := NewFAT32Filesystem(content)
+	if e != nil {
+		return nil, e
+	}
+	toReturn := &WritableFAT32Filesystem{
+		FAT32Filesystem: f,
+		writer:          content,
+		dirtyFATSectors: make(map[uint32]bool),
+		nextFreeCluster: 2,
+	}
+	clusterCount := f.ClusterCount()
+	for c := uint32(2); c < clusterCount; c++ {
+		if (f.FAT[c] & 0x0fffffff) == 0 {
+			toReturn.freeClusters++
+		}
+	}
+	hint := f.Info.FirstAvailableClusterHint
+	if (hint >= 2) && (hint < clusterCount) {
+		toReturn.nextFreeCluster = hint
+	}
+	return toReturn, nil
+}
+
+// Returns an error if the filesystem has been closed.
+func (w *WritableFAT32Filesystem) checkClosed() error {
+	if w.closed {
+		return fmt.Errorf("The filesystem has been closed")
+	}
+	return nil
+}
+
+// Writes the given data at the given offset in the underlying content.
+func (w *WritableFAT32Filesystem) writeAt(offset int64, data []byte) error {
+	_, e := w.writer.Seek(offset, io.SeekStart)
+	if e != nil {
+		return fmt.Errorf("Error seeking to offset %d: %w", offset, e)
+	}
+	n, e := w.writer.Write(data)
+	if e != nil {
+		return fmt.Errorf("Error writing %d bytes at offset %d: %w",
+			len(data), offset, e)
+	}
+	if n != len(data) {
+		return fmt.Errorf("Only wrote %d/%d bytes at offset %d", n,
+			len(data), offset)
+	}
+	return nil
+}
+
+// Sets the FAT entry for the given cluster, and updates the free cluster
+// count. The change isn't written to disk until flushFAT is called.
+func (w *WritableFAT32Filesystem) setFAT(cluster, value uint32) {
+	oldValue := w.FAT[cluster] & 0x0fffffff
+	value &= 0x0fffffff
+	if (oldValue == 0) && (value != 0) {
+		w.freeClusters--
+	} else if (oldValue != 0) && (value == 0) {
+		w.freeClusters++
+	}
+	// The top 4 bits of each entry are reserved, and must be preserved.
+	w.FAT[cluster] = (w.FAT[cluster] & 0xf0000000) | value
+	w.dirtyFATSectors[(cluster*4)/SectorSize] = true
+}
+
+// Writes every modified sector of the FAT to each copy of the FAT on disk.
+func (w *WritableFAT32Filesystem) flushFAT() error {
+	entriesPerSector := uint32(SectorSize / 4)
+	var buffer bytes.Buffer
+	for sector := range w.dirtyFATSectors {
+		buffer.Reset()
+		start := sector * entriesPerSector
+		binary.Write(&buffer, binary.LittleEndian,
+			w.FAT[start:start+entriesPerSector])
+		for i := uint32(0); i < uint32(w.Header.BPB.FATCount); i++ {
+			offset := (int64(w.Header.BPB.ReservedSectorCount) +
+				int64(i*w.Header.EBR.SectorsPerFAT) + int64(sector)) *
+				SectorSize
+			e := w.writeAt(offset, buffer.Bytes())
+			if e != nil {
+				return fmt.Errorf("Error writing FAT %d: %w", i, e)
+			}
+		}
+		delete(w.dirtyFATSectors, sector)
+	}
+	return nil
+}
+
+// Writes any pending changes to the FAT, and updates the FSInfo structure so
+// that its free cluster count and next free cluster hint are correct.
+func (w *WritableFAT32Filesystem) Flush() error {
+	e := w.checkClosed()
+	if e != nil {
+		return e
+	}
+	e = w.flushFAT()
+	if e != nil {
+		return e
+	}
+	w.Info.LastKnownFreeCluster = w.freeClusters
+	w.Info.FirstAvailableClusterHint = w.nextFreeCluster
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, w.Info)
+	e = w.writeAt(int64(w.Header.EBR.FSInfoSector)*SectorSize,
+		buffer.Bytes())
+	if e != nil {
+		return fmt.Errorf("Error writing FSInfo: %w", e)
+	}
+	return nil
+}
+
+// Flushes all changes to disk. The filesystem can't be modified after this
+// has been called. This doesn't close the underlying content.
+func (w *WritableFAT32Filesystem) Close() error {
+	e := w.Flush()
+	if e != nil {
+		return e
+	}
+	w.closed = true
+	return nil
+}
+
+// Allocates a chain of the given number of free clusters, starting the search
+// at the next free cluster hint. The clusters will be consecutive if
+// possible. Returns the clusters in the new chain.
+func (w *WritableFAT32Filesystem) allocateChain(count uint32) ([]uint32,
+	error) {
+	if count == 0 {
+		return nil, nil
+	}
+	if count > w.freeClusters {
+		return nil, fmt.Errorf("Not enough free space: need %d clusters, "+
+			"only %d are free", count, w.freeClusters)
+	}
+	clusterCount := w.ClusterCount()
+	toReturn := make([]uint32, 0, count)
+	c := w.nextFreeCluster
+	for uint32(len(toReturn)) < count {
+		if c >= clusterCount {
+			c = 2
+		}
+		if (w.FAT[c] & 0x0fffffff) == 0 {
+			toReturn = append(toReturn, c)
+		}
+		c++
+	}
+	for i, cluster := range toReturn {
+		if i == (len(toReturn) - 1) {
+			w.setFAT(cluster, endOfChainMarker)
+		} else {
+			w.setFAT(cluster, toReturn[i+1])
+		}
+	}
+	w.nextFreeCluster = c
+	if w.nextFreeCluster >= clusterCount {
+		w.nextFreeCluster = 2
+	}
+	return toReturn, nil
+}
+
+// Marks every cluster in the chain starting at the given cluster as free. If
+// the chain is damaged, the clusters prior to the damage are still freed.
+func (w *WritableFAT32Filesystem) freeChain(start uint32) error {
+	if start < 2 {
+		return nil
+	}
+	clusters, e := w.ChainClusters(start)
+	for _, c := range clusters {
+		w.setFAT(c, 0)
+		// Keep the hint pointing at the first free cluster.
+		if c < w.nextFreeCluster {
+			w.nextFreeCluster = c
+		}
+	}
+	if e != nil {
+		return fmt.Errorf("Error freeing chain: %w", e)
+	}
+	return nil
+}
+
+// Writes the given data into the given clusters, padding the last cluster
+// with zeros.
+func (w *WritableFAT32Filesystem) writeClusters(clusters []uint32,
+	data []byte) error {
+	clusterSize := int(w.ClusterSize)
+	if len(data) > (len(clusters) * clusterSize) {
+		return fmt.Errorf("Internal error: %d bytes don't fit in %d "+
+			"clusters", len(data), len(clusters))
+	}
+	buffer := make([]byte, clusterSize)
+	for i, c := range clusters {
+		for j := range buffer {
+			buffer[j] = 0
+		}
+		start := i * clusterSize
+		if start < len(data) {
+			copy(buffer, data[start:])
+		}
+		e := w.writeAt(w.GetDataOffset(c, 0), buffer)
+		if e != nil {
+			return fmt.Errorf("Error writing cluster %d: %w", c, e)
+		}
+	}
+	return nil
+}
+
+// Returns the number of clusters needed to hold the given number of bytes.
+func (w *WritableFAT32Filesystem) clustersNeeded(size uint64) uint32 {
+	clusterSize := uint64(w.ClusterSize)
+	return uint32((size + clusterSize - 1) / clusterSize)
+}
+
+// Holds the content of a directory while we modify it.
+type writableDirectory struct {
+	// The first cluster of the directory.
+	startCluster uint32
+	clusters     []uint32
+	// The raw content of all of the directory's clusters.
+	data    []byte
+	entries []FoundDirectoryEntry
+}
+
+// Returns the number of 32-byte slots in the directory.
+func (d *writableDirectory) slotCount() int {
+	return len(d.data) / DirectoryEntrySize
+}
+
+// Returns the slot in the directory at which the given entry is located.
+func (d *writableDirectory) slotIndex(entry *FoundDirectoryEntry,
+	clusterSize uint32) (int, error) {
+	entriesPerCluster := int(clusterSize / DirectoryEntrySize)
+	for i, c := range d.clusters {
+		if c == entry.Cluster {
+			return (i * entriesPerCluster) + entry.Index, nil
+		}
+	}
+	return 0, fmt.Errorf("Internal error: entry isn't in the directory")
+}
+
+// Loads the directory starting at the given cluster.
+func (w *WritableFAT32Filesystem) loadDirectory(start uint32) (
+	*writableDirectory, error) {
+	clusters, data, e := w.readDirectoryData(start)
+	if e != nil {
+		return nil, e
+	}
+	entries, e := w.parseDirectoryData(clusters, data, false)
+	if e != nil {
+		return nil, fmt.Errorf("Error parsing directory: %w", e)
+	}
+	return &writableDirectory{
+		startCluster: start,
+		clusters:     clusters,
+		data:         data,
+		entries:      entries,
+	}, nil
+}
+
+// Loads the directory at the given path, which is relative to the root
+// directory.
+func (w *WritableFAT32Filesystem) openDirectory(path string) (
+	*writableDirectory, error) {
+	entry, e := w.Lookup(path)
+	if e != nil {
+		return nil, e
+	}
+	if entry == nil {
+		return w.loadDirectory(w.Header.EBR.RootDirClusterNumber)
+	}
+	if !entry.Entry.IsDirectory() {
+		return nil, fmt.Errorf("%s is not a directory", path)
+	}
+	return w.loadDirectory(entry.Entry.StartCluster())
+}
+
+// Writes the given slots of the directory from d.data to disk.
+func (w *WritableFAT32Filesystem) writeSlots(d *writableDirectory, first,
+	count int) error {
+	entriesPerCluster := int(w.ClusterSize / DirectoryEntrySize)
+	for i := first; i < (first + count); i++ {
+		cluster := d.clusters[i/entriesPerCluster]
+		offset := w.GetDataOffset(cluster,
+			uint32((i%entriesPerCluster)*DirectoryEntrySize))
+		start := i * DirectoryEntrySize
+		e := w.writeAt(offset, d.data[start:start+DirectoryEntrySize])
+		if e != nil {
+			return fmt.Errorf("Error writing directory entry: %w", e)
+		}
+	}
+	return nil
+}
+
+// Adds a new zeroed cluster to the end of the directory.
+func (w *WritableFAT32Filesystem) extendDirectory(
+	d *writableDirectory) error {
+	newClusters, e := w.allocateChain(1)
+	if e != nil {
+		return fmt.Errorf("Error allocating directory cluster: %w", e)
+	}
+	newCluster := newClusters[0]
+	// Zero the cluster before linking it, so a failed write doesn't leave
+	// garbage entries in the directory.
+	e = w.writeClusters(newClusters, nil)
+	if e != nil {
+		w.freeChain(newCluster)
+		return e
+	}
+	w.setFAT(d.clusters[len(d.clusters)-1], newCluster)
+	d.clusters = append(d.clusters, newCluster)
+	d.data = append(d.data, make([]byte, w.ClusterSize)...)
+	return nil
+}
+
+// Finds a run of the given number of unused slots in the directory,
+// extending the directory if necessary. Returns the index of the first slot.
+func (w *WritableFAT32Filesystem) findFreeSlots(d *writableDirectory,
+	count int) (int, error) {
+	runStart := 0
+	runLength := 0
+	afterEnd := false
+	for {
+		for i := runStart + runLength; i < d.slotCount(); i++ {
+			firstByte := d.data[i*DirectoryEntrySize]
+			if firstByte == 0 {
+				// Every slot after the end marker is unused.
+				afterEnd = true
+			}
+			if afterEnd || (firstByte == DeletedEntryMarker) {
+				runLength++
+				if runLength == count {
+					return runStart, nil
+				}
+				continue
+			}
+			runStart = i + 1
+			runLength = 0
+		}
+		e := w.extendDirectory(d)
+		if e != nil {
+			return 0, e
+		}
+		afterEnd = true
+	}
+}
+
+// Returns the on-disk representation of the given directory entries.
+func entryBytes(entries []DirectoryEntry) []byte {
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, entries)
+	return buffer.Bytes()
+}
+
+// Returns the index of the first slot holding an end-of-directory marker, or
+// the number of slots if there isn't one.
+func (d *writableDirectory) endMarkerSlot() int {
+	for i := 0; i < d.slotCount(); i++ {
+		if d.data[i*DirectoryEntrySize] == 0 {
+			return i
+		}
+	}
+	return d.slotCount()
+}
+
+// Stores the given entries in consecutive slots of the directory, starting at
+// the given slot, and writes them to disk. Makes sure that the directory is
+// still terminated correctly afterwards.
+func (w *WritableFAT32Filesystem) storeEntries(d *writableDirectory,
+	first int, entries []DirectoryEntry) error {
+	endMarker := d.endMarkerSlot()
+	copy(d.data[first*DirectoryEntrySize:], entryBytes(entries))
+	count := len(entries)
+	// If we wrote over the end-of-directory marker, the slot following the
+	// new entries may contain garbage, so it needs to become the new marker.
+	end := first + count
+	if (endMarker < end) && (end < d.slotCount()) &&
+		(d.data[end*DirectoryEntrySize] != 0) {
+		start := end * DirectoryEntrySize
+		for i := start; i < (start + DirectoryEntrySize); i++ {
+			d.data[i] = 0
+		}
+		count++
+	}
+	return w.writeSlots(d, first, count)
+}
+
+// Returns the date and time fields used in directory entries for the given
+// time.
+func fatTimestamp(t time.Time) (uint16, uint16) {
+	year := t.Year() - 1980
+	if year < 0 {
+		year = 0
+	}
+	date := uint16((year << 9) | (int(t.Month()) << 5) | t.Day())
+	timeOfDay := uint16((t.Hour() << 11) | (t.Minute() << 5) |
+		(t.Second() / 2))
+	return date, timeOfDay
+}
+
+// Returns true if the name contains characters that can't be used in a long
+// file name.
+func isValidLongName(name string) bool {
+	if (name == "") || (name == ".") || (name == "..") {
+		return false
+	}
+	if len(utf16.Encode([]rune(name))) > 255 {
+		return false
+	}
+	for _, c := range name {
+		if (c < 0x20) || strings.ContainsRune("\"*/:<>?\\|", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Converts a name into the upper-case base name and extension used to build a
+// short name. Returns true if the conversion lost information, in which case
+// a numeric tail (e.g. "~1") must be added to the base name.
+func shortNameBasis(name string) (string, string, bool) {
+	lossy := false
+	upper := strings.ToUpper(name)
+	// Leading periods and all spaces are removed.
+	stripped := strings.TrimLeft(strings.ReplaceAll(upper, " ", ""), ".")
+	if stripped != upper {
+		lossy = true
+	}
+	base := stripped
+	extension := ""
+	lastDot := strings.LastIndexByte(stripped, '.')
+	if lastDot >= 0 {
+		base = stripped[:lastDot]
+		extension = stripped[lastDot+1:]
+	}
+	convert := func(s string, limit int) string {
+		var toReturn []byte
+		for _, c := range s {
+			if len(toReturn) >= limit {
+				lossy = true
+				break
+			}
+			if (c == '.') || (c > 0x7e) || !isValidShortNameChar(byte(c)) {
+				// The remaining periods in the base name are dropped, and
+				// other invalid characters are replaced with underscores.
+				lossy = true
+				if c != '.' {
+					toReturn = append(toReturn, '_')
+				}
+				continue
+			}
+			toReturn = append(toReturn, byte(c))
+		}
+		return string(toReturn)
+	}
+	return convert(base, 8), convert(extension, 3), lossy
+}
+
+// Returns the 8.3 name and extension fields for a short name made from the
+// given base and extension, with the given numeric tail (e.g. "~1") appended
+// to the base. The tail may be empty.
+func formatShortName(base, extension, tail string) ([8]byte, [3]byte) {
+	var name [8]byte
+	var ext [3]byte
+	copy(name[:], "        ")
+	copy(ext[:], "   ")
+	if (len(base) + len(tail)) > 8 {
+		base = base[:8-len(tail)]
+	}
+	copy(name[:], base+tail)
+	copy(ext[:], extension)
+	// A leading 0xe5 would mark the entry as deleted.
+	if name[0] == DeletedEntryMarker {
+		name[0] = 0x05
+	}
+	return name, ext
+}
+
+// Returns true if the directory already contains an entry with the given
+// short name.
+func (d *writableDirectory) hasShortName(name [8]byte, ext [3]byte) bool {
+	for i := range d.entries {
+		entry := &(d.entries[i].Entry)
+		if entry.IsDeleted() {
+			continue
+		}
+		if (entry.Name == name) && (entry.Extension == ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Chooses the short name for a new entry with the given name in the
+// directory. Returns true if long name entries are needed in addition to the
+// short name. If the name can't be stored exactly as a short name, or the
+// short name is already in use, this generates a unique name with a numeric
+// tail, e.g. "LONGNA~1.TXT", shortening the base name as the tail grows.
+func (d *writableDirectory) chooseShortName(name string) ([8]byte, [3]byte,
+	bool, error) {
+	base, extension, lossy := shortNameBasis(name)
+	if base == "" {
+		base = "_"
+		lossy = true
+	}
+	if !lossy {
+		shortName, shortExt := formatShortName(base, extension, "")
+		if !d.hasShortName(shortName, shortExt) {
+			// We only need a long name if the name's case doesn't match.
+			fullName := base
+			if extension != "" {
+				fullName += "." + extension
+			}
+			return shortName, shortExt, fullName != name, nil
+		}
+	}
+	// The largest number of entries a directory can hold is 65536, so we're
+	// guaranteed to find an unused tail well before running out of digits.
+	for i := 1; i <= 999999; i++ {
+		shortName, shortExt := formatShortName(base, extension,
+			fmt.Sprintf("~%d", i))
+		if !d.hasShortName(shortName, shortExt) {
+			return shortName, shortExt, true, nil
+		}
+	}
+	return [8]byte{}, [3]byte{}, true, fmt.Errorf("Couldn't find an unused "+
+		"short name for %s", name)
+}
+
+// Returns the long name entries needed to store the given name, in on-disk
+// order, for an entry with the given short name checksum. The entries are
+// returned as DirectoryEntry structs so that they can be written alongside
+// the short-name entry.
+func longNameEntries(name string, checksum byte) []DirectoryEntry {
+	characters := utf16.Encode([]rune(name))
+	entryCount := (len(characters) + 12) / 13
+	// The name is terminated by a NULL character (unless it exactly fills the
+	// last entry) and padded with 0xffff.
+	padded := make([]uint16, entryCount*13)
+	for i := range padded {
+		padded[i] = 0xffff
+	}
+	copy(padded, characters)
+	if len(characters) < len(padded) {
+		padded[len(characters)] = 0
+	}
+	toReturn := make([]DirectoryEntry, entryCount)
+	var buffer bytes.Buffer
+	for i := 0; i < entryCount; i++ {
+		chunk := padded[i*13 : (i+1)*13]
+		l := LongNameEntry{
+			Sequence:   byte(i + 1),
+			Attributes: AttributeLongName,
+			Checksum:   checksum,
+		}
+		if i == (entryCount - 1) {
+			l.Sequence |= 0x40
+		}
+		copy(l.Name1[:], chunk[0:5])
+		copy(l.Name2[:], chunk[5:11])
+		copy(l.Name3[:], chunk[11:13])
+		buffer.Reset()
+		binary.Write(&buffer, binary.LittleEndian, &l)
+		// The last part of the name is stored first.
+		binary.Read(&buffer, binary.LittleEndian,
+			&(toReturn[entryCount-1-i]))
+	}
+	return toReturn
+}
+
+// Sets the start cluster stored in a directory entry.
+func (d *DirectoryEntry) SetStartCluster(c uint32) {
+	d.ClusterHigh = uint16(c >> 16)
+	d.ClusterLow = uint16(c)
+}
+
+// Adds a new entry with the given name to the directory, along with any long
+// name entries it needs. The entry's name fields are filled in by this
+// function; the other fields must already be set.
+func (w *WritableFAT32Filesystem) addEntry(d *writableDirectory, name string,
+	entry *DirectoryEntry) error {
+	if !isValidLongName(name) {
+		return fmt.Errorf("Invalid file name: \"%s\"", name)
+	}
+	shortName, shortExt, needLongName, e := d.chooseShortName(name)
+	if e != nil {
+		return e
+	}
+	entry.Name = shortName
+	entry.Extension = shortExt
+	var entries []DirectoryEntry
+	if needLongName {
+		entries = longNameEntries(name, entry.ShortNameChecksum())
+	}
+	entries = append(entries, *entry)
+	first, e := w.findFreeSlots(d, len(entries))
+	if e != nil {
+		return fmt.Errorf("Error finding space in directory: %w", e)
+	}
+	e = w.storeEntries(d, first, entries)
+	if e != nil {
+		return e
+	}
+	// Keep the parsed entries in sync, in case the directory is modified
+	// again.
+	d.entries, e = w.parseDirectoryData(d.clusters, d.data, false)
+	return e
+}
+
+// Overwrites an existing short-name entry in the directory with the given
+// content.
+func (w *WritableFAT32Filesystem) updateEntry(d *writableDirectory,
+	existing *FoundDirectoryEntry, entry *DirectoryEntry) error {
+	slot, e := d.slotIndex(existing, w.ClusterSize)
+	if e != nil {
+		return e
+	}
+	e = w.storeEntries(d, slot, []DirectoryEntry{*entry})
+	if e != nil {
+		return e
+	}
+	existing.Entry = *entry
+	return nil
+}
+
+// Marks an entry, and any long name entries belonging to it, as deleted.
+// This doesn't free the entry's clusters.
+func (w *WritableFAT32Filesystem) deleteEntry(d *writableDirectory,
+	entry *FoundDirectoryEntry) error {
+	slot, e := d.slotIndex(entry, w.ClusterSize)
+	if e != nil {
+		return e
+	}
+	first := slot - entry.LongNameEntries
+	for i := first; i <= slot; i++ {
+		d.data[i*DirectoryEntrySize] = DeletedEntryMarker
+	}
+	e = w.writeSlots(d, first, (slot-first)+1)
+	if e != nil {
+		return e
+	}
+	d.entries, e = w.parseDirectoryData(d.clusters, d.data, false)
+	return e
+}
+
+// Splits a path into the path of its parent directory and its final
+// component.
+func splitParent(filePath string) (string, string, error) {
+	components := splitPath(filePath)
+	if len(components) == 0 {
+		return "", "", fmt.Errorf("Invalid path: \"%s\"", filePath)
+	}
+	last := len(components) - 1
+	return path.Join(components[:last]...), components[last], nil
+}
+
+// Creates a file at the given path with the given content, replacing the
+// file's content if it already exists. The directory containing the file
+// must already exist.
+func (w *WritableFAT32Filesystem) WriteFile(filePath string,
+	data []byte) error {
+	e := w.checkClosed()
+	if e != nil {
+		return e
+	}
+	if uint64(len(data)) > 0xffffffff {
+		return fmt.Errorf("%s is too large for FAT32", filePath)
+	}
+	parentPath, name, e := splitParent(filePath)
+	if e != nil {
+		return e
+	}
+	d, e := w.openDirectory(parentPath)
+	if e != nil {
+		return fmt.Errorf("Error opening directory for %s: %w", filePath, e)
+	}
+	existing := findEntry(d.entries, name)
+	if (existing != nil) && existing.Entry.IsDirectory() {
+		return fmt.Errorf("%s is a directory", filePath)
+	}
+
+	// Write the content before updating the directory entry. The new
+	// clusters are freed if anything fails, so they aren't left allocated
+	// when the FAT is next written.
+	clusters, e := w.allocateChain(w.clustersNeeded(uint64(len(data))))
+	if e != nil {
+		return fmt.Errorf("Error allocating space for %s: %w", filePath, e)
+	}
+	freeClusters := func() {
+		if len(clusters) != 0 {
+			w.freeChain(clusters[0])
+		}
+	}
+	e = w.writeClusters(clusters, data)
+	if e != nil {
+		freeClusters()
+		return fmt.Errorf("Error writing content of %s: %w", filePath, e)
+	}
+	var entry DirectoryEntry
+	if existing != nil {
+		entry = existing.Entry
+	} else {
+		entry.Attributes = AttributeArchive
+		entry.CreateDate, entry.CreateTime = fatTimestamp(time.Now())
+	}
+	entry.ModifyDate, entry.ModifyTime = fatTimestamp(time.Now())
+	entry.AccessDate = entry.ModifyDate
+	entry.FileSize = uint32(len(data))
+	oldStart := entry.StartCluster()
+	entry.SetStartCluster(0)
+	if len(clusters) != 0 {
+		entry.SetStartCluster(clusters[0])
+	}
+	if existing != nil {
+		e = w.updateEntry(d, existing, &entry)
+	} else {
+		e = w.addEntry(d, name, &entry)
+	}
+	if e != nil {
+		freeClusters()
+		return fmt.Errorf("Error writing directory entry for %s: %w",
+			filePath, e)
+	}
+	// Only free the old content once the entry no longer refers to it.
+	if existing != nil {
+		e = w.freeChain(oldStart)
+		if e != nil {
+			// The entry already refers to the new content, so the FAT must
+			// still be written.
+			w.flushFAT()
+			return fmt.Errorf("Error freeing old content of %s: %w",
+				filePath, e)
+		}
+	}
+	return w.flushFAT()
+}
+
+// Deletes the file or empty directory at the given path, freeing its
+// clusters.
+func (w *WritableFAT32Filesystem) Remove(filePath string) error {
+	return w.remove(filePath, false)
+}
+
+// Deletes the file or directory at the given path, along with everything the
+// directory contains. Returns nil if the path doesn't exist.
+func (w *WritableFAT32Filesystem) RemoveAll(filePath string) error {
+	e := w.remove(filePath, true)
+	if errors.Is(e, fs.ErrNotExist) {
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,475 @@
+package fat
+
+// This file contains the functions for modifying directories in a writable
+// FAT32 filesystem: creating, removing, renaming and moving them.
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+)
+
+// Returns a directory entry for a subdirectory with the given short name,
+// starting at the given cluster. Used for "." and "..", and for new
+// directories (in which case the name is set later).
+func dotEntry(name string, cluster uint32, date,
+	timeOfDay uint16) DirectoryEntry {
+	toReturn := DirectoryEntry{
+		Attributes: AttributeDirectory,
+		CreateDate: date,
+		CreateTime: timeOfDay,
+		AccessDate: date,
+		ModifyDate: date,
+		ModifyTime: timeOfDay,
+	}
+	copy(toReturn.Name[:], "        ")
+	copy(toReturn.Extension[:], "   ")
+	copy(toReturn.Name[:], name)
+	toReturn.SetStartCluster(cluster)
+	return toReturn
+}
+
+// Returns the cluster number that a ".." entry should store to refer to the
+// given directory. This is 0 for the root directory.
+func (w *WritableFAT32Filesystem) parentReference(
+	d *writableDirectory) uint32 {
+	if d.startCluster == w.Header.EBR.RootDirClusterNumber {
+		return 0
+	}
+	return d.startCluster
+}
+
+// Creates a new directory at the given path. The parent directory must
+// already exist.
+func (w *WritableFAT32Filesystem) Mkdir(dirPath string) error {
+	e := w.checkClosed()
+	if e != nil {
+		return e
+	}
+	parentPath, name, e := splitParent(dirPath)
+	if e != nil {
+		return e
+	}
+	parent, e := w.openDirectory(parentPath)
+	if e != nil {
+		return fmt.Errorf("Error opening parent directory of %s: %w", dirPath,
+			e)
+	}
+	if findEntry(parent.entries, name) != nil {
+		return fmt.Errorf("%s: %w", dirPath, fs.ErrExist)
+	}
+	if !isValidLongName(name) {
+		return fmt.Errorf("Invalid directory name: \"%s\"", name)
+	}
+	clusters, e := w.allocateChain(1)
+	if e != nil {
+		return fmt.Errorf("Error allocating cluster for %s: %w", dirPath, e)
+	}
+	date, timeOfDay := fatTimestamp(time.Now())
+	contents := []DirectoryEntry{
+		dotEntry(".", clusters[0], date, timeOfDay),
+		dotEntry("..", w.parentReference(parent), date, timeOfDay),
+	}
+	data := make([]byte, w.ClusterSize)
+	copy(data, entryBytes(contents))
+	// Free the new cluster if anything fails, so it isn't left allocated
+	// when the FAT is next written.
+	e = w.writeClusters(clusters, data)
+	if e != nil {
+		w.freeChain(clusters[0])
+		return fmt.Errorf("Error writing content of %s: %w", dirPath, e)
+	}
+	entry := dotEntry("", clusters[0], date, timeOfDay)
+	e = w.addEntry(parent, name, &entry)
+	if e != nil {
+		w.freeChain(clusters[0])
+		return fmt.Errorf("Error adding entry for %s: %w", dirPath, e)
+	}
+	return w.flushFAT()
+}
+
+// Creates the directory at the given path, along with any of its parents that
+// don't already exist. Does nothing if the directory already exists.
+func (w *WritableFAT32Filesystem) MkdirAll(dirPath string) error {
+	e := w.checkClosed()
+	if e != nil {
+		return e
+	}
+	components := splitPath(dirPath)
+	current := ""
+	for _, name := range components {
+		if current != "" {
+			current += "/"
+		}
+		current += name
+		entry, e := w.Lookup(current)
+		if e == nil {
+			if !entry.Entry.IsDirectory() {
+				return fmt.Errorf("%s exists and is not a directory", current)
+			}
+			continue
+		}
+		if !errors.Is(e, fs.ErrNotExist) {
+			return fmt.Errorf("Error looking up %s: %w", current, e)
+		}
+		e = w.Mkdir(current)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Returns the cluster of the parent of the directory starting at the given
+// cluster, according to its ".." entry.
+func (w *WritableFAT32Filesystem) parentCluster(cluster uint32) (uint32,
+	error) {
+	entries, e := w.ReadDirectory(cluster)
+	if e != nil {
+		return 0, e
+	}
+	for i := range entries {
+		d := &(entries[i].Entry)
+		if d.IsDotEntry() && (d.Name[1] == '.') {
+			if d.StartCluster() == 0 {
+				return w.Header.EBR.RootDirClusterNumber, nil
+			}
+			return d.StartCluster(), nil
+		}
+	}
+	return 0, fmt.Errorf("Directory at cluster %d has no \"..\" entry",
+		cluster)
+}
+
+// Returns true if the directory starting at the cluster "inner" is the same
+// as, or is contained in, the directory starting at cluster "outer".
+func (w *WritableFAT32Filesystem) isWithinDirectory(inner,
+	outer uint32) (bool, error) {
+	root := w.Header.EBR.RootDirClusterNumber
+	visited := make(map[uint32]bool)
+	current := inner
+	for {
+		if current == outer {
+			return true, nil
+		}
+		if (current == root) || visited[current] {
+			return false, nil
+		}
+		visited[current] = true
+		parent, e := w.parentCluster(current)
+		if e != nil {
+			return false, e
+		}
+		current = parent
+	}
+}
+
+// Changes the ".." entry of the directory starting at the given cluster so
+// that it refers to the given parent directory.
+func (w *WritableFAT32Filesystem) setParent(cluster uint32,
+	parent *writableDirectory) error {
+	d, e := w.loadDirectory(cluster)
+	if e != nil {
+		return e
+	}
+	for i := range d.entries {
+		entry := &(d.entries[i])
+		if !entry.Entry.IsDotEntry() || (entry.Entry.Name[1] != '.') {
+			continue
+		}
+		updated := entry.Entry
+		updated.SetStartCluster(w.parentReference(parent))
+		return w.updateEntry(d, entry, &updated)
+	}
+	return fmt.Errorf("Directory at cluster %d has no \"..\" entry", cluster)
+}
+
+// The slots holding an entry and its long name entries, saved before the
+// entry is deleted so that it can be restored.
+type savedEntry struct {
+	// The index of the first slot.
+	first int
+	data  []byte
+}
+
+// Saves the slots holding the given entry, so that restoreEntry can undo
+// deleting it.
+func (w *WritableFAT32Filesystem) saveEntry(d *writableDirectory,
+	entry *FoundDirectoryEntry) (*savedEntry, error) {
+	slot, e := d.slotIndex(entry, w.ClusterSize)
+	if e != nil {
+		return nil, e
+	}
+	first := slot - entry.LongNameEntries
+	return &savedEntry{
+		first: first,
+		data: append([]byte{}, d.data[first*DirectoryEntrySize:(slot+1)*
+			DirectoryEntrySize]...),
+	}, nil
+}
+
+// Writes the slots saved by saveEntry back to the directory. Returns
+// addError, annotated with any error that occurs while restoring the entry.
+func (w *WritableFAT32Filesystem) restoreEntry(d *writableDirectory,
+	saved *savedEntry, addError error) error {
+	copy(d.data[saved.first*DirectoryEntrySize:], saved.data)
+	e := w.writeSlots(d, saved.first, len(saved.data)/DirectoryEntrySize)
+	if e == nil {
+		d.entries, e = w.parseDirectoryData(d.clusters, d.data, false)
+	}
+	if e != nil {
+		return fmt.Errorf("Error adding new entry (%s), and error restoring "+
+			"the old entry: %w", addError, e)
+	}
+	return fmt.Errorf("Error adding new entry: %w", addError)
+}
+
+// Replaces the given entry in the directory with an entry with the same
+// content and a new name. The old entry is removed first, so that its short
+// name can be reused, but it's restored if the new entry can't be added, so
+// that a failure doesn't lose the file.
+func (w *WritableFAT32Filesystem) replaceEntry(d *writableDirectory,
+	old *FoundDirectoryEntry, name string) error {
+	saved, e := w.saveEntry(d, old)
+	if e != nil {
+		return e
+	}
+	updated := old.Entry
+	e = w.deleteEntry(d, old)
+	if e != nil {
+		return fmt.Errorf("Error removing old entry: %w", e)
+	}
+	e = w.addEntry(d, name, &updated)
+	if e != nil {
+		return w.restoreEntry(d, saved, e)
+	}
+	return nil
+}
+
+// Renames or moves the file or directory at oldPath to newPath. The directory
+// that will contain newPath must already exist. If newPath is an existing
+// file, it is replaced, but existing directories are never replaced.
+func (w *WritableFAT32Filesystem) Rename(oldPath, newPath string) error {
+	e := w.checkClosed()
+	if e != nil {
+		return e
+	}
+	oldParentPath, oldName, e := splitParent(oldPath)
+	if e != nil {
+		return e
+	}
+	newParentPath, newName, e := splitParent(newPath)
+	if e != nil {
+		return e
+	}
+	if !isValidLongName(newName) {
+		return fmt.Errorf("Invalid file name: \"%s\"", newName)
+	}
+	oldParent, e := w.openDirectory(oldParentPath)
+	if e != nil {
+		return fmt.Errorf("Error opening directory containing %s: %w",
+			oldPath, e)
+	}
+	oldEntry := findEntry(oldParent.entries, oldName)
+	if oldEntry == nil {
+		return fmt.Errorf("%s: %w", oldPath, fs.ErrNotExist)
+	}
+	newParent := oldParent
+	if newParentPath != oldParentPath {
+		newParent, e = w.openDirectory(newParentPath)
+		if e != nil {
+			return fmt.Errorf("Error opening directory to contain %s: %w",
+				newPath, e)
+		}
+	}
+	sameDirectory := newParent.startCluster == oldParent.startCluster
+	if sameDirectory {
+		// The two paths may refer to the same directory in different ways.
+		newParent = oldParent
+	}
+	isDirectory := oldEntry.Entry.IsDirectory()
+	if isDirectory && !sameDirectory {
+		within, e := w.isWithinDirectory(newParent.startCluster,
+			oldEntry.Entry.StartCluster())
+		if e != nil {
+			return fmt.Errorf("Error checking destination of %s: %w",
+				oldPath, e)
+		}
+		if within {
+			return fmt.Errorf("Can't move %s into itself", oldPath)
+		}
+	}
+
+	// Deal with an existing entry at the destination. If it's the entry
+	// we're renaming (e.g. only the case is changing), replace the old entry
+	// in place so that its short name can be reused.
+	existing := findEntry(newParent.entries, newName)
+	oldCopy := *oldEntry
+	var replaced *savedEntry
+	existingStart := uint32(0)
+	if existing != nil {
+		if sameDirectory && (existing.Cluster == oldEntry.Cluster) &&
+			(existing.Index == oldEntry.Index) {
+			e = w.replaceEntry(oldParent, &oldCopy, newName)
+			if e != nil {
+				return fmt.Errorf("Error renaming %s to %s: %w", oldPath,
+					newPath, e)
+			}
+			return w.flushFAT()
+		}
+		if existing.Entry.IsDirectory() || isDirectory {
+			return fmt.Errorf("%s: %w", newPath, fs.ErrExist)
+		}
+		// The existing entry is removed to make room for the new one, but
+		// its clusters aren't freed until the new entry has been added, so
+		// it can be restored if adding the new entry fails.
+		existingStart = existing.Entry.StartCluster()
+		replaced, e = w.saveEntry(newParent, existing)
+		if e != nil {
+			return fmt.Errorf("Error reading existing %s: %w", newPath, e)
+		}
+		e = w.deleteEntry(newParent, existing)
+		if e != nil {
+			return fmt.Errorf("Error removing existing %s: %w", newPath, e)
+		}
+		// Deleting an entry re-parses the directory, so find the old entry
+		// again.
+		if sameDirectory {
+			oldEntry = findEntry(oldParent.entries, oldName)
+			oldCopy = *oldEntry
+		}
+	}
+
+	// Add the new entry before removing the old one, so that a failure
+	// doesn't lose the file.
+	updated := oldCopy.Entry
+	e = w.addEntry(newParent, newName, &updated)
+	if e != nil {
+		if replaced != nil {
+			return fmt.Errorf("Error renaming %s to %s: %w", oldPath,
+				newPath, w.restoreEntry(newParent, replaced, e))
+		}
+		return fmt.Errorf("Error adding entry for %s: %w", newPath, e)
+	}
+	if replaced != nil {
+		e = w.freeChain(existingStart)
+		if e != nil {
+			return fmt.Errorf("Error freeing replaced %s: %w", newPath, e)
+		}
+	}
+	e = w.deleteEntry(oldParent, &oldCopy)
+	if e != nil {
+		return fmt.Errorf("Error removing old entry for %s: %w", oldPath, e)
+	}
+	if isDirectory && !sameDirectory {
+		e = w.setParent(oldCopy.Entry.StartCluster(), newParent)
+		if e != nil {
+			return fmt.Errorf("Error updating parent of %s: %w", newPath, e)
+		}
+	}
+	return w.flushFAT()
+}
+
+// Frees the clusters of every file and directory within the directory
+// starting at the given cluster, but not those of the directory itself.
+func (w *WritableFAT32Filesystem) freeDirectoryContents(cluster uint32,
+	visited map[uint32]bool) error {
+	if visited[cluster] {
+		return nil
+	}
+	visited[cluster] = true
+	entries, e := w.ReadDirectory(cluster)
+	if e != nil {
+		return e
+	}
+	for i := range entries {
+		d := &(entries[i].Entry)
+		if d.IsDeleted() || d.IsVolumeLabel() || d.IsDotEntry() {
+			continue
+		}
+		start := d.StartCluster()
+		if d.IsDirectory() && (start >= 2) {
+			e = w.freeDirectoryContents(start, visited)
+			if e != nil {
+				return e
+			}
+		}
+		e = w.freeChain(start)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Returns true if the directory starting at the given cluster contains
+// anything other than "." and "..".
+func (w *WritableFAT32Filesystem) directoryHasContents(cluster uint32) (bool,
+	error) {
+	entries, e := w.ReadDirectory(cluster)
+	if e != nil {
+		return false, e
+	}
+	for i := range entries {
+		d := &(entries[i].Entry)
+		if d.IsDeleted() || d.IsDotEntry() {
+			continue
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Implements Remove and RemoveAll. If recursive is false, this refuses to
+// remove directories that aren't empty.
+func (w *WritableFAT32Filesystem) remove(filePath string,
+	recursive bool) error {
+	e := w.checkClosed()
+	if e != nil {
+		return e
+	}
+	parentPath, name, e := splitParent(filePath)
+	if e != nil {
+		return fmt.Errorf("Can't remove the root directory")
+	}
+	d, e := w.openDirectory(parentPath)
+	if e != nil {
+		return fmt.Errorf("Error opening directory for %s: %w", filePath, e)
+	}
+	entry := findEntry(d.entries, name)
+	if entry == nil {
+		return fmt.Errorf("%s: %w", filePath, fs.ErrNotExist)
+	}
+	start := entry.Entry.StartCluster()
+	isDirectory := entry.Entry.IsDirectory() && (start >= 2)
+	if isDirectory && !recursive {
+		hasContents, e := w.directoryHasContents(start)
+		if e != nil {
+			return fmt.Errorf("Error reading %s: %w", filePath, e)
+		}
+		if hasContents {
+			return fmt.Errorf("Directory %s is not empty", filePath)
+		}
+	}
+	// Delete the entry before freeing anything, so that a failure can't
+	// leave an entry referring to free clusters. At worst, a failure after
+	// this leaves some clusters allocated but unused.
+	e = w.deleteEntry(d, entry)
+	if e != nil {
+		return fmt.Errorf("Error deleting directory entry for %s: %w",
+			filePath, e)
+	}
+	if isDirectory && recursive {
+		e = w.freeDirectoryContents(start, make(map[uint32]bool))
+		if e != nil {
+			return fmt.Errorf("Error freeing contents of %s: %w", filePath,
+				e)
+		}
+	}
+	e = w.freeChain(start)
+	if e != nil {
+		return fmt.Errorf("Error freeing clusters of %s: %w", filePath, e)
+	}
+	return w.flushFAT()
+}
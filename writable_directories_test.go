@@ -0,0 +1,287 @@
+package fat
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestDirectoryOperations(t *testing.T) {
+	m := newTestImage()
+	file := m.openFile(t)
+	w, e := NewWritableFAT32Filesystem(file)
+	if e != nil {
+		t.Logf("Failed opening writable filesystem: %s\n", e)
+		t.FailNow()
+	}
+	initialFree := w.freeClusters
+	e = w.MkdirAll("photos/2024/january")
+	if e != nil {
+		t.Logf("Failed creating directories: %s\n", e)
+		t.FailNow()
+	}
+	e = w.MkdirAll("photos/2024")
+	if e != nil {
+		t.Logf("MkdirAll failed for existing directory: %s\n", e)
+		t.FailNow()
+	}
+	e = w.Mkdir("photos")
+	if e == nil {
+		t.Logf("Didn't get an error creating an existing directory\n")
+		t.FailNow()
+	}
+	// Create enough similar names to need multi-digit numeric tails.
+	for i := 0; i < 12; i++ {
+		name := fmt.Sprintf("photos/2024/january/picture number %d.jpeg", i)
+		e = w.WriteFile(name, testContent(100+i))
+		if e != nil {
+			t.Logf("Failed writing %s: %s\n", name, e)
+			t.FailNow()
+		}
+	}
+	entry, e := w.Lookup("photos/2024/january/picture number 11.jpeg")
+	if e != nil {
+		t.Logf("Failed looking up file: %s\n", e)
+		t.FailNow()
+	}
+	if entry.Entry.ShortName() != "PICTU~12.JPE" {
+		t.Logf("Got unexpected short name %s\n", entry.Entry.ShortName())
+		t.FailNow()
+	}
+
+	// Move a directory and make sure its ".." entry is updated.
+	e = w.Rename("photos/2024/january", "January photos")
+	if e != nil {
+		t.Logf("Failed moving directory: %s\n", e)
+		t.FailNow()
+	}
+	content, e := w.ReadFile("january PHOTOS/picture number 3.jpeg")
+	if e != nil {
+		t.Logf("Failed reading file in moved directory: %s\n", e)
+		t.FailNow()
+	}
+	if !bytes.Equal(content, testContent(103)) {
+		t.Logf("Read incorrect content from moved file\n")
+		t.FailNow()
+	}
+	moved, e := w.Lookup("January photos")
+	if e != nil {
+		t.Logf("Failed looking up moved directory: %s\n", e)
+		t.FailNow()
+	}
+	parent, e := w.parentCluster(moved.Entry.StartCluster())
+	if e != nil {
+		t.Logf("Failed reading moved directory's parent: %s\n", e)
+		t.FailNow()
+	}
+	if parent != testRootCluster {
+		t.Logf("Moved directory's \"..\" entry wasn't updated\n")
+		t.FailNow()
+	}
+	e = w.Rename("photos", "January photos/photos")
+	if e != nil {
+		t.Logf("Failed moving directory: %s\n", e)
+		t.FailNow()
+	}
+	e = w.Rename("January photos", "January photos/photos/2024/loop")
+	if e == nil {
+		t.Logf("Didn't get an error moving a directory into itself\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error moving directory into itself: %s\n", e)
+	e = w.Rename("January photos/picture number 1.jpeg", "renamed.txt")
+	if e != nil {
+		t.Logf("Failed moving file: %s\n", e)
+		t.FailNow()
+	}
+	_, e = w.Lookup("January photos/picture number 1.jpeg")
+	if e == nil {
+		t.Logf("Moved file still exists at its old path\n")
+		t.FailNow()
+	}
+	// Renaming onto an existing file replaces it, and frees its clusters.
+	e = w.WriteFile("replacement.txt", testContent(3000))
+	if e != nil {
+		t.Logf("Failed writing replacement file: %s\n", e)
+		t.FailNow()
+	}
+	e = w.Rename("replacement.txt", "renamed.txt")
+	if e != nil {
+		t.Logf("Failed replacing a file: %s\n", e)
+		t.FailNow()
+	}
+	content, e = w.ReadFile("renamed.txt")
+	if (e != nil) || !bytes.Equal(content, testContent(3000)) {
+		t.Logf("Didn't read the replacement content: %v\n", e)
+		t.FailNow()
+	}
+
+	e = w.Remove("January photos")
+	if e == nil {
+		t.Logf("Didn't get an error removing a non-empty directory\n")
+		t.FailNow()
+	}
+	e = w.RemoveAll("January photos")
+	if e != nil {
+		t.Logf("Failed removing directory tree: %s\n", e)
+		t.FailNow()
+	}
+	e = w.Remove("renamed.txt")
+	if e != nil {
+		t.Logf("Failed removing file: %s\n", e)
+		t.FailNow()
+	}
+	e = w.RemoveAll("doesn't exist")
+	if e != nil {
+		t.Logf("RemoveAll failed for a missing path: %s\n", e)
+		t.FailNow()
+	}
+	// Every cluster we allocated should have been freed.
+	if w.freeClusters != initialFree {
+		t.Logf("Expected %d free clusters after removing everything, got "+
+			"%d\n", initialFree, w.freeClusters)
+		t.FailNow()
+	}
+	e = w.Close()
+	if e != nil {
+		t.Logf("Failed closing filesystem: %s\n", e)
+		t.FailNow()
+	}
+}
+
+// Returns a test image with a full root directory, and every cluster in use
+// except the given number at the end of the volume.
+func newFullTestImage(freeClusters uint32) *testImage {
+	m := newTestImage()
+	for i := 0; i < (SectorSize / DirectoryEntrySize); i++ {
+		m.addFile(testRootCluster, i, fmt.Sprintf("FILE%d", i), 0, nil)
+	}
+	clusterCount := uint32(testSectorCount-testReservedSectors-
+		(2*testSectorsPerFAT)) + 2
+	firstFree := clusterCount - freeClusters
+	for c := uint32(testRootCluster + 1); c < firstFree; c++ {
+		m.setFAT(c, 0x0fffffff)
+	}
+	return m
+}
+
+func TestDirectoryFailures(t *testing.T) {
+	// There's room for the new directory, but not for its entry in the root
+	// directory, so its cluster must be freed again.
+	m := newFullTestImage(1)
+	w, e := NewWritableFAT32Filesystem(m.openFile(t))
+	if e != nil {
+		t.Logf("Failed opening writable filesystem: %s\n", e)
+		t.FailNow()
+	}
+	e = w.Mkdir("new directory")
+	if e == nil {
+		t.Logf("Didn't get an error creating a directory in a full root\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error creating a directory: %s\n", e)
+	if w.freeClusters != 1 {
+		t.Logf("A failed Mkdir left %d free clusters rather than 1\n",
+			w.freeClusters)
+		t.Fail()
+	}
+
+	// Changing the case of a name needs a long name entry, for which there
+	// is no space. The file must still exist afterwards.
+	m = newFullTestImage(0)
+	w, e = NewWritableFAT32Filesystem(m.openFile(t))
+	if e != nil {
+		t.Logf("Failed opening writable filesystem: %s\n", e)
+		t.FailNow()
+	}
+	e = w.Rename("FILE3", "file3")
+	if e == nil {
+		t.Logf("Didn't get an error renaming a file in a full directory\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error renaming a file: %s\n", e)
+	_, e = w.Lookup("FILE3")
+	if e != nil {
+		t.Logf("Failed looking up file after a failed rename: %s\n", e)
+		t.Fail()
+	}
+
+	// Replacing an existing file with a name that needs a long name entry
+	// needs more slots than the existing file frees. The existing file must
+	// still be there afterwards.
+	m = newFullTestImage(0)
+	w, e = NewWritableFAT32Filesystem(m.openFile(t))
+	if e != nil {
+		t.Logf("Failed opening writable filesystem: %s\n", e)
+		t.FailNow()
+	}
+	e = w.Rename("FILE3", "file5")
+	if e == nil {
+		t.Logf("Didn't get an error replacing a file in a full directory\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error replacing a file: %s\n", e)
+	for _, name := range []string{"FILE3", "FILE5"} {
+		_, e = w.Lookup(name)
+		if e != nil {
+			t.Logf("Failed looking up %s after a failed rename: %s\n", name,
+				e)
+			t.Fail()
+		}
+	}
+
+	// MkdirAll shouldn't treat errors other than a missing path as meaning
+	// it needs to create the directory.
+	e = w.MkdirAll("FILE3/sub")
+	if e == nil {
+		t.Logf("Didn't get an error creating a directory within a file\n")
+		t.Fail()
+	}
+	w.Close()
+	e = w.MkdirAll("closed")
+	if e == nil {
+		t.Logf("Didn't get an error from MkdirAll after closing\n")
+		t.Fail()
+	}
+}
+
+func TestRemoveAllFailure(t *testing.T) {
+	m := newTestImage()
+	directory := m.addFile(testRootCluster, 0, "SUB", 0, []uint32{3})
+	directory.Attributes = AttributeDirectory
+	m.setEntry(testRootCluster, 0, directory)
+	m.addFile(3, 0, "A", 1000, []uint32{4, 5})
+	file := &failingWriter{
+		File: m.openFile(t),
+	}
+	w, e := NewWritableFAT32Filesystem(file)
+	if e != nil {
+		t.Logf("Failed opening writable filesystem: %s\n", e)
+		t.FailNow()
+	}
+	// The entry for SUB can't be deleted, so nothing it refers to may be
+	// freed.
+	file.failStart = w.GetDataOffset(testRootCluster, 0)
+	file.failEnd = file.failStart + int64(w.ClusterSize)
+	freeBefore := w.freeClusters
+	e = w.RemoveAll("SUB")
+	if e == nil {
+		t.Logf("Didn't get an error when the entry couldn't be deleted\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error removing a directory: %s\n", e)
+	if w.freeClusters != freeBefore {
+		t.Logf("A failed RemoveAll changed the free clusters from %d to "+
+			"%d\n", freeBefore, w.freeClusters)
+		t.Fail()
+	}
+	content, e := w.ReadFile("SUB/A")
+	if e != nil {
+		t.Logf("Failed reading SUB/A after a failed RemoveAll: %s\n", e)
+		t.FailNow()
+	}
+	if len(content) != 1000 {
+		t.Logf("Read %d bytes from SUB/A, expected 1000\n", len(content))
+		t.Fail()
+	}
+}
@@ -0,0 +1,252 @@
+package fat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes the test image to a temporary file, and returns the file opened for
+// reading and writing. The file is closed when the test completes.
+func (m *testImage) openFile(t *testing.T) *os.File {
+	path := filepath.Join(t.TempDir(), "test.img")
+	e := os.WriteFile(path, m.data, 0644)
+	if e != nil {
+		t.Logf("Failed writing test image: %s\n", e)
+		t.FailNow()
+	}
+	f, e := os.OpenFile(path, os.O_RDWR, 0)
+	if e != nil {
+		t.Logf("Failed opening test image: %s\n", e)
+		t.FailNow()
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// Returns n bytes of test data.
+func testContent(n int) []byte {
+	toReturn := make([]byte, n)
+	for i := range toReturn {
+		toReturn[i] = byte(i * 7)
+	}
+	return toReturn
+}
+
+func TestWriteFile(t *testing.T) {
+	m := newTestImage()
+	m.addFile(testRootCluster, 0, "EXISTING", 1000, []uint32{3, 4})
+	file := m.openFile(t)
+	w, e := NewWritableFAT32Filesystem(file)
+	if e != nil {
+		t.Logf("Failed opening writable filesystem: %s\n", e)
+		t.FailNow()
+	}
+	names := []string{"SHORT.TXT", "A long file name.jpeg", "EXISTING",
+		"empty"}
+	contents := [][]byte{testContent(100), testContent(5000),
+		testContent(600), testContent(0)}
+	for i := range names {
+		e = w.WriteFile(names[i], contents[i])
+		if e != nil {
+			t.Logf("Failed writing %s: %s\n", names[i], e)
+			t.FailNow()
+		}
+	}
+	e = w.Close()
+	if e != nil {
+		t.Logf("Failed closing writable filesystem: %s\n", e)
+		t.FailNow()
+	}
+
+	// Make sure the files can be read back after re-opening the image.
+	f, e := NewFAT32Filesystem(file)
+	if e != nil {
+		t.Logf("Failed re-opening image: %s\n", e)
+		t.FailNow()
+	}
+	for i := range names {
+		content, e := f.ReadFile(names[i])
+		if e != nil {
+			t.Logf("Failed reading %s: %s\n", names[i], e)
+			t.FailNow()
+		}
+		if !bytes.Equal(content, contents[i]) {
+			t.Logf("Read incorrect content from %s\n", names[i])
+			t.FailNow()
+		}
+	}
+	entry, e := f.Lookup("a long FILE name.jpeg")
+	if e != nil {
+		t.Logf("Failed looking up long name: %s\n", e)
+		t.FailNow()
+	}
+	if entry.Entry.ShortName() != "ALONGF~1.JPE" {
+		t.Logf("Got unexpected short name: %s\n", entry.Entry.ShortName())
+		t.FailNow()
+	}
+	s, e := f.Stats()
+	if e != nil {
+		t.Logf("Failed getting stats: %s\n", e)
+		t.FailNow()
+	}
+	if len(s.InfoMismatches) != 0 {
+		t.Logf("FSInfo wasn't updated correctly: %v\n", s.InfoMismatches)
+		t.FailNow()
+	}
+	// Both FAT copies should match.
+	fatSize := testSectorsPerFAT * SectorSize
+	fat1 := make([]byte, fatSize)
+	fat2 := make([]byte, fatSize)
+	file.ReadAt(fat1, testReservedSectors*SectorSize)
+	file.ReadAt(fat2, (testReservedSectors+testSectorsPerFAT)*SectorSize)
+	if !bytes.Equal(fat1, fat2) {
+		t.Logf("The FAT copies don't match\n")
+		t.FailNow()
+	}
+}
+
+// Wraps a test image's file, failing any write that overlaps a range of
+// offsets, to simulate a damaged sector.
+type failingWriter struct {
+	*os.File
+	failStart int64
+	failEnd   int64
+}
+
+func (f *failingWriter) Write(data []byte) (int, error) {
+	offset, e := f.Seek(0, io.SeekCurrent)
+	if e != nil {
+		return 0, e
+	}
+	if (offset < f.failEnd) && ((offset + int64(len(data))) > f.failStart) {
+		return 0, fmt.Errorf("Simulated write error at offset %d", offset)
+	}
+	return f.File.Write(data)
+}
+
+func TestWriteFileFailures(t *testing.T) {
+	// There's room for the file's content, but not for its entry in the
+	// full root directory, so its cluster must be freed again.
+	m := newFullTestImage(1)
+	w, e := NewWritableFAT32Filesystem(m.openFile(t))
+	if e != nil {
+		t.Logf("Failed opening writable filesystem: %s\n", e)
+		t.FailNow()
+	}
+	e = w.WriteFile("NEWFILE.BIN", testContent(100))
+	if e == nil {
+		t.Logf("Didn't get an error writing a file in a full directory\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error writing a file: %s\n", e)
+	if w.freeClusters != 1 {
+		t.Logf("A failed WriteFile left %d free clusters rather than 1\n",
+			w.freeClusters)
+		t.Fail()
+	}
+
+	// If the directory entry can't be updated when overwriting a file, the
+	// old content must be kept, and the new content freed.
+	m = newTestImage()
+	m.addFile(testRootCluster, 0, "EXISTING", 1000, []uint32{3, 4})
+	file := &failingWriter{
+		File: m.openFile(t),
+	}
+	w, e = NewWritableFAT32Filesystem(file)
+	if e != nil {
+		t.Logf("Failed opening writable filesystem: %s\n", e)
+		t.FailNow()
+	}
+	file.failStart = w.GetDataOffset(testRootCluster, 0)
+	file.failEnd = file.failStart + int64(w.ClusterSize)
+	oldContent, e := w.ReadFile("EXISTING")
+	if e != nil {
+		t.Logf("Failed reading EXISTING: %s\n", e)
+		t.FailNow()
+	}
+	freeBefore := w.freeClusters
+	e = w.WriteFile("EXISTING", testContent(5000))
+	if e == nil {
+		t.Logf("Didn't get an error when the entry couldn't be updated\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error overwriting a file: %s\n", e)
+	if w.freeClusters != freeBefore {
+		t.Logf("A failed overwrite changed the free clusters from %d to "+
+			"%d\n", freeBefore, w.freeClusters)
+		t.Fail()
+	}
+	e = w.Close()
+	if e != nil {
+		t.Logf("Failed closing filesystem: %s\n", e)
+		t.FailNow()
+	}
+	f, e := NewFAT32Filesystem(file)
+	if e != nil {
+		t.Logf("Failed re-opening image: %s\n", e)
+		t.FailNow()
+	}
+	content, e := f.ReadFile("EXISTING")
+	if e != nil {
+		t.Logf("Failed reading EXISTING after a failed overwrite: %s\n", e)
+		t.FailNow()
+	}
+	if !bytes.Equal(content, oldContent) {
+		t.Logf("A failed overwrite lost the old content\n")
+		t.Fail()
+	}
+}
+
+func TestRemoveFile(t *testing.T) {
+	m := newTestImage()
+	file := m.openFile(t)
+	w, e := NewWritableFAT32Filesystem(file)
+	if e != nil {
+		t.Logf("Failed opening writable filesystem: %s\n", e)
+		t.FailNow()
+	}
+	// Write enough files with long names to need a second directory cluster.
+	for i := 0; i < 9; i++ {
+		name := string([]byte{'l', 'o', 'n', 'g', ' ', 'f', 'i', 'l', 'e',
+			' ', byte('a' + i)})
+		e = w.WriteFile(name, testContent(1000))
+		if e != nil {
+			t.Logf("Failed writing %s: %s\n", name, e)
+			t.FailNow()
+		}
+	}
+	freeBefore := w.freeClusters
+	e = w.Remove("long file c")
+	if e != nil {
+		t.Logf("Failed removing file: %s\n", e)
+		t.FailNow()
+	}
+	if w.freeClusters != (freeBefore + 2) {
+		t.Logf("Removing the file didn't free its clusters\n")
+		t.FailNow()
+	}
+	_, e = w.ReadFile("long file c")
+	if e == nil {
+		t.Logf("Didn't get an error reading a removed file\n")
+		t.FailNow()
+	}
+	t.Logf("Got expected error reading removed file: %s\n", e)
+	content, e := w.ReadFile("long file i")
+	if e != nil {
+		t.Logf("Failed reading file in second directory cluster: %s\n", e)
+		t.FailNow()
+	}
+	if !bytes.Equal(content, testContent(1000)) {
+		t.Logf("Read incorrect content\n")
+		t.FailNow()
+	}
+	e = w.Close()
+	if e != nil {
+		t.Logf("Failed closing writable filesystem: %s\n", e)
+		t.FailNow()
+	}
+}